@@ -115,10 +115,22 @@ func App(opts ...options.AppOption) (*fiber.App, error) {
 		return nil, fmt.Errorf("failed basic startup tasks with error %s", err.Error())
 	}
 
+	// buffered bodies are read before any handler runs, nothing could bound
+	// the time taken to receive them
+	if options.MaxUploadDuration > 0 && !options.StreamUploads {
+		return nil, errors.New("the maximum upload duration requires streaming uploads")
+	}
+
 	// Return errors as JSON responses
 	app := fiber.New(fiber.Config{
 		BodyLimit:             options.UploadLimitMB * 1024 * 1024, // this is the default limit of 4MB
 		DisableStartupMessage: options.DisableMessage,
+		// uploads are read part by part, see UploadFilesEndpoint. fasthttp
+		// can't stream the bodies of some routes only, the bodies of the
+		// other routes are read back into memory under BodyLimit, see
+		// LimitStreamedBodies
+		StreamRequestBody:            options.StreamUploads,
+		DisablePreParseMultipartForm: options.StreamUploads,
 		// Override default error handler
 		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
 			// Status code defaults to 500
@@ -155,6 +167,10 @@ func App(opts ...options.AppOption) (*fiber.App, error) {
 		app.Use(metrics.APIMiddleware(options.Metrics))
 	}
 
+	if options.StreamUploads {
+		app.Use(openai.LimitStreamedBodies(options, "/v1/files", "/files"))
+	}
+
 	// Auth middleware checking if API key is valid. If no API key is set, no auth is required.
 	auth := func(c *fiber.Ctx) error {
 		if len(options.ApiKeys) == 0 {
@@ -226,8 +242,19 @@ func App(opts ...options.AppOption) (*fiber.App, error) {
 	os.MkdirAll(options.UploadDir, 0755)
 	os.MkdirAll(options.Loader.ModelPath, 0755)
 
+	openai.ConfigureFilesBackend(options)
+	openai.ConfigureMetadataSink(options)
+
 	// Load upload json
-	openai.LoadUploadConfig(options.UploadDir)
+	if err := openai.LoadUploadConfig(options); err != nil {
+		return nil, err
+	}
+	openai.ReconcileFileSizes(options)
+	openai.StartFileReaper(options)
+
+	if options.ContentAddressedFiles && options.BlobCompactionInterval > 0 {
+		openai.StartBlobCompactor(options)
+	}
 
 	modelGalleryService := localai.CreateModelGalleryService(options.Galleries, options.Loader.ModelPath, galleryService)
 	app.Post("/models/apply", auth, modelGalleryService.ApplyModelGalleryEndpoint())
@@ -248,17 +275,69 @@ func App(opts ...options.AppOption) (*fiber.App, error) {
 	app.Post("/v1/edits", auth, openai.EditEndpoint(cl, options))
 	app.Post("/edits", auth, openai.EditEndpoint(cl, options))
 
+	admin := openai.AdminOnly(options)
+
 	// files
-	app.Post("/v1/files", auth, openai.UploadFilesEndpoint(cl, options))
-	app.Post("/files", auth, openai.UploadFilesEndpoint(cl, options))
-	app.Get("/v1/files", auth, openai.ListFilesEndpoint(cl, options))
-	app.Get("/files", auth, openai.ListFilesEndpoint(cl, options))
-	app.Get("/v1/files/:file_id", auth, openai.GetFilesEndpoint(cl, options))
-	app.Get("/files/:file_id", auth, openai.GetFilesEndpoint(cl, options))
-	app.Delete("/v1/files/:file_id", auth, openai.DeleteFilesEndpoint(cl, options))
-	app.Delete("/files/:file_id", auth, openai.DeleteFilesEndpoint(cl, options))
-	app.Get("/v1/files/:file_id/content", auth, openai.GetFilesContentsEndpoint(cl, options))
-	app.Get("/files/:file_id/content", auth, openai.GetFilesContentsEndpoint(cl, options))
+	filesRead := openai.RequireFileScope(options, openai.ScopeFilesRead)
+	filesWrite := openai.RequireFileScope(options, openai.ScopeFilesWrite)
+	filesDelete := openai.RequireFileScope(options, openai.ScopeFilesDelete)
+	app.Post("/v1/files", auth, filesWrite, openai.UploadFilesEndpoint(cl, options))
+	app.Post("/files", auth, filesWrite, openai.UploadFilesEndpoint(cl, options))
+	app.Post("/v1/files/from-url", auth, filesWrite, openai.UploadFileFromURLEndpoint(cl, options))
+	app.Post("/files/from-url", auth, filesWrite, openai.UploadFileFromURLEndpoint(cl, options))
+	app.Post("/v1/files/batch", auth, filesWrite, openai.UploadFilesBatchEndpoint(cl, options))
+	app.Post("/files/batch", auth, filesWrite, openai.UploadFilesBatchEndpoint(cl, options))
+	app.Post("/v1/files/metadata/batch", auth, filesWrite, openai.BatchUpdateMetadataEndpoint(cl, options))
+	app.Post("/files/metadata/batch", auth, filesWrite, openai.BatchUpdateMetadataEndpoint(cl, options))
+	app.Post("/v1/files/retrieve/batch", auth, filesRead, openai.BatchGetFilesEndpoint(cl, options))
+	app.Post("/files/retrieve/batch", auth, filesRead, openai.BatchGetFilesEndpoint(cl, options))
+	app.Post("/v1/files/delete/batch", auth, filesDelete, openai.BatchDeleteFilesEndpoint(cl, options))
+	app.Post("/files/delete/batch", auth, filesDelete, openai.BatchDeleteFilesEndpoint(cl, options))
+	app.Post("/v1/files/delete", auth, filesDelete, openai.BatchDeleteFilesEndpoint(cl, options))
+	app.Post("/files/delete", auth, filesDelete, openai.BatchDeleteFilesEndpoint(cl, options))
+	app.Post("/v1/files/diff", auth, filesRead, openai.DiffFilesEndpoint(cl, options))
+	app.Post("/files/diff", auth, filesRead, openai.DiffFilesEndpoint(cl, options))
+	app.Head("/v1/files", auth, filesRead, openai.HeadFilesEndpoint(cl, options))
+	app.Head("/files", auth, filesRead, openai.HeadFilesEndpoint(cl, options))
+	app.Get("/v1/files", auth, filesRead, openai.ListFilesEndpoint(cl, options))
+	app.Get("/files", auth, filesRead, openai.ListFilesEndpoint(cl, options))
+	app.Get("/v1/files/can-upload", auth, filesRead, openai.CanUploadFilesEndpoint(cl, options))
+	app.Get("/files/can-upload", auth, filesRead, openai.CanUploadFilesEndpoint(cl, options))
+	app.Get("/v1/files/usage", auth, filesRead, openai.StorageUsageEndpoint(cl, options))
+	app.Get("/files/usage", auth, filesRead, openai.StorageUsageEndpoint(cl, options))
+	app.Get("/v1/files/export", auth, filesRead, openai.ExportFilesEndpoint(cl, options))
+	app.Get("/files/export", auth, filesRead, openai.ExportFilesEndpoint(cl, options))
+	app.Post("/v1/files/import", auth, filesWrite, openai.ImportFilesEndpoint(cl, options))
+	app.Post("/files/import", auth, filesWrite, openai.ImportFilesEndpoint(cl, options))
+	app.Get("/v1/files/storage-stats", admin, openai.StorageStatsEndpoint(cl, options))
+	app.Get("/files/storage-stats", admin, openai.StorageStatsEndpoint(cl, options))
+	app.Get("/v1/files/report", admin, openai.FilesReportEndpoint(cl, options))
+	app.Get("/files/report", admin, openai.FilesReportEndpoint(cl, options))
+	app.Get("/v1/files/:file_id", auth, filesRead, openai.GetFilesEndpoint(cl, options))
+	app.Get("/files/:file_id", auth, filesRead, openai.GetFilesEndpoint(cl, options))
+	app.Delete("/v1/files/:file_id", auth, filesDelete, openai.DeleteFilesEndpoint(cl, options))
+	app.Delete("/files/:file_id", auth, filesDelete, openai.DeleteFilesEndpoint(cl, options))
+	app.Patch("/v1/files/:file_id", auth, filesWrite, openai.UpdateFileEndpoint(cl, options))
+	app.Patch("/files/:file_id", auth, filesWrite, openai.UpdateFileEndpoint(cl, options))
+	app.Get("/v1/files/:file_id/content", auth, filesRead, openai.GetFilesContentsEndpoint(cl, options))
+	app.Get("/files/:file_id/content", auth, filesRead, openai.GetFilesContentsEndpoint(cl, options))
+	app.Get("/v1/files/:file_id/convert", auth, filesRead, openai.ConvertFilesEndpoint(cl, options))
+	app.Get("/files/:file_id/convert", auth, filesRead, openai.ConvertFilesEndpoint(cl, options))
+	app.Get("/v1/files/:file_id/thumbnail", auth, filesRead, openai.ThumbnailFilesEndpoint(cl, options))
+	app.Get("/files/:file_id/thumbnail", auth, filesRead, openai.ThumbnailFilesEndpoint(cl, options))
+
+	// admin
+	app.Get("/v1/admin/tenants", admin, openai.ListTenantsEndpoint(cl, options))
+	app.Put("/v1/admin/tenants/:tenant_id/quota", admin, openai.SetTenantQuotaEndpoint(cl, options))
+	app.Put("/v1/admin/files/:file_id/hold", admin, openai.LegalHoldEndpoint(cl, options))
+	app.Delete("/v1/admin/files/:file_id/hold", admin, openai.LegalHoldEndpoint(cl, options))
+	app.Post("/v1/admin/files/reload", admin, openai.ReloadFilesIndexEndpoint(cl, options))
+	app.Post("/v1/files/purge", admin, openai.PurgeFilesEndpoint(cl, options))
+	app.Post("/files/purge", admin, openai.PurgeFilesEndpoint(cl, options))
+	// after the other POST routes of /files, which would otherwise be taken
+	// for file IDs
+	app.Post("/v1/files/:file_id", auth, filesWrite, openai.UpdateFileEndpoint(cl, options))
+	app.Post("/files/:file_id", auth, filesWrite, openai.UpdateFileEndpoint(cl, options))
 
 	// completion
 	app.Post("/v1/completions", auth, openai.CompletionEndpoint(cl, options))
@@ -285,13 +364,9 @@ func App(opts ...options.AppOption) (*fiber.App, error) {
 		app.Static("/generated-audio", options.AudioDir)
 	}
 
-	ok := func(c *fiber.Ctx) error {
-		return c.SendStatus(200)
-	}
-
 	// Kubernetes health checks
-	app.Get("/healthz", ok)
-	app.Get("/readyz", ok)
+	app.Get("/healthz", openai.HealthEndpoint(options))
+	app.Get("/readyz", openai.ReadinessEndpoint(options))
 
 	// Experimental Backend Statistics Module
 	backendMonitor := localai.NewBackendMonitor(cl, options) // Split out for now
@@ -1,153 +1,1270 @@
 package openai
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	config "github.com/go-skynet/LocalAI/api/config"
 	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
 	"github.com/go-skynet/LocalAI/pkg/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
+	"io"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var uploadedFiles []File
-
 // File represents the structure of a file object from the OpenAI API.
-type File struct {
-	ID        string    `json:"id"`         // Unique identifier for the file
-	Object    string    `json:"object"`     // Type of the object (e.g., "file")
-	Bytes     int       `json:"bytes"`      // Size of the file in bytes
-	CreatedAt time.Time `json:"created_at"` // The time at which the file was created
-	Filename  string    `json:"filename"`   // The name of the file
-	Purpose   string    `json:"purpose"`    // The purpose of the file (e.g., "fine-tune", "classifications", etc.)
+type File = schema.File
+
+// saveUploadConfig persists the index served by the endpoints.
+func saveUploadConfig(o *options.Option) {
+	defaultStore.save(o)
 }
 
-func saveUploadConfig(uploadDir string) {
-	file, err := json.MarshalIndent(uploadedFiles, "", " ")
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
 	if err != nil {
-		log.Error().Msgf("Failed to JSON marshal the uploadedFiles: %s", err)
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// flushed before the rename, or a crash could leave an empty file in place
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
+	return nil
+}
 
-	err = os.WriteFile(filepath.Join(uploadDir, "uploadedFiles.json"), file, 0644)
-	if err != nil {
-		log.Error().Msgf("Failed to save uploadedFiles to file: %s", err)
+// LoadUploadConfig loads the index served by the endpoints, along with the
+// tenant quotas.
+func LoadUploadConfig(o *options.Option) error {
+	if err := defaultStore.load(o); err != nil {
+		return err
 	}
+	defaultStore.loadTenantQuotas(o)
+	return nil
 }
 
-func LoadUploadConfig(uploadPath string) {
-	file, err := os.ReadFile(filepath.Join(uploadPath, "uploadedFiles.json"))
-	if err != nil {
-		log.Error().Msgf("Failed to read file: %s", err)
-	} else {
-		err = json.Unmarshal(file, &uploadedFiles)
+// Reason codes reported when an upload is rejected.
+const (
+	rejectMissingFile    = "missing_file"
+	rejectTooLarge       = "too_large"
+	rejectMissingPurpose = "invalid_purpose"
+	rejectFileExists     = "file_exists"
+	rejectBadMetadata    = "invalid_metadata"
+	rejectQuotaExceeded  = "quota_exceeded"
+	rejectTooManyFiles   = "too_many_files"
+	rejectDiskFull       = "disk_full"
+	rejectFileImmutable  = "file_immutable"
+	rejectBlockedURL     = "blocked_url"
+	rejectFetchFailed    = "fetch_failed"
+	rejectByHook         = "rejected_by_hook"
+	rejectDeniedFilename = "denied_filename"
+	rejectUploadTimeout  = "upload_timeout"
+	rejectBadChecksum    = "checksum_mismatch"
+	rejectDuplicate      = "duplicate_content"
+	rejectBadFilename    = "invalid_filename"
+	rejectBadExpiration  = "invalid_expiration"
+	rejectBadEncoding    = "unsupported_encoding"
+)
+
+// Errors the store refuses a file with, whether it is uploaded, fetched,
+// imported or registered by the server. They are wrapped in a fileRefusal
+// telling the limit at stake, and answered as a rejection by the endpoints.
+var (
+	errFileTooLarge    = errors.New("file exceeds the upload limit")
+	errInvalidPurpose  = errors.New("invalid purpose")
+	errQuotaExceeded   = errors.New("storage quota exceeded")
+	errTooManyFiles    = errors.New("file count limit reached")
+	errDiskFull        = errors.New("not enough free disk space")
+	errInvalidFilename = errors.New("invalid filename")
+	errFilenameDenied  = errors.New("file name is not allowed")
+	errFileExists      = errors.New("file already exists")
+	errRefusedByHook   = errors.New("refused by a pre-upload hook")
+)
+
+// fileRefusal is why the store refuses a file: kind is one of the errors
+// above, or errFileImmutable, and cause the error of the hook refusing it.
+type fileRefusal struct {
+	kind    error
+	message string
+	cause   error
+}
+
+func (r *fileRefusal) Error() string {
+	return r.message
+}
+
+func (r *fileRefusal) Unwrap() []error {
+	if r.cause != nil {
+		return []error{r.kind, r.cause}
+	}
+	return []error{r.kind}
+}
+
+func refuse(kind error, format string, args ...any) error {
+	return &fileRefusal{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// uploadRejection tells why an upload can't be accepted, as answered to the
+// client. rejectionFor maps the refusals of the store to one.
+type uploadRejection struct {
+	status  int
+	reason  string
+	message string
+}
+
+func (r *uploadRejection) Error() string {
+	return r.message
+}
+
+// storageUsage returns the number of files and their total size.
+func storageUsage() (int, int64) {
+	return defaultStore.usage()
+}
+
+// usage returns the number of files of s and their total size.
+func (s *FileStore) usage() (int, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, f := range s.files {
+		total += int64(f.Bytes)
+	}
+	return len(s.files), total
+}
+
+// checkUploadLimits reports whether a file of size bytes for purpose would be
+// accepted from tenant, given the per-file limit and the storage quotas.
+func checkUploadLimits(o *options.Option, size int64, purpose, tenant string) error {
+	return defaultStore.checkUploadLimits(o, nil, size, purpose, tenant)
+}
+
+// checkUploadLimits is checkUploadLimits against the files of s, counting the
+// files staged but not indexed yet in the quotas.
+func (s *FileStore) checkUploadLimits(o *options.Option, staged []File, size int64, purpose, tenant string) error {
+	if size > int64(o.UploadLimitMB*1024*1024) {
+		return refuse(errFileTooLarge, "File size %d exceeds upload limit %d", size, o.UploadLimitMB)
+	}
+
+	if purpose == "" {
+		return refuse(errInvalidPurpose, "Purpose is not defined")
+	}
+	if err := checkPurposeAllowed(o, purpose); err != nil {
+		return err
+	}
+
+	count, used := s.usage()
+	for _, f := range staged {
+		count++
+		used += int64(f.Bytes)
+	}
+	if o.MaxTotalStorageMB > 0 && used+size > int64(o.MaxTotalStorageMB)*1024*1024 {
+		return refuse(errQuotaExceeded, "File size %d exceeds the remaining storage quota (%d of %d MB used)", size, used/(1024*1024), o.MaxTotalStorageMB)
+	}
+
+	if o.MaxFiles > 0 && count >= o.MaxFiles {
+		return refuse(errTooManyFiles, "File count limit of %d reached", o.MaxFiles)
+	}
+
+	if err := s.checkTenantQuota(tenant, size, staged); err != nil {
+		return err
+	}
+
+	// keep some space free on the upload filesystem, filling it up
+	// completely can take the whole server down
+	if o.MinFreeDiskMB > 0 {
+		free, err := diskFree(o.UploadDir)
 		if err != nil {
-			log.Error().Msgf("Failed to JSON unmarshal the file into uploadedFiles: %s", err)
+			log.Warn().Msgf("Unable to check free space of %s: %s", o.UploadDir, err)
+		} else if int64(free)-size < int64(o.MinFreeDiskMB)*1024*1024 {
+			return refuse(errDiskFull, "Not enough free disk space to store the file")
 		}
 	}
+
+	return nil
+}
+
+// defaultAllowedPurposes are the purposes recognized by OpenAI, accepted when
+// no AllowedPurposes are configured.
+var defaultAllowedPurposes = []string{"fine-tune", "assistants", "batch", "vision", "user_data", "evals"}
+
+// checkPurposeAllowed refuses the purposes not listed in AllowedPurposes, so
+// that a typo doesn't store files no consumer ever finds.
+func checkPurposeAllowed(o *options.Option, purpose string) error {
+	allowed := o.AllowedPurposes
+	if len(allowed) == 0 {
+		allowed = defaultAllowedPurposes
+	}
+	if slices.Contains(allowed, purpose) || slices.Contains(allowed, "*") {
+		return nil
+	}
+	return refuse(errInvalidPurpose, "Invalid purpose %q, accepted values are: %s", purpose, strings.Join(allowed, ", "))
+}
+
+// logUploadRejection records why an upload was refused, both in the logs and
+// in the rejections metric, so operators can tell why clients fail to upload.
+func logUploadRejection(c *fiber.Ctx, o *options.Option, reason, purpose, filename string, size int64) {
+	log.Warn().
+		Str("reason", reason).
+		Str("client", c.IP()).
+		Str("filename", filename).
+		Int64("size", size).
+		Msg("file upload rejected")
+
+	if o.Metrics != nil {
+		o.Metrics.ObserveUploadRejection(reason)
+		// uploads refused before their size is known are left out
+		if size > 0 {
+			o.Metrics.ObserveUploadSize(purpose, uploadRejected, size)
+		}
+	}
+}
+
+// Outcomes of the uploads in the size metric.
+const (
+	uploadAccepted = "accepted"
+	uploadRejected = "rejected"
+)
+
+// observeAcceptedUpload records the size of a stored upload.
+func observeAcceptedUpload(o *options.Option, f File) {
+	if o.Metrics != nil {
+		o.Metrics.ObserveUploadSize(f.Purpose, uploadAccepted, int64(f.Bytes))
+	}
+}
+
+// CanUploadFilesEndpoint tells whether an upload of the given bytes and purpose
+// would currently be accepted, without sending the file.
+func CanUploadFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type CanUpload struct {
+		Accepted bool   `json:"accepted"`
+		Reason   string `json:"reason,omitempty"`
+		Message  string `json:"message,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		size, err := strconv.ParseInt(c.Query("bytes"), 10, 64)
+		if err != nil || size < 0 {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "bytes must be a positive integer")
+		}
+
+		if r := rejectionFor(checkUploadLimits(o, size, c.Query("purpose"), requestTenant(c, o))); r != nil {
+			return sendJSON(c, CanUpload{Reason: r.reason, Message: r.message})
+		}
+		return sendJSON(c, CanUpload{Accepted: true})
+	}
+}
+
+// StorageUsage reports the storage used by the files against the quotas, a
+// zero limit meaning none is set.
+type StorageUsage struct {
+	Object   string       `json:"object"`
+	Files    int          `json:"files"`
+	Bytes    int64        `json:"bytes"`
+	MaxFiles int          `json:"max_files"`
+	MaxBytes int64        `json:"max_bytes"`
+	Tenant   *TenantUsage `json:"tenant,omitempty"`
+}
+
+// StorageUsageEndpoint reports the current usage of the storage quota, with
+// the usage of the tenant of the request when it has one.
+func StorageUsageEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		count, used := storageUsage()
+		usage := StorageUsage{
+			Object:   "file.usage",
+			Files:    count,
+			Bytes:    used,
+			MaxFiles: o.MaxFiles,
+			MaxBytes: int64(o.MaxTotalStorageMB) * 1024 * 1024,
+		}
+		if tenant := requestTenant(c, o); tenant != "" {
+			t := describeTenant(tenant)
+			usage.Tenant = &t
+		}
+		return sendJSON(c, usage)
+	}
 }
 
 // UploadFilesEndpoint https://platform.openai.com/docs/api-reference/files/create
 func UploadFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		file, err := c.FormFile("file")
+		// the deadline covers reading the body, which is streamed when the
+		// option is set
+		ctx := c.UserContext()
+		if o.MaxUploadDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.Context().Time().Add(o.MaxUploadDuration))
+			defer cancel()
+		}
+
+		file, r := uploadFilePart(ctx, c, o)
+		defer file.remove()
+		if r != nil {
+			logUploadRejection(c, o, r.reason, c.FormValue("purpose"), file.Filename, file.Size)
+			return sendRejection(c, r)
+		}
+
+		purpose := c.FormValue("purpose", "")
+		checksum, err := declaredChecksum(c.FormValue("checksum"))
 		if err != nil {
-			return err
+			logUploadRejection(c, o, rejectBadChecksum, purpose, file.Filename, file.Size)
+			return sendFileError(c, fiber.StatusBadRequest, rejectBadChecksum, err.Error())
 		}
 
-		// Check the file size
-		if file.Size > int64(o.UploadLimitMB*1024*1024) {
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("File size %d exceeds upload limit %d", file.Size, o.UploadLimitMB))
+		// Check the file size, purpose and storage limits
+		if r := rejectionFor(checkUploadLimits(o, file.Size, purpose, requestTenant(c, o))); r != nil {
+			logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+			return sendRejection(c, r)
 		}
 
-		purpose := c.FormValue("purpose", "") //TODO put in purpose dirs
-		if purpose == "" {
-			return c.Status(fiber.StatusBadRequest).SendString("Purpose is not defined")
+		metadata, err := uploadMetadata(c, o)
+		if err != nil {
+			logUploadRejection(c, o, rejectBadMetadata, purpose, file.Filename, file.Size)
+			return sendFileError(c, fiber.StatusBadRequest, rejectBadMetadata, fmt.Sprintf("Invalid metadata: %s", err))
 		}
+		metadata = withDefaultMetadata(o, metadata)
 
-		// Sanitize the filename to prevent directory traversal
-		filename := utils.SanitizeFileName(file.Filename)
+		expiresAfter, err := uploadExpiresAfter(c)
+		if err != nil {
+			logUploadRejection(c, o, rejectBadExpiration, purpose, file.Filename, file.Size)
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+		encoding, err := uploadContentEncoding(c, file)
+		if err != nil {
+			logUploadRejection(c, o, rejectBadEncoding, purpose, file.Filename, file.Size)
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
 
-		savePath := filepath.Join(o.UploadDir, filename)
+		if r := rejectionFor(checkFilenameAllowed(o, file.Filename)); r != nil {
+			logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+			return sendRejection(c, r)
+		}
 
-		// Check if file already exists
-		if _, err := os.Stat(savePath); !os.IsNotExist(err) {
-			return c.Status(fiber.StatusBadRequest).SendString("File already exists")
+		// Content already stored for the purpose is answered with the existing
+		// file when the client asks for it
+		if dedupRequested(c) {
+			sum, err := hashUpload(file)
+			if err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, "Failed to read file: "+err.Error())
+			}
+			if checksum == "" || checksum == sum {
+				if existing, ok := storedDuplicate(requestOwnerKey(c, o), purpose, requestTenant(c, o), sum); ok {
+					c.Set(deduplicatedHeader, "true")
+					files := []File{existing}
+					presentFiles(c, o, files)
+					return sendJSON(c.Status(fiber.StatusOK), files[0])
+				}
+				// recorded so that later uploads of the content find this one
+				checksum = sum
+			}
 		}
 
-		err = c.SaveFile(file, savePath)
+		// Check if file already exists, which only an overwrite accepts
+		var replaced *File
+		if r := rejectionFor(checkFileConflict(o, requestOwnerKey(c, o), purpose, file.Filename)); r != nil {
+			if r.reason != rejectFileExists || !overwriteRequested(c) {
+				logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+				return sendRejection(c, r)
+			}
+			if existing, ok := indexedUpload(requestOwnerKey(c, o), purpose, file.Filename); ok {
+				if !ownsFile(c, o, existing) {
+					// only the owner of a file may replace it
+					logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+					return sendRejection(c, r)
+				}
+				if existing.LegalHold {
+					return sendFileError(c, fiber.StatusConflict, codeFileOnHold, errFileOnHold.Error())
+				}
+				replaced = &existing
+			}
+		}
+
+		req := uploadRequest(c, o, file.Filename, purpose, file.Size, metadata)
+		if r := rejectionFor(runPreUploadHooks(c.UserContext(), o, req)); r != nil {
+			logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+			return sendRejection(c, r)
+		}
+
+		src, err := file.Open()
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to save file: " + err.Error())
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, "Failed to save file: "+err.Error())
 		}
+		defer src.Close()
 
 		f := File{
-			ID:        fmt.Sprintf("file-%d", time.Now().Unix()),
+			ID:        newFileID(),
 			Object:    "file",
 			Bytes:     int(file.Size),
 			CreatedAt: time.Now(),
 			Filename:  file.Filename,
 			Purpose:   purpose,
+			Metadata:  metadata,
+			Tenant:    requestTenant(c, o),
+			Source:    uploadSource(c, o),
+			OwnerKey:  requestOwnerKey(c, o),
+			Sha256:    checksum,
+			// the declared type is only kept when the content can't tell
+			ContentType:     file.Header.Get(fiber.HeaderContentType),
+			ContentEncoding: encoding,
+		}
+		if replaced != nil {
+			// the new content takes the place of the old one in the index
+			f.ID = replaced.ID
+		}
+		setExpiration(o, &f, expiresAfter)
+
+		err = storeFile(ctx, o, &f, src)
+		if err == nil && replaced != nil {
+			releaseReplacedContent(ctx, o, *replaced, f)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			logUploadRejection(c, o, rejectUploadTimeout, purpose, file.Filename, file.Size)
+			return sendFileError(c, fiber.StatusRequestTimeout, rejectUploadTimeout, "Upload took longer than allowed")
+		}
+		if errors.Is(err, errChecksumMismatch) {
+			logUploadRejection(c, o, rejectBadChecksum, purpose, file.Filename, file.Size)
+		}
+		var derr *duplicateContentError
+		if errors.As(err, &derr) {
+			logUploadRejection(c, o, rejectDuplicate, purpose, file.Filename, file.Size)
+		}
+		if err == nil {
+			runPostUploadHooks(c.UserContext(), o, req, f)
+		}
+		return sendStoredFile(c, o, f, err)
+	}
+}
+
+// checkFilenameAllowed refuses uploads whose name can't be stored, such as
+// "..", or whose sanitized name matches one of the denied names or glob
+// patterns, ignoring case.
+func checkFilenameAllowed(o *options.Option, filename string) error {
+	name := strings.ToLower(utils.SanitizeFileName(filename))
+	if !storableName(name) {
+		return refuse(errInvalidFilename, "Invalid filename %q", filename)
+	}
+	for _, pattern := range o.DeniedFilenames {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), name); ok {
+			return refuse(errFilenameDenied, "File name %s is not allowed", filename)
+		}
+	}
+	return nil
+}
+
+// checkFileConflict reports whether a new file of owner for purpose can't be
+// named filename because another file of the same purpose already is. Files
+// of other owners don't clash, so as not to tell they exist.
+func checkFileConflict(o *options.Option, owner, purpose, filename string) error {
+	return defaultStore.checkFileConflict(o, owner, purpose, filename)
+}
+
+// checkFileConflict is checkFileConflict against the files of s.
+func (s *FileStore) checkFileConflict(o *options.Option, owner, purpose, filename string) error {
+	if o.AllowDuplicateFilenames {
+		// files are stored under their ID, names can't clash
+		return nil
+	}
+	// Sanitize the filename to prevent directory traversal
+	name := utils.SanitizeFileName(filename)
+	if !s.fileExists(o, owner, purpose, name, filepath.Join(o.UploadDir, purposeDir(purpose), name)) {
+		return nil
+	}
+	if o.WORMFiles {
+		return refuse(errFileImmutable, "%s", errFileImmutable)
+	}
+	return refuse(errFileExists, "File already exists")
+}
+
+// overwriteRequested tells whether the client asked to replace a file of the
+// same name, with the overwrite form value or the X-Overwrite header.
+func overwriteRequested(c *fiber.Ctx) bool {
+	overwrite, _ := strconv.ParseBool(c.FormValue("overwrite", c.Get("X-Overwrite")))
+	return overwrite
+}
+
+// indexedUpload returns the indexed file of owner for purpose stored under
+// the name filename is sanitized to.
+func indexedUpload(owner, purpose, filename string) (File, bool) {
+	name := utils.SanitizeFileName(filename)
+	defaultStore.mu.RLock()
+	defer defaultStore.mu.RUnlock()
+	for _, f := range defaultStore.files {
+		if f.Purpose == purpose && utils.SanitizeFileName(f.Filename) == name && ownedBy(f, owner) {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// releaseReplacedContent drops the content of old once an overwrite stored f
+// in its place. Files stored under their name were overwritten in place, only
+// the blob of a content-addressed file is left to release.
+func releaseReplacedContent(ctx context.Context, o *options.Option, old, f File) {
+	dropDerivedContent(o, old.ID)
+	if !o.ContentAddressedFiles || old.Sha256 == "" || old.Sha256 == f.Sha256 {
+		return
+	}
+	defaultStore.blobsMu.Lock()
+	defer defaultStore.blobsMu.Unlock()
+	if err := defaultStore.releaseBlob(ctx, o, old.Purpose, blobName(o, old.Sha256, old.Purpose)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Msgf("Unable to release blob %s of overwritten file %s: %v", old.Sha256, old.ID, err)
+	}
+}
+
+// sendStoredFile responds to an upload with f, or with the error storeFile
+// returned for it.
+func sendStoredFile(c *fiber.Ctx, o *options.Option, f File, err error) error {
+	var derr *duplicateContentError
+	if errors.As(err, &derr) {
+		setDuplicateOf(c, derr.existing)
+	}
+	if err != nil {
+		status, code, message := storeErrorResponse(err)
+		return sendFileError(c, status, code, message)
+	}
+	observeAcceptedUpload(o, f)
+	setDuplicateHeaders(c, o, f)
+	files := []File{f}
+	presentFiles(c, o, files)
+	warnUploads(files)
+	return sendJSON(c.Status(fiber.StatusOK), files[0])
+}
+
+// storeErrorResponse maps an error of storeFile to the status, code and
+// message answered to the client.
+func storeErrorResponse(err error) (int, string, string) {
+	var verr *fileValidationError
+	if errors.As(err, &verr) {
+		return fiber.StatusBadRequest, codeValidationFailed, verr.Error()
+	}
+	if errors.Is(err, errFileOperationTimeout) {
+		return fiber.StatusGatewayTimeout, codeTimeout, "Timed out saving file"
+	}
+	if errors.Is(err, errBackendUnavailable) {
+		return fiber.StatusServiceUnavailable, codeBackendUnavailable, err.Error()
+	}
+	var derr *duplicateContentError
+	if errors.As(err, &derr) {
+		return fiber.StatusConflict, rejectDuplicate, derr.Error()
+	}
+	if errors.Is(err, errChecksumMismatch) {
+		return fiber.StatusUnprocessableEntity, rejectBadChecksum, err.Error()
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return fiber.StatusInsufficientStorage, rejectDiskFull, "Not enough free disk space to store the file"
+	}
+	return fiber.StatusInternalServerError, codeInternalError, "Failed to save file: " + err.Error()
+}
+
+// Default limits on the labels a client can attach to a file.
+const (
+	defaultMaxMetadataKeys        = 16
+	defaultMaxMetadataKeyLength   = 64
+	defaultMaxMetadataValueLength = 512
+)
+
+// metadataLimits returns the limits on file labels configured in o.
+func metadataLimits(o *options.Option) (keys, keyLength, valueLength int) {
+	keys, keyLength, valueLength = o.MaxMetadataKeys, o.MaxMetadataKeyLength, o.MaxMetadataValueLength
+	if keys <= 0 {
+		keys = defaultMaxMetadataKeys
+	}
+	if keyLength <= 0 {
+		keyLength = defaultMaxMetadataKeyLength
+	}
+	if valueLength <= 0 {
+		valueLength = defaultMaxMetadataValueLength
+	}
+	return
+}
+
+// uploadMetadata reads the optional "metadata" part of an upload, a JSON
+// object of string labels sent either as a form field or as a file part.
+func uploadMetadata(c *fiber.Ctx, o *options.Option) (map[string]string, error) {
+	maxKeys, maxKeyLength, maxValueLength := metadataLimits(o)
+	raw := []byte(c.FormValue("metadata"))
+	if len(raw) == 0 {
+		if part, err := c.FormFile("metadata"); err == nil {
+			if part.Size > int64(maxKeys*(maxKeyLength+maxValueLength)*2) {
+				return nil, fmt.Errorf("metadata part is too large")
+			}
+			r, err := part.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			if raw, err = io.ReadAll(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var metadata map[string]string
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, fmt.Errorf("metadata must be a JSON object of strings: %w", err)
+	}
+	if err := validateMetadata(o, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// withDefaultMetadata merges the configured default labels into metadata, the
+// client values winning.
+func withDefaultMetadata(o *options.Option, metadata map[string]string) map[string]string {
+	if len(o.DefaultMetadata) == 0 {
+		return metadata
+	}
+	merged := make(map[string]string, len(o.DefaultMetadata)+len(metadata))
+	for k, v := range o.DefaultMetadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	return merged
+}
+
+func validateMetadata(o *options.Option, metadata map[string]string) error {
+	maxKeys, maxKeyLength, maxValueLength := metadataLimits(o)
+	if len(metadata) > maxKeys {
+		return fmt.Errorf("at most %d metadata keys are allowed", maxKeys)
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxKeyLength {
+			return fmt.Errorf("metadata keys must be between 1 and %d characters", maxKeyLength)
+		}
+		if len(v) > maxValueLength {
+			return fmt.Errorf("metadata value of %s exceeds %d characters", k, maxValueLength)
+		}
+	}
+	return nil
+}
+
+// fileValidationError is returned by storeFile when the purpose validator
+// rejects the content.
+type fileValidationError struct {
+	err error
+}
+
+func (e *fileValidationError) Error() string {
+	return fmt.Sprintf("File validation failed: %s", e.err)
+}
+
+// errChecksumMismatch is returned by storeFile when the content doesn't match
+// the checksum declared by the client.
+var errChecksumMismatch = errors.New("content doesn't match the declared checksum")
+
+// declaredChecksum parses the optional SHA-256 a client declares for an
+// upload, hex encoded and possibly prefixed with "sha256:".
+func declaredChecksum(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	sum := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("Invalid checksum %q: expected a hex encoded SHA-256", s)
+	}
+	return sum, nil
+}
+
+// storeFile validates, persists and indexes the content of f read from src.
+// f is updated with the fields computed while storing it. A checksum already
+// set on f is one declared by the client, which the content must match.
+func storeFile(ctx context.Context, o *options.Option, f *File, src io.ReadSeeker) error {
+	return defaultStore.store(ctx, o, f, src)
+}
+
+// store writes src as the content of f and indexes it, see storeFile.
+func (s *FileStore) store(ctx context.Context, o *options.Option, f *File, src io.ReadSeeker) error {
+	if err := s.stage(ctx, o, f, src, true); err != nil {
+		return err
+	}
+	s.save(o)
+	if f.Status == fileStatusProcessing {
+		s.validateAsync(o, *f)
+	}
+	return nil
+}
+
+// stage validates and persists the content of f read from src like store,
+// only indexing f when index is set. A file staged without being indexed is
+// either committed or discarded.
+func (s *FileStore) stage(ctx context.Context, o *options.Option, f *File, src io.ReadSeeker, index bool) error {
+	if f.Sha256 != "" {
+		sum, err := hashContent(src)
+		if err != nil {
+			return err
+		}
+		if sum != f.Sha256 {
+			return errChecksumMismatch
+		}
+	}
+
+	// compressed files are stored as sent, their decompressed content being
+	// the one checked
+	var plain *os.File
+	if f.ContentEncoding == gzipEncoding {
+		var size int64
+		var err error
+		plain, size, err = decompressToTemp(src)
+		if err != nil {
+			return &fileValidationError{err: err}
+		}
+		defer func() {
+			plain.Close()
+			os.Remove(plain.Name())
+		}()
+		f.UncompressedBytes = int(size)
+	} else if o.NormalizeLineEndings[f.Purpose] {
+		normalized, changed, err := normalizeLineEndings(src)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			normalized.Close()
+			os.Remove(normalized.Name())
+		}()
+		if changed {
+			size, err := normalized.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			f.Bytes = int(size)
+			f.LineEndingsNormalized = true
+		}
+		if _, err := normalized.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		src = normalized
+	}
+
+	src = deadlineReader{ctx, src}
+	checked := src
+	if plain != nil {
+		checked = plain
+	}
+
+	if o.ValidateFineTuneFiles && f.Purpose == fineTunePurpose {
+		err := validateFineTuneJSONL(checked)
+		if _, serr := checked.Seek(0, io.SeekStart); serr != nil && err == nil {
+			err = serr
+		}
+		if err != nil {
+			return &fileValidationError{err: err}
+		}
+	}
+
+	f.Status = fileStatusProcessed
+	_, hasValidator := o.FileValidators[f.Purpose]
+	if hasValidator && o.AsyncFileValidation {
+		f.Status = fileStatusProcessing
+	} else if err := s.validateContent(o, f.Purpose, checked); err != nil {
+		return &fileValidationError{err: err}
+	}
+
+	if err := applyExtensionPolicy(o, f, checked); err != nil {
+		return err
+	}
+	if err := detectContentType(f, checked); err != nil {
+		return err
+	}
+	f.Storage = storageKind(s.backendFor(o, f.Purpose))
+
+	var err error
+	if o.ContentAddressedFiles || o.VerifyOnRead || checksCrossPurposeDuplicates(o) || f.Sha256 != "" {
+		// the content changed if its line endings were normalized
+		f.Sha256, err = hashContent(src)
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.checkCrossPurposeDuplicate(o, *f); err != nil {
+		return err
+	}
+
+	var content io.Reader = src
+	if key, ok := encryptionKey(o, f.Purpose); ok {
+		content, err = newEncryptReader(src, key)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt file: %w", err)
+		}
+	}
+
+	if o.PreallocateUploads {
+		ctx = withPreallocation(ctx, int64(f.Bytes))
+	}
+	if o.ContentAddressedFiles {
+		s.blobsMu.Lock()
+		err = s.saveBlob(ctx, o, f.Purpose, blobName(o, f.Sha256, f.Purpose), content)
+		if err == nil && index {
+			s.add(*f)
+		}
+		s.blobsMu.Unlock()
+	} else {
+		f.Path = s.freeStorageName(o, *f)
+		err = saveWithTimeout(ctx, s.backendFor(o, f.Purpose), o.FileSaveTimeout, storagePath(o, *f), content)
+		if err == nil && index {
+			s.add(*f)
 		}
+	}
+	return err
+}
 
-		uploadedFiles = append(uploadedFiles, f)
-		saveUploadConfig(o.UploadDir)
-		return c.Status(fiber.StatusOK).JSON(f)
+// commit indexes the files staged without being indexed, all at once, and
+// saves the index.
+func (s *FileStore) commit(o *options.Option, files []File) {
+	if o.ContentAddressedFiles {
+		s.blobsMu.Lock()
+	}
+	s.add(files...)
+	if o.ContentAddressedFiles {
+		s.blobsMu.Unlock()
+	}
+	s.save(o)
+	for _, f := range files {
+		if f.Status == fileStatusProcessing {
+			s.validateAsync(o, f)
+		}
 	}
 }
 
+// discard removes the content of files staged without being indexed.
+func (s *FileStore) discard(ctx context.Context, o *options.Option, files []File) {
+	for _, f := range files {
+		var err error
+		if o.ContentAddressedFiles && f.Sha256 != "" {
+			s.blobsMu.Lock()
+			err = s.releaseBlob(ctx, o, f.Purpose, blobName(o, f.Sha256, f.Purpose))
+			s.blobsMu.Unlock()
+		} else {
+			err = removeWithTimeout(ctx, s.backendFor(o, f.Purpose), o.FileRemoveTimeout, storagePath(o, f))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Msgf("Failed to discard the content of staged file %s: %s", f.ID, err)
+		}
+	}
+}
+
+// deadlineReader fails once ctx is done, so that storing a file doesn't
+// outlive its deadline even when the backend ignores the context.
+type deadlineReader struct {
+	ctx context.Context
+	io.ReadSeeker
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
+
+// newFileID returns a random identifier in the OpenAI "file-..." format.
+func newFileID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "file-" + hex.EncodeToString(b)
+}
+
+// errFileImmutable is returned when changing a file frozen by WORM mode.
+var errFileImmutable = errors.New("files are write-once, existing files can't be changed")
+
+// checkFileMutable tells whether f may be overwritten or updated. Files on
+// legal hold are frozen until released. Under WORM every file is immutable
+// from creation, whatever the conflict handling, and can only be deleted.
+func checkFileMutable(o *options.Option, f File) error {
+	if f.LegalHold {
+		return errFileOnHold
+	}
+	if o.WORMFiles {
+		return errFileImmutable
+	}
+	return nil
+}
+
+// fileExists reports whether an upload of owner for purpose named filename
+// would clash with an existing file of the owner. The files of other owners
+// stored at savePath don't clash, the upload being stored beside them. A file
+// left on the local disk without being indexed does, as it would be
+// overwritten.
+func (s *FileStore) fileExists(o *options.Option, owner, purpose, filename, savePath string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	taken := false
+	for _, f := range s.files {
+		if f.Purpose != purpose {
+			continue
+		}
+		if utils.SanitizeFileName(f.Filename) == filename && ownedBy(f, owner) {
+			return true
+		}
+		taken = taken || storagePath(o, f) == savePath
+	}
+	// content-addressed uploads are not stored under their name, and the disk
+	// doesn't tell what other backends hold
+	if taken || o.ContentAddressedFiles || o.FilesBackend != nil || o.PurposeBackends[purpose] != nil {
+		return false
+	}
+
+	_, err := os.Stat(savePath)
+	return !os.IsNotExist(err)
+}
+
+// defaultFilesListLimit is the page size of a list request without a limit,
+// and defaultMaxFilesListLimit the largest page by default, as in the OpenAI
+// API.
+const (
+	defaultFilesListLimit    = 20
+	defaultMaxFilesListLimit = 10000
+)
+
 // ListFilesEndpoint https://platform.openai.com/docs/api-reference/files/list
 func ListFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
 	type ListFiles struct {
-		Data   []File
-		Object string
+		Data    []File
+		Object  string
+		HasMore bool   `json:"has_more"`
+		FirstID string `json:"first_id,omitempty"`
+		LastID  string `json:"last_id,omitempty"`
+	}
+	type FilesGroup struct {
+		Count int    `json:"count"` // Files of the group, on every page
+		Data  []File `json:"data"`
+	}
+	type GroupedListFiles struct {
+		Object  string                 `json:"object"`
+		Groups  map[string]*FilesGroup `json:"groups"`
+		HasMore bool                   `json:"has_more"`
+		FirstID string                 `json:"first_id,omitempty"`
+		LastID  string                 `json:"last_id,omitempty"`
+	}
+
+	var cache *listCache
+	if o.FilesListCacheTTL > 0 {
+		cache = newListCache(o.FilesListCacheTTL, o.FilesListCacheSize)
 	}
 
 	return func(c *fiber.Ctx) error {
 		var listFiles ListFiles
 
-		purpose := c.Query("purpose")
-		if purpose == "" {
-			listFiles.Data = uploadedFiles
-		} else {
-			for _, f := range uploadedFiles {
-				if purpose == f.Purpose {
-					listFiles.Data = append(listFiles.Data, f)
+		var cacheKey string
+		var version uint64
+		if cache != nil {
+			// admins see more of the files and owners only theirs, don't share
+			// their responses
+			cacheKey = strings.Join([]string{requestOwnerKey(c, o),
+				c.Query("purpose"), c.Query("sort", o.FilesListSort), c.Query("order", o.FilesListOrder), c.Query("limit"),
+				c.Query("after"), c.Query("group_by"), strconv.FormatBool(isAdminRequest(c, o)), c.Query("include"),
+			}, "\x00")
+			version = indexVersion()
+			if e, ok := cache.get(cacheKey, version); ok {
+				c.Set("X-Total-Count", e.total)
+				if e.warning != "" {
+					c.Set(fiber.HeaderWarning, e.warning)
+				}
+				c.Set("X-Cache", "HIT")
+				c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+				return c.Status(fiber.StatusOK).Send(e.body)
+			}
+		}
+
+		groupBy := c.Query("group_by")
+		if groupBy != "" && groupBy != "purpose" {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported group_by %q", groupBy))
+		}
+
+		listFiles.Data = ownedFiles(c, o, filterFilesMatching(o, c.Query("purpose")))
+
+		sortBy := c.Query("sort", o.FilesListSort)
+		order := c.Query("order", o.FilesListOrder)
+		if err := sortFiles(listFiles.Data, sortBy, order); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+
+		c.Set("X-Total-Count", strconv.Itoa(len(listFiles.Data)))
+		var grouped *GroupedListFiles
+		if groupBy != "" {
+			grouped = &GroupedListFiles{Object: "list", Groups: map[string]*FilesGroup{}}
+			for _, f := range listFiles.Data {
+				g, ok := grouped.Groups[f.Purpose]
+				if !ok {
+					g = &FilesGroup{Data: []File{}}
+					grouped.Groups[f.Purpose] = g
 				}
+				g.Count++
+			}
+		}
+
+		// after is the ID of the last file of the previous page
+		if after := c.Query("after"); after != "" {
+			i := slices.IndexFunc(listFiles.Data, func(f File) bool { return f.ID == after })
+			if i < 0 {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid after %q: no such file", after))
 			}
+			listFiles.Data = listFiles.Data[i+1:]
 		}
+
+		// Omitting limit returns a page of defaultFilesListLimit files.
+		// limit=0 is a metadata-only probe: no rows are returned but
+		// X-Total-Count and has_more still describe the full result set.
+		maxLimit := o.MaxFilesListLimit
+		if maxLimit <= 0 {
+			maxLimit = defaultMaxFilesListLimit
+		}
+		limit := min(defaultFilesListLimit, maxLimit)
+		if l := c.Query("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 0 {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid limit %q", l))
+			}
+			if limit > maxLimit {
+				c.Set(fiber.HeaderWarning, fmt.Sprintf(`299 - "limit clamped to %d"`, maxLimit))
+				limit = maxLimit
+			}
+		}
+		if limit < len(listFiles.Data) {
+			listFiles.HasMore = true
+			listFiles.Data = listFiles.Data[:limit]
+		}
+		if listFiles.Data == nil {
+			listFiles.Data = []File{}
+		}
+		if len(listFiles.Data) > 0 {
+			listFiles.FirstID = listFiles.Data[0].ID
+			listFiles.LastID = listFiles.Data[len(listFiles.Data)-1].ID
+		}
+		presentFiles(c, o, listFiles.Data)
+
 		listFiles.Object = "list"
-		return c.Status(fiber.StatusOK).JSON(listFiles)
+		var response interface{} = listFiles
+		if grouped != nil {
+			for _, f := range listFiles.Data {
+				g := grouped.Groups[f.Purpose]
+				g.Data = append(g.Data, f)
+			}
+			grouped.HasMore, grouped.FirstID, grouped.LastID = listFiles.HasMore, listFiles.FirstID, listFiles.LastID
+			response = grouped
+		}
+		if cache == nil {
+			return sendJSON(c.Status(fiber.StatusOK), response)
+		}
+
+		body, err := json.Marshal(response)
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+		cache.put(cacheKey, listCacheEntry{
+			body:    body,
+			total:   string(c.Response().Header.Peek("X-Total-Count")),
+			warning: string(c.Response().Header.Peek(fiber.HeaderWarning)),
+			version: version,
+		})
+		c.Set("X-Cache", "MISS")
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		return c.Status(fiber.StatusOK).Send(body)
+	}
+}
+
+// filterFilesMatching returns the files whose purpose matches purpose, case
+// insensitively unless StrictPurposeMatching is set.
+func filterFilesMatching(o *options.Option, purpose string) []File {
+	purpose = strings.TrimSpace(purpose)
+	if o.StrictPurposeMatching || purpose == "" {
+		return filterFiles(purpose)
+	}
+
+	defaultStore.mu.RLock()
+	defer defaultStore.mu.RUnlock()
+
+	now := time.Now()
+	var files []File
+	for _, f := range defaultStore.files {
+		if strings.EqualFold(purpose, f.Purpose) && !fileExpired(f, now) {
+			files = append(files, f)
+		}
 	}
+	return files
 }
 
-func getFileFromRequest(c *fiber.Ctx) (*File, error) {
+// filterFiles returns the files of purpose, or every file when it is empty.
+// Expired files are left out even before they are deleted.
+func filterFiles(purpose string) []File {
+	return defaultStore.list(purpose)
+}
+
+// HeadFilesEndpoint reports the number and total size of the files, optionally
+// filtered by purpose, as headers without a body.
+func HeadFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		files := ownedFiles(c, o, filterFilesMatching(o, c.Query("purpose")))
+
+		var total int64
+		for _, f := range files {
+			total += int64(f.Bytes)
+		}
+
+		c.Set("X-Total-Count", strconv.Itoa(len(files)))
+		c.Set("X-Total-Bytes", strconv.FormatInt(total, 10))
+		c.Status(fiber.StatusOK)
+		return nil
+	}
+}
+
+// sortFiles orders files in place by the given field. An empty field keeps
+// the insertion order, an empty order defaults to ascending.
+func sortFiles(files []File, sortBy, order string) error {
+	if order != "" && order != "asc" && order != "desc" {
+		return fmt.Errorf("unsupported order %q", order)
+	}
+
+	var less func(a, b File) bool
+	switch sortBy {
+	case "":
+		if order == "desc" {
+			slices.Reverse(files)
+		}
+		return nil
+	case "created_at":
+		less = func(a, b File) bool { return a.CreatedAt.Before(b.CreatedAt) }
+	case "filename":
+		less = func(a, b File) bool { return a.Filename < b.Filename }
+	case "bytes":
+		less = func(a, b File) bool { return a.Bytes < b.Bytes }
+	default:
+		return fmt.Errorf("unsupported sort field %q", sortBy)
+	}
+
+	if order == "desc" {
+		asc := less
+		less = func(a, b File) bool { return asc(b, a) }
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return less(files[i], files[j]) })
+	return nil
+}
+
+func getFileFromRequest(c *fiber.Ctx, o *options.Option) (*File, error) {
 	id := c.Params("file_id")
 	if id == "" {
 		return nil, fmt.Errorf("file_id parameter is required")
 	}
 
-	for _, f := range uploadedFiles {
-		if id == f.ID {
-			return &f, nil
-		}
-	}
+	return getOwnedFile(c, o, id)
+}
 
-	return nil, fmt.Errorf("unable to find file id %s", id)
+// errFileNotFound is returned when looking up a file the index doesn't hold.
+var errFileNotFound = errors.New("unable to find file id")
+
+// getFile returns a copy of the indexed file id.
+func getFile(id string) (*File, error) {
+	return defaultStore.get(id)
 }
 
 // GetFilesEndpoint https://platform.openai.com/docs/api-reference/files/retrieve
 func GetFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		file, err := getFileFromRequest(c)
+		file, err := getFileFromRequest(c, o)
+		if err != nil {
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+
+		// the source of an upload is only disclosed to admins
+		f := []File{*file}
+		presentFiles(c, o, f)
+
+		body, err := json.Marshal(f[0])
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		c.Set(fiber.HeaderETag, etag)
+		if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+			return c.SendStatus(fiber.StatusNotModified)
 		}
 
-		return c.JSON(file)
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		return c.Send(body)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch lists etag,
+// using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
 	}
+	return false
+}
+
+// addUploadedFile appends f to the index, or replaces the entry of the same ID.
+func addUploadedFile(f File) {
+	defaultStore.add(f)
+}
+
+// updateUploadedFile applies fn to the indexed file id, reporting whether it
+// was found.
+func updateUploadedFile(id string, fn func(f *File)) bool {
+	return defaultStore.update(id, fn)
+}
+
+// removeUploadedFile drops the file id from the index.
+func removeUploadedFile(id string) {
+	removeUploadedFiles([]string{id})
+}
+
+// removeUploadedFiles drops the files ids from the index.
+func removeUploadedFiles(ids []string) {
+	defaultStore.remove(ids)
 }
 
 // DeleteFilesEndpoint https://platform.openai.com/docs/api-reference/files/delete
@@ -159,29 +1276,27 @@ func DeleteFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fib
 	}
 
 	return func(c *fiber.Ctx) error {
-		file, err := getFileFromRequest(c)
+		file, err := getFileFromRequest(c, o)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
 		}
 
-		err = os.Remove(filepath.Join(o.UploadDir, file.Filename))
-		if err != nil {
-			// If the file doesn't exist then we should just continue to remove it
-			if !errors.Is(err, os.ErrNotExist) {
-				return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Unable to delete file: %s, %v", file.Filename, err))
-			}
+		if file.LegalHold {
+			return sendFileError(c, fiber.StatusConflict, codeFileOnHold, errFileOnHold.Error())
 		}
 
-		// Remove upload from list
-		for i, f := range uploadedFiles {
-			if f.ID == file.ID {
-				uploadedFiles = append(uploadedFiles[:i], uploadedFiles[i+1:]...)
-				break
-			}
+		err = deleteFile(c.UserContext(), o, *file)
+		if errors.Is(err, errFileOperationTimeout) {
+			return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out deleting file: %s", file.Filename))
+		}
+		if errors.Is(err, errBackendUnavailable) {
+			return sendFileError(c, fiber.StatusServiceUnavailable, codeBackendUnavailable, err.Error())
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, fmt.Sprintf("Unable to delete file: %s, %v", file.Filename, err))
 		}
 
-		saveUploadConfig(o.UploadDir)
-		return c.JSON(DeleteStatus{
+		return sendJSON(c, DeleteStatus{
 			Id:      file.ID,
 			Object:  "file",
 			Deleted: true,
@@ -189,19 +1304,294 @@ func DeleteFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fib
 	}
 }
 
+// deleteFile removes f from the storage and the index.
+func deleteFile(ctx context.Context, o *options.Option, f File) error {
+	return deleteFiles(ctx, o, []File{f})[0]
+}
+
+// deleteFiles removes files from the storage and the index served by the
+// endpoints.
+func deleteFiles(ctx context.Context, o *options.Option, files []File) []error {
+	return defaultStore.deleteFiles(ctx, o, files)
+}
+
+// deleteFiles removes files from the storage and the index, which is updated
+// and saved once for all of them. It returns the error of each file, nil for
+// the deleted ones.
+func (s *FileStore) deleteFiles(ctx context.Context, o *options.Option, files []File) []error {
+	errs := make([]error, len(files))
+	var removed []string
+	var blobs []File
+	for i, f := range files {
+		if o.ContentAddressedFiles && f.Sha256 != "" {
+			// the blob is released once the file is out of the index
+			blobs = append(blobs, f)
+			removed = append(removed, f.ID)
+			continue
+		}
+		err := removeWithTimeout(ctx, s.backendFor(o, f.Purpose), o.FileRemoveTimeout, storagePath(o, f))
+		// If the file doesn't exist then we should just continue to remove it
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs[i] = err
+			continue
+		}
+		removed = append(removed, f.ID)
+	}
+
+	if len(blobs) > 0 {
+		s.blobsMu.Lock()
+	}
+	s.remove(removed)
+	for _, f := range blobs {
+		err := s.releaseBlob(ctx, o, f.Purpose, blobName(o, f.Sha256, f.Purpose))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// the file is gone from the index, only an unreferenced blob is left behind
+			log.Error().Msgf("Unable to release blob %s of file %s: %v", f.Sha256, f.ID, err)
+		}
+	}
+	if len(blobs) > 0 {
+		s.blobsMu.Unlock()
+	}
+
+	for _, id := range removed {
+		dropDerivedContent(o, id)
+	}
+	if len(removed) > 0 {
+		s.save(o)
+	}
+	return errs
+}
+
+// openFileContent opens the stored bytes of f, decrypting them with the key of
+// its purpose when they were encrypted at rest.
+func openFileContent(ctx context.Context, o *options.Option, f File) (io.ReadCloser, error) {
+	return defaultStore.openContent(ctx, o, f)
+}
+
+// openContent opens the stored bytes of f kept by s, see openFileContent.
+func (s *FileStore) openContent(ctx context.Context, o *options.Option, f File) (io.ReadCloser, error) {
+	rc, err := openWithTimeout(ctx, s.backendFor(o, f.Purpose), o.FileOpenTimeout, storagePath(o, f))
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(rc)
+	header, _ := br.Peek(len(encryptionMagic))
+	if !isEncrypted(header) {
+		return storedContent{br, rc}, nil
+	}
+
+	key, ok := encryptionKey(o, f.Purpose)
+	if !ok {
+		rc.Close()
+		return nil, fmt.Errorf("no encryption key configured for purpose %s", f.Purpose)
+	}
+	plain, err := newDecryptReader(br, key)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, rc}, nil
+}
+
+// storedContent is the content of a file stored in clear.
+type storedContent struct {
+	*bufio.Reader
+	raw io.ReadCloser
+}
+
+func (c storedContent) Close() error { return c.raw.Close() }
+
+// size returns the length of the content, when the storage tells it.
+func (c storedContent) size() (int64, bool) {
+	s, ok := c.raw.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return 0, false
+	}
+	info, err := s.Stat()
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
 // GetFilesContentsEndpoint https://platform.openai.com/docs/api-reference/files/retrieve-contents
 func GetFilesContentsEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
-	return func(c *fiber.Ctx) error {
-		file, err := getFileFromRequest(c)
+	return withAccessLog(o, func(c *fiber.Ctx) error {
+		file, err := getFileFromRequest(c, o)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+
+		if file.Status == fileStatusQuarantined {
+			return sendFileError(c, fiber.StatusInternalServerError, codeFileQuarantined, fmt.Sprintf("File %s is quarantined: %s", file.ID, file.StatusDetails))
+		}
+
+		release, ok := downloads.acquire(file.ID, o.MaxConcurrentFileDownloads)
+		if !ok {
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return sendFileError(c, fiber.StatusServiceUnavailable, codeTooManyDownloads, fmt.Sprintf("Too many concurrent downloads of file %s", file.ID))
+		}
+		// the download runs until its content is sent
+		sending := false
+		defer func() {
+			if !sending {
+				release()
+			}
+		}()
+
+		rc, err := openFileContent(c.UserContext(), o, *file)
+		if errors.Is(err, errFileOperationTimeout) {
+			return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out opening file: %s", file.Filename))
+		}
+		if errors.Is(err, errBackendUnavailable) {
+			return sendFileError(c, fiber.StatusServiceUnavailable, codeBackendUnavailable, err.Error())
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return sendMissingContent(c, o, *file)
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+
+		// the content is streamed, unless checks need all of it before the
+		// first byte is sent. The recorded size is only relied upon when the
+		// storage can't tell the actual one.
+		size := int64(file.Bytes)
+		if sc, ok := rc.(storedContent); ok {
+			if n, ok := sc.size(); ok {
+				size = n
+			}
+		}
+		body := bufio.NewReader(rc)
+		if checksContentBeforeServing(o) {
+			fileContents, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+			}
+			if err := checkFileSize(o, *file, int64(len(fileContents))); err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeIntegrityError, err.Error())
+			}
+			if err := verifyFileContent(o, *file, fileContents); err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeIntegrityError, err.Error())
+			}
+			size = int64(len(fileContents))
+			rc = io.NopCloser(bytes.NewReader(fileContents))
+			body = bufio.NewReader(rc)
+		}
+		// compressed files are sent as stored to the clients taking gzip, and
+		// decompressed as they are sent to the others
+		decoded := false
+		if file.ContentEncoding == gzipEncoding {
+			c.Vary(fiber.HeaderAcceptEncoding)
+			if acceptsGzip(c) {
+				c.Set(fiber.HeaderContentEncoding, gzipEncoding)
+			} else {
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					rc.Close()
+					return sendFileError(c, fiber.StatusInternalServerError, codeIntegrityError, "Invalid gzip content: "+err.Error())
+				}
+				body = bufio.NewReader(zr)
+				decoded = true
+			}
+		}
+
+		// sniffing looks at the first 512 bytes at most
+		sniff, _ := body.Peek(512)
+
+		ctype := contentType(downloadName(*file), sniff)
+		if file.ContentEncoding != "" && !decoded {
+			// the stored bytes tell nothing of what they decompress to
+			ctype = encodedContentType(*file)
+		}
+		if o.FilesContentNegotiation {
+			base, _, _ := strings.Cut(ctype, ";")
+			if c.Accepts(base) == "" {
+				rc.Close()
+				return sendFileError(c, fiber.StatusNotAcceptable, codeNotAcceptable, fmt.Sprintf("File is only available as %s", base))
+			}
 		}
 
-		fileContents, err := os.ReadFile(filepath.Join(o.UploadDir, file.Filename))
+		c.Set(fiber.HeaderContentType, ctype)
+		c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": downloadName(*file)}))
+		if decoded {
+			// the decompressed size is not known for sure, nor are ranges
+			// of the decompressed content served
+			sending = true
+			return c.SendStream(struct {
+				io.Reader
+				io.Closer
+			}{body, releasingCloser{rc, release}})
+		}
+		c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+		start, end, err := contentRange(c, size)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			rc.Close()
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return sendFileError(c, fiber.StatusRequestedRangeNotSatisfiable, codeRangeNotSatisfiable, err.Error())
 		}
+		if start > 0 || end < size-1 {
+			if _, err := io.CopyN(io.Discard, body, start); err != nil {
+				rc.Close()
+				return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+			}
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			c.Status(fiber.StatusPartialContent)
+		}
+
+		// the stream is closed once sent
+		sending = true
+		return c.SendStream(struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(body, end-start+1), releasingCloser{rc, release}}, int(end-start+1))
+	})
+}
+
+// checksContentBeforeServing tells whether the options call for checking
+// all of the content of a file before serving it.
+func checksContentBeforeServing(o *options.Option) bool {
+	return o.VerifyOnRead || (o.SizeMismatchPolicy != "" && o.SizeMismatchPolicy != sizeMismatchIgnore)
+}
+
+// contentRange returns the first and last byte of the content of size
+// bytes to send, honoring a single range Range header. Other forms of the
+// header are ignored and the whole content is sent.
+func contentRange(c *fiber.Ctx, size int64) (int64, int64, error) {
+	if c.Get(fiber.HeaderRange) == "" {
+		return 0, size - 1, nil
+	}
+	ranges, err := c.Range(int(size))
+	if errors.Is(err, fiber.ErrRangeUnsatisfiable) {
+		return 0, 0, err
+	}
+	if err != nil || ranges.Type != "bytes" || len(ranges.Ranges) != 1 {
+		return 0, size - 1, nil
+	}
+	return int64(ranges.Ranges[0].Start), int64(ranges.Ranges[0].End), nil
+}
+
+// contentType guesses the MIME type of a file from its name, falling back to
+// sniffing its content.
+func contentType(filename string, content []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(content)
+}
 
-		return c.Send(fileContents)
+// sendJSON writes v as the JSON response body. The charset is always spelled
+// out so proxies sniffing the content don't mislabel it.
+func sendJSON(c *fiber.Ctx, v interface{}) error {
+	if err := c.JSON(v); err != nil {
+		return err
 	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return nil
 }
@@ -0,0 +1,70 @@
+package openai
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// accessSampler picks one in every n accesses for logging.
+type accessSampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+func newAccessSampler(n int) *accessSampler {
+	s := &accessSampler{}
+	if n > 0 {
+		s.n = uint64(n)
+	}
+	return s
+}
+
+// sample tells whether the current access should be logged. Nothing is
+// sampled when n is 0.
+func (s *accessSampler) sample() bool {
+	if s.n == 0 {
+		return false
+	}
+	return (s.count.Add(1)-1)%s.n == 0
+}
+
+// withAccessLog logs the accesses served by handler: failures always, and
+// successes as sampled.
+func withAccessLog(o *options.Option, handler fiber.Handler) fiber.Handler {
+	sampler := newAccessSampler(o.FileAccessLogSampling)
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := handler(c)
+
+		status := c.Response().StatusCode()
+		if fe, ok := err.(*fiber.Error); ok {
+			status = fe.Code
+		}
+		failed := err != nil || status >= fiber.StatusBadRequest
+		if !failed && !sampler.sample() {
+			return err
+		}
+
+		event := log.Info()
+		if failed {
+			event = log.Warn().AnErr("error", err)
+		}
+		// reading the body of a streamed response would drain the stream
+		bytes := c.Response().Header.ContentLength()
+		if !c.Response().IsBodyStream() {
+			bytes = len(c.Response().Body())
+		}
+		event.
+			Str("file", c.Params("file_id")).
+			Str("client", c.IP()).
+			Int("status", status).
+			Int("bytes", bytes).
+			Dur("duration", time.Since(start)).
+			Msg("file content accessed")
+		return err
+	}
+}
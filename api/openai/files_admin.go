@@ -0,0 +1,40 @@
+package openai
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// bearerKey returns the API key the request authenticates with, if any.
+func bearerKey(c *fiber.Ctx) string {
+	key, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return key
+}
+
+// isAdminRequest reports whether the request carries one of the admin keys.
+func isAdminRequest(c *fiber.Ctx, o *options.Option) bool {
+	key := bearerKey(c)
+	if key == "" {
+		return false
+	}
+	for _, admin := range o.AdminApiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(admin)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminOnly restricts a route to requests authenticated with an admin key.
+// Admin routes are unreachable when no admin key is configured.
+func AdminOnly(o *options.Option) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !isAdminRequest(c, o) {
+			return sendFileError(c, fiber.StatusForbidden, codeForbidden, "Admin API key required")
+		}
+		return c.Next()
+	}
+}
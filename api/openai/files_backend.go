@@ -0,0 +1,358 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/rs/zerolog/log"
+)
+
+// fileBackend is the persistence layer used by the files endpoints to store,
+// read and remove uploaded bytes.
+type fileBackend interface {
+	Save(ctx context.Context, path string, r io.Reader) error
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	Remove(ctx context.Context, path string) error
+}
+
+// storageKind names the kind of storage of backend, for backends telling it.
+func storageKind(backend fileBackend) string {
+	if k, ok := backend.(interface{ Kind() string }); ok {
+		return k.Kind()
+	}
+	return "custom"
+}
+
+// localBackend stores files on the local filesystem.
+type localBackend struct{}
+
+func (localBackend) Kind() string { return "local" }
+
+func (localBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	preallocated := false
+	if size := preallocationSize(ctx); size > 0 {
+		err := preallocate(dst, size)
+		if errors.Is(err, errPreallocationUnsupported) {
+			log.Debug().Msgf("Unable to preallocate %s: %s", path, err)
+		} else if err != nil {
+			dst.Close()
+			os.Remove(path)
+			return fmt.Errorf("preallocating %d bytes: %w", size, err)
+		}
+		preallocated = err == nil
+	}
+
+	n, err := io.Copy(dst, r)
+	if err == nil && preallocated {
+		// the content may be shorter than announced
+		err = dst.Truncate(n)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return dst.Close()
+}
+
+func (localBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localBackend) Remove(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (localBackend) Rename(ctx context.Context, from, to string) error {
+	return os.Rename(from, to)
+}
+
+// renamingBackend is a backend able to move a file it stores, replacing the
+// file already stored under the new path.
+type renamingBackend interface {
+	fileBackend
+	Rename(ctx context.Context, from, to string) error
+}
+
+// canRename tells whether backend can rename its files, looking through the
+// retries and circuit breaker.
+func canRename(backend fileBackend) bool {
+	_, ok := unwrapBackend(backend).(renamingBackend)
+	return ok
+}
+
+// errPreallocationUnsupported is returned by preallocate when the filesystem
+// can't reserve space ahead.
+var errPreallocationUnsupported = errors.New("preallocation is not supported")
+
+type preallocationKey struct{}
+
+// withPreallocation asks the local backend to reserve size bytes before
+// writing a file saved with ctx, so that a full disk fails the save early.
+func withPreallocation(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, preallocationKey{}, size)
+}
+
+func preallocationSize(ctx context.Context) int64 {
+	size, _ := ctx.Value(preallocationKey{}).(int64)
+	return size
+}
+
+// filesBackend returns the backend storing the files of the purposes without
+// a backend of their own.
+func (s *FileStore) filesBackend() fileBackend {
+	if s.backend == nil {
+		return localBackend{}
+	}
+	return s.backend
+}
+
+// backendFor returns the backend storing the files of purpose.
+func (s *FileStore) backendFor(o *options.Option, purpose string) fileBackend {
+	if b, ok := o.PurposeBackends[purpose]; ok {
+		return b
+	}
+	return s.filesBackend()
+}
+
+// indexCopySuffix names the complete copy of an index file written through
+// FilesBackend before the file itself is replaced.
+const indexCopySuffix = ".tmp"
+
+// saveIndexFile persists data as the file name of the upload directory. It is
+// replaced atomically on the local disk, or saved through FilesBackend when
+// one is configured, so that the index outlives the disk of the server.
+// Backends can't rename, so data is written to a copy before the file itself:
+// a save cut short by a slow backend always leaves one of the two complete,
+// and nothing is removed when it times out.
+func (s *FileStore) saveIndexFile(o *options.Option, name string, data []byte) error {
+	path := filepath.Join(o.UploadDir, name)
+	if o.FilesBackend == nil {
+		return writeFileAtomic(path, data)
+	}
+	for _, dst := range []string{path + indexCopySuffix, path} {
+		err := withFileTimeout(context.Background(), o.FileSaveTimeout, func(ctx context.Context) error {
+			return s.filesBackend().Save(ctx, dst, bytes.NewReader(data))
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readIndexFile reads the file name persisted by saveIndexFile. The error
+// matches os.ErrNotExist when it was never saved. When the file saved through
+// FilesBackend is missing or was cut short, its copy is read instead.
+func (s *FileStore) readIndexFile(o *options.Option, name string) ([]byte, error) {
+	path := filepath.Join(o.UploadDir, name)
+	if o.FilesBackend == nil {
+		return os.ReadFile(path)
+	}
+	data, err := s.readBackendFile(o, path)
+	if err == nil && json.Valid(data) {
+		return data, nil
+	}
+	if copied, cerr := s.readBackendFile(o, path+indexCopySuffix); cerr == nil && json.Valid(copied) {
+		log.Warn().Msgf("The files index %s is unreadable, loading its copy", name)
+		return copied, nil
+	}
+	return data, err
+}
+
+func (s *FileStore) readBackendFile(o *options.Option, path string) ([]byte, error) {
+	rc, err := openWithTimeout(context.Background(), s.filesBackend(), o.FileOpenTimeout, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// errFileOperationTimeout is returned when a backend operation does not
+// complete within its configured timeout.
+var errFileOperationTimeout = errors.New("file operation timed out")
+
+// withFileTimeout runs fn with a context bounded by timeout. The backend call
+// may ignore the context (e.g. a syscall stuck on a hung NFS mount), so fn is
+// run in its own goroutine and abandoned when the deadline is hit; cleanup is
+// then invoked once fn eventually returns so partial state is not left behind.
+// A zero timeout disables the limit.
+func withFileTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error, cleanup func(err error)) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if cleanup != nil {
+			go func() {
+				cleanup(<-done)
+			}()
+		}
+		return errFileOperationTimeout
+	}
+}
+
+// saveWithTimeout saves r as path, giving up after timeout. The content is
+// never read once it returns. Backends able to rename get it under a
+// temporary name first, only moved to path when the save completes in time,
+// so that a late save never touches what a later one stored under path. With
+// the others, a late save is undone unless another save of path started since.
+func saveWithTimeout(ctx context.Context, backend fileBackend, timeout time.Duration, path string, r io.Reader) error {
+	if timeout <= 0 {
+		return backend.Save(ctx, path, r)
+	}
+	src := &stoppableReader{r: r}
+	defer src.stop()
+
+	if !canRename(backend) {
+		save := startedSave(path)
+		err := withFileTimeout(ctx, timeout, func(ctx context.Context) error {
+			return backend.Save(ctx, path, src)
+		}, func(err error) {
+			// the save eventually completed (or failed) after we gave up
+			// on it, make sure nothing is left behind
+			if save.finished() {
+				backend.Remove(context.Background(), path)
+			}
+		})
+		if !errors.Is(err, errFileOperationTimeout) {
+			save.finished()
+		}
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"-"+newFileID())
+	err := withFileTimeout(ctx, timeout, func(ctx context.Context) error {
+		return backend.Save(ctx, tmp, src)
+	}, func(err error) {
+		backend.Remove(context.Background(), tmp)
+	})
+	if err == nil {
+		err = backend.(renamingBackend).Rename(ctx, tmp, path)
+	}
+	if err != nil && !errors.Is(err, errFileOperationTimeout) {
+		backend.Remove(context.Background(), tmp)
+	}
+	return err
+}
+
+// stoppableReader reads r until stop is called, reads then failing. stop waits
+// for the read in progress, so that r is not read anymore once it returns.
+type stoppableReader struct {
+	mu      sync.Mutex
+	r       io.Reader
+	stopped bool
+}
+
+func (s *stoppableReader) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return 0, errFileOperationTimeout
+	}
+	return s.r.Read(p)
+}
+
+// Seek lets the retries rewind the content, when it can be.
+func (s *stoppableReader) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seeker, ok := s.r.(io.Seeker)
+	if s.stopped || !ok {
+		return 0, errors.New("content can't be rewound")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+func (s *stoppableReader) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+}
+
+var (
+	pathSavesMu sync.Mutex
+	pathSavesN  uint64
+	// pathSaves holds the last save started of each path being saved.
+	pathSaves = map[string]uint64{}
+)
+
+// pathSave is a save of path, the seq-th one started.
+type pathSave struct {
+	path string
+	seq  uint64
+}
+
+func startedSave(path string) pathSave {
+	pathSavesMu.Lock()
+	defer pathSavesMu.Unlock()
+	pathSavesN++
+	pathSaves[path] = pathSavesN
+	return pathSave{path, pathSavesN}
+}
+
+// finished tells whether no other save of the path started after this one,
+// which is then forgotten.
+func (s pathSave) finished() bool {
+	pathSavesMu.Lock()
+	defer pathSavesMu.Unlock()
+	if pathSaves[s.path] != s.seq {
+		return false
+	}
+	delete(pathSaves, s.path)
+	return true
+}
+
+func openWithTimeout(ctx context.Context, backend fileBackend, timeout time.Duration, path string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := withFileTimeout(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		rc, err = backend.Open(ctx, path)
+		return err
+	}, func(err error) {
+		if err == nil && rc != nil {
+			rc.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func removeWithTimeout(ctx context.Context, backend fileBackend, timeout time.Duration, path string) error {
+	return withFileTimeout(ctx, timeout, func(ctx context.Context) error {
+		return backend.Remove(ctx, path)
+	}, nil)
+}
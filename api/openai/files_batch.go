@@ -0,0 +1,278 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"time"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/go-skynet/LocalAI/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// BatchResult is the response of the batch endpoints: the files the
+// operation succeeded on, and an entry for each one it failed on, so that
+// partial successes can be told apart.
+type BatchResult struct {
+	Object  string       `json:"object"`
+	Results []File       `json:"results"`
+	Errors  []BatchError `json:"errors"`
+}
+
+// BatchError tells why the operation failed on one item of a batch, named by
+// its ID or, for uploads, by its filename.
+type BatchError struct {
+	ID       string `json:"id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message"`
+	status   int
+}
+
+func newBatchResult() BatchResult {
+	return BatchResult{Object: "list", Results: []File{}, Errors: []BatchError{}}
+}
+
+// batchFileIDs parses the file_ids of a batch request, also taken as ids.
+func batchFileIDs(c *fiber.Ctx) ([]string, error) {
+	var req struct {
+		FileIDs []string `json:"file_ids"`
+		IDs     []string `json:"ids"`
+	}
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return nil, err
+	}
+	ids := append(req.FileIDs, req.IDs...)
+	if len(ids) == 0 {
+		return nil, errors.New("file_ids is required")
+	}
+	return ids, nil
+}
+
+// UploadFilesBatchEndpoint stores every "file" part of a multipart request
+// with the same purpose. By default each file succeeds or fails on its own;
+// with transactional=true the files are staged and only registered once all
+// of them are stored, the first failure discarding the others unseen.
+func UploadFilesBatchEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid multipart form: "+err.Error())
+		}
+		files := form.File["file"]
+		if len(files) == 0 {
+			logUploadRejection(c, o, rejectMissingFile, "", "", 0)
+			return sendFileError(c, fiber.StatusBadRequest, rejectMissingFile, "No file to upload")
+		}
+
+		purpose := c.FormValue("purpose", "")
+		transactional, _ := strconv.ParseBool(c.FormValue("transactional", "false"))
+		tenant := requestTenant(c, o)
+		expiresAfter, err := uploadExpiresAfter(c)
+		if err != nil {
+			for _, file := range files {
+				logUploadRejection(c, o, rejectBadExpiration, purpose, file.Filename, file.Size)
+			}
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+
+		result := newBatchResult()
+		var reqs []schema.UploadRequest
+		for _, file := range files {
+			var staged []File
+			if transactional {
+				staged = result.Results
+			}
+			f, req, berr := storeBatchFile(c, o, file, purpose, tenant, expiresAfter, staged, transactional)
+			if berr == nil {
+				result.Results = append(result.Results, f)
+				reqs = append(reqs, req)
+				continue
+			}
+
+			result.Errors = append(result.Errors, *berr)
+			if transactional {
+				defaultStore.discard(c.UserContext(), o, result.Results)
+				result.Results = []File{}
+				return sendJSON(c.Status(berr.status), result)
+			}
+		}
+
+		if transactional {
+			defaultStore.commit(o, result.Results)
+			for i, f := range result.Results {
+				acceptBatchFile(c, o, reqs[i], f)
+			}
+		}
+		presentFiles(c, o, result.Results)
+		warnUploads(result.Results)
+		return sendJSON(c.Status(fiber.StatusOK), result)
+	}
+}
+
+// storeBatchFile stores a file of a batch, or only stages it when staging.
+// The staged files of the batch count in its limits, and in its names.
+func storeBatchFile(c *fiber.Ctx, o *options.Option, file *multipart.FileHeader, purpose, tenant string, expiresAfter time.Duration, staged []File, staging bool) (File, schema.UploadRequest, *BatchError) {
+	reject := func(err error) *BatchError {
+		r := rejectionFor(err)
+		logUploadRejection(c, o, r.reason, purpose, file.Filename, file.Size)
+		return &BatchError{Filename: file.Filename, Reason: r.reason, Message: r.message, status: r.status}
+	}
+
+	if err := defaultStore.checkUploadLimits(o, staged, file.Size, purpose, tenant); err != nil {
+		return File{}, schema.UploadRequest{}, reject(err)
+	}
+	if err := checkFilenameAllowed(o, file.Filename); err != nil {
+		return File{}, schema.UploadRequest{}, reject(err)
+	}
+	if err := checkFileConflict(o, requestOwnerKey(c, o), purpose, file.Filename); err != nil {
+		return File{}, schema.UploadRequest{}, reject(err)
+	}
+	for _, other := range staged {
+		if !o.AllowDuplicateFilenames && utils.SanitizeFileName(other.Filename) == utils.SanitizeFileName(file.Filename) {
+			return File{}, schema.UploadRequest{}, reject(refuse(errFileExists, "File already exists"))
+		}
+	}
+	metadata := withDefaultMetadata(o, nil)
+	req := uploadRequest(c, o, file.Filename, purpose, file.Size, metadata)
+	if err := runPreUploadHooks(c.UserContext(), o, req); err != nil {
+		return File{}, req, reject(err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return File{}, req, &BatchError{Filename: file.Filename, Reason: codeInternalError, Message: "Failed to save file: " + err.Error(), status: fiber.StatusInternalServerError}
+	}
+	defer src.Close()
+
+	f := File{
+		ID:          newFileID(),
+		Object:      "file",
+		Bytes:       int(file.Size),
+		CreatedAt:   time.Now(),
+		Filename:    file.Filename,
+		Purpose:     purpose,
+		Metadata:    metadata,
+		Tenant:      tenant,
+		Source:      uploadSource(c, o),
+		OwnerKey:    requestOwnerKey(c, o),
+		ContentType: file.Header.Get(fiber.HeaderContentType),
+	}
+	setExpiration(o, &f, expiresAfter)
+	if staging {
+		err = defaultStore.stage(c.UserContext(), o, &f, src, false)
+	} else {
+		err = storeFile(c.UserContext(), o, &f, src)
+	}
+	if err != nil {
+		status, code, message := storeErrorResponse(err)
+		return File{}, req, &BatchError{Filename: file.Filename, Reason: code, Message: message, status: status}
+	}
+	if !staging {
+		acceptBatchFile(c, o, req, f)
+	}
+	return f, req, nil
+}
+
+// acceptBatchFile reports a file of a batch once it is registered.
+func acceptBatchFile(c *fiber.Ctx, o *options.Option, req schema.UploadRequest, f File) {
+	observeAcceptedUpload(o, f)
+	runPostUploadHooks(c.UserContext(), o, req, f)
+}
+
+// BatchGetFilesEndpoint returns the files listed in file_ids.
+func BatchGetFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ids, err := batchFileIDs(c)
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+
+		result := newBatchResult()
+		for _, id := range ids {
+			f, err := getOwnedFile(c, o, id)
+			if err != nil {
+				result.Errors = append(result.Errors, BatchError{ID: id, Reason: batchErrorCode(err), Message: err.Error()})
+				continue
+			}
+			result.Results = append(result.Results, *f)
+		}
+
+		presentFiles(c, o, result.Results)
+		return sendJSON(c, result)
+	}
+}
+
+// BatchDeleteFilesEndpoint deletes the files listed in file_ids, each one
+// succeeding or failing on its own. The index is updated and saved once for
+// the whole batch.
+func BatchDeleteFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ids, err := batchFileIDs(c)
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+
+		// the file or the error of each ID
+		targets := make([]*File, len(ids))
+		errs := make([]error, len(ids))
+		var files []File
+		var slots []int
+		seen := map[string]bool{}
+		for i, id := range ids {
+			f, err := getOwnedFile(c, o, id)
+			if err == nil && seen[id] {
+				// deleted by its first occurrence
+				err = fmt.Errorf("%w %s", errFileNotFound, id)
+			}
+			if err == nil && f.LegalHold {
+				err = errFileOnHold
+			}
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			seen[id] = true
+			targets[i] = f
+			files = append(files, *f)
+			slots = append(slots, i)
+		}
+
+		for j, err := range deleteFiles(c.UserContext(), o, files) {
+			errs[slots[j]] = err
+		}
+		result := newBatchResult()
+		for i, id := range ids {
+			if err := errs[i]; err != nil {
+				result.Errors = append(result.Errors, BatchError{ID: id, Reason: batchErrorCode(err), Message: err.Error()})
+				continue
+			}
+			result.Results = append(result.Results, *targets[i])
+		}
+
+		presentFiles(c, o, result.Results)
+		return sendJSON(c, result)
+	}
+}
+
+// batchErrorCode is the code reported for a file of a batch failing with err.
+func batchErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errFileNotFound):
+		return codeFileNotFound
+	case errors.Is(err, errFileOnHold):
+		return codeFileOnHold
+	case errors.Is(err, errFileImmutable):
+		return rejectFileImmutable
+	case errors.Is(err, errFileOperationTimeout):
+		return codeTimeout
+	case errors.Is(err, errBackendUnavailable):
+		return codeBackendUnavailable
+	}
+	return codeInternalError
+}
@@ -0,0 +1,207 @@
+package openai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// blobsDir is the directory, relative to the upload dir, holding
+// content-addressed blobs when ContentAddressedFiles is enabled.
+const blobsDir = "blobs"
+
+func blobPath(uploadDir, name string) string {
+	return filepath.Join(uploadDir, blobsDir, name)
+}
+
+// blobName is the name of the blob holding content with checksum sum. When
+// encryption at rest is enabled the key is part of the name, so purposes
+// encrypted with different keys never share a blob. Likewise purposes with a
+// backend of their own get their own blobs.
+func blobName(o *options.Option, sum, purpose string) string {
+	name := sum
+	if key, ok := encryptionKey(o, purpose); ok {
+		name = fmt.Sprintf("%s-%02x", name, encryptionKeyID(key))
+	}
+	if _, ok := o.PurposeBackends[purpose]; ok {
+		name += "-" + utils.SanitizeFileName(purpose)
+	}
+	return name
+}
+
+// storagePath returns where the bytes of f live on the backend. Files indexed
+// before their path was recorded are found from their name.
+func storagePath(o *options.Option, f File) string {
+	if o.ContentAddressedFiles && f.Sha256 != "" {
+		return blobPath(o.UploadDir, blobName(o, f.Sha256, f.Purpose))
+	}
+	if f.Path != "" {
+		// the index can be edited by hand, stay inside the upload directory
+		return filepath.Join(o.UploadDir, filepath.Clean(string(filepath.Separator)+f.Path))
+	}
+	return filepath.Join(o.UploadDir, utils.SanitizeFileName(f.Filename))
+}
+
+// storableName tells whether name, as sanitized by utils.SanitizeFileName,
+// names a file rather than the directory holding it.
+func storableName(name string) bool {
+	return name != "" && name != "." && name != string(filepath.Separator)
+}
+
+// storageName is the path to store a new file f at, relative to the upload
+// directory: its name in the directory of its purpose, prefixed with its ID
+// when several files can share the same name. A name that can't be stored is
+// replaced by the ID, never leaving the directory of the purpose itself.
+func storageName(o *options.Option, f File) string {
+	name := utils.SanitizeFileName(f.Filename)
+	if !storableName(name) {
+		return filepath.Join(purposeDir(f.Purpose), f.ID)
+	}
+	if o.AllowDuplicateFilenames {
+		name = f.ID + "-" + name
+	}
+	return filepath.Join(purposeDir(f.Purpose), name)
+}
+
+// freeStorageName is the storageName of f, prefixed with its ID when another
+// file, of another owner, is already stored there.
+func (s *FileStore) freeStorageName(o *options.Option, f File) string {
+	name := storageName(o, f)
+	path := filepath.Join(o.UploadDir, name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, other := range s.files {
+		if other.ID != f.ID && storagePath(o, other) == path {
+			return filepath.Join(purposeDir(f.Purpose), f.ID+"-"+utils.SanitizeFileName(f.Filename))
+		}
+	}
+	return name
+}
+
+// purposeDir is the directory of the upload directory holding the files of
+// purpose. Names the upload directory uses for itself are prefixed with "_".
+func purposeDir(purpose string) string {
+	dir := utils.SanitizeFileName(purpose)
+	switch {
+	case dir == "." || dir == "":
+		return ""
+	case dir == blobsDir || strings.HasPrefix(dir, ".") || strings.HasPrefix(dir, "_"):
+		return "_" + dir
+	}
+	return dir
+}
+
+// blobRefs counts how many files in the index reference the blob name.
+func (s *FileStore) blobRefs(o *options.Option, name string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refs := 0
+	for _, f := range s.files {
+		if f.Sha256 != "" && blobName(o, f.Sha256, f.Purpose) == name {
+			refs++
+		}
+	}
+	return refs
+}
+
+// hashContent computes the SHA-256 of r and rewinds it for a later read.
+func hashContent(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveBlob stores r as the blob name unless another file already references
+// the same content. The caller must hold s.blobsMu.
+func (s *FileStore) saveBlob(ctx context.Context, o *options.Option, purpose, name string, r io.Reader) error {
+	if s.blobRefs(o, name) > 0 {
+		return nil
+	}
+	return saveWithTimeout(ctx, s.backendFor(o, purpose), o.FileSaveTimeout, blobPath(o.UploadDir, name), r)
+}
+
+// releaseBlob removes the blob name once no file references it anymore. The
+// caller must hold s.blobsMu and have already dropped its own reference.
+func (s *FileStore) releaseBlob(ctx context.Context, o *options.Option, purpose, name string) error {
+	if s.blobRefs(o, name) > 0 {
+		return nil
+	}
+	return removeWithTimeout(ctx, s.backendFor(o, purpose), o.FileRemoveTimeout, blobPath(o.UploadDir, name))
+}
+
+// compactBlobs removes blobs that no file references anymore, as left behind by
+// a crash between updating the index and releasing the blob. Blobs younger than
+// gracePeriod are kept so content being written right now is never collected.
+// It returns the number of removed blobs.
+func (s *FileStore) compactBlobs(o *options.Option, gracePeriod time.Duration) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(o.UploadDir, blobsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < gracePeriod {
+			continue
+		}
+
+		// check the references under the lock, an upload may have just
+		// started pointing at this blob
+		s.blobsMu.Lock()
+		if s.blobRefs(o, e.Name()) == 0 {
+			if err := os.Remove(blobPath(o.UploadDir, e.Name())); err != nil {
+				log.Error().Msgf("Failed to remove orphan blob %s: %s", e.Name(), err)
+			} else {
+				removed++
+			}
+		}
+		s.blobsMu.Unlock()
+	}
+
+	return removed, nil
+}
+
+// StartBlobCompactor periodically collects orphan content-addressed blobs until
+// the option context is canceled.
+func StartBlobCompactor(o *options.Option) {
+	go func() {
+		ticker := time.NewTicker(o.BlobCompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.Context.Done():
+				return
+			case <-ticker.C:
+				removed, err := defaultStore.compactBlobs(o, o.BlobCompactionGracePeriod)
+				if err != nil {
+					log.Error().Msgf("Failed to compact blobs: %s", err)
+				} else if removed > 0 {
+					log.Debug().Msgf("Removed %d orphan blobs", removed)
+				}
+			}
+		}
+	}()
+}
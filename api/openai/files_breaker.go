@@ -0,0 +1,247 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/rs/zerolog/log"
+)
+
+// States of a circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBackendUnavailable is returned without calling the backend while its
+// circuit breaker is open.
+var errBackendUnavailable = errors.New("files backend is unavailable")
+
+// circuitBreaker stops calling a failing backend after threshold consecutive
+// failures. Once cooldown has elapsed a single probe call is let through: its
+// success closes the breaker again, its failure keeps it open.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+
+	now      func() time.Time
+	onChange func(from, to string)
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(from, to string)) *circuitBreaker {
+	b := &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed, now: time.Now, onChange: onChange}
+	if onChange != nil {
+		onChange("", breakerClosed)
+	}
+	return b
+}
+
+// setState must be called with the lock held.
+func (b *circuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	log.Warn().Msgf("Files backend circuit breaker is now %s", state)
+	if b.onChange != nil {
+		b.onChange(b.state, state)
+	}
+	b.state = state
+}
+
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a call can go through.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errBackendUnavailable
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errBackendUnavailable
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record accounts for the outcome of a call let through by allow.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// resilientBackend retries failed calls to a backend with a jittered backoff,
+// and protects it with a circuit breaker.
+type resilientBackend struct {
+	backend fileBackend
+	retries int
+	backoff time.Duration
+	breaker *circuitBreaker
+}
+
+// backendFailed tells whether err means the backend is misbehaving, as opposed
+// to the request being wrong.
+func backendFailed(err error) bool {
+	return err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, context.Canceled)
+}
+
+func (b *resilientBackend) do(ctx context.Context, op func() error, rewind func() error) error {
+	if b.breaker != nil {
+		if err := b.breaker.allow(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+retry:
+	for attempt := 0; ; attempt++ {
+		err = op()
+		if !backendFailed(err) || attempt >= b.retries || rewind() != nil {
+			break
+		}
+
+		// full jitter, so that clients failing together don't retry together
+		delay := b.backoff << attempt
+		if delay > 0 {
+			delay = time.Duration(rand.Int63n(int64(delay)))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			// give up, reporting the last failure
+			timer.Stop()
+			break retry
+		case <-timer.C:
+		}
+	}
+
+	if b.breaker != nil {
+		b.breaker.record(backendFailed(err))
+	}
+	return err
+}
+
+func noRewind() error { return nil }
+
+func (b *resilientBackend) Kind() string { return storageKind(b.backend) }
+
+func (b *resilientBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	// a save can only be retried when the content can be read again
+	rewind := func() error { return errors.New("content can't be rewound") }
+	if s, ok := r.(io.Seeker); ok {
+		if start, err := s.Seek(0, io.SeekCurrent); err == nil {
+			rewind = func() error {
+				_, err := s.Seek(start, io.SeekStart)
+				return err
+			}
+		}
+	}
+	return b.do(ctx, func() error { return b.backend.Save(ctx, path, r) }, rewind)
+}
+
+func (b *resilientBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := b.do(ctx, func() error {
+		var err error
+		rc, err = b.backend.Open(ctx, path)
+		return err
+	}, noRewind)
+	return rc, err
+}
+
+func (b *resilientBackend) Remove(ctx context.Context, path string) error {
+	return b.do(ctx, func() error { return b.backend.Remove(ctx, path) }, noRewind)
+}
+
+// Rename must only be called when the wrapped backend renames, see canRename.
+func (b *resilientBackend) Rename(ctx context.Context, from, to string) error {
+	return b.do(ctx, func() error { return b.backend.(renamingBackend).Rename(ctx, from, to) }, noRewind)
+}
+
+// newResilientBackend wraps backend with the retries and circuit breaker
+// configured in o, or returns it as is when neither is or it is already
+// wrapped.
+func newResilientBackend(backend fileBackend, o *options.Option) fileBackend {
+	if o.FileBackendRetries <= 0 && o.FileBackendBreakerThreshold <= 0 {
+		return backend
+	}
+	if _, ok := backend.(*resilientBackend); ok {
+		return backend
+	}
+
+	r := &resilientBackend{backend: backend, retries: o.FileBackendRetries, backoff: o.FileBackendRetryBackoff}
+	if o.FileBackendBreakerThreshold > 0 {
+		var onChange func(from, to string)
+		if o.Metrics != nil {
+			onChange = o.Metrics.ObserveBreakerState
+		}
+		r.breaker = newCircuitBreaker(o.FileBackendBreakerThreshold, o.FileBackendBreakerCooldown, onChange)
+	}
+	return r
+}
+
+// unwrapBackend returns the backend wrapped with retries and a circuit
+// breaker by backend, or backend itself when it is not wrapped.
+func unwrapBackend(backend fileBackend) fileBackend {
+	if r, ok := backend.(*resilientBackend); ok {
+		return r.backend
+	}
+	return backend
+}
+
+// ConfigureFilesBackend installs the FilesBackend option and applies the retry
+// and circuit breaker options to the files backends. It must be called before
+// serving requests, calling it again leaves the backends as they are. The
+// purpose backends are wrapped in a new map, the one of the options may be
+// shared.
+func ConfigureFilesBackend(o *options.Option) {
+	if o.FilesBackend != nil {
+		defaultStore.backend = o.FilesBackend
+	}
+	defaultStore.backend = newResilientBackend(defaultStore.filesBackend(), o)
+	if o.PurposeBackends == nil {
+		return
+	}
+	backends := make(map[string]options.FileBackend, len(o.PurposeBackends))
+	for purpose, backend := range o.PurposeBackends {
+		backends[purpose] = newResilientBackend(backend, o)
+	}
+	o.PurposeBackends = backends
+}
@@ -0,0 +1,75 @@
+package openai
+
+import (
+	"sync"
+	"time"
+)
+
+// indexVersion is the version of the index served by the endpoints, which
+// cached listings compare to tell they are stale.
+func indexVersion() uint64 {
+	return defaultStore.indexVersion()
+}
+
+type listCacheEntry struct {
+	body    []byte
+	total   string
+	warning string
+	version uint64
+	expires time.Time
+}
+
+// listCache keeps serialized file listings, keyed by filter, sort and page,
+// for at most ttl and until the index changes. It holds up to size entries.
+type listCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]listCacheEntry
+}
+
+func newListCache(ttl time.Duration, size int) *listCache {
+	if size <= 0 {
+		size = 128
+	}
+	return &listCache{ttl: ttl, size: size, entries: make(map[string]listCacheEntry)}
+}
+
+func (lc *listCache) get(key string, version uint64) (listCacheEntry, bool) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	e, ok := lc.entries[key]
+	if !ok {
+		return e, false
+	}
+	if e.version != version || time.Now().After(e.expires) {
+		delete(lc.entries, key)
+		return e, false
+	}
+	return e, true
+}
+
+func (lc *listCache) put(key string, e listCacheEntry) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	e.expires = time.Now().Add(lc.ttl)
+	if _, ok := lc.entries[key]; !ok && len(lc.entries) >= lc.size {
+		now := time.Now()
+		var oldest string
+		for k, v := range lc.entries {
+			if v.version != e.version || now.After(v.expires) {
+				delete(lc.entries, k)
+				continue
+			}
+			if oldest == "" || v.expires.Before(lc.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(lc.entries) >= lc.size {
+			delete(lc.entries, oldest)
+		}
+	}
+	lc.entries[key] = e
+}
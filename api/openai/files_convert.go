@@ -0,0 +1,275 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// maxConvertedImageSide bounds the size of resized images.
+const maxConvertedImageSide = 8192
+
+// maxDecodedImagePixels bounds the images decoded to be converted, whose
+// decoded size grows with their dimensions rather than with their file size.
+const maxDecodedImagePixels = 64 * 1024 * 1024
+
+// errImageTooLarge is returned for images with more than
+// maxDecodedImagePixels pixels.
+var errImageTooLarge = fmt.Errorf("image has more than %d pixels", maxDecodedImagePixels)
+
+// fileConverter transforms the content of a file to another format.
+type fileConverter struct {
+	contentType string
+	// accepts tells whether the converter can handle f
+	accepts func(f File) bool
+	// prepare checks the query parameters and returns the conversion to run
+	prepare func(query map[string]string) (func(w io.Writer, r io.Reader) error, error)
+}
+
+// fileConverters maps the target formats of the convert endpoint to their
+// converter.
+var fileConverters = map[string]fileConverter{
+	"csv": {
+		contentType: "text/csv; charset=utf-8",
+		accepts:     isJSONLFile,
+		prepare: func(map[string]string) (func(w io.Writer, r io.Reader) error, error) {
+			return jsonlToCSV, nil
+		},
+	},
+	"png": {
+		contentType: "image/png",
+		accepts:     isImageFile,
+		prepare: func(query map[string]string) (func(w io.Writer, r io.Reader) error, error) {
+			return imageConversion(query, func(w io.Writer, img image.Image) error {
+				return png.Encode(w, img)
+			})
+		},
+	},
+	"jpeg": {
+		contentType: "image/jpeg",
+		accepts:     isImageFile,
+		prepare: func(query map[string]string) (func(w io.Writer, r io.Reader) error, error) {
+			return imageConversion(query, func(w io.Writer, img image.Image) error {
+				return jpeg.Encode(w, img, nil)
+			})
+		},
+	},
+}
+
+func isJSONLFile(f File) bool {
+	return strings.EqualFold(filepath.Ext(downloadName(f)), ".jsonl") || f.Purpose == "fine-tune"
+}
+
+func isImageFile(f File) bool {
+	switch strings.ToLower(filepath.Ext(downloadName(f))) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return f.Purpose == "vision"
+}
+
+// jsonlToCSV writes every JSON object of r as a CSV row. The columns are the
+// keys of the first object, in alphabetical order; non string values are
+// written JSON encoded.
+func jsonlToCSV(w io.Writer, r io.Reader) error {
+	cw := csv.NewWriter(w)
+	var columns []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if columns == nil {
+			for k := range record {
+				columns = append(columns, k)
+			}
+			sort.Strings(columns)
+			if err := cw.Write(columns); err != nil {
+				return err
+			}
+		}
+
+		row := make([]string, len(columns))
+		for i, k := range columns {
+			v, ok := record[k]
+			if !ok {
+				continue
+			}
+			var s string
+			if err := json.Unmarshal(v, &s); err == nil {
+				row[i] = s
+			} else {
+				row[i] = string(v)
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// imageConversion decodes an image, resizes it to the optional width and
+// height query parameters and encodes it back. When only one side is given
+// the other keeps the aspect ratio.
+func imageConversion(query map[string]string, encode func(w io.Writer, img image.Image) error) (func(w io.Writer, r io.Reader) error, error) {
+	side := func(name string) (int, error) {
+		v, ok := query[name]
+		if !ok {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxConvertedImageSide {
+			return 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return n, nil
+	}
+	width, err := side("width")
+	if err != nil {
+		return nil, err
+	}
+	height, err := side("height")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w io.Writer, r io.Reader) error {
+		img, err := decodeImage(r)
+		if err != nil {
+			return err
+		}
+		return encode(w, resizeImage(img, width, height))
+	}, nil
+}
+
+// decodeImage decodes the image of r, refusing from its header an image with
+// more than maxDecodedImagePixels pixels.
+func decodeImage(r io.Reader) (image.Image, error) {
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxDecodedImagePixels {
+		return nil, errImageTooLarge
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	return img, err
+}
+
+// resizeImage scales img with nearest neighbour sampling.
+func resizeImage(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if width == 0 && height == 0 || b.Dx() == 0 || b.Dy() == 0 {
+		return img
+	}
+	if width == 0 {
+		width = min(maxConvertedImageSide, max(1, b.Dx()*height/b.Dy()))
+	}
+	if height == 0 {
+		height = min(maxConvertedImageSide, max(1, b.Dy()*width/b.Dx()))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height))
+		}
+	}
+	return dst
+}
+
+// ConvertFilesEndpoint streams the content of a file converted to the format
+// requested by the "to" query parameter. The output is kept in the derived
+// content cache when one is configured, and otherwise never stored.
+func ConvertFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		file, err := getFileFromRequest(c, o)
+		if err != nil {
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+
+		to := strings.ToLower(c.Query("to"))
+		if to == "" {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Missing target format")
+		}
+		converter, ok := fileConverters[to]
+		if !ok || !converter.accepts(*file) {
+			return sendFileError(c, fiber.StatusUnsupportedMediaType, codeUnsupportedMediaType, fmt.Sprintf("Can't convert %s to %s", file.Filename, to))
+		}
+		convert, err := converter.prepare(c.Queries())
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+
+		dc := derivedCacheFor(o)
+		transform := derivedTransform("convert", c.Queries())
+		if dc != nil {
+			if cached, ok := dc.open(*file, transform); ok {
+				return sendDerivedContent(c, converter.contentType, cached, true)
+			}
+		}
+
+		rc, err := openDecodedContent(c.UserContext(), o, *file)
+		if errors.Is(err, errFileOperationTimeout) {
+			return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out opening file: %s", file.Filename))
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+
+		if dc != nil {
+			// the output is complete before it is sent, so a failed conversion
+			// is answered as an error
+			defer rc.Close()
+			converted, err := dc.store(*file, transform, func(w io.Writer) error { return convert(w, rc) })
+			if err != nil {
+				log.Warn().Msgf("Failed to convert %s to %s: %s", file.ID, to, err)
+				return sendFileError(c, fiber.StatusUnprocessableEntity, codeInvalidRequest, fmt.Sprintf("Unable to convert %s to %s: %s", file.Filename, to, err))
+			}
+			return sendDerivedContent(c, converter.contentType, converted, false)
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			defer rc.Close()
+			err := convert(pw, rc)
+			if err != nil {
+				log.Warn().Msgf("Failed to convert %s to %s: %s", file.ID, to, err)
+			}
+			pw.CloseWithError(err)
+		}()
+
+		c.Set(fiber.HeaderContentType, converter.contentType)
+		return c.SendStream(pr)
+	}
+}
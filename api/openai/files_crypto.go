@@ -0,0 +1,202 @@
+package openai
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-skynet/LocalAI/api/options"
+)
+
+// Encrypted files start with a header made of encryptionMagic, the id of the
+// key used and a random nonce prefix. The content follows as a sequence of
+// AES-GCM sealed records of at most encryptionChunkSize plaintext bytes, each
+// prefixed by a flag marking the last record and the sealed length, so that a
+// truncated file fails to decrypt instead of silently coming back short.
+var encryptionMagic = []byte("LAIENC1")
+
+const (
+	encryptionChunkSize   = 64 * 1024
+	encryptionPrefixSize  = 7
+	encryptionHeaderSize  = 8 + encryptionPrefixSize // magic + key id + nonce prefix
+	encryptionRecordFinal = 1
+)
+
+var errWrongEncryptionKey = errors.New("file was encrypted with a different key")
+
+// defaultEncryptionKey is the FileEncryptionKeys entry used by purposes without
+// a dedicated key.
+const defaultEncryptionKey = "*"
+
+// encryptionKey returns the key protecting files of the given purpose, if
+// encryption at rest is enabled.
+func encryptionKey(o *options.Option, purpose string) ([]byte, bool) {
+	if key, ok := o.FileEncryptionKeys[purpose]; ok {
+		return key, true
+	}
+	key, ok := o.FileEncryptionKeys[defaultEncryptionKey]
+	return key, ok
+}
+
+// encryptionKeyID identifies a key in the file header, so that a file read
+// with the wrong purpose key is reported as such.
+func encryptionKeyID(key []byte) byte {
+	sum := sha256.Sum256(key)
+	return sum[0]
+}
+
+func recordNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if final {
+		nonce[11] = encryptionRecordFinal
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     bytes.Buffer
+	done    bool
+}
+
+// newEncryptReader returns a reader producing the encrypted form of src.
+func newEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &encryptReader{src: src, aead: aead, prefix: make([]byte, encryptionPrefixSize)}
+	if _, err := rand.Read(r.prefix); err != nil {
+		return nil, err
+	}
+
+	r.buf.Write(encryptionMagic)
+	r.buf.WriteByte(encryptionKeyID(key))
+	r.buf.Write(r.prefix)
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		chunk := make([]byte, encryptionChunkSize)
+		n, err := io.ReadFull(r.src, chunk)
+		final := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			final = true
+		case err != nil:
+			return 0, err
+		}
+
+		flag := byte(0)
+		if final {
+			flag = encryptionRecordFinal
+		}
+		sealed := r.aead.Seal(nil, recordNonce(r.prefix, r.counter, final), chunk[:n], []byte{flag})
+		r.counter++
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+		r.buf.WriteByte(flag)
+		r.buf.Write(size[:])
+		r.buf.Write(sealed)
+		r.done = final
+	}
+
+	return r.buf.Read(p)
+}
+
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     bytes.Buffer
+	done    bool
+}
+
+// newDecryptReader returns a reader over the plaintext of the encrypted src.
+// It fails with errWrongEncryptionKey when src was sealed with another key.
+func newDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, errors.New("file is not encrypted")
+	}
+	if header[len(encryptionMagic)] != encryptionKeyID(key) {
+		return nil, errWrongEncryptionKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{src: src, aead: aead, prefix: header[len(encryptionMagic)+1:]}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		var head [5]byte
+		if _, err := io.ReadFull(r.src, head[:]); err != nil {
+			return 0, fmt.Errorf("encrypted file is truncated: %w", err)
+		}
+		flag := head[0]
+		size := binary.BigEndian.Uint32(head[1:])
+		if size > encryptionChunkSize+uint32(r.aead.Overhead()) {
+			return 0, errors.New("encrypted file is corrupted")
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r.src, sealed); err != nil {
+			return 0, fmt.Errorf("encrypted file is truncated: %w", err)
+		}
+
+		final := flag == encryptionRecordFinal
+		plain, err := r.aead.Open(nil, recordNonce(r.prefix, r.counter, final), sealed, []byte{flag})
+		if err != nil {
+			return 0, errWrongEncryptionKey
+		}
+		r.counter++
+		r.buf.Write(plain)
+		r.done = final
+	}
+
+	return r.buf.Read(p)
+}
+
+// isEncrypted reports whether the content starting with header was written
+// encrypted. Files stored before encryption was enabled are served as is.
+func isEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, encryptionMagic)
+}
@@ -0,0 +1,222 @@
+package openai
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultDerivedContentCacheMB bounds the derived content cache when
+// DerivedContentCacheMB is unset.
+const defaultDerivedContentCacheMB = 256
+
+// derivedCachePrefix starts the names of the cached outputs, the other files
+// of the cache directory being left alone.
+const derivedCachePrefix = "derived-"
+
+type derivedEntry struct {
+	key         string
+	fileID      string
+	fingerprint string
+	path        string
+	size        int64
+}
+
+// derivedCache keeps on disk the outputs of the transforms of files, such as
+// conversions and thumbnails, keyed by file and transform parameters. Once it
+// holds more than max bytes the least recently used outputs are evicted.
+type derivedCache struct {
+	dir string
+	max int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+	size    int64
+}
+
+// derivedCaches holds one cache per options, shared by the endpoints
+// transforming files.
+var derivedCaches sync.Map
+
+// derivedCacheFor returns the derived content cache of o, nil when it is
+// disabled. Outputs left over in its directory by a previous run are removed
+// when it is created, as nothing tells what they were made from.
+func derivedCacheFor(o *options.Option) *derivedCache {
+	if o.DerivedContentCacheDir == "" {
+		return nil
+	}
+	if dc, ok := derivedCaches.Load(o); ok {
+		return dc.(*derivedCache)
+	}
+
+	maxMB := o.DerivedContentCacheMB
+	if maxMB <= 0 {
+		maxMB = defaultDerivedContentCacheMB
+	}
+	dc := &derivedCache{dir: o.DerivedContentCacheDir, max: int64(maxMB) * 1024 * 1024, entries: map[string]*list.Element{}, lru: list.New()}
+	actual, loaded := derivedCaches.LoadOrStore(o, dc)
+	if !loaded {
+		leftovers, _ := filepath.Glob(filepath.Join(dc.dir, derivedCachePrefix+"*"))
+		for _, path := range leftovers {
+			os.Remove(path)
+		}
+	}
+	return actual.(*derivedCache)
+}
+
+// derivedFingerprint changes along with the content of f.
+func derivedFingerprint(f File) string {
+	return fmt.Sprintf("%d/%d/%s/%s", f.CreatedAt.UnixMilli(), f.Bytes, f.Sha256, f.ContentEncoding)
+}
+
+func derivedKey(f File, transform string) string {
+	return f.ID + "\x00" + transform
+}
+
+// open returns the cached output of transform for f. Finding an output made
+// from an older content of f drops every such output.
+func (dc *derivedCache) open(f File, transform string) (*os.File, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	el, ok := dc.entries[derivedKey(f, transform)]
+	if !ok {
+		return nil, false
+	}
+	fingerprint := derivedFingerprint(f)
+	if el.Value.(*derivedEntry).fingerprint != fingerprint {
+		dc.dropLocked(f.ID, fingerprint)
+		return nil, false
+	}
+
+	file, err := os.Open(el.Value.(*derivedEntry).path)
+	if err != nil {
+		dc.removeLocked(el)
+		return nil, false
+	}
+	dc.lru.MoveToFront(el)
+	return file, true
+}
+
+// store caches the output written by produce as the one of transform for f,
+// and returns it opened. Nothing is cached when produce fails.
+func (dc *derivedCache) store(f File, transform string, produce func(w io.Writer) error) (*os.File, error) {
+	if err := os.MkdirAll(dc.dir, 0750); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dc.dir, derivedCachePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	err = produce(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(tmp.Name())
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	entry := &derivedEntry{key: derivedKey(f, transform), fileID: f.ID, fingerprint: derivedFingerprint(f), path: tmp.Name(), size: info.Size()}
+	if el, ok := dc.entries[entry.key]; ok {
+		dc.removeLocked(el)
+	}
+	dc.entries[entry.key] = dc.lru.PushFront(entry)
+	dc.size += entry.size
+	for dc.size > dc.max && dc.lru.Len() > 1 {
+		dc.removeLocked(dc.lru.Back())
+	}
+	return file, nil
+}
+
+// drop removes every output cached for the file id.
+func (dc *derivedCache) drop(id string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.dropLocked(id, "")
+}
+
+// dropLocked removes the outputs cached for the file id other than those of
+// the fingerprint keep. The caller must hold mu.
+func (dc *derivedCache) dropLocked(id, keep string) {
+	for el := dc.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*derivedEntry); e.fileID == id && e.fingerprint != keep {
+			dc.removeLocked(el)
+		}
+		el = next
+	}
+}
+
+// removeLocked evicts the output of el. The caller must hold mu.
+func (dc *derivedCache) removeLocked(el *list.Element) {
+	e := dc.lru.Remove(el).(*derivedEntry)
+	delete(dc.entries, e.key)
+	dc.size -= e.size
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		log.Warn().Msgf("Unable to remove cached output %s: %s", e.path, err)
+	}
+}
+
+// dropDerivedContent forgets the outputs cached for the file id, whose
+// content is gone or replaced.
+func dropDerivedContent(o *options.Option, id string) {
+	if dc := derivedCacheFor(o); dc != nil {
+		dc.drop(id)
+	}
+}
+
+// derivedTransform describes a transform by its name and the query
+// parameters it depends on, in a stable order.
+func derivedTransform(name string, query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "&%s=%s", k, query[k])
+	}
+	return b.String()
+}
+
+// sendDerivedContent sends an output opened from the cache, telling whether it
+// was already cached.
+func sendDerivedContent(c *fiber.Ctx, contentType string, file *os.File, hit bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	if hit {
+		c.Set("X-Cache", "HIT")
+	} else {
+		c.Set("X-Cache", "MISS")
+	}
+	// the file is closed once sent
+	return c.SendStream(file, int(info.Size()))
+}
@@ -0,0 +1,254 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxDiffFileSize bounds the files the diff endpoint compares.
+const maxDiffFileSize = 8 * 1024 * 1024
+
+// diffOp is one line of a line-level diff.
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// maxDiffEdits bounds the edit distance diffLines searches for, as the cost of
+// Myers' algorithm grows with its square.
+const maxDiffEdits = 2048
+
+// diffLines returns the edit script turning a into b, computed with Myers'
+// algorithm so that the diff stays cheap for similar files. Files further
+// apart than maxDiffEdits get a coarse diff replacing everything between their
+// common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxD := min(n+m, maxDiffEdits)
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] keeps the diagonals -d..d reached before step d
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace, d)
+			}
+		}
+	}
+	return coarseDiff(a, b)
+}
+
+func backtrackDiff(a, b []string, trace [][]int, d int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		// diagonal k of step d is stored at index k+d
+		v := func(k int) int { return trace[d][k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 {
+		x--
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func coarseDiff(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	for _, l := range a[prefix : len(a)-suffix] {
+		ops = append(ops, diffOp{'-', l})
+	}
+	for _, l := range b[prefix : len(b)-suffix] {
+		ops = append(ops, diffOp{'+', l})
+	}
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+// diffSummary counts the lines added, removed and changed by ops. Within a run
+// of edits, removed lines replaced by added ones count as changed.
+func diffSummary(ops []diffOp) (added, removed, changed int) {
+	flush := func(r, a int) {
+		c := min(r, a)
+		changed += c
+		removed += r - c
+		added += a - c
+	}
+
+	var r, a int
+	for _, op := range ops {
+		switch op.kind {
+		case '-':
+			r++
+		case '+':
+			a++
+		default:
+			flush(r, a)
+			r, a = 0, 0
+		}
+	}
+	flush(r, a)
+	return
+}
+
+var (
+	errBinaryFile      = errors.New("binary files can't be compared")
+	errTooLargeForDiff = fmt.Errorf("files larger than %d bytes can't be compared", maxDiffFileSize)
+)
+
+// readTextFile returns the lines of a text file, refusing binary content and
+// files larger than maxDiffFileSize.
+func readTextFile(c *fiber.Ctx, o *options.Option, id string) ([]string, error) {
+	f, err := getOwnedFile(c, o, id)
+	if err != nil {
+		return nil, err
+	}
+	if f.Bytes > maxDiffFileSize {
+		return nil, errTooLargeForDiff
+	}
+
+	rc, err := openDecodedContent(c.UserContext(), o, *f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(io.LimitReader(rc, maxDiffFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxDiffFileSize {
+		return nil, errTooLargeForDiff
+	}
+	if bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		return nil, errBinaryFile
+	}
+
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// DiffFilesEndpoint compares two text files line by line, reporting how many
+// lines were added, removed or changed and optionally the diff itself.
+func DiffFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type DiffRequest struct {
+		FromFileID  string `json:"from_file_id"`
+		ToFileID    string `json:"to_file_id"`
+		IncludeDiff bool   `json:"include_diff"`
+	}
+	type DiffResult struct {
+		Object     string   `json:"object"`
+		FromFileID string   `json:"from_file_id"`
+		ToFileID   string   `json:"to_file_id"`
+		Added      int      `json:"added"`
+		Removed    int      `json:"removed"`
+		Changed    int      `json:"changed"`
+		Diff       []string `json:"diff,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		var req DiffRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+		if req.FromFileID == "" || req.ToFileID == "" {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "from_file_id and to_file_id are required")
+		}
+
+		var lines [2][]string
+		for i, id := range []string{req.FromFileID, req.ToFileID} {
+			l, err := readTextFile(c, o, id)
+			if errors.Is(err, errBinaryFile) {
+				return sendFileError(c, fiber.StatusUnsupportedMediaType, codeUnsupportedMediaType, fmt.Sprintf("File %s: %s", id, err))
+			}
+			if errors.Is(err, errTooLargeForDiff) {
+				return sendFileError(c, fiber.StatusRequestEntityTooLarge, rejectTooLarge, fmt.Sprintf("File %s: %s", id, err))
+			}
+			if errors.Is(err, errFileOperationTimeout) {
+				return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out opening file: %s", id))
+			}
+			if errors.Is(err, errFileNotFound) {
+				return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+			}
+			if err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+			}
+			lines[i] = l
+		}
+
+		ops := diffLines(lines[0], lines[1])
+		result := DiffResult{Object: "file.diff", FromFileID: req.FromFileID, ToFileID: req.ToFileID}
+		result.Added, result.Removed, result.Changed = diffSummary(ops)
+		if req.IncludeDiff {
+			result.Diff = make([]string, len(ops))
+			for i, op := range ops {
+				result.Diff[i] = string(op.kind) + op.line
+			}
+		}
+		return sendJSON(c, result)
+	}
+}
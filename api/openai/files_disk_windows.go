@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package openai
+
+import "fmt"
+
+var diskFree = func(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space is not available on this platform")
+}
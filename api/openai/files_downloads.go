@@ -0,0 +1,54 @@
+package openai
+
+import (
+	"io"
+	"sync"
+)
+
+// downloadLimiter bounds the concurrent downloads of each file, counting the
+// running ones by file ID. A file is forgotten as soon as its last download
+// ends, so idle files cost nothing.
+type downloadLimiter struct {
+	mu      sync.Mutex
+	running map[string]int
+}
+
+var downloads = &downloadLimiter{running: map[string]int{}}
+
+// acquire reserves a download of the file id, returning the func ending it,
+// or false when limit downloads of id are already running. A limit of 0 or
+// less means no limit.
+func (l *downloadLimiter) acquire(id string, limit int) (func(), bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[id] >= limit {
+		return nil, false
+	}
+	l.running[id]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.running[id]--; l.running[id] <= 0 {
+				delete(l.running, id)
+			}
+		})
+	}, true
+}
+
+// releasingCloser ends a download once its content is closed.
+type releasingCloser struct {
+	io.Closer
+	release func()
+}
+
+func (c releasingCloser) Close() error {
+	defer c.release()
+	return c.Closer.Close()
+}
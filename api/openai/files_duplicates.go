@@ -0,0 +1,127 @@
+package openai
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Values of CrossPurposeDuplicatePolicy.
+const (
+	crossPurposeDuplicateAllow = "allow"
+	crossPurposeDuplicateWarn  = "warn"
+	crossPurposeDuplicateBlock = "block"
+)
+
+// Headers describing the file an upload duplicates the content of.
+const (
+	duplicateFileIDHeader      = "X-Duplicate-File-ID"
+	duplicateFilePurposeHeader = "X-Duplicate-File-Purpose"
+)
+
+// deduplicatedHeader is set when an upload answers with an existing file of
+// the same content instead of storing a new one.
+const deduplicatedHeader = "X-Deduplicated"
+
+// duplicateContentError is returned by storeFile when the content is already
+// stored under another purpose and CrossPurposeDuplicatePolicy blocks it.
+type duplicateContentError struct {
+	existing File
+}
+
+func (e *duplicateContentError) Error() string {
+	return fmt.Sprintf("Same content already uploaded as %s for purpose %s", e.existing.ID, e.existing.Purpose)
+}
+
+// checksCrossPurposeDuplicates tells whether uploads are compared with the
+// files of other purposes.
+func checksCrossPurposeDuplicates(o *options.Option) bool {
+	return o.CrossPurposeDuplicatePolicy == crossPurposeDuplicateWarn || o.CrossPurposeDuplicatePolicy == crossPurposeDuplicateBlock
+}
+
+// crossPurposeDuplicate returns a file of the owner and tenant of f, other
+// than f, with the same checksum under another purpose. Only files stored with
+// a checksum can be found, and the files of others are left out so as not to
+// tell what they hold.
+func (s *FileStore) crossPurposeDuplicate(f File) (File, bool) {
+	if f.Sha256 == "" {
+		return File{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, existing := range s.files {
+		if existing.ID != f.ID && existing.Sha256 == f.Sha256 && existing.Purpose != f.Purpose &&
+			existing.Tenant == f.Tenant && ownedBy(existing, f.OwnerKey) {
+			return existing, true
+		}
+	}
+	return File{}, false
+}
+
+// checkCrossPurposeDuplicate applies CrossPurposeDuplicatePolicy to f, whose
+// checksum is computed.
+func (s *FileStore) checkCrossPurposeDuplicate(o *options.Option, f File) error {
+	if !checksCrossPurposeDuplicates(o) {
+		return nil
+	}
+	existing, ok := s.crossPurposeDuplicate(f)
+	if !ok {
+		return nil
+	}
+	if o.CrossPurposeDuplicatePolicy == crossPurposeDuplicateBlock {
+		return &duplicateContentError{existing: existing}
+	}
+	log.Warn().Msgf("Upload %s for purpose %s duplicates file %s of purpose %s", f.Filename, f.Purpose, existing.ID, existing.Purpose)
+	return nil
+}
+
+// setDuplicateHeaders points the client to the file f duplicates, if any.
+func setDuplicateHeaders(c *fiber.Ctx, o *options.Option, f File) {
+	if !checksCrossPurposeDuplicates(o) {
+		return
+	}
+	if existing, ok := defaultStore.crossPurposeDuplicate(f); ok {
+		setDuplicateOf(c, existing)
+	}
+}
+
+func setDuplicateOf(c *fiber.Ctx, existing File) {
+	c.Set(duplicateFileIDHeader, existing.ID)
+	c.Set(duplicateFilePurposeHeader, existing.Purpose)
+}
+
+// dedupRequested tells whether the client asked to get back the existing file
+// when the content is already stored for the purpose.
+func dedupRequested(c *fiber.Ctx) bool {
+	dedup, _ := strconv.ParseBool(c.FormValue("dedup"))
+	return dedup
+}
+
+// storedDuplicate returns a live file of the owner and tenant with the
+// checksum sum under purpose. Only files stored with a checksum can be found.
+func storedDuplicate(owner, purpose, tenant, sum string) (File, bool) {
+	now := time.Now()
+	defaultStore.mu.RLock()
+	defer defaultStore.mu.RUnlock()
+	for _, existing := range defaultStore.files {
+		if existing.Sha256 == sum && existing.Purpose == purpose && existing.Tenant == tenant && ownedBy(existing, owner) && !fileExpired(existing, now) {
+			return existing, true
+		}
+	}
+	return File{}, false
+}
+
+// hashUpload computes the SHA-256 of an uploaded file.
+func hashUpload(file *uploadPart) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return hashContent(src)
+}
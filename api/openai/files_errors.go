@@ -0,0 +1,105 @@
+package openai
+
+import (
+	"errors"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Codes of the errors answered by the files endpoints, so that clients can
+// tell them apart without matching messages. Rejected uploads are answered
+// with their reason code (too_large, quota_exceeded, file_exists, disk_full,
+// invalid_purpose...), the other errors with one of:
+//
+//   - file_not_found: no file has the requested ID
+//   - invalid_request: a parameter or the body of the request is invalid
+//   - invalid_archive: an imported archive can't be read or trusted
+//   - file_on_hold: the file is on legal hold
+//   - file_quarantined: the content of the file failed verification
+//   - integrity_error: the stored content doesn't match the index
+//   - content_missing: the storage no longer holds the content of the file
+//   - validation_failed: the content was refused by the purpose validator
+//   - unsupported_media_type: the file can't be processed as asked
+//   - not_acceptable: the file isn't available in the accepted types
+//   - range_not_satisfiable: the requested range is past the content
+//   - too_many_downloads: the file is already downloaded at the limit
+//   - timeout: the storage didn't answer in time
+//   - backend_unavailable: the storage is failing
+//   - forbidden: the API key isn't allowed the operation
+//   - internal_error: anything else going wrong on the server
+const (
+	codeFileNotFound         = "file_not_found"
+	codeInvalidRequest       = "invalid_request"
+	codeInvalidArchive       = "invalid_archive"
+	codeFileOnHold           = "file_on_hold"
+	codeFileQuarantined      = "file_quarantined"
+	codeIntegrityError       = "integrity_error"
+	codeContentMissing       = "content_missing"
+	codeValidationFailed     = "validation_failed"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeNotAcceptable        = "not_acceptable"
+	codeRangeNotSatisfiable  = "range_not_satisfiable"
+	codeTooManyDownloads     = "too_many_downloads"
+	codeTimeout              = "timeout"
+	codeBackendUnavailable   = "backend_unavailable"
+	codeForbidden            = "forbidden"
+	codeInternalError        = "internal_error"
+)
+
+// sendFileError answers an error in the OpenAI error envelope, with code
+// telling what went wrong and message explaining it to humans.
+func sendFileError(c *fiber.Ctx, status int, code, message string) error {
+	errType := "invalid_request_error"
+	if status >= fiber.StatusInternalServerError {
+		errType = "server_error"
+	}
+	return sendJSON(c.Status(status), schema.ErrorResponse{
+		Error: &schema.APIError{Code: code, Message: message, Type: errType},
+	})
+}
+
+// refusalRejections are the statuses and reasons answering the refusals of
+// the store, by kind.
+var refusalRejections = []struct {
+	kind   error
+	status int
+	reason string
+}{
+	{errFileTooLarge, fiber.StatusBadRequest, rejectTooLarge},
+	{errInvalidPurpose, fiber.StatusBadRequest, rejectMissingPurpose},
+	{errQuotaExceeded, fiber.StatusBadRequest, rejectQuotaExceeded},
+	{errTooManyFiles, fiber.StatusBadRequest, rejectTooManyFiles},
+	{errDiskFull, fiber.StatusInsufficientStorage, rejectDiskFull},
+	{errInvalidFilename, fiber.StatusBadRequest, rejectBadFilename},
+	{errFilenameDenied, fiber.StatusBadRequest, rejectDeniedFilename},
+	{errFileExists, fiber.StatusBadRequest, rejectFileExists},
+	{errFileImmutable, fiber.StatusConflict, rejectFileImmutable},
+	{errRefusedByHook, fiber.StatusBadRequest, rejectByHook},
+}
+
+// rejectionFor maps the refusal err of a file to the rejection answering it,
+// nil when err is. A hook refusing with an UploadHookError picks its status.
+func rejectionFor(err error) *uploadRejection {
+	if err == nil {
+		return nil
+	}
+	for _, r := range refusalRejections {
+		if !errors.Is(err, r.kind) {
+			continue
+		}
+		status := r.status
+		var herr *options.UploadHookError
+		if r.kind == errRefusedByHook && errors.As(err, &herr) && herr.Status != 0 {
+			status = herr.Status
+		}
+		return &uploadRejection{status, r.reason, err.Error()}
+	}
+	return &uploadRejection{fiber.StatusInternalServerError, codeInternalError, err.Error()}
+}
+
+// sendRejection answers a rejected upload.
+func sendRejection(c *fiber.Ctx, r *uploadRejection) error {
+	return sendFileError(c, r.status, r.reason, r.message)
+}
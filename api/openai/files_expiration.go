@@ -0,0 +1,117 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultFileReapInterval is how often expired files are deleted when
+// FileReapInterval is unset.
+const defaultFileReapInterval = time.Minute
+
+// expiresAfterAnchor is the only anchor of expires_after, as in the OpenAI
+// API: files expire a number of seconds after they were created.
+const expiresAfterAnchor = "created_at"
+
+// errFileExpired is returned when looking up a file past its expiration, not
+// deleted yet.
+var errFileExpired = errors.New("file has expired")
+
+// fileExpired tells whether f is past its expiration at now.
+func fileExpired(f File, now time.Time) bool {
+	return f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)
+}
+
+// uploadExpiresAfter parses the expires_after[anchor] and
+// expires_after[seconds] form values of an upload, returning 0 when unset.
+func uploadExpiresAfter(c *fiber.Ctx) (time.Duration, error) {
+	anchor, seconds := c.FormValue("expires_after[anchor]"), c.FormValue("expires_after[seconds]")
+	if anchor == "" && seconds == "" {
+		return 0, nil
+	}
+	if anchor != "" && anchor != expiresAfterAnchor {
+		return 0, fmt.Errorf("expires_after[anchor] must be %q", expiresAfterAnchor)
+	}
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("expires_after[seconds] must be a positive number of seconds")
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// setExpiration sets when f expires: after expiresAfter when set, else after
+// the default FileTTL, if any.
+func setExpiration(o *options.Option, f *File, expiresAfter time.Duration) {
+	if expiresAfter <= 0 {
+		expiresAfter = o.FileTTL
+	}
+	if expiresAfter <= 0 {
+		return
+	}
+	expiresAt := f.CreatedAt.Add(expiresAfter)
+	f.ExpiresAt = &expiresAt
+}
+
+// expiredFiles returns the indexed files past their expiration at now.
+func expiredFiles(now time.Time) []File {
+	defaultStore.mu.RLock()
+	defer defaultStore.mu.RUnlock()
+
+	var files []File
+	for _, f := range defaultStore.files {
+		if fileExpired(f, now) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// reapExpiredFiles deletes the files past their expiration at now, returning
+// how many were. Files on legal hold are kept, though hidden.
+func reapExpiredFiles(ctx context.Context, o *options.Option, now time.Time) int {
+	reaped := 0
+	for _, f := range expiredFiles(now) {
+		if f.LegalHold {
+			continue
+		}
+		if err := deleteFile(ctx, o, f); err != nil {
+			log.Warn().Msgf("Failed to delete expired file %s: %s", f.ID, err)
+			continue
+		}
+		reaped++
+	}
+	return reaped
+}
+
+// StartFileReaper periodically deletes the expired files until the option
+// context is canceled. The returned channel is closed once the reaper stopped.
+func StartFileReaper(o *options.Option) <-chan struct{} {
+	interval := o.FileReapInterval
+	if interval <= 0 {
+		interval = defaultFileReapInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.Context.Done():
+				return
+			case now := <-ticker.C:
+				if reaped := reapExpiredFiles(o.Context, o, now); reaped > 0 {
+					log.Debug().Msgf("Deleted %d expired files", reaped)
+				}
+			}
+		}
+	}()
+	return done
+}
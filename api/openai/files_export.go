@@ -0,0 +1,509 @@
+package openai
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const exportManifestName = "manifest.json"
+
+// defaultExportNaming names archive entries after the file IDs.
+const defaultExportNaming = "{id}"
+
+// exportEntryPaths names the archive entries of files following the naming
+// template of o, which can reference {id}, {purpose} and {filename}, under the
+// optional top-level directory. Clashing names get a numeric suffix in the
+// order of files, so the same files always produce the same layout.
+func exportEntryPaths(o *options.Option, files []File) []string {
+	naming := o.FilesExportNaming
+	if naming == "" {
+		naming = defaultExportNaming
+	}
+
+	taken := map[string]bool{exportManifestPath(o): true}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		name := strings.NewReplacer(
+			"{id}", f.ID,
+			"{purpose}", utils.SanitizeFileName(f.Purpose),
+			"{filename}", utils.SanitizeFileName(f.Filename),
+		).Replace(naming)
+		// keep every entry inside the archive root
+		name = strings.TrimPrefix(path.Clean("/"+path.Join(o.FilesExportRootDir, name)), "/")
+
+		candidate := name
+		ext := path.Ext(name)
+		for n := 1; taken[candidate]; n++ {
+			candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+		taken[candidate] = true
+		paths[i] = candidate
+	}
+	return paths
+}
+
+func exportManifestPath(o *options.Option) string {
+	return strings.TrimPrefix(path.Clean("/"+path.Join(o.FilesExportRootDir, exportManifestName)), "/")
+}
+
+// findExportManifest returns the manifest of an archive, either at its root or
+// in the directory holding every entry.
+func findExportManifest(zr *zip.Reader) (*zip.File, bool) {
+	var root string
+	for i, zf := range zr.File {
+		if zf.Name == exportManifestName {
+			return zf, true
+		}
+		dir, _, ok := strings.Cut(zf.Name, "/")
+		if !ok || (i > 0 && dir != root) {
+			root = ""
+			continue
+		}
+		if i == 0 {
+			root = dir
+		}
+	}
+	if root == "" {
+		return nil, false
+	}
+	for _, zf := range zr.File {
+		if zf.Name == root+"/"+exportManifestName {
+			return zf, true
+		}
+	}
+	return nil, false
+}
+
+// exportEntry describes one file of an exported archive.
+type exportEntry struct {
+	File     File   `json:"file"`
+	Path     string `json:"path"`     // Name of the archive entry holding the content
+	Checksum string `json:"checksum"` // Hex encoded SHA-256 of the content
+}
+
+// exportManifest lists the content of an exported archive. When a signing key
+// is configured, Signature is the hex encoded HMAC-SHA256 of the JSON encoded
+// Files, so the importing side can tell the archive was not tampered with.
+type exportManifest struct {
+	Files     []exportEntry `json:"files"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+func signManifest(key []byte, files []exportEntry) (string, error) {
+	payload, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyManifest(key []byte, m exportManifest) error {
+	if m.Signature == "" {
+		return fmt.Errorf("manifest is not signed")
+	}
+	expected, err := signManifest(key, m.Files)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid manifest signature")
+	}
+	want, _ := hex.DecodeString(expected)
+	if !hmac.Equal(got, want) {
+		return fmt.Errorf("invalid manifest signature")
+	}
+	return nil
+}
+
+// writeExportArchive writes files and their manifest as a zip archive to w.
+// present, if set, prepares the files described by the manifest like those of
+// a response.
+func writeExportArchive(ctx context.Context, o *options.Option, w io.Writer, files []File, present func([]File)) error {
+	zw := zip.NewWriter(w)
+
+	described := slices.Clone(files)
+	for i := range described {
+		described[i].Path = ""
+	}
+	if present != nil {
+		present(described)
+	}
+
+	manifest := exportManifest{Files: []exportEntry{}}
+	paths := exportEntryPaths(o, files)
+	add := func(i int, r io.Reader) error {
+		dst, err := zw.Create(paths[i])
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(dst, h), r); err != nil {
+			return fmt.Errorf("reading file %s: %w", files[i].ID, err)
+		}
+		manifest.Files = append(manifest.Files, exportEntry{File: described[i], Path: paths[i], Checksum: hex.EncodeToString(h.Sum(nil))})
+		return nil
+	}
+
+	if o.FilesArchiveConcurrency > 1 {
+		if err := addPrefetchedContents(ctx, o, files, add); err != nil {
+			return err
+		}
+	} else {
+		for i, f := range files {
+			rc, err := openFileContent(ctx, o, f)
+			if err != nil {
+				return fmt.Errorf("opening file %s: %w", f.ID, err)
+			}
+			err = add(i, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(o.FilesExportSigningKey) > 0 {
+		signature, err := signManifest(o.FilesExportSigningKey, manifest.Files)
+		if err != nil {
+			return err
+		}
+		manifest.Signature = signature
+	}
+
+	mw, err := zw.Create(exportManifestPath(o))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(mw).Encode(manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// spooledContent is the content of a file read ahead of its turn in the
+// archive.
+type spooledContent struct {
+	tmp *os.File
+	err error
+}
+
+func (s spooledContent) remove() {
+	if s.tmp != nil {
+		s.tmp.Close()
+		os.Remove(s.tmp.Name())
+	}
+}
+
+// spoolFileContent copies the content of f to a rewound temporary file.
+func spoolFileContent(ctx context.Context, o *options.Option, f File) spooledContent {
+	rc, err := openFileContent(ctx, o, f)
+	if err != nil {
+		return spooledContent{err: fmt.Errorf("opening file %s: %w", f.ID, err)}
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "localai-export-*")
+	if err != nil {
+		return spooledContent{err: err}
+	}
+	s := spooledContent{tmp: tmp}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		s.remove()
+		return spooledContent{err: fmt.Errorf("reading file %s: %w", f.ID, err)}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		s.remove()
+		return spooledContent{err: err}
+	}
+	return s
+}
+
+// addPrefetchedContents reads the contents of files with up to
+// FilesArchiveConcurrency of them in flight, while add is called with each of
+// them in the order of files. As the zip writer takes a single entry at a
+// time, the contents read ahead wait in temporary files for their turn.
+func addPrefetchedContents(ctx context.Context, o *options.Option, files []File, add func(i int, r io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	contents := make([]chan spooledContent, len(files))
+	for i := range contents {
+		contents[i] = make(chan spooledContent, 1)
+	}
+	// a slot is taken for every content read and not added yet
+	slots := make(chan struct{}, o.FilesArchiveConcurrency)
+	go func() {
+		for i, f := range files {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				for ; i < len(files); i++ {
+					contents[i] <- spooledContent{err: ctx.Err()}
+				}
+				return
+			}
+			go func(i int, f File) {
+				contents[i] <- spoolFileContent(ctx, o, f)
+			}(i, f)
+		}
+	}()
+
+	for i := range files {
+		content := <-contents[i]
+		err := content.err
+		if err == nil {
+			err = add(i, content.tmp)
+		}
+		content.remove()
+		<-slots
+		if err != nil {
+			// stop reading ahead and drop what was already read
+			cancel()
+			for _, pending := range contents[i+1:] {
+				(<-pending).remove()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportFilesEndpoint returns every file, optionally filtered by purpose, as a
+// zip archive along with a manifest describing them.
+func ExportFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		files := ownedFiles(c, o, filterFilesMatching(o, c.Query("purpose")))
+		present := func(files []File) { presentFiles(c, o, files) }
+
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="files-export.zip"`)
+		if err := writeExportArchive(c.UserContext(), o, c.Response().BodyWriter(), files, present); err != nil {
+			c.Response().ResetBody()
+			c.Response().Header.Del(fiber.HeaderContentDisposition)
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, "Failed to export files: "+err.Error())
+		}
+		return nil
+	}
+}
+
+// ImportFilesEndpoint registers the files of an archive produced by
+// ExportFilesEndpoint. The whole archive is rejected if its manifest signature
+// or any checksum doesn't match; files whose ID or name already exist are
+// skipped.
+func ImportFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type ImportResult struct {
+		Object  string   `json:"object"`
+		Data    []File   `json:"data"`
+		Skipped []string `json:"skipped"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "No archive to import: "+err.Error())
+		}
+
+		archive, err := file.Open()
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+		defer archive.Close()
+
+		zr, err := zip.NewReader(archive, file.Size)
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, "Invalid archive: "+err.Error())
+		}
+
+		entries := map[string]*zip.File{}
+		for _, zf := range zr.File {
+			entries[zf.Name] = zf
+		}
+
+		mf, ok := findExportManifest(zr)
+		if !ok {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, "Archive has no manifest")
+		}
+		var manifest exportManifest
+		if err := readZipJSON(mf, &manifest); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, "Invalid manifest: "+err.Error())
+		}
+
+		if len(o.FilesExportSigningKey) > 0 {
+			if err := verifyManifest(o.FilesExportSigningKey, manifest); err != nil {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, err.Error())
+			}
+		}
+
+		// extract and verify everything before registering anything
+		extracted := make([]*os.File, len(manifest.Files))
+		defer func() {
+			for _, tmp := range extracted {
+				if tmp != nil {
+					tmp.Close()
+					os.Remove(tmp.Name())
+				}
+			}
+		}()
+		for _, entry := range manifest.Files {
+			if _, ok := entries[entry.Path]; !ok {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, fmt.Sprintf("Archive is missing %s", entry.Path))
+			}
+		}
+		errs := make([]error, len(manifest.Files))
+		forEachConcurrently(len(manifest.Files), o.FilesArchiveConcurrency, func(i int) {
+			entry := manifest.Files[i]
+			extracted[i], errs[i] = extractZipEntry(entries[entry.Path], entry.Checksum, o.UploadLimitMB)
+		})
+		// the first invalid entry is reported, whichever failed first
+		for i, err := range errs {
+			if err != nil && !errors.Is(err, errEntryTooLarge) {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidArchive, fmt.Sprintf("Invalid archive entry %s: %s", manifest.Files[i].Path, err))
+			}
+		}
+
+		result := ImportResult{Object: "list", Data: []File{}, Skipped: []string{}}
+		for i, entry := range manifest.Files {
+			f := entry.File
+			f.Sha256 = ""
+			// links and paths belong to the exporting server
+			f.URL, f.Path = "", ""
+			// the manifest is only trusted for what the importer could upload
+			// itself: the files are its own, without a hold, and their size is
+			// the one of their content
+			f.OwnerKey, f.Tenant = requestOwnerKey(c, o), requestTenant(c, o)
+			f.LegalHold, f.Status, f.StatusDetails = false, "", ""
+			f.UncompressedBytes, f.LineEndingsNormalized = 0, false
+			if errors.Is(errs[i], errEntryTooLarge) {
+				logUploadRejection(c, o, rejectTooLarge, f.Purpose, f.Filename, int64(entries[entry.Path].UncompressedSize64))
+				result.Skipped = append(result.Skipped, f.ID)
+				continue
+			}
+			size, err := extracted[i].Seek(0, io.SeekEnd)
+			if err == nil {
+				_, err = extracted[i].Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+			}
+			f.Bytes = int(size)
+
+			if _, err := getFile(f.ID); err == nil || checkFileConflict(o, f.OwnerKey, f.Purpose, f.Filename) != nil {
+				result.Skipped = append(result.Skipped, f.ID)
+				continue
+			}
+			// imported files are held to the limits of uploads
+			err = checkUploadLimits(o, size, f.Purpose, f.Tenant)
+			if err == nil {
+				err = checkFilenameAllowed(o, f.Filename)
+			}
+			if r := rejectionFor(err); r != nil {
+				logUploadRejection(c, o, r.reason, f.Purpose, f.Filename, size)
+				result.Skipped = append(result.Skipped, f.ID)
+				continue
+			}
+
+			if err := storeFile(c.UserContext(), o, &f, extracted[i]); err != nil {
+				log.Warn().Msgf("Failed to import file %s: %s", f.ID, err)
+				result.Skipped = append(result.Skipped, f.ID)
+				continue
+			}
+			result.Data = append(result.Data, f)
+		}
+
+		presentFiles(c, o, result.Data)
+		return sendJSON(c, result)
+	}
+}
+
+// forEachConcurrently calls fn for every index below n, running up to limit
+// of them at once, and returns once they are all done.
+func forEachConcurrently(n, limit int, fn func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func readZipJSON(zf *zip.File, v interface{}) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// errEntryTooLarge is returned for archive entries exceeding the upload limit,
+// which are skipped like the files refused by the other upload limits.
+var errEntryTooLarge = errors.New("entry exceeds the upload limit")
+
+// extractZipEntry copies zf to a temporary file, checking its content matches
+// checksum and fits in the upload limit of limitMB. An entry decompressing to
+// more than its header tells is cut off at the limit. The returned file is
+// rewound and must be removed by the caller.
+func extractZipEntry(zf *zip.File, checksum string, limitMB int) (*os.File, error) {
+	limit := int64(limitMB) * 1024 * 1024
+	if zf.UncompressedSize64 > uint64(limit) {
+		return nil, errEntryTooLarge
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "localai-import-*")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(rc, limit+1))
+	if err != nil {
+		return tmp, err
+	}
+	if n > limit {
+		return tmp, errEntryTooLarge
+	}
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		return tmp, fmt.Errorf("checksum mismatch")
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	return tmp, err
+}
@@ -0,0 +1,130 @@
+package openai
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+)
+
+// Policies for the names of files uploaded without an extension.
+const (
+	extensionPreserve = "preserve"
+	extensionAppend   = "append"
+)
+
+// sniffedExtensions maps the sniffed types to the extension given to them,
+// where the mime package would pick a surprising one.
+var sniffedExtensions = map[string]string{
+	"text/plain":       ".txt",
+	"application/json": ".json",
+	"image/jpeg":       ".jpg",
+	"image/png":        ".png",
+	"image/gif":        ".gif",
+	"image/webp":       ".webp",
+	"application/pdf":  ".pdf",
+	"application/zip":  ".zip",
+	"audio/mpeg":       ".mp3",
+	"audio/wave":       ".wav",
+}
+
+// sniffContentType detects the type of the beginning of r, rewinding r
+// afterwards. It returns an empty string for empty content.
+func sniffContentType(r io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// inferExtension sniffs the beginning of r and returns the extension of its
+// type, rewinding r afterwards.
+func inferExtension(r io.ReadSeeker) (string, error) {
+	sniffed, err := sniffContentType(r)
+	if err != nil || sniffed == "" {
+		return "", err
+	}
+
+	return extensionForType(sniffed), nil
+}
+
+// extensionForType returns the extension of files of the MIME type ctype, or
+// an empty string when it has none.
+func extensionForType(ctype string) string {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	ctype = strings.TrimSpace(ctype)
+	if ext, ok := sniffedExtensions[ctype]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(ctype); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// detectContentType sets the content type of f to the sniffed type of src,
+// keeping the type the client declared in f when sniffing can't tell.
+func detectContentType(f *File, src io.ReadSeeker) error {
+	sniffed, err := sniffContentType(src)
+	if err != nil {
+		return err
+	}
+	if sniffed != "" && (sniffed != "application/octet-stream" || f.ContentType == "") {
+		f.ContentType = sniffed
+	}
+	return nil
+}
+
+// applyExtensionPolicy gives f the extension of its sniffed content when it
+// has none and the append policy is set. Its display name is left untouched.
+func applyExtensionPolicy(o *options.Option, f *File, src io.ReadSeeker) error {
+	if o.ExtensionlessFilenamePolicy != extensionAppend || filepath.Ext(f.Filename) != "" {
+		return nil
+	}
+	ext, err := inferExtension(src)
+	if err != nil {
+		return err
+	}
+	f.Extension = ext
+	return nil
+}
+
+// genericFilenames are names telling nothing about a file, as given by
+// clients uploading from a buffer.
+var genericFilenames = map[string]bool{
+	"file":     true,
+	"blob":     true,
+	"upload":   true,
+	"download": true,
+	"untitled": true,
+}
+
+// downloadName is the name f is served under. Files without a meaningful
+// name are served under their ID, with the extension of their content type,
+// and compressed files lose their .gz suffix as they are served decompressed.
+func downloadName(f File) string {
+	name := strings.TrimSpace(f.Filename)
+	if name == "" || genericFilenames[strings.ToLower(name)] {
+		ext := f.Extension
+		if ext == "" {
+			ext = extensionForType(f.ContentType)
+		}
+		return f.ID + ext
+	}
+	name = f.Filename + f.Extension
+	if f.ContentEncoding == gzipEncoding && len(name) > len(".gz") && strings.EqualFold(filepath.Ext(name), ".gz") {
+		name = name[:len(name)-len(".gz")]
+	}
+	return name
+}
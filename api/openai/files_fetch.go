@@ -0,0 +1,205 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultFileFetchTimeout bounds remote fetches when FileFetchTimeout is unset.
+const defaultFileFetchTimeout = 60 * time.Second
+
+// sourceURLMetadataKey is the metadata label recording where a fetched file
+// comes from.
+const sourceURLMetadataKey = "source_url"
+
+var errBlockedAddress = errors.New("fetching from internal addresses is not allowed")
+
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isBlockedIP reports whether ip is internal to the deployment and must not be
+// reached on behalf of a client.
+var isBlockedIP = func(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || carrierGradeNAT.Contains(ip)
+}
+
+// fetchClient returns a client refusing to connect to internal addresses. The
+// check runs on the resolved address of every connection, redirects included,
+// so DNS tricks can't get around it.
+func fetchClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// UploadFileFromURLEndpoint stores a file fetched by the server from a remote
+// URL, applying the same checks as a regular upload.
+func UploadFileFromURLEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type FromURLRequest struct {
+		URL      string `json:"url"`
+		Purpose  string `json:"purpose"`
+		Filename string `json:"filename"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		var req FromURLRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "url must be an absolute http(s) URL")
+		}
+		filename := req.Filename
+		if filename == "" {
+			filename = path.Base(u.Path)
+		}
+		if filename == "" || filename == "/" || filename == "." {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Unable to tell the file name from the url, set filename")
+		}
+
+		tenant := requestTenant(c, o)
+		if r := rejectionFor(checkUploadLimits(o, 0, req.Purpose, tenant)); r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, 0)
+			return sendRejection(c, r)
+		}
+		if r := rejectionFor(checkFilenameAllowed(o, filename)); r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, 0)
+			return sendRejection(c, r)
+		}
+		if r := rejectionFor(checkFileConflict(o, requestOwnerKey(c, o), req.Purpose, filename)); r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, 0)
+			return sendRejection(c, r)
+		}
+
+		timeout := o.FileFetchTimeout
+		if timeout <= 0 {
+			timeout = defaultFileFetchTimeout
+		}
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+
+		tmp, size, r := fetchToTemp(ctx, fetchClient(timeout), req.URL, int64(o.UploadLimitMB)*1024*1024)
+		if tmp != nil {
+			defer func() {
+				tmp.Close()
+				os.Remove(tmp.Name())
+			}()
+		}
+		if r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, size)
+			return sendRejection(c, r)
+		}
+
+		// now that the size is known, check it against the quotas
+		if r := rejectionFor(checkUploadLimits(o, size, req.Purpose, tenant)); r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, size)
+			return sendRejection(c, r)
+		}
+
+		metadata := withDefaultMetadata(o, map[string]string{sourceURLMetadataKey: req.URL})
+		hookReq := uploadRequest(c, o, filename, req.Purpose, size, metadata)
+		if r := rejectionFor(runPreUploadHooks(c.UserContext(), o, hookReq)); r != nil {
+			logUploadRejection(c, o, r.reason, req.Purpose, filename, size)
+			return sendRejection(c, r)
+		}
+
+		f := File{
+			ID:        newFileID(),
+			Object:    "file",
+			Bytes:     int(size),
+			CreatedAt: time.Now(),
+			Filename:  filename,
+			Purpose:   req.Purpose,
+			Metadata:  metadata,
+			Tenant:    tenant,
+			Source:    uploadSource(c, o),
+			OwnerKey:  requestOwnerKey(c, o),
+		}
+		setExpiration(o, &f, 0)
+		err = storeFile(c.UserContext(), o, &f, tmp)
+		if err == nil {
+			runPostUploadHooks(c.UserContext(), o, hookReq, f)
+		}
+		return sendStoredFile(c, o, f, err)
+	}
+}
+
+// fetchToTemp downloads rawURL to a rewound temporary file, refusing content
+// larger than limit. The returned file, if any, must be removed by the caller.
+func fetchToTemp(ctx context.Context, client *http.Client, rawURL string, limit int64) (*os.File, int64, *uploadRejection) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, &uploadRejection{fiber.StatusBadRequest, rejectFetchFailed, err.Error()}
+	}
+
+	resp, err := client.Do(httpReq)
+	if errors.Is(err, errBlockedAddress) {
+		return nil, 0, &uploadRejection{fiber.StatusBadRequest, rejectBlockedURL, errBlockedAddress.Error()}
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, 0, &uploadRejection{fiber.StatusGatewayTimeout, rejectFetchFailed, "Timed out fetching the file"}
+		}
+		return nil, 0, &uploadRejection{fiber.StatusBadGateway, rejectFetchFailed, fmt.Sprintf("Failed to fetch the file: %s", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &uploadRejection{fiber.StatusBadGateway, rejectFetchFailed, fmt.Sprintf("Remote server answered %s", resp.Status)}
+	}
+	if resp.ContentLength > limit {
+		return nil, resp.ContentLength, &uploadRejection{fiber.StatusBadRequest, rejectTooLarge, fmt.Sprintf("File size %d exceeds upload limit %d", resp.ContentLength, limit/(1024*1024))}
+	}
+
+	tmp, err := os.CreateTemp("", "localai-fetch-*")
+	if err != nil {
+		return nil, 0, &uploadRejection{fiber.StatusInternalServerError, rejectFetchFailed, err.Error()}
+	}
+
+	// the announced length can't be trusted, read one byte past the limit
+	size, err := io.Copy(tmp, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return tmp, size, &uploadRejection{fiber.StatusGatewayTimeout, rejectFetchFailed, "Timed out fetching the file"}
+		}
+		return tmp, size, &uploadRejection{fiber.StatusBadGateway, rejectFetchFailed, fmt.Sprintf("Failed to fetch the file: %s", err)}
+	}
+	if size > limit {
+		return tmp, size, &uploadRejection{fiber.StatusBadRequest, rejectTooLarge, fmt.Sprintf("File size exceeds upload limit %d", limit/(1024*1024))}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return tmp, size, &uploadRejection{fiber.StatusInternalServerError, rejectFetchFailed, err.Error()}
+	}
+	return tmp, size, nil
+}
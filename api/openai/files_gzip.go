@@ -0,0 +1,100 @@
+package openai
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// gzipEncoding is the content encoding of the files uploaded gzip compressed.
+const gzipEncoding = "gzip"
+
+// uploadContentEncoding returns the encoding of an uploaded file, given by the
+// Content-Encoding header of its part or the content_encoding form field.
+func uploadContentEncoding(c *fiber.Ctx, file *uploadPart) (string, error) {
+	encoding := file.Header.Get(fiber.HeaderContentEncoding)
+	if encoding == "" {
+		encoding = c.FormValue("content_encoding")
+	}
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return "", nil
+	case gzipEncoding:
+		return gzipEncoding, nil
+	}
+	return "", fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decompressToTemp writes the decompressed content of the gzip stream src to
+// a rewound temporary file, returning its size. src is rewound as well.
+func decompressToTemp(src io.ReadSeeker) (*os.File, int64, error) {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid gzip content: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "localai-gunzip-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, zr)
+	if err != nil {
+		err = fmt.Errorf("invalid gzip content: %w", err)
+	} else if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+		_, err = src.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// acceptsGzip tells whether the client takes the content gzip encoded.
+func acceptsGzip(c *fiber.Ctx) bool {
+	return c.Get(fiber.HeaderAcceptEncoding) != "" && c.AcceptsEncodings(gzipEncoding) != ""
+}
+
+// openDecodedContent opens the content of f like openFileContent, decompressing
+// the files stored compressed.
+func openDecodedContent(ctx context.Context, o *options.Option, f File) (io.ReadCloser, error) {
+	return defaultStore.openDecodedContent(ctx, o, f)
+}
+
+// openDecodedContent opens the decoded content of f kept by s.
+func (s *FileStore) openDecodedContent(ctx context.Context, o *options.Option, f File) (io.ReadCloser, error) {
+	rc, err := s.openContent(ctx, o, f)
+	if err != nil || f.ContentEncoding != gzipEncoding {
+		return rc, err
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("invalid gzip content: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, rc}, nil
+}
+
+// encodedContentType is the type of the decompressed content of f, told by
+// its name or recorded when it was stored.
+func encodedContentType(f File) string {
+	if t := mime.TypeByExtension(filepath.Ext(downloadName(f))); t != "" {
+		return t
+	}
+	if f.ContentType != "" {
+		return f.ContentType
+	}
+	return "application/octet-stream"
+}
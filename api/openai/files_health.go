@@ -0,0 +1,126 @@
+package openai
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Overall states of the file subsystem.
+const (
+	HealthOK        = "ok"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Degraded conditions reported by FilesHealth.
+const (
+	degradedReadOnly       = "read_only"
+	degradedDiskLow        = "disk_low"
+	degradedQuotaNearFull  = "quota_near_full"
+	degradedFilesNearLimit = "files_near_limit"
+)
+
+// quotaWarningRatio is the share of a quota past which it is reported as
+// nearly full.
+const quotaWarningRatio = 0.9
+
+// healthProbeTimeout bounds the backend probe of FilesHealth.
+const healthProbeTimeout = 5 * time.Second
+
+// FilesHealthStatus describes the state of the file subsystem.
+type FilesHealthStatus struct {
+	Status           string   `json:"status"`
+	BackendReachable bool     `json:"backend_reachable"`
+	IndexLoaded      bool     `json:"index_loaded"`
+	IndexError       string   `json:"index_error,omitempty"`
+	FreeDiskBytes    *uint64  `json:"free_disk_bytes,omitempty"` // Unset when unknown
+	TotalFiles       int      `json:"total_files"`
+	TotalBytes       int64    `json:"total_bytes"`
+	Degraded         []string `json:"degraded,omitempty"`
+}
+
+// probeWritable checks that new files can be written to dir.
+var probeWritable = func(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// HealthEndpoint answers liveness probes with FilesHealth. A server that
+// answers is alive, the status is 200 even when files can't be served.
+func HealthEndpoint(o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		files := FilesHealth(o)
+		return sendJSON(c, fiber.Map{"status": files.Status, "files": files})
+	}
+}
+
+// ReadinessEndpoint answers readiness probes with FilesHealth, with a 503
+// while the file subsystem is unhealthy.
+func ReadinessEndpoint(o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		files := FilesHealth(o)
+		if files.Status == HealthUnhealthy {
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return sendJSON(c, fiber.Map{"status": files.Status, "files": files})
+	}
+}
+
+// FilesHealth reports whether the files backend is reachable and the index was
+// loaded, along with the storage usage and the conditions degrading the
+// service. The subsystem is unhealthy when files can't be served at all.
+func FilesHealth(o *options.Option) FilesHealthStatus {
+	h := FilesHealthStatus{Status: HealthOK}
+
+	defaultStore.mu.RLock()
+	if defaultStore.loadErr != nil {
+		h.IndexError = defaultStore.loadErr.Error()
+	}
+	defaultStore.mu.RUnlock()
+	h.IndexLoaded = h.IndexError == ""
+	h.TotalFiles, h.TotalBytes = storageUsage()
+
+	timeout := o.FileOpenTimeout
+	if timeout <= 0 {
+		timeout = healthProbeTimeout
+	}
+	// a missing file is a valid answer of a working backend
+	rc, err := openWithTimeout(context.Background(), defaultStore.filesBackend(), timeout, filepath.Join(o.UploadDir, ".health"))
+	if rc != nil {
+		rc.Close()
+	}
+	h.BackendReachable = !backendFailed(err)
+
+	if err := probeWritable(o.UploadDir); err != nil && !os.IsNotExist(err) {
+		h.Degraded = append(h.Degraded, degradedReadOnly)
+	}
+	if free, err := diskFree(o.UploadDir); err == nil {
+		h.FreeDiskBytes = &free
+		if o.MinFreeDiskMB > 0 && free < uint64(o.MinFreeDiskMB)*1024*1024 {
+			h.Degraded = append(h.Degraded, degradedDiskLow)
+		}
+	}
+	if o.MaxTotalStorageMB > 0 && float64(h.TotalBytes) >= quotaWarningRatio*float64(o.MaxTotalStorageMB)*1024*1024 {
+		h.Degraded = append(h.Degraded, degradedQuotaNearFull)
+	}
+	if o.MaxFiles > 0 && float64(h.TotalFiles) >= quotaWarningRatio*float64(o.MaxFiles) {
+		h.Degraded = append(h.Degraded, degradedFilesNearLimit)
+	}
+
+	switch {
+	case !h.IndexLoaded || !h.BackendReachable:
+		h.Status = HealthUnhealthy
+	case len(h.Degraded) > 0:
+		h.Status = HealthDegraded
+	}
+	return h
+}
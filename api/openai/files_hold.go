@@ -0,0 +1,34 @@
+package openai
+
+import (
+	"errors"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// errFileOnHold is returned when removing or changing a file on legal hold.
+var errFileOnHold = errors.New("file is on legal hold")
+
+// LegalHoldEndpoint places a file on legal hold with PUT, and releases it with
+// DELETE. A held file can't be deleted nor purged.
+func LegalHoldEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		file, err := getFileFromRequest(c, o)
+		if err != nil {
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+
+		hold := c.Method() != fiber.MethodDelete
+		updateUploadedFile(file.ID, func(f *File) {
+			f.LegalHold = hold
+		})
+		saveUploadConfig(o)
+
+		file.LegalHold = hold
+		f := []File{*file}
+		presentFiles(c, o, f)
+		return sendJSON(c, f[0])
+	}
+}
@@ -0,0 +1,38 @@
+package openai
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/gofiber/fiber/v2"
+)
+
+func uploadRequest(c *fiber.Ctx, o *options.Option, filename, purpose string, size int64, metadata map[string]string) schema.UploadRequest {
+	return schema.UploadRequest{
+		Filename: filename,
+		Purpose:  purpose,
+		Bytes:    size,
+		Metadata: metadata,
+		Tenant:   requestTenant(c, o),
+		Client:   strings.Clone(c.IP()),
+	}
+}
+
+// runPreUploadHooks runs the pre-upload hooks in order, stopping at the first
+// one refusing the upload.
+func runPreUploadHooks(ctx context.Context, o *options.Option, req schema.UploadRequest) error {
+	for _, hook := range o.PreUpload {
+		if err := hook(ctx, req); err != nil {
+			return &fileRefusal{kind: errRefusedByHook, message: err.Error(), cause: err}
+		}
+	}
+	return nil
+}
+
+func runPostUploadHooks(ctx context.Context, o *options.Option, req schema.UploadRequest, f File) {
+	for _, hook := range o.PostUpload {
+		hook(ctx, req, f)
+	}
+}
@@ -0,0 +1,47 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// normalizeLineEndings copies src to a temporary file with its CRLF line
+// endings converted to LF, reporting whether any was. The file must be
+// removed by the caller.
+func normalizeLineEndings(src io.Reader) (*os.File, bool, error) {
+	tmp, err := os.CreateTemp("", "localai-normalized-*")
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(tmp)
+	for {
+		line, err := r.ReadBytes('\n')
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-2], '\n')
+			changed = true
+		}
+		if _, werr := w.Write(line); werr != nil {
+			err = werr
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, false, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, false, err
+	}
+	return tmp, changed, nil
+}
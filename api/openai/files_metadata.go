@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// patchMetadata returns metadata with the set labels added and the removed
+// ones dropped, leaving metadata untouched.
+func patchMetadata(metadata, set map[string]string, remove []string) map[string]string {
+	patched := make(map[string]string, len(metadata)+len(set))
+	for k, v := range metadata {
+		patched[k] = v
+	}
+	for k, v := range set {
+		patched[k] = v
+	}
+	for _, k := range remove {
+		delete(patched, k)
+	}
+	if len(patched) == 0 {
+		return nil
+	}
+	return patched
+}
+
+// BatchUpdateMetadataEndpoint applies a metadata patch to every file selected
+// by ID or by purpose, reporting the outcome for each of them.
+func BatchUpdateMetadataEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type BatchMetadataRequest struct {
+		FileIDs []string          `json:"file_ids"`
+		Purpose string            `json:"purpose"`
+		Set     map[string]string `json:"set"`
+		Remove  []string          `json:"remove"`
+	}
+	return func(c *fiber.Ctx) error {
+		var req BatchMetadataRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+		if (len(req.FileIDs) == 0) == (req.Purpose == "") {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Select the files with either file_ids or purpose")
+		}
+		if len(req.Set) == 0 && len(req.Remove) == 0 {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Nothing to update, set or remove some keys")
+		}
+
+		ids := req.FileIDs
+		if req.Purpose != "" {
+			for _, f := range ownedFiles(c, o, filterFiles(req.Purpose)) {
+				ids = append(ids, f.ID)
+			}
+		}
+
+		result := newBatchResult()
+		for _, id := range ids {
+			var err error
+			var reason string
+			var updated File
+			owned := true
+			found := updateUploadedFile(id, func(f *File) {
+				if owned = ownsFile(c, o, *f); !owned {
+					return
+				}
+				if err = checkFileMutable(o, *f); err != nil {
+					reason = batchErrorCode(err)
+					return
+				}
+				patched := patchMetadata(f.Metadata, req.Set, req.Remove)
+				if err = validateMetadata(o, patched); err != nil {
+					reason = rejectBadMetadata
+					return
+				}
+				f.Metadata = patched
+				updated = *f
+			})
+			if !found || !owned {
+				err = fmt.Errorf("%w %s", errFileNotFound, id)
+				reason = codeFileNotFound
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, BatchError{ID: id, Reason: reason, Message: err.Error()})
+				continue
+			}
+			result.Results = append(result.Results, updated)
+		}
+		if len(result.Results) > 0 {
+			saveUploadConfig(o)
+		}
+
+		presentFiles(c, o, result.Results)
+		return sendJSON(c, result)
+	}
+}
@@ -0,0 +1,73 @@
+package openai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestOwner returns who the files uploaded by the request belong to, and
+// whether the request is restricted to the files it owns. Without API keys
+// and owner header, files are shared by every client.
+func requestOwner(c *fiber.Ctx, o *options.Option) (string, bool) {
+	if len(o.ApiKeys) > 0 {
+		if key := bearerKey(c); key != "" {
+			return apiKeyID(key), true
+		}
+		return "", true
+	}
+	if o.FilesOwnerHeader != "" {
+		return strings.Clone(c.Get(o.FilesOwnerHeader)), true
+	}
+	return "", false
+}
+
+// requestOwnerKey returns the owner recorded for the files the request
+// uploads.
+func requestOwnerKey(c *fiber.Ctx, o *options.Option) string {
+	owner, _ := requestOwner(c, o)
+	return owner
+}
+
+// ownsFile reports whether the request may see f. Admins see every file, and
+// files indexed before they had an owner are left shared.
+func ownsFile(c *fiber.Ctx, o *options.Option, f File) bool {
+	owner, scoped := requestOwner(c, o)
+	return !scoped || f.OwnerKey == "" || f.OwnerKey == owner || isAdminRequest(c, o)
+}
+
+// ownedBy reports whether f is a file of owner. Files without an owner are
+// shared, and so are all the files when requests have no owner.
+func ownedBy(f File, owner string) bool {
+	return owner == "" || f.OwnerKey == "" || f.OwnerKey == owner
+}
+
+// ownedFiles keeps the files the request may see, in place.
+func ownedFiles(c *fiber.Ctx, o *options.Option, files []File) []File {
+	if _, scoped := requestOwner(c, o); !scoped || isAdminRequest(c, o) {
+		return files
+	}
+	owned := files[:0]
+	for _, f := range files {
+		if ownsFile(c, o, f) {
+			owned = append(owned, f)
+		}
+	}
+	return owned
+}
+
+// getOwnedFile returns the file id when the request may see it. The files of
+// other owners are not found, rather than forbidden, so as not to tell they
+// exist.
+func getOwnedFile(c *fiber.Ctx, o *options.Option, id string) (*File, error) {
+	f, err := getFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ownsFile(c, o, *f) {
+		return nil, fmt.Errorf("%w %s", errFileNotFound, id)
+	}
+	return f, nil
+}
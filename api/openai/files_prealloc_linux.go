@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package openai
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes on disk for f, growing it to size.
+var preallocate = func(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errPreallocationUnsupported
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package openai
+
+import "os"
+
+var preallocate = func(f *os.File, size int64) error {
+	return errPreallocationUnsupported
+}
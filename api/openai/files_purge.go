@@ -0,0 +1,115 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// ageUnits are the units parseAge accepts on top of those of
+// time.ParseDuration.
+var ageUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseAge parses a human friendly duration such as "30d", "2w" or "1d12h".
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("empty duration")
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	var total time.Duration
+	for rest := s; rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsDigit(r) })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+		j := strings.IndexFunc(rest, unicode.IsDigit)
+		if j < 0 {
+			j = len(rest)
+		}
+		unit, ok := ageUnits[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q: unknown unit %q", s, rest[:j])
+		}
+		total += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
+
+// PurgeFilesEndpoint deletes every file older than the older_than query
+// parameter, optionally restricted to a purpose. With dry_run the matching
+// files are only reported. Files on legal hold are skipped.
+func PurgeFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type PurgeSkipped struct {
+		ID     string `json:"id"`
+		Reason string `json:"reason"`
+	}
+	type PurgeResult struct {
+		Object  string         `json:"object"`
+		DryRun  bool           `json:"dry_run"`
+		Matched int            `json:"matched"`
+		Deleted int            `json:"deleted"`
+		Data    []string       `json:"data"`
+		Skipped []PurgeSkipped `json:"skipped"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		age, err := parseAge(c.Query("older_than"))
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid older_than: %s", err))
+		}
+		dryRun, err := strconv.ParseBool(c.Query("dry_run", "false"))
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid dry_run")
+		}
+
+		cutoff := time.Now().Add(-age)
+		result := PurgeResult{Object: "file.purge", DryRun: dryRun, Data: []string{}, Skipped: []PurgeSkipped{}}
+		for _, f := range filterFiles(c.Query("purpose")) {
+			if !f.CreatedAt.Before(cutoff) {
+				continue
+			}
+			result.Matched++
+			if f.LegalHold {
+				result.Skipped = append(result.Skipped, PurgeSkipped{ID: f.ID, Reason: "legal_hold"})
+				continue
+			}
+			if dryRun {
+				result.Data = append(result.Data, f.ID)
+				continue
+			}
+
+			if err := deleteFile(c.UserContext(), o, f); err != nil {
+				log.Warn().Msgf("Failed to purge file %s: %s", f.ID, err)
+				result.Skipped = append(result.Skipped, PurgeSkipped{ID: f.ID, Reason: err.Error()})
+				continue
+			}
+			result.Deleted++
+			result.Data = append(result.Data, f.ID)
+		}
+
+		return sendJSON(c, result)
+	}
+}
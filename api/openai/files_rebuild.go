@@ -0,0 +1,124 @@
+package openai
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/rs/zerolog/log"
+)
+
+// uploadIndexFile is the file of the upload directory persisting the index.
+const uploadIndexFile = "uploadedFiles.json"
+
+// Policies applied when the index can't be loaded at startup, besides the
+// default of rebuilding it.
+const (
+	indexLoadEmpty    = "empty"
+	indexLoadFailFast = "fail-fast"
+)
+
+// rebuildIndex reconstructs the index from the files stored in the upload
+// directory, telling their purpose from the directory holding them. Their
+// metadata is lost, and content-addressed blobs can't be recovered as their
+// names are unknown.
+func rebuildIndex(o *options.Option) ([]File, error) {
+	entries, err := os.ReadDir(o.UploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || name == blobsDir {
+			continue
+		}
+		if e.IsDir() {
+			purposeFiles, err := rebuildPurposeDir(o, name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, purposeFiles...)
+			continue
+		}
+		if !e.Type().IsRegular() || name == uploadIndexFile || name == tenantQuotasFile || strings.HasPrefix(name, uploadIndexFile+".") {
+			continue
+		}
+		f, err := rebuiltFile(e, "", name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// rebuildPurposeDir reconstructs the files of the purpose directory dir.
+func rebuildPurposeDir(o *options.Option, dir string) ([]File, error) {
+	entries, err := os.ReadDir(filepath.Join(o.UploadDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	// see purposeDir
+	purpose := strings.TrimPrefix(dir, "_")
+
+	var files []File
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		f, err := rebuiltFile(e, purpose, filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// rebuiltFile describes the file of purpose stored at path, relative to the
+// upload directory.
+func rebuiltFile(e os.DirEntry, purpose, path string) (File, error) {
+	info, err := e.Info()
+	if err != nil {
+		return File{}, err
+	}
+	id, filename := storedFileID(e.Name())
+	return File{
+		ID:        id,
+		Object:    "file",
+		Bytes:     int(info.Size()),
+		CreatedAt: info.ModTime(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    fileStatusProcessed,
+		Path:      path,
+	}, nil
+}
+
+// storedFileIDPattern matches the names files sharing their name with others
+// are stored under, see storageName.
+var storedFileIDPattern = regexp.MustCompile(`^(file-[0-9a-f]{24})-(.+)$`)
+
+// storedFileID recovers the ID and the name of the file stored as name, giving
+// it a new ID when it wasn't stored under one.
+func storedFileID(name string) (id, filename string) {
+	if m := storedFileIDPattern.FindStringSubmatch(name); m != nil {
+		return m[1], m[2]
+	}
+	return newFileID(), name
+}
+
+// backupIndex keeps the unreadable index aside before it is overwritten.
+func backupIndex(uploadDir string) {
+	index := filepath.Join(uploadDir, uploadIndexFile)
+	backup := fmt.Sprintf("%s.corrupt-%d", index, time.Now().Unix())
+	if err := os.Rename(index, backup); err != nil && !os.IsNotExist(err) {
+		log.Error().Msgf("Failed to back up the files index: %s", err)
+	}
+}
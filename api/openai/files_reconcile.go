@@ -0,0 +1,152 @@
+package openai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Policies applied when the size recorded for a file differs from its content.
+const (
+	sizeMismatchIgnore  = "ignore"
+	sizeMismatchCorrect = "correct"
+	sizeMismatchError   = "error"
+)
+
+// Policies applied when the storage no longer holds the content of a file on
+// download, e.g. an object deleted out of band.
+const (
+	missingContentPrune = "prune"
+	missingContentError = "error"
+	missingContentKeep  = "keep"
+)
+
+// sendMissingContent answers the download of f, whose content is missing from
+// the storage, as told by MissingContentPolicy: the file is dropped from the
+// index and not found under "prune", not found but kept under "keep", and an
+// internal error under "error", the default. Files on legal hold are kept.
+func sendMissingContent(c *fiber.Ctx, o *options.Option, f File) error {
+	storage := storageKind(defaultStore.backendFor(o, f.Purpose))
+	log.Error().
+		Str("policy", o.MissingContentPolicy).
+		Str("storage", storage).
+		Msgf("Content of file %s is missing from the storage", f.ID)
+
+	policy := o.MissingContentPolicy
+	if policy == missingContentPrune && f.LegalHold {
+		policy = missingContentKeep
+	}
+	switch policy {
+	case missingContentPrune:
+		removeUploadedFile(f.ID)
+		saveUploadConfig(o)
+		return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, fmt.Sprintf("File %s is gone, its content was missing from the storage", f.ID))
+	case missingContentKeep:
+		return sendFileError(c, fiber.StatusNotFound, codeContentMissing, fmt.Sprintf("Content of file %s is missing from the storage", f.ID))
+	default:
+		return sendFileError(c, fiber.StatusInternalServerError, codeContentMissing, fmt.Sprintf("Content of file %s is missing from the %s storage", f.ID, storage))
+	}
+}
+
+// fileSizeMismatchError is returned by checkFileSize under the error policy.
+type fileSizeMismatchError struct {
+	id            string
+	stored, found int64
+}
+
+func (e *fileSizeMismatchError) Error() string {
+	return fmt.Sprintf("file %s has %d bytes but %d are recorded", e.id, e.found, e.stored)
+}
+
+// verifyFileContent checks content against the checksum of f when VerifyOnRead
+// is set. On a mismatch the file is quarantined, so that it is no longer
+// served until an operator looks at it.
+func verifyFileContent(o *options.Option, f File, content []byte) error {
+	if !o.VerifyOnRead || f.Sha256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) == f.Sha256 {
+		return nil
+	}
+
+	log.Error().
+		Str("file", f.ID).
+		Str("expected", f.Sha256).
+		Str("found", hex.EncodeToString(sum[:])).
+		Msg("file content failed verification, quarantining it")
+	updateUploadedFile(f.ID, func(f *File) {
+		f.Status = fileStatusQuarantined
+		f.StatusDetails = "checksum mismatch"
+	})
+	saveUploadConfig(o)
+	return fmt.Errorf("file %s failed integrity verification", f.ID)
+}
+
+// checkFileSize applies the size mismatch policy to f, whose content was found
+// to be size bytes long. Corrections are persisted.
+func checkFileSize(o *options.Option, f File, size int64) error {
+	if int64(f.Bytes) == size {
+		return nil
+	}
+
+	switch o.SizeMismatchPolicy {
+	case sizeMismatchCorrect:
+		log.Warn().
+			Str("file", f.ID).
+			Int("stored", f.Bytes).
+			Int64("found", size).
+			Msg("correcting recorded file size")
+		updateUploadedFile(f.ID, func(f *File) {
+			f.Bytes = int(size)
+		})
+		saveUploadConfig(o)
+	case sizeMismatchError:
+		return &fileSizeMismatchError{f.ID, int64(f.Bytes), size}
+	}
+	return nil
+}
+
+// contentSize counts the bytes of the content of f, decrypted if need be.
+func contentSize(ctx context.Context, o *options.Option, f File) (int64, error) {
+	rc, err := openFileContent(ctx, o, f)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(io.Discard, rc)
+}
+
+// ReconcileFileSizes checks the recorded size of every file against its
+// content, as at startup after the storage may have been changed behind our
+// back. Under the error policy mismatching files are set in error.
+func ReconcileFileSizes(o *options.Option) {
+	if o.SizeMismatchPolicy == "" || o.SizeMismatchPolicy == sizeMismatchIgnore {
+		return
+	}
+
+	for _, f := range filterFiles("") {
+		size, err := contentSize(context.Background(), o, f)
+		if err != nil {
+			log.Warn().Msgf("Unable to check the size of file %s: %s", f.ID, err)
+			continue
+		}
+
+		err = checkFileSize(o, f, size)
+		if err == nil {
+			continue
+		}
+		log.Error().Msgf("File %s: %s", f.ID, err)
+		updateUploadedFile(f.ID, func(f *File) {
+			f.Status = fileStatusError
+			f.StatusDetails = err.Error()
+		})
+		saveUploadConfig(o)
+	}
+}
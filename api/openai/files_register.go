@@ -0,0 +1,42 @@
+package openai
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/go-skynet/LocalAI/api/options"
+)
+
+// RegisterFile adds a file produced by the server itself, such as a
+// transcript, to the files API. It goes through the same limits, validation,
+// hooks and storage as an HTTP upload; a refused file is reported as an error.
+func RegisterFile(o *options.Option, content io.Reader, filename, purpose string) (*File, error) {
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// storing needs to know the size and to read the content more than once
+	tmp, err := os.CreateTemp("", "localai-register-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if _, err := io.Copy(tmp, content); err != nil {
+		return nil, err
+	}
+
+	f, err := defaultStore.addContent(ctx, o, File{
+		Filename: filename,
+		Purpose:  purpose,
+		Metadata: withDefaultMetadata(o, nil),
+	}, tmp)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
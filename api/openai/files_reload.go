@@ -0,0 +1,36 @@
+package openai
+
+import (
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// ReloadFilesIndexEndpoint replaces the index with the one persisted in the
+// upload directory, e.g. after it was restored or edited by hand, and checks
+// the sizes of the reloaded files as done at startup.
+func ReloadFilesIndexEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type ReloadResult struct {
+		Object        string `json:"object"`
+		PreviousFiles int    `json:"previous_files"`
+		Files         int    `json:"files"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		// blobs are reference counted by the index, keep their saves and
+		// releases from interleaving with its replacement
+		defaultStore.blobsMu.Lock()
+		previous := len(filterFiles(""))
+		err := LoadUploadConfig(o)
+		defaultStore.blobsMu.Unlock()
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+		ReconcileFileSizes(o)
+
+		result := ReloadResult{Object: "file.index_reload", PreviousFiles: previous, Files: len(filterFiles(""))}
+		log.Info().Msgf("Reloaded the files index: %d files, %d before", result.Files, result.PreviousFiles)
+		return sendJSON(c, result)
+	}
+}
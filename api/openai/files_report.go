@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// reportColumns are the columns of the CSV inventory report.
+var reportColumns = []string{"id", "filename", "purpose", "bytes", "created_at", "age_seconds", "sha256", "status", "content_type", "tenant", "legal_hold", "metadata"}
+
+// reportEntry describes a file in the inventory report.
+type reportEntry struct {
+	ID          string            `json:"id"`
+	Filename    string            `json:"filename"`
+	Purpose     string            `json:"purpose"`
+	Bytes       int               `json:"bytes"`
+	CreatedAt   int64             `json:"created_at"`
+	AgeSeconds  int64             `json:"age_seconds"`
+	Sha256      string            `json:"sha256"`
+	Status      string            `json:"status"`
+	ContentType string            `json:"content_type"`
+	Tenant      string            `json:"tenant"`
+	LegalHold   bool              `json:"legal_hold"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+func newReportEntry(f File, now time.Time) reportEntry {
+	return reportEntry{
+		ID:          f.ID,
+		Filename:    f.Filename,
+		Purpose:     f.Purpose,
+		Bytes:       f.Bytes,
+		CreatedAt:   f.CreatedAt.Unix(),
+		AgeSeconds:  int64(now.Sub(f.CreatedAt).Seconds()),
+		Sha256:      f.Sha256,
+		Status:      f.Status,
+		ContentType: f.ContentType,
+		Tenant:      f.Tenant,
+		LegalHold:   f.LegalHold,
+		Metadata:    f.Metadata,
+	}
+}
+
+// writeCSVReport writes files as CSV rows, the metadata JSON encoded and the
+// creation time in RFC 3339 for spreadsheets to read it.
+func writeCSVReport(w io.Writer, files []File, now time.Time) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reportColumns); err != nil {
+		return err
+	}
+	for _, f := range files {
+		e := newReportEntry(f, now)
+		metadata := ""
+		if len(e.Metadata) > 0 {
+			data, err := json.Marshal(e.Metadata)
+			if err != nil {
+				return err
+			}
+			metadata = string(data)
+		}
+		err := cw.Write([]string{
+			e.ID, e.Filename, e.Purpose, strconv.Itoa(e.Bytes),
+			f.CreatedAt.UTC().Format(time.RFC3339), strconv.FormatInt(e.AgeSeconds, 10),
+			e.Sha256, e.Status, e.ContentType, e.Tenant, strconv.FormatBool(e.LegalHold), metadata,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSONReport writes files as a JSON object, one entry at a time.
+func writeJSONReport(w io.Writer, files []File, now time.Time) error {
+	if _, err := fmt.Fprintf(w, `{"object":"file.report","generated_at":%d,"data":[`, now.Unix()); err != nil {
+		return err
+	}
+	for i, f := range files {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(newReportEntry(f, now))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// FilesReportEndpoint streams an inventory of every file, as JSON or, with
+// format=csv, as CSV.
+func FilesReportEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var write func(w io.Writer, files []File, now time.Time) error
+		switch format := c.Query("format", "json"); format {
+		case "json":
+			write = writeJSONReport
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		case "csv":
+			write = writeCSVReport
+			c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+			c.Set(fiber.HeaderContentDisposition, `attachment; filename="files-report.csv"`)
+		default:
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported format %q", format))
+		}
+
+		files := filterFiles("")
+		now := time.Now()
+		pr, pw := io.Pipe()
+		go func() {
+			err := write(pw, files, now)
+			if err != nil {
+				log.Warn().Msgf("Failed to write the files report: %s", err)
+			}
+			pw.CloseWithError(err)
+		}()
+		return c.SendStream(pr)
+	}
+}
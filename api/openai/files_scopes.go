@@ -0,0 +1,40 @@
+package openai
+
+import (
+	"slices"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Scopes an API key can be restricted to on the files endpoints.
+const (
+	ScopeFilesRead   = "read"
+	ScopeFilesWrite  = "write"
+	ScopeFilesDelete = "delete"
+)
+
+// hasFileScope reports whether the request may use endpoints requiring scope.
+// Keys without configured scopes, admin keys and unauthenticated deployments
+// are allowed everything.
+func hasFileScope(c *fiber.Ctx, o *options.Option, scope string) bool {
+	if len(o.ApiKeys) == 0 || isAdminRequest(c, o) {
+		return true
+	}
+	scopes, ok := o.ApiKeyScopes[bearerKey(c)]
+	if !ok {
+		return true
+	}
+	return slices.Contains(scopes, scope)
+}
+
+// RequireFileScope restricts a route to keys granted scope. It is meant to run
+// after the auth middleware has validated the key.
+func RequireFileScope(o *options.Option, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !hasFileScope(c, o, scope) {
+			return sendFileError(c, fiber.StatusForbidden, codeForbidden, "API key is missing the "+scope+" scope")
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,109 @@
+package openai
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of changes of the index told to the metadata sink.
+const (
+	fileCreated = "created"
+	fileUpdated = "updated"
+	fileDeleted = "deleted"
+)
+
+type metadataEvent struct {
+	kind string
+	file File
+}
+
+// metadataMirror hands the changes of the index to the metadata sink from a
+// single goroutine, so that they reach it in order without the index waiting
+// for it.
+type metadataMirror struct {
+	sink    options.MetadataSink
+	retries int
+	backoff time.Duration
+
+	mu      sync.Mutex
+	queue   []metadataEvent
+	running bool
+	pending sync.WaitGroup
+}
+
+// ConfigureMetadataSink installs the MetadataSink option on the index served
+// by the endpoints. It must be called before serving requests.
+func ConfigureMetadataSink(o *options.Option) {
+	defaultStore.mirror = nil
+	if o.MetadataSink != nil {
+		defaultStore.mirror = &metadataMirror{sink: o.MetadataSink, retries: o.MetadataSinkRetries, backoff: o.MetadataSinkRetryBackoff}
+	}
+}
+
+// notify queues a change of f for the sink. It is called with the index lock
+// held, which keeps the changes in the order they are made.
+func (m *metadataMirror) notify(kind string, f File) {
+	// the labels are shared with the index, which may change them in place
+	f.Metadata = maps.Clone(f.Metadata)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending.Add(1)
+	m.queue = append(m.queue, metadataEvent{kind: kind, file: f})
+	if !m.running {
+		m.running = true
+		go m.run()
+	}
+}
+
+func (m *metadataMirror) run() {
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		event := m.queue[0]
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+
+		m.deliver(event)
+		m.pending.Done()
+	}
+}
+
+func (m *metadataMirror) deliver(event metadataEvent) {
+	call := m.sink.FileUpdated
+	switch event.kind {
+	case fileCreated:
+		call = m.sink.FileCreated
+	case fileDeleted:
+		call = m.sink.FileDeleted
+	}
+
+	backoff := m.backoff
+	for attempt := 0; ; attempt++ {
+		err := call(context.Background(), event.file)
+		if err == nil {
+			return
+		}
+		if attempt >= m.retries {
+			log.Error().Msgf("Failed to mirror the %s file %s to the metadata sink: %s", event.kind, event.file.ID, err)
+			return
+		}
+		log.Warn().Msgf("Failed to mirror the %s file %s to the metadata sink, retrying: %s", event.kind, event.file.ID, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// wait returns once the queued changes are handed to the sink.
+func (m *metadataMirror) wait() {
+	m.pending.Wait()
+}
@@ -0,0 +1,74 @@
+package openai
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiKeyID identifies an API key without revealing it.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+// uploadSource describes the client of an upload, or returns nil when source
+// capture is disabled.
+func uploadSource(c *fiber.Ctx, o *options.Option) *schema.FileSource {
+	if o.DisableUploadSourceCapture {
+		return nil
+	}
+	s := &schema.FileSource{
+		IP:        strings.Clone(c.IP()),
+		UserAgent: strings.Clone(c.Get(fiber.HeaderUserAgent)),
+	}
+	if key := bearerKey(c); key != "" {
+		s.APIKeyID = apiKeyID(key)
+	}
+	return s
+}
+
+// presentFiles prepares files for a response. It links them to their content
+// when FilesBaseURL is set, hides where they are stored, and drops the fields
+// only admins can see: the upload source and owner, and the storage unless
+// asked for with include=storage.
+func presentFiles(c *fiber.Ctx, o *options.Option, files []File) {
+	admin := isAdminRequest(c, o)
+	storage := admin && includes(c, "storage")
+	for i := range files {
+		files[i].URL = fileURL(o, files[i].ID)
+		files[i].Path = ""
+		if !admin {
+			files[i].Source = nil
+			files[i].OwnerKey = ""
+		}
+		if !storage {
+			files[i].Storage = ""
+		}
+	}
+}
+
+// fileURL returns the address of the content of the file id, or an empty
+// string when no FilesBaseURL is configured.
+func fileURL(o *options.Option, id string) string {
+	if o.FilesBaseURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(o.FilesBaseURL, "/") + "/v1/files/" + url.PathEscape(id) + "/content"
+}
+
+// includes reports whether the comma separated include query parameter lists
+// field.
+func includes(c *fiber.Ctx, field string) bool {
+	for _, f := range strings.Split(c.Query("include"), ",") {
+		if strings.TrimSpace(f) == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package openai
+
+import (
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultShard names the default backend in the storage stats.
+const defaultShard = "default"
+
+// StorageStats describes how the stored files use the storage.
+type StorageStats struct {
+	Object string `json:"object"`
+	Files  int    `json:"files"`
+	// Distinct stored objects, lower than Files when content is shared
+	UniqueBlobs   int     `json:"unique_blobs"`
+	LogicalBytes  int64   `json:"logical_bytes"`
+	PhysicalBytes int64   `json:"physical_bytes"`
+	DedupRatio    float64 `json:"dedup_ratio"` // LogicalBytes over PhysicalBytes
+	// Files per backend, the purposes with a backend of their own being
+	// counted apart from the default one
+	Shards map[string]int `json:"shards"`
+}
+
+// storageStats computes the stats of files.
+func storageStats(o *options.Option, files []File) StorageStats {
+	stats := StorageStats{Object: "file.storage_stats", Files: len(files), Shards: map[string]int{}, DedupRatio: 1}
+
+	seen := map[string]bool{}
+	for _, f := range files {
+		shard := defaultShard
+		if _, ok := o.PurposeBackends[f.Purpose]; ok {
+			shard = f.Purpose
+		}
+		stats.Shards[shard]++
+		stats.LogicalBytes += int64(f.Bytes)
+
+		key := shard + "\x00" + storagePath(o, f)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		stats.UniqueBlobs++
+		stats.PhysicalBytes += int64(f.Bytes)
+	}
+
+	if stats.PhysicalBytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.PhysicalBytes)
+	}
+	return stats
+}
+
+// StorageStatsEndpoint reports the dedup savings and the balance of the files
+// across backends, computed from a snapshot of the index.
+func StorageStatsEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return sendJSON(c, storageStats(o, filterFiles("")))
+	}
+}
@@ -0,0 +1,396 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/go-skynet/LocalAI/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// FileStore is an index of uploaded files along with their content, stored
+// under the UploadDir of its options. It can be used on its own, without
+// serving the files API.
+type FileStore struct {
+	o *options.Option
+
+	// mu guards files, which background tasks such as async validation
+	// update concurrently with the readers, and version, bumped on every
+	// change so cached listings can tell they are stale.
+	mu      sync.RWMutex
+	files   []File
+	version uint64
+	// loadErr is why the index couldn't be loaded, if it couldn't.
+	loadErr error
+
+	// saveMu serializes the saves of the index, and saved is the version of
+	// files last written by them.
+	saveMu sync.Mutex
+	saved  uint64
+
+	// mirror hands the changes to the metadata sink, nil when there is none.
+	mirror *metadataMirror
+
+	// quotasMu guards quotas, the quotas of the tenants, and quotasSaveMu
+	// serializes their saves.
+	quotasMu     sync.RWMutex
+	quotas       map[string]tenantQuota
+	quotasSaveMu sync.Mutex
+
+	// validatorPools holds one validatorPool per options, shared by every
+	// route serving uploads with them.
+	validatorPools sync.Map
+
+	// backend stores the files of the purposes without a backend of their
+	// own, the local disk when nil.
+	backend fileBackend
+
+	// blobsMu serializes the reference checks against saving and removing
+	// blobs, so that two uploads of the same content, or an upload racing a
+	// delete, never see a half-written or already-removed blob.
+	blobsMu sync.Mutex
+
+	// renameMu serializes the renames, from checking that the new name is
+	// free to moving the content under it.
+	renameMu sync.Mutex
+}
+
+// defaultStore is the index served by the endpoints, whose helpers pass it the
+// options of the endpoint.
+var defaultStore = &FileStore{}
+
+// NewFileStore returns an empty store of the files of o, kept by its
+// FilesBackend or on the local disk. Load reads back the index it saved.
+func NewFileStore(o *options.Option) *FileStore {
+	return &FileStore{o: o, backend: o.FilesBackend}
+}
+
+// Load reads the index and the tenant quotas from the upload directory.
+func (s *FileStore) Load() error {
+	if err := s.load(s.o); err != nil {
+		return err
+	}
+	s.loadTenantQuotas(s.o)
+	return nil
+}
+
+// Save writes the index to the upload directory.
+func (s *FileStore) Save() error {
+	return s.save(s.o)
+}
+
+// Add stores content as the file f and indexes it. The ID, object and
+// creation time are set when missing, the size is the one of content. The
+// file is refused like an upload when it exceeds the limits of the options,
+// its name is denied, another file of its owner already has it or a
+// pre-upload hook refuses it, the error then wrapping errFileTooLarge,
+// errFilenameDenied, errFileExists, errRefusedByHook and the like. The
+// post-upload hooks see the file once stored.
+func (s *FileStore) Add(ctx context.Context, f File, content io.ReadSeeker) (File, error) {
+	return s.addContent(ctx, s.o, f, content)
+}
+
+// addContent is Add with the options o, those of the endpoints for defaultStore.
+func (s *FileStore) addContent(ctx context.Context, o *options.Option, f File, content io.ReadSeeker) (File, error) {
+	f.Purpose = strings.TrimSpace(f.Purpose)
+	f.Filename = utils.SanitizeFileName(f.Filename)
+	if f.ID == "" {
+		f.ID = newFileID()
+	}
+	if f.Object == "" {
+		f.Object = "file"
+	}
+	if f.CreatedAt.IsZero() {
+		f.CreatedAt = time.Now()
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return File{}, err
+	}
+	f.Bytes = int(size)
+
+	if err := s.checkUploadLimits(o, nil, size, f.Purpose, f.Tenant); err != nil {
+		return File{}, err
+	}
+	if err := checkFilenameAllowed(o, f.Filename); err != nil {
+		return File{}, err
+	}
+	if err := s.checkFileConflict(o, f.OwnerKey, f.Purpose, f.Filename); err != nil {
+		return File{}, err
+	}
+	req := schema.UploadRequest{
+		Filename: f.Filename,
+		Purpose:  f.Purpose,
+		Bytes:    size,
+		Metadata: f.Metadata,
+		Tenant:   f.Tenant,
+	}
+	if err := runPreUploadHooks(ctx, o, req); err != nil {
+		return File{}, err
+	}
+
+	if err := s.store(ctx, o, &f, content); err != nil {
+		return File{}, err
+	}
+	runPostUploadHooks(ctx, o, req, f)
+	return f, nil
+}
+
+// List returns the files of purpose, or every file when it is empty.
+func (s *FileStore) List(purpose string) []File {
+	return s.list(purpose)
+}
+
+// Get returns the file id.
+func (s *FileStore) Get(id string) (File, error) {
+	f, err := s.get(id)
+	if err != nil {
+		return File{}, err
+	}
+	return *f, nil
+}
+
+// Delete removes the file id from the storage and the index. Files on legal
+// hold are kept.
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	f, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if f.LegalHold {
+		return errFileOnHold
+	}
+	return s.deleteFiles(ctx, s.o, []File{*f})[0]
+}
+
+// Content opens the decoded content of the file id, which the caller must
+// close.
+func (s *FileStore) Content(ctx context.Context, id string) (io.ReadCloser, error) {
+	f, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.openDecodedContent(ctx, s.o, *f)
+}
+
+// save persists the index, unless it is ephemeral. The index is written to a
+// temporary file renamed over the previous one, so that the file never holds
+// a partial write, and a snapshot older than the one already saved by a
+// concurrent call is dropped. Failures are logged as well as returned, most
+// callers having nothing more to do about them.
+func (s *FileStore) save(o *options.Option) error {
+	if o.EphemeralIndex {
+		return nil
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.RLock()
+	version := s.version
+	file, err := json.MarshalIndent(s.files, "", " ")
+	s.mu.RUnlock()
+	if err != nil {
+		log.Error().Msgf("Failed to JSON marshal the uploadedFiles: %s", err)
+		return err
+	}
+	if version < s.saved {
+		return nil
+	}
+
+	if err := s.saveIndexFile(o, uploadIndexFile, file); err != nil {
+		log.Error().Msgf("Failed to save uploadedFiles to file: %s", err)
+		return err
+	}
+	s.saved = version
+	return nil
+}
+
+// load reads the index of uploaded files, unless it is ephemeral. When it
+// can't be read, the index load failure policy decides whether to rebuild it
+// from the files on disk, to start with an empty index, or to return the
+// error.
+func (s *FileStore) load(o *options.Option) error {
+	if o.EphemeralIndex {
+		log.Warn().Msg("The files index is ephemeral, uploaded files will be forgotten on restart")
+		return nil
+	}
+
+	var files []File
+	file, err := s.readIndexFile(o, uploadIndexFile)
+	if err == nil {
+		err = json.Unmarshal(file, &files)
+	} else if errors.Is(err, os.ErrNotExist) {
+		// nothing was uploaded yet
+		err = nil
+	}
+
+	loadErr := err
+	rebuilt := false
+	if err != nil {
+		log.Error().Msgf("Failed to load the files index: %s", err)
+		switch o.IndexLoadFailurePolicy {
+		case indexLoadFailFast:
+			return fmt.Errorf("failed to load the files index: %w", err)
+		case indexLoadEmpty:
+			files = nil
+		default:
+			if files, err = rebuildIndex(o); err != nil {
+				log.Error().Msgf("Failed to rebuild the files index: %s", err)
+				files = nil
+			} else {
+				log.Warn().Msgf("Rebuilt the files index from %d files on disk", len(files))
+				loadErr = nil
+				rebuilt = true
+			}
+		}
+	}
+
+	for i := range files {
+		// indexes written before files had a status only held processed ones
+		if files[i].Status == "" {
+			files[i].Status = fileStatusProcessed
+		}
+	}
+
+	s.mu.Lock()
+	s.version++
+	s.files = files
+	s.loadErr = loadErr
+	s.mu.Unlock()
+
+	if rebuilt {
+		backupIndex(o.UploadDir)
+		s.save(o)
+	}
+	return nil
+}
+
+// notify hands a change of f to the metadata sink when the store is mirrored.
+// It is called with mu held, which keeps the changes in the order they are
+// made.
+func (s *FileStore) notify(kind string, f File) {
+	if s.mirror != nil {
+		s.mirror.notify(kind, f)
+	}
+}
+
+// add appends files to the index, or replaces the entries of the same IDs.
+func (s *FileStore) add(files ...File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	for _, f := range files {
+		if i := s.indexOf(f.ID); i >= 0 {
+			s.files[i] = f
+			s.notify(fileUpdated, f)
+			continue
+		}
+		s.files = append(s.files, f)
+		s.notify(fileCreated, f)
+	}
+}
+
+// indexOf returns the position of the file id in the index, -1 when it isn't
+// there. The caller must hold mu.
+func (s *FileStore) indexOf(id string) int {
+	for i := range s.files {
+		if s.files[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// update applies fn to the indexed file id, reporting whether it was found.
+func (s *FileStore) update(id string, fn func(f *File)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	for i := range s.files {
+		if s.files[i].ID == id {
+			fn(&s.files[i])
+			s.notify(fileUpdated, s.files[i])
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the files ids from the index. The remaining files are copied
+// to a new slice rather than shifted in place, so that a slice of the index
+// handed out earlier is never modified under its holder.
+func (s *FileStore) remove(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]File, 0, len(s.files))
+	for _, f := range s.files {
+		if drop[f.ID] {
+			s.notify(fileDeleted, f)
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) != len(s.files) {
+		s.version++
+		s.files = files
+	}
+}
+
+// get returns a copy of the indexed file id.
+func (s *FileStore) get(id string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.files {
+		if id == f.ID {
+			if fileExpired(f, time.Now()) {
+				return nil, fmt.Errorf("%w %s: %w", errFileNotFound, id, errFileExpired)
+			}
+			return &f, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %s", errFileNotFound, id)
+}
+
+// list returns the files of purpose, or every file when it is empty. Expired
+// files are left out even before they are deleted.
+func (s *FileStore) list(purpose string) []File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var files []File
+	for _, f := range s.files {
+		if (purpose == "" || purpose == f.Purpose) && !fileExpired(f, now) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (s *FileStore) indexVersion() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
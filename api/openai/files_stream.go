@@ -0,0 +1,211 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxStreamedFieldBytes bounds the form fields of a streamed upload, which
+// are kept in memory.
+const maxStreamedFieldBytes = 1024 * 1024
+
+// LimitStreamedBodies reads the streamed bodies of the requests into memory,
+// refusing those exceeding the upload limit as fasthttp does with the bodies
+// it buffers, so that handlers reading the whole body stay bounded. The POST
+// requests to the streamed paths are left streaming, their handlers reading
+// the body part by part.
+func LimitStreamedBodies(o *options.Option, streamed ...string) fiber.Handler {
+	limit := int64(o.UploadLimitMB) * 1024 * 1024
+	return func(c *fiber.Ctx) error {
+		if !c.Request().IsBodyStream() {
+			return c.Next()
+		}
+		if c.Method() == fiber.MethodPost {
+			path := strings.TrimSuffix(c.Path(), "/")
+			for _, p := range streamed {
+				if path == p {
+					return c.Next()
+				}
+			}
+		}
+
+		if int64(c.Request().Header.ContentLength()) > limit {
+			c.Context().SetConnectionClose()
+			return fiber.ErrRequestEntityTooLarge
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Context().RequestBodyStream(), limit+1))
+		if err != nil {
+			c.Context().SetConnectionClose()
+			return fiber.NewError(fiber.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if int64(len(body)) > limit {
+			// what is left of the body can't be told apart from a next request
+			c.Context().SetConnectionClose()
+			return fiber.ErrRequestEntityTooLarge
+		}
+		c.Request().SetBody(body)
+		return c.Next()
+	}
+}
+
+// uploadPart is the file of an upload, taken from the parsed multipart form
+// or spooled from the request body stream.
+type uploadPart struct {
+	Filename string
+	Size     int64
+	Header   textproto.MIMEHeader
+	open     func() (multipart.File, error)
+	// tmp is the file the content was spooled to, if any
+	tmp string
+}
+
+func (p *uploadPart) Open() (multipart.File, error) {
+	return p.open()
+}
+
+// remove deletes the spooled content, once the upload is done with it.
+func (p *uploadPart) remove() {
+	if p.tmp != "" {
+		os.Remove(p.tmp)
+		p.tmp = ""
+	}
+}
+
+// uploadFilePart returns the "file" part of an upload. A rejected upload still
+// returns the part, describing what was received of it.
+func uploadFilePart(ctx context.Context, c *fiber.Ctx, o *options.Option) (*uploadPart, *uploadRejection) {
+	if c.Request().IsBodyStream() {
+		return streamUploadParts(ctx, c, o)
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return &uploadPart{}, &uploadRejection{fiber.StatusBadRequest, rejectMissingFile, "No file to upload: " + err.Error()}
+	}
+	return &uploadPart{Filename: fh.Filename, Size: fh.Size, Header: fh.Header, open: fh.Open}, nil
+}
+
+// streamUploadParts reads the multipart body of an upload as it arrives. The
+// file part is copied to a temporary file, the upload being refused as soon as
+// it exceeds the upload limit, while the other parts are kept as form values.
+// Nothing is left on disk when the upload is refused or its stream aborted.
+// A client still sending the body past the deadline of ctx is cut off.
+func streamUploadParts(ctx context.Context, c *fiber.Ctx, o *options.Option) (*uploadPart, *uploadRejection) {
+	file := &uploadPart{}
+	fail := func(status int, reason, message string) (*uploadPart, *uploadRejection) {
+		file.remove()
+		// what is left of the body can't be told apart from a next request
+		c.Context().SetConnectionClose()
+		return file, &uploadRejection{status, reason, message}
+	}
+
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return fail(fiber.StatusBadRequest, rejectMissingFile, "No file to upload: the request is not a multipart form")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// a read waiting for a stalled client is interrupted as well
+		if conn := c.Context().Conn(); conn != nil {
+			conn.SetReadDeadline(deadline)
+			defer conn.SetReadDeadline(time.Time{})
+		}
+	}
+	aborted := func(err error) (*uploadPart, *uploadRejection) {
+		var ne net.Error
+		if ctx.Err() != nil || errors.As(err, &ne) && ne.Timeout() {
+			return fail(fiber.StatusRequestTimeout, rejectUploadTimeout, "Upload took longer than allowed")
+		}
+		return fail(fiber.StatusBadRequest, codeInvalidRequest, "Upload aborted: "+err.Error())
+	}
+
+	found := false
+	limit := int64(o.UploadLimitMB) * 1024 * 1024
+	mr := multipart.NewReader(contextReader{ctx, c.Context().RequestBodyStream()}, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return aborted(err)
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" && !found {
+			found = true
+			file.Filename, file.Header = part.FileName(), part.Header
+			if err := spoolUploadPart(file, part, limit); err != nil {
+				var r *uploadRejection
+				if errors.As(err, &r) {
+					return fail(r.status, r.reason, r.message)
+				}
+				return aborted(err)
+			}
+			continue
+		}
+
+		// the other parts are read through FormValue like those of a parsed form
+		value, err := io.ReadAll(io.LimitReader(part, maxStreamedFieldBytes+1))
+		if err != nil {
+			return aborted(err)
+		}
+		if len(value) > maxStreamedFieldBytes {
+			return fail(fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Form field %s is too large", part.FormName()))
+		}
+		c.Request().PostArgs().AddBytesV(part.FormName(), value)
+	}
+
+	if !found {
+		return fail(fiber.StatusBadRequest, rejectMissingFile, "No file to upload: the form has no file part")
+	}
+	return file, nil
+}
+
+// spoolUploadPart copies part to a temporary file recorded in file, reading
+// at most one byte past limit. The error is an *uploadRejection unless part
+// couldn't be read.
+func spoolUploadPart(file *uploadPart, part io.Reader, limit int64) error {
+	tmp, err := os.CreateTemp("", "localai-upload-*")
+	if err != nil {
+		return &uploadRejection{fiber.StatusInternalServerError, codeInternalError, "Failed to save file: " + err.Error()}
+	}
+	file.tmp = tmp.Name()
+	file.open = func() (multipart.File, error) { return os.Open(file.tmp) }
+
+	file.Size, err = io.Copy(tmp, io.LimitReader(part, limit+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if file.Size > limit {
+		return &uploadRejection{fiber.StatusBadRequest, rejectTooLarge, fmt.Sprintf("File size exceeds upload limit %d", limit/(1024*1024))}
+	}
+	return nil
+}
+
+// contextReader fails once ctx is done, bounding reads that keep returning
+// what a client trickles.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,231 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// tenantHeader names the tenant a request acts for when the API is not
+// protected by keys. Files uploaded with it count against that tenant's quota.
+const tenantHeader = "X-Tenant-ID"
+
+const tenantQuotasFile = "tenantQuotas.json"
+
+// tenantQuota limits what a single tenant can store, zero meaning no limit.
+type tenantQuota struct {
+	MaxTotalStorageMB int `json:"max_total_storage_mb"`
+	MaxFiles          int `json:"max_files"`
+}
+
+// requestTenant returns the tenant of the request, copied as it outlives the
+// request when stored on a file. With API keys the tenant is the one the key
+// is assigned to, clients can't pick another with the header.
+func requestTenant(c *fiber.Ctx, o *options.Option) string {
+	if len(o.ApiKeys) > 0 {
+		return o.TenantKeys[bearerKey(c)]
+	}
+	return strings.Clone(c.Get(tenantHeader))
+}
+
+// tenantQuota returns the quota of tenant in s, if it has one.
+func (s *FileStore) tenantQuota(tenant string) (tenantQuota, bool) {
+	s.quotasMu.RLock()
+	defer s.quotasMu.RUnlock()
+	q, ok := s.quotas[tenant]
+	return q, ok
+}
+
+// setTenantQuota sets the quota of tenant in s and persists the quotas.
+func (s *FileStore) setTenantQuota(o *options.Option, tenant string, q tenantQuota) error {
+	s.quotasMu.Lock()
+	if s.quotas == nil {
+		s.quotas = map[string]tenantQuota{}
+	}
+	s.quotas[tenant] = q
+	s.quotasMu.Unlock()
+	return s.saveTenantQuotas(o)
+}
+
+// quotaTenants returns the tenants having a quota in s.
+func (s *FileStore) quotaTenants() []string {
+	s.quotasMu.RLock()
+	defer s.quotasMu.RUnlock()
+	tenants := make([]string, 0, len(s.quotas))
+	for t := range s.quotas {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
+
+// saveTenantQuotas persists the tenant quotas next to the files index, the
+// same way, so that a crash never leaves them half written, and like it
+// unless the index is ephemeral. Saves are serialized so that the last one
+// writes the latest quotas.
+func (s *FileStore) saveTenantQuotas(o *options.Option) error {
+	if o.EphemeralIndex {
+		return nil
+	}
+
+	s.quotasSaveMu.Lock()
+	defer s.quotasSaveMu.Unlock()
+
+	s.quotasMu.RLock()
+	data, err := json.MarshalIndent(s.quotas, "", " ")
+	s.quotasMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if o.FilesBackend == nil {
+		if err := os.MkdirAll(o.UploadDir, 0755); err != nil {
+			return err
+		}
+	}
+	return s.saveIndexFile(o, tenantQuotasFile, data)
+}
+
+// loadTenantQuotas reads back the tenant quotas of s, unless the index is
+// ephemeral.
+func (s *FileStore) loadTenantQuotas(o *options.Option) {
+	if o.EphemeralIndex {
+		return
+	}
+
+	data, err := s.readIndexFile(o, tenantQuotasFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error().Msgf("Failed to read tenant quotas: %s", err)
+		}
+		return
+	}
+
+	quotas := map[string]tenantQuota{}
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		log.Error().Msgf("Failed to JSON unmarshal the tenant quotas: %s", err)
+		return
+	}
+	s.quotasMu.Lock()
+	s.quotas = quotas
+	s.quotasMu.Unlock()
+}
+
+// tenantUsage returns the number of files of tenant and their total size.
+func tenantUsage(tenant string) (int, int64) {
+	return defaultStore.tenantUsage(tenant)
+}
+
+// tenantUsage returns the number of files of tenant in s and their total size.
+func (s *FileStore) tenantUsage(tenant string) (int, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	var total int64
+	for _, f := range s.files {
+		if f.Tenant == tenant {
+			count++
+			total += int64(f.Bytes)
+		}
+	}
+	return count, total
+}
+
+// checkTenantQuota reports whether tenant can store size more bytes, on top of
+// the files staged for it.
+func (s *FileStore) checkTenantQuota(tenant string, size int64, staged []File) error {
+	if tenant == "" {
+		return nil
+	}
+	q, ok := s.tenantQuota(tenant)
+	if !ok {
+		return nil
+	}
+
+	count, used := s.tenantUsage(tenant)
+	for _, f := range staged {
+		if f.Tenant == tenant {
+			count++
+			used += int64(f.Bytes)
+		}
+	}
+	if q.MaxTotalStorageMB > 0 && used+size > int64(q.MaxTotalStorageMB)*1024*1024 {
+		return refuse(errQuotaExceeded, "File size %d exceeds the remaining storage quota of tenant %s (%d of %d MB used)", size, tenant, used/(1024*1024), q.MaxTotalStorageMB)
+	}
+	if q.MaxFiles > 0 && count >= q.MaxFiles {
+		return refuse(errTooManyFiles, "File count limit of %d reached for tenant %s", q.MaxFiles, tenant)
+	}
+	return nil
+}
+
+// TenantUsage describes what a tenant stores and its quota.
+type TenantUsage struct {
+	Tenant string       `json:"tenant"`
+	Files  int          `json:"files"`
+	Bytes  int64        `json:"bytes"`
+	Quota  *tenantQuota `json:"quota,omitempty"`
+}
+
+func describeTenant(tenant string) TenantUsage {
+	count, used := tenantUsage(tenant)
+	u := TenantUsage{Tenant: tenant, Files: count, Bytes: used}
+	if q, ok := defaultStore.tenantQuota(tenant); ok {
+		u.Quota = &q
+	}
+	return u
+}
+
+// SetTenantQuotaEndpoint sets the storage quota of a tenant.
+func SetTenantQuotaEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		tenant := strings.Clone(c.Params("tenant_id"))
+
+		var q tenantQuota
+		if err := json.Unmarshal(c.Body(), &q); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid quota: "+err.Error())
+		}
+		if q.MaxTotalStorageMB < 0 || q.MaxFiles < 0 {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Quota limits can't be negative")
+		}
+
+		if err := defaultStore.setTenantQuota(o, tenant, q); err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, "Failed to save tenant quotas: "+err.Error())
+		}
+
+		return sendJSON(c, describeTenant(tenant))
+	}
+}
+
+// ListTenantsEndpoint reports the usage of every tenant storing files or
+// having a quota.
+func ListTenantsEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		tenants := map[string]bool{}
+		for _, f := range filterFiles("") {
+			if f.Tenant != "" {
+				tenants[f.Tenant] = true
+			}
+		}
+		for _, t := range defaultStore.quotaTenants() {
+			tenants[t] = true
+		}
+
+		names := make([]string, 0, len(tenants))
+		for t := range tenants {
+			names = append(names, t)
+		}
+		sort.Strings(names)
+
+		data := make([]TenantUsage, 0, len(names))
+		for _, t := range names {
+			data = append(data, describeTenant(t))
+		}
+		return sendJSON(c, fiber.Map{"object": "list", "data": data})
+	}
+}
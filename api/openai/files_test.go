@@ -1,27 +1,56 @@
 package openai
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	config "github.com/go-skynet/LocalAI/api/config"
 	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/api/schema"
+	"github.com/go-skynet/LocalAI/metrics"
 	utils2 "github.com/go-skynet/LocalAI/pkg/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"testing"
 )
 
 type ListFiles struct {
-	Data   []File
-	Object string
+	Data    []File
+	Object  string
+	HasMore bool   `json:"has_more"`
+	FirstID string `json:"first_id"`
+	LastID  string `json:"last_id"`
 }
 
 func startUpApp() (app *fiber.App, option *options.Option, loader *config.ConfigLoader) {
@@ -41,10 +70,28 @@ func startUpApp() (app *fiber.App, option *options.Option, loader *config.Config
 
 	// Create a Test Server
 	app.Post("/files", UploadFilesEndpoint(loader, option))
+	app.Post("/files/from-url", UploadFileFromURLEndpoint(loader, option))
+	app.Post("/files/batch", UploadFilesBatchEndpoint(loader, option))
+	app.Post("/files/diff", DiffFilesEndpoint(loader, option))
+	app.Post("/files/metadata/batch", BatchUpdateMetadataEndpoint(loader, option))
+	app.Post("/files/retrieve/batch", BatchGetFilesEndpoint(loader, option))
+	app.Post("/files/delete/batch", BatchDeleteFilesEndpoint(loader, option))
+	app.Post("/files/delete", BatchDeleteFilesEndpoint(loader, option))
+	app.Head("/files", HeadFilesEndpoint(loader, option))
 	app.Get("/files", ListFilesEndpoint(loader, option))
+	app.Get("/files/can-upload", CanUploadFilesEndpoint(loader, option))
+	app.Get("/files/usage", StorageUsageEndpoint(loader, option))
+	app.Get("/files/export", ExportFilesEndpoint(loader, option))
+	app.Post("/files/import", ImportFilesEndpoint(loader, option))
+	app.Get("/files/storage-stats", StorageStatsEndpoint(loader, option))
+	app.Get("/files/report", FilesReportEndpoint(loader, option))
 	app.Get("/files/:file_id", GetFilesEndpoint(loader, option))
 	app.Delete("/files/:file_id", DeleteFilesEndpoint(loader, option))
 	app.Get("/files/:file_id/content", GetFilesContentsEndpoint(loader, option))
+	app.Get("/files/:file_id/convert", ConvertFilesEndpoint(loader, option))
+	app.Get("/files/:file_id/thumbnail", ThumbnailFilesEndpoint(loader, option))
+	app.Patch("/files/:file_id", UpdateFileEndpoint(loader, option))
+	app.Post("/files/:file_id", UpdateFileEndpoint(loader, option))
 
 	return
 }
@@ -98,7 +145,7 @@ func TestUploadFileExceedSizeLimit(t *testing.T) {
 		file := CallFilesUploadEndpointWithCleanup(t, app, "test.txt", "file", "fine-tune", 5, option)
 
 		// Check if file exists in the disk
-		filePath := filepath.Join(option.UploadDir, utils2.SanitizeFileName("test.txt"))
+		filePath := filepath.Join(option.UploadDir, "fine-tune", utils2.SanitizeFileName("test.txt"))
 		_, err := os.Stat(filePath)
 
 		assert.False(t, os.IsNotExist(err))
@@ -114,8 +161,8 @@ func TestUploadFileExceedSizeLimit(t *testing.T) {
 		assert.Equal(t, 200, resp.StatusCode)
 
 		listFiles := responseToListFile(t, resp)
-		if len(listFiles.Data) != len(uploadedFiles) {
-			t.Errorf("Expected %v files, got %v files", len(uploadedFiles), len(listFiles.Data))
+		if len(listFiles.Data) != len(defaultStore.files) {
+			t.Errorf("Expected %v files, got %v files", len(defaultStore.files), len(listFiles.Data))
 		}
 	})
 	t.Run("ListFilesEndpoint with valid purpose parameter", func(t *testing.T) {
@@ -284,3 +331,6034 @@ func responseToListFile(t *testing.T, resp *http.Response) ListFiles {
 
 	return listFiles
 }
+
+func responseToError(t *testing.T, resp *http.Response) schema.APIError {
+	var body schema.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == nil {
+		t.Errorf("Failed to decode error response: %v", err)
+		return schema.APIError{}
+	}
+	return *body.Error
+}
+
+// blockingBackend never completes an operation until release is closed.
+type blockingBackend struct {
+	release chan struct{}
+}
+
+func (b *blockingBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	<-b.release
+	return nil
+}
+
+func (b *blockingBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	<-b.release
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (b *blockingBackend) Remove(ctx context.Context, path string) error {
+	<-b.release
+	return nil
+}
+
+func TestFileOperationTimeout(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FileSaveTimeout = 50 * time.Millisecond
+	option.FileOpenTimeout = 50 * time.Millisecond
+	option.FileRemoveTimeout = 50 * time.Millisecond
+
+	t.Run("UploadFilesEndpoint save times out", func(t *testing.T) {
+		backend := &blockingBackend{release: make(chan struct{})}
+		defaultStore.backend = backend
+		t.Cleanup(func() {
+			close(backend.release)
+			defaultStore.backend = localBackend{}
+		})
+
+		start := time.Now()
+		resp, err := CallFilesUploadEndpoint(t, app, "timeout.txt", "file", "fine-tune", 1, option)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusGatewayTimeout, resp.StatusCode)
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		for _, f := range defaultStore.files {
+			assert.NotEqual(t, "timeout.txt", f.Filename)
+		}
+	})
+	t.Run("GetFilesContentsEndpoint open times out", func(t *testing.T) {
+		file := CallFilesUploadEndpointWithCleanup(t, app, "slow.txt", "file", "fine-tune", 1, option)
+
+		backend := &blockingBackend{release: make(chan struct{})}
+		defaultStore.backend = backend
+		defer func() {
+			close(backend.release)
+			defaultStore.backend = localBackend{}
+		}()
+
+		req := httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/content", nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusGatewayTimeout, resp.StatusCode)
+
+		resp, err = CallFilesDeleteEndpoint(t, app, file.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusGatewayTimeout, resp.StatusCode)
+	})
+}
+
+func TestListFilesOrdering(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FilesListSort = "created_at"
+	option.FilesListOrder = "desc"
+
+	now := time.Now()
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "b.txt", Bytes: 30, CreatedAt: now.Add(-2 * time.Hour), Purpose: "fine-tune"},
+		{ID: "file-2", Object: "file", Filename: "c.txt", Bytes: 10, CreatedAt: now.Add(-1 * time.Hour), Purpose: "fine-tune"},
+		{ID: "file-3", Object: "file", Filename: "a.txt", Bytes: 20, CreatedAt: now, Purpose: "fine-tune"},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	ids := func(target string) []string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var res []string
+		for _, f := range responseToListFile(t, resp).Data {
+			res = append(res, f.ID)
+		}
+		return res
+	}
+
+	t.Run("configured default ordering", func(t *testing.T) {
+		assert.Equal(t, []string{"file-3", "file-2", "file-1"}, ids("/files"))
+	})
+	t.Run("query overrides order", func(t *testing.T) {
+		assert.Equal(t, []string{"file-1", "file-2", "file-3"}, ids("/files?order=asc"))
+	})
+	t.Run("query overrides sort field", func(t *testing.T) {
+		assert.Equal(t, []string{"file-3", "file-1", "file-2"}, ids("/files?sort=filename&order=asc"))
+		assert.Equal(t, []string{"file-1", "file-3", "file-2"}, ids("/files?sort=bytes"))
+	})
+	t.Run("unsupported sort field", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files?sort=nope", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+var (
+	testMetricsOnce sync.Once
+	testMetrics     *metrics.Metrics
+)
+
+// setupTestMetrics returns metrics exported on the default prometheus
+// registry, which can only be set up once per process.
+func setupTestMetrics(t *testing.T) *metrics.Metrics {
+	testMetricsOnce.Do(func() {
+		var err error
+		testMetrics, err = metrics.SetupMetrics()
+		assert.NoError(t, err)
+	})
+	return testMetrics
+}
+
+func TestUploadRejectionReporting(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.Metrics = setupTestMetrics(t)
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	rejected := func(reason string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "files_upload_rejections_total" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "reason" && l.GetValue() == reason {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	for _, tc := range []struct {
+		reason   string
+		filename string
+		tag      string
+		purpose  string
+		size     int
+	}{
+		{reason: rejectMissingFile, filename: "missing.txt", tag: "not-a-file", purpose: "fine-tune", size: 1},
+		{reason: rejectTooLarge, filename: "large.txt", tag: "file", purpose: "fine-tune", size: 11},
+		{reason: rejectMissingPurpose, filename: "nopurpose.txt", tag: "file", purpose: "", size: 1},
+		{reason: rejectFileExists, filename: "exists.txt", tag: "file", purpose: "fine-tune", size: 1},
+	} {
+		t.Run(tc.reason, func(t *testing.T) {
+			if tc.reason == rejectFileExists {
+				_ = CallFilesUploadEndpointWithCleanup(t, app, tc.filename, tc.tag, tc.purpose, tc.size, option)
+			}
+			logs.Reset()
+			before := rejected(tc.reason)
+
+			_, err := CallFilesUploadEndpoint(t, app, tc.filename, tc.tag, tc.purpose, tc.size, option)
+			assert.NoError(t, err)
+
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+			assert.Equal(t, "warn", entry["level"])
+			assert.Equal(t, tc.reason, entry["reason"])
+			assert.Contains(t, entry, "client")
+			if tc.reason != rejectMissingFile {
+				assert.Equal(t, tc.filename, entry["filename"])
+			}
+
+			assert.Equal(t, before+1, rejected(tc.reason))
+		})
+	}
+
+	for reason, fields := range map[string]map[string]string{
+		rejectBadExpiration: {"purpose": "fine-tune", "expires_after[seconds]": "-1"},
+		rejectBadEncoding:   {"purpose": "fine-tune", "content_encoding": "br"},
+	} {
+		t.Run(reason, func(t *testing.T) {
+			logs.Reset()
+			before := rejected(reason)
+
+			resp := callFilesUploadWithFields(t, app, "fields.txt", []byte("content"), fields)
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+			assert.Equal(t, reason, entry["reason"])
+			assert.Equal(t, "fields.txt", entry["filename"])
+			assert.Equal(t, before+1, rejected(reason))
+		})
+	}
+}
+
+func TestContentAddressedFiles(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.ContentAddressedFiles = true
+
+	first := CallFilesUploadEndpointWithCleanup(t, app, "first.txt", "file", "fine-tune", 1, option)
+	second := CallFilesUploadEndpointWithCleanup(t, app, "second.txt", "file", "fine-tune", 1, option)
+
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.NotEmpty(t, first.Sha256)
+	assert.Equal(t, first.Sha256, second.Sha256)
+
+	blob := blobPath(option.UploadDir, first.Sha256)
+	entries, err := os.ReadDir(filepath.Join(option.UploadDir, blobsDir))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	resp, err := CallFilesDeleteEndpoint(t, app, first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	_, err = os.Stat(blob)
+	assert.NoError(t, err, "blob must survive while still referenced")
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/"+second.ID+"/content", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Len(t, bodyToByteArray(resp, t), 1024*1024)
+
+	resp, err = CallFilesDeleteEndpoint(t, app, second.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	_, err = os.Stat(blob)
+	assert.True(t, os.IsNotExist(err), "blob must be removed with its last reference")
+}
+
+func TestHeadFilesEndpoint(t *testing.T) {
+	app, _, _ := startUpApp()
+
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "a.txt", Bytes: 10, Purpose: "fine-tune"},
+		{ID: "file-2", Object: "file", Filename: "b.txt", Bytes: 20, Purpose: "fine-tune"},
+		{ID: "file-3", Object: "file", Filename: "c.txt", Bytes: 40, Purpose: "assistants"},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodHead, "/files?purpose=fine-tune", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+	assert.Equal(t, "30", resp.Header.Get("X-Total-Bytes"))
+	assert.Empty(t, bodyToByteArray(resp, t))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodHead, "/files", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", resp.Header.Get("X-Total-Count"))
+	assert.Equal(t, "70", resp.Header.Get("X-Total-Bytes"))
+}
+
+func TestListFilesLimit(t *testing.T) {
+	app, _, _ := startUpApp()
+
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "a.txt", Purpose: "fine-tune"},
+		{ID: "file-2", Object: "file", Filename: "b.txt", Purpose: "fine-tune"},
+		{ID: "file-3", Object: "file", Filename: "c.txt", Purpose: "assistants"},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	list := func(target string) (*http.Response, ListFiles) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		return resp, responseToListFile(t, resp)
+	}
+
+	t.Run("limit=0 returns totals only", func(t *testing.T) {
+		resp, listFiles := list("/files?limit=0&purpose=fine-tune")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotNil(t, listFiles.Data)
+		assert.Empty(t, listFiles.Data)
+		assert.True(t, listFiles.HasMore)
+		assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+	})
+	t.Run("limit=0 on an empty result", func(t *testing.T) {
+		resp, listFiles := list("/files?limit=0&purpose=batch")
+		assert.Empty(t, listFiles.Data)
+		assert.False(t, listFiles.HasMore)
+		assert.Equal(t, "0", resp.Header.Get("X-Total-Count"))
+	})
+	t.Run("omitted limit returns everything", func(t *testing.T) {
+		resp, listFiles := list("/files")
+		assert.Len(t, listFiles.Data, 3)
+		assert.False(t, listFiles.HasMore)
+		assert.Equal(t, "3", resp.Header.Get("X-Total-Count"))
+	})
+	t.Run("positive limit truncates", func(t *testing.T) {
+		resp, listFiles := list("/files?limit=2")
+		assert.Len(t, listFiles.Data, 2)
+		assert.True(t, listFiles.HasMore)
+		assert.Equal(t, "3", resp.Header.Get("X-Total-Count"))
+	})
+	t.Run("negative limit is rejected", func(t *testing.T) {
+		resp, _ := list("/files?limit=-1")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestCompactBlobs(t *testing.T) {
+	_, option, _ := startUpApp()
+	option.ContentAddressedFiles = true
+	t.Cleanup(func() { os.RemoveAll(option.UploadDir) })
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(option.UploadDir, blobsDir), 0755))
+	old := time.Now().Add(-2 * time.Hour)
+	seed := func(sum string, mtime time.Time) string {
+		p := blobPath(option.UploadDir, sum)
+		assert.NoError(t, os.WriteFile(p, []byte(sum), 0644))
+		assert.NoError(t, os.Chtimes(p, mtime, mtime))
+		return p
+	}
+
+	orphan := seed("orphan", old)
+	referenced := seed("referenced", old)
+	fresh := seed("fresh", time.Now())
+
+	defaultStore.files = []File{{ID: "file-1", Object: "file", Filename: "a.txt", Purpose: "fine-tune", Sha256: "referenced"}}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	removed, err := defaultStore.compactBlobs(option, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(referenced)
+	assert.NoError(t, err)
+	_, err = os.Stat(fresh)
+	assert.NoError(t, err, "blobs within the grace period are kept")
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize - 7} {
+		plain := bytes.Repeat([]byte("x"), size)
+
+		enc, err := newEncryptReader(bytes.NewReader(plain), key)
+		assert.NoError(t, err)
+		sealed, err := io.ReadAll(enc)
+		assert.NoError(t, err)
+		assert.True(t, isEncrypted(sealed))
+
+		dec, err := newDecryptReader(bytes.NewReader(sealed), key)
+		assert.NoError(t, err)
+		got, err := io.ReadAll(dec)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, got, "size %d", size)
+
+		dec, err = newDecryptReader(bytes.NewReader(sealed[:len(sealed)-1]), key)
+		assert.NoError(t, err)
+		_, err = io.ReadAll(dec)
+		assert.Error(t, err, "truncated content must not decrypt (size %d)", size)
+	}
+}
+
+func TestPerPurposeEncryptionKeys(t *testing.T) {
+	app, option, _ := startUpApp()
+	fineTuneKey := bytes.Repeat([]byte{1}, 32)
+	assistantsKey := bytes.Repeat([]byte{2}, 32)
+	option.FileEncryptionKeys = map[string][]byte{
+		"fine-tune":  fineTuneKey,
+		"assistants": assistantsKey,
+	}
+
+	fineTune := CallFilesUploadEndpointWithCleanup(t, app, "ft.txt", "file", "fine-tune", 1, option)
+	assistants := CallFilesUploadEndpointWithCleanup(t, app, "as.txt", "file", "assistants", 1, option)
+
+	for _, f := range []File{fineTune, assistants} {
+		onDisk, err := os.ReadFile(filepath.Join(option.UploadDir, f.Purpose, f.Filename))
+		assert.NoError(t, err)
+		assert.True(t, isEncrypted(onDisk))
+		assert.NotContains(t, string(onDisk), "aaaa")
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, strings.Repeat("a", 1024*1024), bodyToString(resp, t))
+	}
+
+	onDisk, err := os.ReadFile(filepath.Join(option.UploadDir, "fine-tune", fineTune.Filename))
+	assert.NoError(t, err)
+	_, err = newDecryptReader(bytes.NewReader(onDisk), assistantsKey)
+	assert.ErrorIs(t, err, errWrongEncryptionKey)
+
+	// a file whose purpose now maps to another key can't be read back
+	for i := range defaultStore.files {
+		if defaultStore.files[i].ID == fineTune.ID {
+			defaultStore.files[i].Purpose = "assistants"
+		}
+	}
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+fineTune.ID+"/content", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, bodyToString(resp, t), errWrongEncryptionKey.Error())
+}
+
+func TestValidatorPool(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AsyncFileValidation = true
+	option.MaxConcurrentValidators = 2
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	option.FileValidators = map[string]options.FileValidator{
+		"fine-tune": func(r io.Reader) error {
+			mu.Lock()
+			active++
+			if active > peak {
+				peak = active
+			}
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+			_, err := io.Copy(io.Discard, r)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return err
+		},
+		"assistants": func(r io.Reader) error {
+			return fmt.Errorf("bad content")
+		},
+	}
+
+	const burst = 8
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		name := fmt.Sprintf("burst-%d.txt", i)
+		file := createTestFile(t, name, 1, option)
+		body, writer := newMultipartFile(file.Name(), "file", "fine-tune")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/files", body)
+			req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+			assert.Equal(t, fileStatusProcessing, responseToFile(t, resp).Status)
+		}()
+	}
+	wg.Wait()
+
+	failed := CallFilesUploadEndpointWithCleanup(t, app, "invalid.txt", "file", "assistants", 1, option)
+	assert.Equal(t, fileStatusProcessing, failed.Status)
+
+	statuses := func() map[string]string {
+		res := map[string]string{}
+		for _, f := range filterFiles("") {
+			res[f.ID] = f.Status
+		}
+		return res
+	}
+	assert.Eventually(t, func() bool {
+		for _, s := range statuses() {
+			if s == fileStatusProcessing {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for id, s := range statuses() {
+		if id == failed.ID {
+			assert.Equal(t, fileStatusError, s)
+		} else {
+			assert.Equal(t, fileStatusProcessed, s)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.LessOrEqual(t, peak, 2)
+	assert.Equal(t, 2, peak)
+
+	defaultStore.mu.Lock()
+	defaultStore.files = nil
+	defaultStore.mu.Unlock()
+}
+
+func TestSyncValidation(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FileValidators = map[string]options.FileValidator{
+		"fine-tune": func(r io.Reader) error {
+			return fmt.Errorf("bad content")
+		},
+	}
+
+	resp, err := CallFilesUploadEndpoint(t, app, "rejected.txt", "file", "fine-tune", 1, option)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, bodyToString(resp, t), "bad content")
+	assert.Empty(t, filterFiles(""))
+
+	accepted := CallFilesUploadEndpointWithCleanup(t, app, "accepted.txt", "file", "assistants", 1, option)
+	assert.Equal(t, fileStatusProcessed, accepted.Status)
+}
+
+// rewriteArchive copies a zip archive, letting edit change each entry content.
+func rewriteArchive(t *testing.T, archive []byte, edit func(name string, content []byte) []byte) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+
+		w, err := zw.Create(zf.Name)
+		assert.NoError(t, err)
+		w.Write(edit(zf.Name, content))
+	}
+	assert.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func callFilesImportEndpoint(t *testing.T, app *fiber.App, archive []byte) *http.Response {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "export.zip")
+	assert.NoError(t, err)
+	part.Write(archive)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/files/import", body)
+	req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestSignedExportImport(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FilesExportSigningKey = []byte("secret")
+
+	first := CallFilesUploadEndpointWithCleanup(t, app, "first.txt", "file", "fine-tune", 1, option)
+	_ = CallFilesUploadEndpointWithCleanup(t, app, "second.txt", "file", "assistants", 1, option)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/export", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get(fiber.HeaderContentType))
+	archive := bodyToByteArray(resp, t)
+
+	// start over from an empty instance
+	defaultStore.files = nil
+	assert.NoError(t, os.RemoveAll(option.UploadDir))
+
+	t.Run("tampered manifest is rejected", func(t *testing.T) {
+		tampered := rewriteArchive(t, archive, func(name string, content []byte) []byte {
+			if name == exportManifestName {
+				return bytes.Replace(content, []byte("first.txt"), []byte("evil.txt"), 1)
+			}
+			return content
+		})
+		resp := callFilesImportEndpoint(t, app, tampered)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "invalid manifest signature")
+		assert.Empty(t, filterFiles(""))
+	})
+	t.Run("tampered content is rejected", func(t *testing.T) {
+		tampered := rewriteArchive(t, archive, func(name string, content []byte) []byte {
+			if name == first.ID {
+				return []byte("evil")
+			}
+			return content
+		})
+		resp := callFilesImportEndpoint(t, app, tampered)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "checksum mismatch")
+		assert.Empty(t, filterFiles(""))
+	})
+	t.Run("valid archive is imported", func(t *testing.T) {
+		resp := callFilesImportEndpoint(t, app, archive)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, filterFiles(""), 2)
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+first.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("a", 1024*1024), bodyToString(resp, t))
+	})
+}
+
+func TestListFilesCache(t *testing.T) {
+	option := &options.Option{
+		UploadLimitMB:     10,
+		UploadDir:         "test_dir",
+		FilesListCacheTTL: time.Minute,
+	}
+	app := fiber.New(fiber.Config{BodyLimit: 20 * 1024 * 1024})
+	app.Post("/files", UploadFilesEndpoint(nil, option))
+	app.Get("/files", ListFilesEndpoint(nil, option))
+	app.Delete("/files/:file_id", DeleteFilesEndpoint(nil, option))
+
+	list := func(target string) (string, int) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		return resp.Header.Get("X-Cache"), len(responseToListFile(t, resp).Data)
+	}
+
+	first := CallFilesUploadEndpointWithCleanup(t, app, "first.txt", "file", "fine-tune", 1, option)
+
+	state, count := list("/files")
+	assert.Equal(t, "MISS", state)
+	assert.Equal(t, 1, count)
+	state, count = list("/files")
+	assert.Equal(t, "HIT", state)
+	assert.Equal(t, 1, count)
+
+	state, _ = list("/files?purpose=fine-tune")
+	assert.Equal(t, "MISS", state, "each filter has its own entry")
+
+	_ = CallFilesUploadEndpointWithCleanup(t, app, "second.txt", "file", "fine-tune", 1, option)
+	state, count = list("/files")
+	assert.Equal(t, "MISS", state, "an upload invalidates the cache")
+	assert.Equal(t, 2, count)
+
+	_, err := CallFilesDeleteEndpoint(t, app, first.ID)
+	assert.NoError(t, err)
+	state, count = list("/files")
+	assert.Equal(t, "MISS", state, "a delete invalidates the cache")
+	assert.Equal(t, 1, count)
+}
+
+func TestListCacheBounds(t *testing.T) {
+	lc := newListCache(time.Minute, 2)
+	lc.put("a", listCacheEntry{body: []byte("a")})
+	lc.put("b", listCacheEntry{body: []byte("b")})
+	lc.put("c", listCacheEntry{body: []byte("c")})
+	assert.Len(t, lc.entries, 2)
+	_, ok := lc.get("a", 0)
+	assert.False(t, ok, "the oldest entry is evicted")
+
+	lc = newListCache(time.Nanosecond, 2)
+	lc.put("a", listCacheEntry{body: []byte("a")})
+	time.Sleep(time.Millisecond)
+	_, ok = lc.get("a", 0)
+	assert.False(t, ok, "entries expire after the ttl")
+}
+
+// callFilesUploadWithFields uploads content as name along with extra form fields.
+func callFilesUploadWithFields(t *testing.T, app *fiber.App, name string, content []byte, fields map[string]string) *http.Response {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	assert.NoError(t, err)
+	part.Write(content)
+	for k, v := range fields {
+		assert.NoError(t, writer.WriteField(k, v))
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/files", body)
+	req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestUploadMetadata(t *testing.T) {
+	app, option, _ := startUpApp()
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	t.Run("metadata JSON part", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "labeled.jsonl")
+		part.Write([]byte(`{"prompt":"a","completion":"b"}`))
+		meta, _ := writer.CreateFormFile("metadata", "metadata.json")
+		meta.Write([]byte(`{"dataset":"support","split":"train"}`))
+		writer.WriteField("purpose", "fine-tune")
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		f := responseToFile(t, resp)
+		assert.Equal(t, map[string]string{"dataset": "support", "split": "train"}, f.Metadata)
+
+		resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, f.Metadata, responseToFile(t, resp).Metadata)
+	})
+	t.Run("metadata form field", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "field.txt", []byte("x"), map[string]string{
+			"purpose":  "fine-tune",
+			"metadata": `{"team":"ml"}`,
+		})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, map[string]string{"team": "ml"}, responseToFile(t, resp).Metadata)
+	})
+	t.Run("invalid metadata", func(t *testing.T) {
+		for _, metadata := range []string{
+			`not json`,
+			`{"nested":{"a":1}}`,
+			`{"key":"` + strings.Repeat("v", defaultMaxMetadataValueLength+1) + `"}`,
+		} {
+			resp := callFilesUploadWithFields(t, app, "invalid.txt", []byte("x"), map[string]string{
+				"purpose":  "fine-tune",
+				"metadata": metadata,
+			})
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+			assert.Contains(t, bodyToString(resp, t), "Invalid metadata")
+		}
+	})
+}
+
+func TestCanUploadFilesEndpoint(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.MaxTotalStorageMB = 4
+	option.MaxFiles = 2
+
+	type CanUpload struct {
+		Accepted bool
+		Reason   string
+		Message  string
+	}
+	canUpload := func(query string) CanUpload {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/can-upload?"+query, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var res CanUpload
+		assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &res))
+		return res
+	}
+
+	defaultStore.files = []File{{ID: "file-1", Object: "file", Filename: "a.txt", Bytes: 2 * 1024 * 1024, Purpose: "fine-tune"}}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	res := canUpload("bytes=1024&purpose=fine-tune")
+	assert.True(t, res.Accepted)
+	assert.Empty(t, res.Reason)
+
+	res = canUpload(fmt.Sprintf("bytes=%d&purpose=fine-tune", 2*1024*1024))
+	assert.True(t, res.Accepted)
+
+	res = canUpload(fmt.Sprintf("bytes=%d&purpose=fine-tune", 2*1024*1024+1))
+	assert.False(t, res.Accepted)
+	assert.Equal(t, rejectQuotaExceeded, res.Reason)
+
+	res = canUpload(fmt.Sprintf("bytes=%d&purpose=fine-tune", 11*1024*1024))
+	assert.False(t, res.Accepted)
+	assert.Equal(t, rejectTooLarge, res.Reason)
+
+	res = canUpload("bytes=1024")
+	assert.False(t, res.Accepted)
+	assert.Equal(t, rejectMissingPurpose, res.Reason)
+
+	defaultStore.files = append(defaultStore.files, File{ID: "file-2", Object: "file", Filename: "b.txt", Bytes: 1, Purpose: "fine-tune"})
+	res = canUpload("bytes=1024&purpose=fine-tune")
+	assert.False(t, res.Accepted)
+	assert.Equal(t, rejectTooManyFiles, res.Reason)
+
+	resp, err := CallFilesUploadEndpoint(t, app, "count.txt", "file", "fine-tune", 1, option)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, bodyToString(resp, t), "File count limit")
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/can-upload?bytes=abc", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestUploadDiskFullReservation(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.MinFreeDiskMB = 100
+
+	free := uint64(0)
+	statfs := diskFree
+	diskFree = func(path string) (uint64, error) {
+		return free, nil
+	}
+	t.Cleanup(func() { diskFree = statfs })
+
+	t.Run("rejected near the threshold", func(t *testing.T) {
+		free = 100*1024*1024 + 512*1024
+		resp, err := CallFilesUploadEndpoint(t, app, "full.txt", "file", "fine-tune", 1, option)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusInsufficientStorage, resp.StatusCode)
+		assert.Empty(t, filterFiles(""))
+	})
+	t.Run("accepted above the threshold", func(t *testing.T) {
+		free = 200 * 1024 * 1024
+		file := CallFilesUploadEndpointWithCleanup(t, app, "roomy.txt", "file", "fine-tune", 1, option)
+		assert.NotEmpty(t, file.ID)
+	})
+}
+
+func TestWORMFiles(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.WORMFiles = true
+
+	file := CallFilesUploadEndpointWithCleanup(t, app, "worm.txt", "file", "fine-tune", 1, option)
+
+	t.Run("overwrite is rejected", func(t *testing.T) {
+		resp, err := CallFilesUploadEndpoint(t, app, "worm.txt", "file", "fine-tune", 2, option)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+		files := filterFiles("")
+		assert.Len(t, files, 1)
+		assert.Equal(t, file.ID, files[0].ID)
+		assert.Equal(t, file.Bytes, files[0].Bytes)
+	})
+	t.Run("update is rejected", func(t *testing.T) {
+		f, err := getFile(file.ID)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, checkFileMutable(option, *f), errFileImmutable)
+	})
+	t.Run("delete is allowed", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/files/"+file.ID, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, filterFiles(""))
+	})
+}
+
+func TestFilesContentTypes(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() { os.RemoveAll(option.UploadDir) })
+
+	resp := callFilesUploadWithFields(t, app, "data.jsonl", []byte(`{"a":1}`+"\n"), map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, fiber.MIMEApplicationJSONCharsetUTF8, resp.Header.Get(fiber.HeaderContentType))
+	file := responseToFile(t, resp)
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	resp = callFilesUploadWithFields(t, app, "page.txt", []byte("<html><body>hi</body></html>"), map[string]string{"purpose": "fine-tune"})
+	page := responseToFile(t, resp)
+
+	for _, path := range []string{"/files", "/files/" + file.ID, "/files/can-upload?bytes=1&purpose=fine-tune"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, fiber.MIMEApplicationJSONCharsetUTF8, resp.Header.Get(fiber.HeaderContentType), path)
+	}
+
+	// cached listings are served with the same type
+	cached := fiber.New()
+	cached.Get("/files", ListFilesEndpoint(nil, &options.Option{UploadDir: option.UploadDir, FilesListCacheTTL: time.Minute}))
+	for _, cache := range []string{"MISS", "HIT"} {
+		resp, err := cached.Test(httptest.NewRequest(http.MethodGet, "/files", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, cache, resp.Header.Get("X-Cache"))
+		assert.Equal(t, fiber.MIMEApplicationJSONCharsetUTF8, resp.Header.Get(fiber.HeaderContentType))
+	}
+
+	// the stored name decides the type of the content, not what it looks like
+	req := httptest.NewRequest(http.MethodGet, "/files/"+page.ID+"/content", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get(fiber.HeaderContentType))
+
+	req = httptest.NewRequest(http.MethodDelete, "/files/"+file.ID, nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.MIMEApplicationJSONCharsetUTF8, resp.Header.Get(fiber.HeaderContentType))
+}
+
+func TestConvertFilesEndpoint(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	jsonl := `{"prompt":"hello","completion":"world","n":1}` + "\n" + `{"prompt":"a, b","completion":"c"}` + "\n"
+	resp := callFilesUploadWithFields(t, app, "train.jsonl", []byte(jsonl), map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	file := responseToFile(t, resp)
+
+	t.Run("jsonl to csv", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/convert?to=csv", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get(fiber.HeaderContentType))
+		assert.Equal(t, "completion,n,prompt\nworld,1,hello\nc,,\"a, b\"\n", bodyToString(resp, t))
+
+		// nothing new is stored
+		assert.Len(t, filterFiles(""), 1)
+	})
+	t.Run("unsupported target", func(t *testing.T) {
+		for _, to := range []string{"xml", "png"} {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/convert?to="+to, nil))
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusUnsupportedMediaType, resp.StatusCode, to)
+		}
+	})
+}
+
+// hugePNG returns a PNG whose header claims width by height pixels, with no
+// pixels actually encoded.
+func hugePNG(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))))
+	b := buf.Bytes()
+	// the IHDR chunk follows the 8 bytes signature and its own length and type
+	binary.BigEndian.PutUint32(b[16:], width)
+	binary.BigEndian.PutUint32(b[20:], height)
+	binary.BigEndian.PutUint32(b[29:], crc32.ChecksumIEEE(b[12:29]))
+	return b
+}
+
+func TestImageConversionBounds(t *testing.T) {
+	t.Run("images with too many pixels are not decoded", func(t *testing.T) {
+		_, err := decodeImage(bytes.NewReader(hugePNG(t, 100000, 100000)))
+		assert.ErrorIs(t, err, errImageTooLarge)
+
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2))))
+		img, err := decodeImage(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Pt(3, 2), img.Bounds().Size())
+	})
+	t.Run("the derived side is clamped", func(t *testing.T) {
+		tall := image.NewGray(image.Rect(0, 0, 1, 100))
+		assert.Equal(t, image.Pt(100, maxConvertedImageSide), resizeImage(tall, 100, 0).Bounds().Size())
+		wide := image.NewGray(image.Rect(0, 0, 100, 1))
+		assert.Equal(t, image.Pt(maxConvertedImageSide, 100), resizeImage(wide, 0, 100).Bounds().Size())
+	})
+}
+
+func TestTenantQuotas(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AdminApiKeys = []string{"admin-key"}
+	admin := AdminOnly(option)
+	app.Get("/admin/tenants", admin, ListTenantsEndpoint(nil, option))
+	app.Put("/admin/tenants/:tenant_id/quota", admin, SetTenantQuotaEndpoint(nil, option))
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		defaultStore.quotas = map[string]tenantQuota{}
+		os.RemoveAll(option.UploadDir)
+	})
+
+	setQuota := func(key, tenant, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPut, "/admin/tenants/"+tenant+"/quota", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	upload := func(tenant, name string) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", name)
+		part.Write([]byte("content"))
+		writer.WriteField("purpose", "fine-tune")
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(tenantHeader, tenant)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("admin only", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusForbidden, setQuota("", "acme", `{"max_files":1}`).StatusCode)
+		assert.Equal(t, fiber.StatusForbidden, setQuota("user-key", "acme", `{"max_files":1}`).StatusCode)
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/admin/tenants", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+		_, ok := defaultStore.tenantQuota("acme")
+		assert.False(t, ok)
+	})
+	t.Run("set quota", func(t *testing.T) {
+		resp := setQuota("admin-key", "acme", `{"max_files":1}`)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var usage TenantUsage
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+		assert.Equal(t, "acme", usage.Tenant)
+		assert.Equal(t, 1, usage.Quota.MaxFiles)
+
+		// persisted alongside the index
+		defaultStore.quotas = map[string]tenantQuota{}
+		defaultStore.loadTenantQuotas(option)
+		q, ok := defaultStore.tenantQuota("acme")
+		assert.True(t, ok)
+		assert.Equal(t, 1, q.MaxFiles)
+
+		assert.Equal(t, fiber.StatusBadRequest, setQuota("admin-key", "acme", `{"max_files":-1}`).StatusCode)
+	})
+	t.Run("enforced per tenant", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusOK, upload("acme", "a.txt").StatusCode)
+		resp := upload("acme", "b.txt")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "tenant acme")
+
+		// other tenants are not affected
+		assert.Equal(t, fiber.StatusOK, upload("globex", "c.txt").StatusCode)
+	})
+	t.Run("usage", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/tenants", nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer admin-key")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		var list struct {
+			Data []TenantUsage `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		assert.Len(t, list.Data, 2)
+		assert.Equal(t, "acme", list.Data[0].Tenant)
+		assert.Equal(t, 1, list.Data[0].Files)
+		assert.Equal(t, int64(len("content")), list.Data[0].Bytes)
+		assert.Equal(t, "globex", list.Data[1].Tenant)
+		assert.Nil(t, list.Data[1].Quota)
+	})
+	t.Run("tenant of the key", func(t *testing.T) {
+		option.ApiKeys = []string{"acme-key", "other-key"}
+		option.TenantKeys = map[string]string{"acme-key": "acme"}
+		t.Cleanup(func() {
+			option.ApiKeys, option.TenantKeys = nil, nil
+		})
+		uploadWithKey := func(key, tenant, name string) *http.Response {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("file", name)
+			part.Write([]byte("content"))
+			writer.WriteField("purpose", "fine-tune")
+			writer.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/files", body)
+			req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+			req.Header.Set(tenantHeader, tenant)
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		// the header can't escape the quota of the key's tenant
+		resp := uploadWithKey("acme-key", "globex", "d.txt")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "tenant acme")
+
+		// nor charge another tenant from a key without one
+		resp = uploadWithKey("other-key", "acme", "e.txt")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, responseToFile(t, resp).Tenant)
+	})
+}
+
+func TestSizeMismatchPolicy(t *testing.T) {
+	for _, policy := range []string{sizeMismatchCorrect, sizeMismatchError, sizeMismatchIgnore} {
+		for name, content := range map[string]string{"grown": "0123456789abcdef", "shrunk": "0123"} {
+			t.Run(policy+" "+name, func(t *testing.T) {
+				app, option, _ := startUpApp()
+				option.SizeMismatchPolicy = policy
+				os.MkdirAll(option.UploadDir, 0755)
+				t.Cleanup(func() {
+					defaultStore.files = nil
+					os.RemoveAll(option.UploadDir)
+				})
+
+				resp := callFilesUploadWithFields(t, app, "sized.txt", []byte("01234567"), map[string]string{"purpose": "fine-tune"})
+				file := responseToFile(t, resp)
+				assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, "fine-tune", "sized.txt"), []byte(content), 0644))
+
+				resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/content", nil))
+				assert.NoError(t, err)
+				stored, _ := getFile(file.ID)
+				switch policy {
+				case sizeMismatchCorrect:
+					assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+					assert.Equal(t, len(content), stored.Bytes)
+				case sizeMismatchError:
+					assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+					assert.Equal(t, 8, stored.Bytes)
+				case sizeMismatchIgnore:
+					assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+					assert.Equal(t, 8, stored.Bytes)
+				}
+
+				// startup reconciliation
+				updateUploadedFile(file.ID, func(f *File) { f.Bytes = 8 })
+				ReconcileFileSizes(option)
+				stored, _ = getFile(file.ID)
+				switch policy {
+				case sizeMismatchCorrect:
+					assert.Equal(t, len(content), stored.Bytes)
+					assert.Equal(t, fileStatusProcessed, stored.Status)
+				case sizeMismatchError:
+					assert.Equal(t, 8, stored.Bytes)
+					assert.Equal(t, fileStatusError, stored.Status)
+				case sizeMismatchIgnore:
+					assert.Equal(t, 8, stored.Bytes)
+					assert.Equal(t, fileStatusProcessed, stored.Status)
+				}
+			})
+		}
+	}
+}
+
+func TestUploadFileFromURL(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.UploadLimitMB = 1
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.jsonl":
+			w.Write([]byte(`{"prompt":"hello"}`))
+		case "/big.bin":
+			w.Write(bytes.Repeat([]byte("a"), 2*1024*1024))
+		}
+	}))
+	t.Cleanup(remote.Close)
+
+	fromURL := func(u string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"url": u, "purpose": "fine-tune"})
+		req := httptest.NewRequest(http.MethodPost, "/files/from-url", bytes.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("internal address is blocked", func(t *testing.T) {
+		resp := fromURL(remote.URL + "/data.jsonl")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "internal addresses")
+		assert.Empty(t, filterFiles(""))
+	})
+
+	// the test server listens on loopback, let it through
+	blocked := isBlockedIP
+	isBlockedIP = func(ip net.IP) bool { return !ip.IsLoopback() && blocked(ip) }
+	t.Cleanup(func() { isBlockedIP = blocked })
+
+	t.Run("fetch", func(t *testing.T) {
+		resp := fromURL(remote.URL + "/data.jsonl")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		file := responseToFile(t, resp)
+		assert.Equal(t, "data.jsonl", file.Filename)
+		assert.Equal(t, len(`{"prompt":"hello"}`), file.Bytes)
+		assert.Equal(t, remote.URL+"/data.jsonl", file.Metadata[sourceURLMetadataKey])
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"prompt":"hello"}`, bodyToString(resp, t))
+	})
+	t.Run("oversized remote file", func(t *testing.T) {
+		resp := fromURL(remote.URL + "/big.bin")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "exceeds upload limit")
+		assert.Len(t, filterFiles(""), 1)
+	})
+}
+
+func TestFileScopes(t *testing.T) {
+	option := &options.Option{
+		UploadLimitMB: 10,
+		UploadDir:     "test_dir",
+		ApiKeys:       []string{"reader", "writer"},
+		ApiKeyScopes:  map[string][]string{"reader": {ScopeFilesRead}},
+	}
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	read := RequireFileScope(option, ScopeFilesRead)
+	write := RequireFileScope(option, ScopeFilesWrite)
+	del := RequireFileScope(option, ScopeFilesDelete)
+	app := fiber.New()
+	app.Post("/files", write, UploadFilesEndpoint(nil, option))
+	app.Get("/files", read, ListFilesEndpoint(nil, option))
+	app.Delete("/files/:file_id", del, DeleteFilesEndpoint(nil, option))
+
+	upload := func(key string) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "scoped.txt")
+		part.Write([]byte("content"))
+		writer.WriteField("purpose", "fine-tune")
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	call := func(method, target, key string) *http.Response {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("read-only key can't upload", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusForbidden, upload("reader").StatusCode)
+		assert.Empty(t, filterFiles(""))
+	})
+
+	resp := upload("writer")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	file := responseToFile(t, resp)
+
+	t.Run("read-only key can list", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusOK, call(http.MethodGet, "/files", "reader").StatusCode)
+	})
+	t.Run("read-only key can't delete", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusForbidden, call(http.MethodDelete, "/files/"+file.ID, "reader").StatusCode)
+		assert.Len(t, filterFiles(""), 1)
+	})
+	t.Run("unscoped key can delete", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusOK, call(http.MethodDelete, "/files/"+file.ID, "writer").StatusCode)
+		assert.Empty(t, filterFiles(""))
+	})
+}
+
+func TestUploadFilesBatch(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.UploadLimitMB = 1
+	var mu sync.Mutex
+	var indexed []int
+	var hooked []string
+	option.PreUpload = []options.PreUploadHook{func(ctx context.Context, req schema.UploadRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		indexed = append(indexed, len(filterFiles("")))
+		return nil
+	}}
+	option.PostUpload = []options.PostUploadHook{func(ctx context.Context, req schema.UploadRequest, f schema.File) {
+		mu.Lock()
+		defer mu.Unlock()
+		hooked = append(hooked, f.Filename)
+	}}
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		indexed, hooked = nil, nil
+	}
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	sizes := []int{10, 10, 2 * 1024 * 1024}
+	batch := func(transactional bool) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for i, size := range sizes {
+			part, _ := writer.CreateFormFile("file", fmt.Sprintf("batch-%d.txt", i))
+			part.Write(bytes.Repeat([]byte("a"), size))
+		}
+		writer.WriteField("purpose", "fine-tune")
+		writer.WriteField("transactional", strconv.FormatBool(transactional))
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files/batch", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	t.Run("transactional batch is rolled back", func(t *testing.T) {
+		resp := batch(true)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		var result BatchResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Empty(t, result.Results)
+		assert.Len(t, result.Errors, 1)
+		assert.Equal(t, "batch-2.txt", result.Errors[0].Filename)
+		assert.Equal(t, rejectTooLarge, result.Errors[0].Reason)
+
+		assert.Empty(t, filterFiles(""))
+		for i := 0; i < 2; i++ {
+			_, err := os.Stat(filepath.Join(option.UploadDir, "fine-tune", fmt.Sprintf("batch-%d.txt", i)))
+			assert.True(t, os.IsNotExist(err))
+		}
+		assert.Equal(t, []int{0, 0}, indexed, "staged files are not listed")
+		assert.Empty(t, hooked, "no hook fires for a rolled back batch")
+	})
+	t.Run("transactional batch registers the files once stored", func(t *testing.T) {
+		reset()
+		sizes = []int{10, 10}
+		t.Cleanup(func() {
+			sizes = []int{10, 10, 2 * 1024 * 1024}
+			defaultStore.files = nil
+			os.RemoveAll(option.UploadDir)
+		})
+		resp := batch(true)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, filterFiles(""), 2)
+		assert.Equal(t, []int{0, 0}, indexed)
+		assert.Equal(t, []string{"batch-0.txt", "batch-1.txt"}, hooked)
+	})
+	t.Run("transactional batch can't repeat a name", func(t *testing.T) {
+		reset()
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for i := 0; i < 2; i++ {
+			part, _ := writer.CreateFormFile("file", "same.txt")
+			part.Write([]byte("content"))
+		}
+		writer.WriteField("purpose", "fine-tune")
+		writer.WriteField("transactional", "true")
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files/batch", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Empty(t, filterFiles(""))
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "same.txt"))
+	})
+	t.Run("default batch keeps the valid files", func(t *testing.T) {
+		reset()
+		resp := batch(false)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var result BatchResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Len(t, result.Results, 2)
+		assert.Len(t, result.Errors, 1)
+		assert.Len(t, filterFiles(""), 2)
+	})
+}
+
+// flakyBackend fails every call while failing is set, counting the calls.
+type flakyBackend struct {
+	mu      sync.Mutex
+	failing bool
+	calls   int
+}
+
+func (b *flakyBackend) call() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.failing {
+		return errors.New("backend is down")
+	}
+	return nil
+}
+
+func (b *flakyBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	io.Copy(io.Discard, r)
+	return b.call()
+}
+
+func (b *flakyBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := b.call(); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader("content")), nil
+}
+
+func (b *flakyBackend) Remove(ctx context.Context, path string) error {
+	return b.call()
+}
+
+func TestResilientBackend(t *testing.T) {
+	breakerGauge := func(state string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "files_backend_breaker_state" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "state" && l.GetValue() == state {
+						return m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	t.Run("retries", func(t *testing.T) {
+		flaky := &flakyBackend{failing: true}
+		backend := newResilientBackend(flaky, &options.Option{FileBackendRetries: 2, FileBackendRetryBackoff: time.Millisecond})
+
+		// content that can be read again is saved again
+		assert.Error(t, backend.Save(context.Background(), "f", strings.NewReader("content")))
+		assert.Equal(t, 3, flaky.calls)
+
+		flaky.calls = 0
+		assert.Error(t, backend.Save(context.Background(), "f", io.LimitReader(strings.NewReader("content"), 7)))
+		assert.Equal(t, 1, flaky.calls)
+
+		flaky.calls = 0
+		flaky.failing = false
+		assert.NoError(t, backend.Remove(context.Background(), "f"))
+		assert.Equal(t, 1, flaky.calls)
+	})
+
+	t.Run("breaker trips and recloses", func(t *testing.T) {
+		flaky := &flakyBackend{failing: true}
+		backend := newResilientBackend(flaky, &options.Option{
+			FileBackendBreakerThreshold: 3,
+			FileBackendBreakerCooldown:  time.Minute,
+			Metrics:                     setupTestMetrics(t),
+		}).(*resilientBackend)
+		now := time.Now()
+		backend.breaker.now = func() time.Time { return now }
+		closed := breakerGauge(breakerClosed)
+
+		for i := 0; i < 3; i++ {
+			_, err := backend.Open(context.Background(), "f")
+			assert.Error(t, err)
+		}
+		assert.Equal(t, breakerOpen, backend.breaker.State())
+		assert.Equal(t, float64(1), breakerGauge(breakerOpen))
+		assert.Equal(t, closed-1, breakerGauge(breakerClosed))
+
+		// sustained failures fail fast without reaching the backend
+		_, err := backend.Open(context.Background(), "f")
+		assert.ErrorIs(t, err, errBackendUnavailable)
+		assert.Equal(t, 3, flaky.calls)
+
+		// a failed probe keeps it open
+		now = now.Add(time.Minute)
+		_, err = backend.Open(context.Background(), "f")
+		assert.NotErrorIs(t, err, errBackendUnavailable)
+		assert.Equal(t, 4, flaky.calls)
+		assert.Equal(t, breakerOpen, backend.breaker.State())
+
+		// a successful one closes it
+		now = now.Add(time.Minute)
+		flaky.failing = false
+		rc, err := backend.Open(context.Background(), "f")
+		assert.NoError(t, err)
+		rc.Close()
+		assert.Equal(t, breakerClosed, backend.breaker.State())
+		assert.Equal(t, float64(0), breakerGauge(breakerOpen))
+		assert.Equal(t, closed, breakerGauge(breakerClosed))
+	})
+
+	t.Run("open breaker answers 503", func(t *testing.T) {
+		app, option, _ := startUpApp()
+		os.MkdirAll(option.UploadDir, 0755)
+		t.Cleanup(func() {
+			defaultStore.files = nil
+			os.RemoveAll(option.UploadDir)
+		})
+
+		backend := newResilientBackend(&flakyBackend{failing: true}, &options.Option{FileBackendBreakerThreshold: 1, FileBackendBreakerCooldown: time.Minute})
+		previous := defaultStore.backend
+		defaultStore.backend = backend
+		t.Cleanup(func() { defaultStore.backend = previous })
+
+		resp := callFilesUploadWithFields(t, app, "down.txt", []byte("content"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+		resp = callFilesUploadWithFields(t, app, "down.txt", []byte("content"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusServiceUnavailable, resp.StatusCode)
+	})
+	t.Run("configured once", func(t *testing.T) {
+		vision := &memoryBackend{}
+		shared := map[string]options.FileBackend{"vision": vision}
+		option := &options.Option{UploadDir: t.TempDir(), FileBackendRetries: 1, PurposeBackends: shared}
+		previous := defaultStore.backend
+		defaultStore.backend = nil
+		t.Cleanup(func() { defaultStore.backend = previous })
+
+		ConfigureFilesBackend(option)
+		ConfigureFilesBackend(option)
+		assert.Same(t, vision, shared["vision"], "the map of the options is left as is")
+		if wrapped, ok := option.PurposeBackends["vision"].(*resilientBackend); assert.True(t, ok) {
+			assert.Same(t, vision, wrapped.backend)
+		}
+		if wrapped, ok := defaultStore.backend.(*resilientBackend); assert.True(t, ok) {
+			assert.Equal(t, localBackend{}, wrapped.backend)
+		}
+	})
+	t.Run("a wrapped local disk renames in place", func(t *testing.T) {
+		option := &options.Option{UploadDir: t.TempDir(), FileBackendRetries: 1}
+		backend := newResilientBackend(localBackend{}, option)
+		from := filepath.Join(option.UploadDir, "fine-tune", "a.txt")
+		to := filepath.Join(option.UploadDir, "assistants", "a.txt")
+		assert.NoError(t, backend.Save(context.Background(), from, strings.NewReader("content")))
+		before, err := os.Stat(from)
+		assert.NoError(t, err)
+
+		assert.NoError(t, moveStoredContent(context.Background(), option, backend, from, backend, to))
+		after, err := os.Stat(to)
+		if assert.NoError(t, err) {
+			assert.True(t, os.SameFile(before, after))
+		}
+		assert.NoFileExists(t, from)
+	})
+}
+
+func TestExportNaming(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var ids []string
+	for _, upload := range []struct{ name, purpose string }{
+		{"data.jsonl", "fine-tune"},
+		{"notes.txt", "fine-tune"},
+		{"manifest.json", "assistants"},
+	} {
+		resp := callFilesUploadWithFields(t, app, upload.name, []byte(upload.name), map[string]string{"purpose": upload.purpose})
+		ids = append(ids, responseToFile(t, resp).ID)
+	}
+
+	layout := func() []string {
+		var buf bytes.Buffer
+		assert.NoError(t, writeExportArchive(context.Background(), option, &buf, filterFiles(""), nil))
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		assert.NoError(t, err)
+		var names []string
+		for _, zf := range zr.File {
+			names = append(names, zf.Name)
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		naming, root string
+		expected     []string
+	}{
+		{"", "", []string{ids[0], ids[1], ids[2], "manifest.json"}},
+		{"{purpose}/{filename}", "", []string{"fine-tune/data.jsonl", "fine-tune/notes.txt", "assistants/manifest.json", "manifest.json"}},
+		{"{filename}", "", []string{"data.jsonl", "notes.txt", "manifest-1.json", "manifest.json"}},
+		{"{purpose}", "", []string{"fine-tune", "fine-tune-1", "assistants", "manifest.json"}},
+		{"{filename}", "export", []string{"export/data.jsonl", "export/notes.txt", "export/manifest-1.json", "export/manifest.json"}},
+		{"../{id}", "", []string{ids[0], ids[1], ids[2], "manifest.json"}},
+	} {
+		option.FilesExportNaming, option.FilesExportRootDir = tc.naming, tc.root
+		assert.Equal(t, tc.expected, layout(), tc.naming)
+		// the same files always get the same names
+		assert.Equal(t, tc.expected, layout(), tc.naming)
+	}
+
+	t.Run("archive with a top-level directory is imported", func(t *testing.T) {
+		option.FilesExportNaming, option.FilesExportRootDir = "{purpose}/{filename}", "export"
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/export", nil))
+		assert.NoError(t, err)
+		archive := bodyToByteArray(resp, t)
+
+		defaultStore.files = nil
+		assert.NoError(t, os.RemoveAll(option.UploadDir))
+		resp = callFilesImportEndpoint(t, app, archive)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, filterFiles(""), 3)
+	})
+}
+
+func TestRegisterFile(t *testing.T) {
+	app, option, _ := startUpApp()
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	f, err := RegisterFile(option, strings.NewReader("hello world"), "transcript.txt", "assistants")
+	assert.NoError(t, err)
+	assert.Equal(t, 11, f.Bytes)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files", nil))
+	assert.NoError(t, err)
+	list := responseToListFile(t, resp)
+	assert.Len(t, list.Data, 1)
+	assert.Equal(t, f.ID, list.Data[0].ID)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", bodyToString(resp, t))
+
+	// persisted like uploads
+	defaultStore.files = nil
+	LoadUploadConfig(option)
+	_, err = getFile(f.ID)
+	assert.NoError(t, err)
+
+	t.Run("same checks as uploads", func(t *testing.T) {
+		_, err := RegisterFile(option, strings.NewReader("again"), "transcript.txt", "assistants")
+		assert.EqualError(t, err, "File already exists")
+		_, err = RegisterFile(option, strings.NewReader("no purpose"), "other.txt", "")
+		assert.EqualError(t, err, "Purpose is not defined")
+
+		option.FileValidators = map[string]options.FileValidator{"assistants": func(r io.Reader) error {
+			return errors.New("bad content")
+		}}
+		t.Cleanup(func() { option.FileValidators = nil })
+		_, err = RegisterFile(option, strings.NewReader("rejected"), "invalid.txt", "assistants")
+		assert.ErrorContains(t, err, "bad content")
+		assert.Len(t, filterFiles(""), 1)
+
+		option.DeniedFilenames = []string{"*.exe"}
+		t.Cleanup(func() { option.DeniedFilenames = nil })
+		_, err = RegisterFile(option, strings.NewReader("denied"), "tool.EXE", "assistants")
+		assert.EqualError(t, err, "File name tool.EXE is not allowed")
+	})
+	t.Run("upload hooks", func(t *testing.T) {
+		var seen []string
+		option.PreUpload = []options.PreUploadHook{func(ctx context.Context, req schema.UploadRequest) error {
+			if req.Filename == "refused.txt" {
+				return errors.New("refused by policy")
+			}
+			return nil
+		}}
+		option.PostUpload = []options.PostUploadHook{func(ctx context.Context, req schema.UploadRequest, f schema.File) {
+			seen = append(seen, req.Filename)
+		}}
+		t.Cleanup(func() { option.PreUpload, option.PostUpload = nil, nil })
+
+		_, err := RegisterFile(option, strings.NewReader("refused"), "refused.txt", "assistants")
+		assert.EqualError(t, err, "refused by policy")
+		_, err = RegisterFile(option, strings.NewReader("accepted"), "dir/accepted.txt", "assistants")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"accepted.txt"}, seen)
+	})
+}
+
+func TestListFilesMaxLimit(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.MaxFilesListLimit = 2
+	for i := 0; i < 3; i++ {
+		defaultStore.files = append(defaultStore.files, File{ID: fmt.Sprintf("file-%d", i), Object: "file", Filename: fmt.Sprintf("%d.txt", i), Purpose: "fine-tune"})
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	list := func(target string) (*http.Response, ListFiles) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return resp, responseToListFile(t, resp)
+	}
+
+	t.Run("over the cap is clamped", func(t *testing.T) {
+		resp, files := list("/files?limit=10000000")
+		assert.Len(t, files.Data, 2)
+		assert.True(t, files.HasMore)
+		assert.Equal(t, "3", resp.Header.Get("X-Total-Count"))
+		assert.Contains(t, resp.Header.Get(fiber.HeaderWarning), "limit clamped to 2")
+	})
+	t.Run("within the cap", func(t *testing.T) {
+		resp, files := list("/files?limit=1")
+		assert.Len(t, files.Data, 1)
+		assert.Empty(t, resp.Header.Get(fiber.HeaderWarning))
+	})
+	t.Run("no limit gets a full page", func(t *testing.T) {
+		resp, files := list("/files")
+		assert.Len(t, files.Data, 2)
+		assert.True(t, files.HasMore)
+		assert.Empty(t, resp.Header.Get(fiber.HeaderWarning))
+	})
+}
+
+func TestDiffFilesEndpoint(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, content string) File {
+		resp := callFilesUploadWithFields(t, app, name, []byte(content), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToFile(t, resp)
+	}
+	v1 := upload("v1.jsonl", `{"p":"a"}
+{"p":"b"}
+{"p":"c"}
+{"p":"d"}
+`)
+	v2 := upload("v2.jsonl", `{"p":"a"}
+{"p":"B"}
+{"p":"c"}
+{"p":"e"}
+{"p":"f"}
+`)
+	binary := upload("model.bin", "\x00\x01\x02")
+
+	diff := func(from, to string, include bool) *http.Response {
+		body, _ := json.Marshal(map[string]interface{}{"from_file_id": from, "to_file_id": to, "include_diff": include})
+		req := httptest.NewRequest(http.MethodPost, "/files/diff", bytes.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	type diffResult struct {
+		Added, Removed, Changed int
+		Diff                    []string
+	}
+
+	t.Run("jsonl files", func(t *testing.T) {
+		resp := diff(v1.ID, v2.ID, true)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var result diffResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, 1, result.Added)
+		assert.Equal(t, 0, result.Removed)
+		assert.Equal(t, 2, result.Changed)
+		assert.Equal(t, []string{
+			` {"p":"a"}`, `-{"p":"b"}`, `+{"p":"B"}`, ` {"p":"c"}`, `-{"p":"d"}`, `+{"p":"e"}`, `+{"p":"f"}`,
+		}, result.Diff)
+	})
+	t.Run("summary only", func(t *testing.T) {
+		resp := diff(v2.ID, v1.ID, false)
+		var result diffResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, 1, result.Removed)
+		assert.Equal(t, 2, result.Changed)
+		assert.Nil(t, result.Diff)
+	})
+	t.Run("identical files", func(t *testing.T) {
+		resp := diff(v1.ID, v1.ID, false)
+		var result diffResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, diffResult{}, result)
+	})
+	t.Run("binary file", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusUnsupportedMediaType, diff(v1.ID, binary.ID, false).StatusCode)
+	})
+}
+
+func TestFilesContentNegotiation(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FilesContentNegotiation = true
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	resp := callFilesUploadWithFields(t, app, "notes.txt", []byte("hello"), map[string]string{"purpose": "fine-tune"})
+	file := responseToFile(t, resp)
+
+	content := func(accept string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+file.ID+"/content", nil)
+		if accept != "" {
+			req.Header.Set(fiber.HeaderAccept, accept)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	for _, accept := range []string{"text/plain", "text/*", "*/*", "application/json;q=0.9, text/plain", ""} {
+		resp := content(accept)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, accept)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get(fiber.HeaderContentType), accept)
+		assert.Equal(t, "hello", bodyToString(resp, t))
+	}
+
+	resp = content("application/json")
+	assert.Equal(t, fiber.StatusNotAcceptable, resp.StatusCode)
+	assert.Contains(t, bodyToString(resp, t), "text/plain")
+
+	// without negotiation the file is served whatever is asked for
+	option.FilesContentNegotiation = false
+	assert.Equal(t, fiber.StatusOK, content("application/json").StatusCode)
+}
+
+func TestUploadHooks(t *testing.T) {
+	app, option, _ := startUpApp()
+
+	var calls []string
+	var created []File
+	option.PreUpload = []options.PreUploadHook{
+		func(ctx context.Context, req schema.UploadRequest) error {
+			calls = append(calls, "first")
+			return nil
+		},
+		func(ctx context.Context, req schema.UploadRequest) error {
+			calls = append(calls, "second")
+			if req.Filename == "forbidden.txt" {
+				return &options.UploadHookError{Status: fiber.StatusForbidden, Message: "forbidden by policy"}
+			}
+			return nil
+		},
+	}
+	option.PostUpload = []options.PostUploadHook{
+		func(ctx context.Context, req schema.UploadRequest, f File) {
+			assert.Equal(t, req.Filename, f.Filename)
+			created = append(created, f)
+		},
+	}
+
+	t.Run("pre-hook aborts the upload", func(t *testing.T) {
+		calls = nil
+		resp, err := CallFilesUploadEndpoint(t, app, "forbidden.txt", "file", "fine-tune", 1, option)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+		apiErr := responseToError(t, resp)
+		assert.Equal(t, "forbidden by policy", apiErr.Message)
+		assert.Equal(t, rejectByHook, apiErr.Code)
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.Empty(t, filterFiles(""))
+		assert.Empty(t, created)
+	})
+	t.Run("post-hook sees the created file", func(t *testing.T) {
+		file := CallFilesUploadEndpointWithCleanup(t, app, "allowed.txt", "file", "fine-tune", 1, option)
+		assert.Len(t, created, 1)
+		assert.Equal(t, file.ID, created[0].ID)
+		assert.Equal(t, "fine-tune", created[0].Purpose)
+	})
+}
+
+func TestUploadSource(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AdminApiKeys = []string{"admin-key"}
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name string) File {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", name)
+		part.Write([]byte("content"))
+		writer.WriteField("purpose", "fine-tune")
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(fiber.HeaderUserAgent, "uploader/1.0")
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer user-key")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		f := responseToFile(t, resp)
+		assert.Nil(t, f.Source)
+		return f
+	}
+	describe := func(id, key string) File {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+id, nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return responseToFile(t, resp)
+	}
+
+	t.Run("captured when enabled", func(t *testing.T) {
+		f := upload("captured.txt")
+
+		described := describe(f.ID, "admin-key")
+		if assert.NotNil(t, described.Source) {
+			assert.Equal(t, "0.0.0.0", described.Source.IP)
+			assert.Equal(t, "uploader/1.0", described.Source.UserAgent)
+			assert.Equal(t, apiKeyID("user-key"), described.Source.APIKeyID)
+			assert.NotContains(t, described.Source.APIKeyID, "user-key")
+		}
+		assert.Nil(t, describe(f.ID, "user-key").Source)
+	})
+	t.Run("absent when disabled", func(t *testing.T) {
+		option.DisableUploadSourceCapture = true
+		t.Cleanup(func() { option.DisableUploadSourceCapture = false })
+
+		f := upload("private.txt")
+		assert.Nil(t, describe(f.ID, "admin-key").Source)
+	})
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	crlf := []byte("{\"a\":1}\r\n{\"a\":2}\r\n")
+	content := func(id string) []byte {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+id+"/content", nil))
+		assert.NoError(t, err)
+		return bodyToByteArray(resp, t)
+	}
+
+	t.Run("preserved when disabled", func(t *testing.T) {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "windows.jsonl", crlf, map[string]string{"purpose": "fine-tune"}))
+		assert.Equal(t, crlf, content(f.ID))
+		assert.Equal(t, len(crlf), f.Bytes)
+		assert.False(t, f.LineEndingsNormalized)
+	})
+	t.Run("converted to LF when enabled", func(t *testing.T) {
+		options.WithNormalizedLineEndings("fine-tune")(option)
+		t.Cleanup(func() { option.NormalizeLineEndings = nil })
+
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "normalized.jsonl", crlf, map[string]string{"purpose": "fine-tune"}))
+		lf := []byte("{\"a\":1}\n{\"a\":2}\n")
+		assert.Equal(t, lf, content(f.ID))
+		assert.Equal(t, len(lf), f.Bytes)
+		assert.True(t, f.LineEndingsNormalized)
+
+		f = responseToFile(t, callFilesUploadWithFields(t, app, "unix.jsonl", lf, map[string]string{"purpose": "fine-tune"}))
+		assert.Equal(t, lf, content(f.ID))
+		assert.False(t, f.LineEndingsNormalized)
+	})
+}
+
+func TestDeniedFilenames(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithDeniedFilenames(".env", "id_rsa*", "*.pem")(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	for _, name := range []string{".env", "config/.env", "ID_RSA.pub", "server.pem"} {
+		resp := callFilesUploadWithFields(t, app, name, []byte("secret"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode, name)
+		assert.Contains(t, bodyToString(resp, t), "not allowed", name)
+	}
+	assert.Empty(t, filterFiles(""))
+
+	resp := callFilesUploadWithFields(t, app, "env.txt", []byte("fine"), map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Len(t, filterFiles(""), 1)
+}
+
+func TestDefaultMetadata(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithDefaultMetadata(map[string]string{"env": "prod", "ingest_version": "3"})(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	t.Run("defaults applied", func(t *testing.T) {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "defaults.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+		assert.Equal(t, map[string]string{"env": "prod", "ingest_version": "3"}, f.Metadata)
+	})
+	t.Run("client values win", func(t *testing.T) {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "override.txt", []byte("content"), map[string]string{
+			"purpose":  "fine-tune",
+			"metadata": `{"env":"staging","team":"ml"}`,
+		}))
+		assert.Equal(t, map[string]string{"env": "staging", "ingest_version": "3", "team": "ml"}, f.Metadata)
+
+		described, err := getFile(f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, f.Metadata, described.Metadata)
+		assert.Equal(t, "prod", option.DefaultMetadata["env"])
+	})
+}
+
+func TestParseAge(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"90m":   90 * time.Minute,
+		"30d":   30 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"1d12h": 36 * time.Hour,
+	} {
+		got, err := parseAge(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "d", "30", "3y", "-1d"} {
+		_, err := parseAge(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestPurgeFiles(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AdminApiKeys = []string{"admin-key"}
+	admin := AdminOnly(option)
+	app.Post("/admin/purge", admin, PurgeFilesEndpoint(nil, option))
+	app.Put("/admin/files/:file_id/hold", admin, LegalHoldEndpoint(nil, option))
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose string, age time.Duration) File {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, name, []byte("content"), map[string]string{"purpose": purpose}))
+		updateUploadedFile(f.ID, func(f *File) { f.CreatedAt = time.Now().Add(-age) })
+		return f
+	}
+	old := upload("old.jsonl", "fine-tune", 40*24*time.Hour)
+	held := upload("held.jsonl", "fine-tune", 40*24*time.Hour)
+	oldOther := upload("other.txt", "assistants", 40*24*time.Hour)
+	recent := upload("recent.jsonl", "fine-tune", time.Hour)
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/files/"+held.ID+"/hold", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer admin-key")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	// the hold is shown like any other file, without where it is stored
+	placed := responseToFile(t, resp)
+	assert.True(t, placed.LegalHold)
+	assert.Empty(t, placed.Path)
+	assert.Empty(t, placed.Storage)
+
+	type purgeResult struct {
+		DryRun  bool     `json:"dry_run"`
+		Matched int      `json:"matched"`
+		Deleted int      `json:"deleted"`
+		Data    []string `json:"data"`
+		Skipped []struct {
+			ID     string `json:"id"`
+			Reason string `json:"reason"`
+		} `json:"skipped"`
+	}
+	purge := func(query string) purgeResult {
+		req := httptest.NewRequest(http.MethodPost, "/admin/purge?"+query, nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer admin-key")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var result purgeResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	t.Run("admin only", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/admin/purge?older_than=30d", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	})
+	t.Run("invalid age", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/purge?older_than=soon", nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer admin-key")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("dry run", func(t *testing.T) {
+		result := purge("older_than=30d&purpose=fine-tune&dry_run=true")
+		assert.True(t, result.DryRun)
+		assert.Equal(t, 2, result.Matched)
+		assert.Equal(t, 0, result.Deleted)
+		assert.Equal(t, []string{old.ID}, result.Data)
+		assert.Len(t, filterFiles(""), 4)
+	})
+	t.Run("held files are skipped", func(t *testing.T) {
+		result := purge("older_than=30d&purpose=fine-tune")
+		assert.Equal(t, 2, result.Matched)
+		assert.Equal(t, 1, result.Deleted)
+		assert.Equal(t, []string{old.ID}, result.Data)
+		if assert.Len(t, result.Skipped, 1) {
+			assert.Equal(t, held.ID, result.Skipped[0].ID)
+			assert.Equal(t, "legal_hold", result.Skipped[0].Reason)
+		}
+
+		var ids []string
+		for _, f := range filterFiles("") {
+			ids = append(ids, f.ID)
+		}
+		assert.ElementsMatch(t, []string{held.ID, oldOther.ID, recent.ID}, ids)
+	})
+	t.Run("held files can't be deleted", func(t *testing.T) {
+		resp, err := CallFilesDeleteEndpoint(t, app, held.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	})
+}
+
+// s3Backend pretends to be an object storage while keeping files locally.
+type s3Backend struct {
+	localBackend
+}
+
+func (s3Backend) Kind() string { return "s3" }
+
+func TestFileStorageField(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AdminApiKeys = []string{"admin-key"}
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	describe := func(id, key, query string) File {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+id+query, nil)
+		if key != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return responseToFile(t, resp)
+	}
+
+	local := responseToFile(t, callFilesUploadWithFields(t, app, "local.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	assert.Empty(t, local.Storage)
+
+	previous := defaultStore.backend
+	defaultStore.backend = s3Backend{}
+	remote := responseToFile(t, callFilesUploadWithFields(t, app, "remote.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	defaultStore.backend = previous
+
+	t.Run("reflects the backend", func(t *testing.T) {
+		assert.Equal(t, "local", describe(local.ID, "admin-key", "?include=storage").Storage)
+		assert.Equal(t, "s3", describe(remote.ID, "admin-key", "?include=storage").Storage)
+	})
+	t.Run("only shown on request", func(t *testing.T) {
+		assert.Empty(t, describe(local.ID, "admin-key", "").Storage)
+	})
+	t.Run("admin only", func(t *testing.T) {
+		assert.Empty(t, describe(local.ID, "", "?include=storage").Storage)
+		assert.Empty(t, describe(local.ID, "user-key", "?include=storage").Storage)
+	})
+}
+
+func TestExtensionlessFilenames(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var img bytes.Buffer
+	assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))))
+
+	download := func(id string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+id+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	for _, policy := range []string{"preserve", "append"} {
+		t.Run(policy, func(t *testing.T) {
+			option.ExtensionlessFilenamePolicy = policy
+			t.Cleanup(func() {
+				option.ExtensionlessFilenamePolicy = ""
+				defaultStore.files = nil
+				os.RemoveAll(option.UploadDir)
+			})
+
+			text := responseToFile(t, callFilesUploadWithFields(t, app, "notes", []byte("plain text"), map[string]string{"purpose": "assistants"}))
+			picture := responseToFile(t, callFilesUploadWithFields(t, app, "picture", img.Bytes(), map[string]string{"purpose": "assistants"}))
+			assert.Equal(t, "notes", text.Filename)
+			assert.Equal(t, "picture", picture.Filename)
+
+			textResp := download(text.ID)
+			assert.Equal(t, "text/plain; charset=utf-8", textResp.Header.Get(fiber.HeaderContentType))
+			pictureResp := download(picture.ID)
+			assert.Equal(t, "image/png", pictureResp.Header.Get(fiber.HeaderContentType))
+
+			if policy == "append" {
+				assert.Equal(t, ".txt", text.Extension)
+				assert.Equal(t, ".png", picture.Extension)
+				assert.Equal(t, `attachment; filename=notes.txt`, textResp.Header.Get(fiber.HeaderContentDisposition))
+				assert.Equal(t, `attachment; filename=picture.png`, pictureResp.Header.Get(fiber.HeaderContentDisposition))
+			} else {
+				assert.Empty(t, text.Extension)
+				assert.Empty(t, picture.Extension)
+				assert.Equal(t, `attachment; filename=notes`, textResp.Header.Get(fiber.HeaderContentDisposition))
+				assert.Equal(t, `attachment; filename=picture`, pictureResp.Header.Get(fiber.HeaderContentDisposition))
+			}
+		})
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithMaxMetadata(2, 8, 16)(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(metadata string) *http.Response {
+		return callFilesUploadWithFields(t, app, "labelled.txt", []byte("x"), map[string]string{
+			"purpose":  "fine-tune",
+			"metadata": metadata,
+		})
+	}
+
+	for name, metadata := range map[string]string{
+		"too many keys":   `{"a":"1","b":"2","c":"3"}`,
+		"oversized value": `{"a":"` + strings.Repeat("v", 17) + `"}`,
+		"oversized key":   `{"` + strings.Repeat("k", 9) + `":"1"}`,
+	} {
+		resp := upload(metadata)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode, name)
+		assert.Contains(t, bodyToString(resp, t), "Invalid metadata", name)
+	}
+	assert.Empty(t, filterFiles(""))
+
+	resp := upload(`{"a":"` + strings.Repeat("v", 16) + `","b":"2"}`)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+}
+
+func TestFilesHealth(t *testing.T) {
+	app, option, _ := startUpApp()
+	app.Get("/healthz", HealthEndpoint(option))
+	app.Get("/readyz", ReadinessEndpoint(option))
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		defaultStore.loadErr = nil
+		os.RemoveAll(option.UploadDir)
+	})
+	probe := func(target string) int {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		var body struct {
+			Status string            `json:"status"`
+			Files  FilesHealthStatus `json:"files"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, body.Status, body.Files.Status)
+		return resp.StatusCode
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		callFilesUploadWithFields(t, app, "healthy.txt", []byte("content"), map[string]string{"purpose": "fine-tune"})
+
+		h := FilesHealth(option)
+		assert.Equal(t, HealthOK, h.Status)
+		assert.Equal(t, fiber.StatusOK, probe("/healthz"))
+		assert.Equal(t, fiber.StatusOK, probe("/readyz"))
+		assert.True(t, h.BackendReachable)
+		assert.True(t, h.IndexLoaded)
+		assert.NotNil(t, h.FreeDiskBytes)
+		assert.Equal(t, 1, h.TotalFiles)
+		assert.Equal(t, int64(len("content")), h.TotalBytes)
+		assert.Empty(t, h.Degraded)
+	})
+	t.Run("degraded conditions", func(t *testing.T) {
+		statfs, writable := diskFree, probeWritable
+		diskFree = func(path string) (uint64, error) { return 1024, nil }
+		probeWritable = func(dir string) error { return syscall.EROFS }
+		option.MinFreeDiskMB = 1
+		option.MaxFiles = 1
+		t.Cleanup(func() {
+			diskFree, probeWritable = statfs, writable
+			option.MinFreeDiskMB = 0
+			option.MaxFiles = 0
+		})
+
+		h := FilesHealth(option)
+		assert.Equal(t, HealthDegraded, h.Status)
+		assert.ElementsMatch(t, []string{degradedReadOnly, degradedDiskLow, degradedFilesNearLimit}, h.Degraded)
+		assert.Equal(t, uint64(1024), *h.FreeDiskBytes)
+	})
+	t.Run("backend unreachable", func(t *testing.T) {
+		previous := defaultStore.backend
+		defaultStore.backend = &flakyBackend{failing: true}
+		t.Cleanup(func() { defaultStore.backend = previous })
+
+		h := FilesHealth(option)
+		assert.Equal(t, HealthUnhealthy, h.Status)
+		assert.False(t, h.BackendReachable)
+		// still alive, only not ready
+		assert.Equal(t, fiber.StatusOK, probe("/healthz"))
+		assert.Equal(t, fiber.StatusServiceUnavailable, probe("/readyz"))
+	})
+	t.Run("index not loaded", func(t *testing.T) {
+		option.IndexLoadFailurePolicy = "empty"
+		t.Cleanup(func() { option.IndexLoadFailurePolicy = "" })
+		assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, "uploadedFiles.json"), []byte("{corrupt"), 0644))
+		LoadUploadConfig(option)
+
+		h := FilesHealth(option)
+		assert.Equal(t, HealthUnhealthy, h.Status)
+		assert.False(t, h.IndexLoaded)
+		assert.NotEmpty(t, h.IndexError)
+	})
+}
+
+func TestIndexLoadFailurePolicy(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		defaultStore.loadErr = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "kept.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	index := filepath.Join(option.UploadDir, uploadIndexFile)
+	corrupt := func(t *testing.T, policy string) {
+		option.IndexLoadFailurePolicy = policy
+		t.Cleanup(func() { option.IndexLoadFailurePolicy = "" })
+		assert.NoError(t, os.WriteFile(index, []byte("{corrupt"), 0644))
+	}
+
+	t.Run("fail-fast", func(t *testing.T) {
+		corrupt(t, "fail-fast")
+		assert.Error(t, LoadUploadConfig(option))
+	})
+	t.Run("empty", func(t *testing.T) {
+		corrupt(t, "empty")
+		assert.NoError(t, LoadUploadConfig(option))
+		assert.Empty(t, filterFiles(""))
+		assert.NotNil(t, defaultStore.loadErr)
+	})
+	t.Run("rebuild", func(t *testing.T) {
+		corrupt(t, "")
+		assert.NoError(t, LoadUploadConfig(option))
+		assert.Nil(t, defaultStore.loadErr)
+
+		files := filterFiles("")
+		if assert.Len(t, files, 1) {
+			assert.Equal(t, "kept.txt", files[0].Filename)
+			assert.Equal(t, f.Bytes, files[0].Bytes)
+		}
+
+		// the rebuilt index is saved, the corrupt one kept aside
+		backups, _ := filepath.Glob(index + ".corrupt-*")
+		assert.Len(t, backups, 1)
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+		assert.Len(t, filterFiles(""), 1)
+	})
+	t.Run("write cut short by a crash", func(t *testing.T) {
+		data, err := os.ReadFile(index)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(index, data[:len(data)/2], 0644))
+
+		option.IndexLoadFailurePolicy = "fail-fast"
+		t.Cleanup(func() { option.IndexLoadFailurePolicy = "" })
+		assert.Error(t, LoadUploadConfig(option))
+
+		option.IndexLoadFailurePolicy = ""
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+		if files := filterFiles(""); assert.Len(t, files, 1) {
+			assert.Equal(t, "kept.txt", files[0].Filename)
+		}
+	})
+	t.Run("first boot", func(t *testing.T) {
+		var logs bytes.Buffer
+		logger := log.Logger
+		log.Logger = zerolog.New(&logs)
+		t.Cleanup(func() { log.Logger = logger })
+
+		assert.NoError(t, os.Remove(index))
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+		assert.Empty(t, filterFiles(""))
+		assert.Nil(t, defaultStore.loadErr)
+		assert.NotContains(t, logs.String(), `"level":"error"`)
+	})
+	t.Run("saves leave no temporary file", func(t *testing.T) {
+		saveUploadConfig(option)
+		leftovers, _ := filepath.Glob(filepath.Join(option.UploadDir, "."+uploadIndexFile+"-*"))
+		assert.Empty(t, leftovers)
+	})
+}
+
+func TestFileAccessLogSampling(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.FileAccessLogSampling = 10
+	app.Get("/sampled/:file_id/content", GetFilesContentsEndpoint(nil, option))
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "popular.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	accesses := func(level string) int {
+		n := 0
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]interface{}
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["message"] == "file content accessed" && entry["level"] == level {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i := 0; i < 200; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/sampled/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	}
+	assert.InDelta(t, 20, accesses("info"), 2)
+
+	for i := 0; i < 5; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/sampled/file-missing/content", nil))
+		assert.NoError(t, err)
+		assert.NotEqual(t, fiber.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, 5, accesses("warn"))
+}
+
+func TestFileMetadataETag(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "cached.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	describe := func(ifNoneMatch string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+f.ID, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set(fiber.HeaderIfNoneMatch, ifNoneMatch)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	resp := describe("")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get(fiber.HeaderETag)
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, f.ID, responseToFile(t, resp).ID)
+
+	t.Run("unchanged", func(t *testing.T) {
+		for _, header := range []string{etag, "W/" + etag, `"other", ` + etag} {
+			resp := describe(header)
+			assert.Equal(t, fiber.StatusNotModified, resp.StatusCode, header)
+			assert.Empty(t, bodyToString(resp, t))
+		}
+	})
+	t.Run("updated", func(t *testing.T) {
+		updateUploadedFile(f.ID, func(f *File) { f.Metadata = map[string]string{"team": "ml"} })
+
+		resp := describe(etag)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get(fiber.HeaderETag))
+		assert.Equal(t, "ml", responseToFile(t, resp).Metadata["team"])
+	})
+}
+
+func TestEphemeralIndex(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.EphemeralIndex = true
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+	index := filepath.Join(option.UploadDir, uploadIndexFile)
+
+	kept := responseToFile(t, callFilesUploadWithFields(t, app, "kept.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	removed := responseToFile(t, callFilesUploadWithFields(t, app, "removed.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	resp, err := CallFilesDeleteEndpoint(t, app, removed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files", nil))
+	assert.NoError(t, err)
+	list := responseToListFile(t, resp)
+	if assert.Len(t, list.Data, 1) {
+		assert.Equal(t, kept.ID, list.Data[0].ID)
+	}
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/"+kept.ID+"/content", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "content", bodyToString(resp, t))
+
+	assert.NoFileExists(t, index)
+
+	// an index left behind by a persistent run is ignored
+	assert.NoError(t, os.WriteFile(index, []byte(`[{"id":"file-old"}]`), 0644))
+	assert.NoError(t, LoadUploadConfig(option))
+	_, err = getFile("file-old")
+	assert.Error(t, err)
+	_, err = getFile(kept.ID)
+	assert.NoError(t, err)
+
+	// and so are the tenant quotas
+	quotas := filepath.Join(option.UploadDir, tenantQuotasFile)
+	t.Cleanup(func() { defaultStore.quotas = map[string]tenantQuota{} })
+	defaultStore.quotas = map[string]tenantQuota{"acme": {MaxFiles: 1}}
+	assert.NoError(t, defaultStore.saveTenantQuotas(option))
+	assert.NoFileExists(t, quotas)
+	assert.NoError(t, os.WriteFile(quotas, []byte(`{"globex":{"max_files":1}}`), 0644))
+	assert.NoError(t, LoadUploadConfig(option))
+	_, ok := defaultStore.tenantQuota("globex")
+	assert.False(t, ok)
+}
+
+func TestBatchUpdateMetadata(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithMaxMetadata(2, 0, 0)(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose, metadata string) File {
+		return responseToFile(t, callFilesUploadWithFields(t, app, name, []byte("content"), map[string]string{"purpose": purpose, "metadata": metadata}))
+	}
+	first := upload("first.jsonl", "fine-tune", `{"team":"ml"}`)
+	second := upload("second.jsonl", "fine-tune", `{"team":"ml","stage":"raw"}`)
+	other := upload("other.txt", "assistants", `{"team":"ml"}`)
+
+	patch := func(body string) (int, BatchResult) {
+		req := httptest.NewRequest(http.MethodPost, "/files/metadata/batch", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		var result BatchResult
+		if resp.StatusCode == fiber.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+	metadata := func(id string) map[string]string {
+		f, err := getFile(id)
+		assert.NoError(t, err)
+		return f.Metadata
+	}
+
+	t.Run("invalid selector", func(t *testing.T) {
+		status, _ := patch(`{"set":{"a":"b"}}`)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+		status, _ = patch(`{"purpose":"fine-tune","file_ids":["x"],"set":{"a":"b"}}`)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+	})
+	t.Run("set a key across a purpose", func(t *testing.T) {
+		status, result := patch(`{"purpose":"fine-tune","set":{"team":"research"}}`)
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Len(t, result.Results, 2)
+		assert.Empty(t, result.Errors)
+		for _, f := range result.Results {
+			assert.Equal(t, "research", f.Metadata["team"])
+		}
+		assert.Equal(t, map[string]string{"team": "research"}, metadata(first.ID))
+		assert.Equal(t, map[string]string{"team": "research", "stage": "raw"}, metadata(second.ID))
+		assert.Equal(t, map[string]string{"team": "ml"}, metadata(other.ID))
+	})
+	t.Run("remove a key", func(t *testing.T) {
+		status, result := patch(`{"file_ids":["` + second.ID + `","file-missing"],"remove":["stage"]}`)
+		assert.Equal(t, fiber.StatusOK, status)
+		if assert.Len(t, result.Results, 1) && assert.Len(t, result.Errors, 1) {
+			assert.Equal(t, second.ID, result.Results[0].ID)
+			assert.Equal(t, "file-missing", result.Errors[0].ID)
+			assert.NotEmpty(t, result.Errors[0].Message)
+		}
+		assert.Equal(t, map[string]string{"team": "research"}, metadata(second.ID))
+	})
+	t.Run("limits enforced per file", func(t *testing.T) {
+		status, result := patch(`{"file_ids":["` + first.ID + `","` + other.ID + `"],"set":{"x":"1"}}`)
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Len(t, result.Results, 2)
+		assert.Empty(t, result.Errors)
+		status, result = patch(`{"file_ids":["` + first.ID + `"],"set":{"y":"2"}}`)
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Empty(t, result.Results)
+		if assert.Len(t, result.Errors, 1) {
+			assert.Contains(t, result.Errors[0].Message, "at most 2")
+		}
+		assert.Equal(t, map[string]string{"team": "research", "x": "1"}, metadata(first.ID))
+	})
+}
+
+// slowBackend stores files locally, reading their content a byte at a time.
+type slowBackend struct {
+	localBackend
+}
+
+func (b slowBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	return b.localBackend.Save(ctx, path, readerFunc(func(p []byte) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return r.Read(p[:1])
+	}))
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestMaxUploadDuration(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.MaxUploadDuration = 100 * time.Millisecond
+	os.MkdirAll(option.UploadDir, 0755)
+	previous := defaultStore.backend
+	defaultStore.backend = slowBackend{}
+	t.Cleanup(func() {
+		defaultStore.backend = previous
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "trickled.txt", bytes.Repeat([]byte("a"), 1000), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusRequestTimeout, resp.StatusCode)
+		assert.Empty(t, filterFiles(""))
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "trickled.txt"))
+	})
+	t.Run("within the limit", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "quick.txt", []byte("a"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", "quick.txt"))
+	})
+}
+
+func TestThumbnailFilesEndpoint(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var img bytes.Buffer
+	assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	picture := responseToFile(t, callFilesUploadWithFields(t, app, "wide.png", img.Bytes(), map[string]string{"purpose": "vision"}))
+	text := responseToFile(t, callFilesUploadWithFields(t, app, "notes.txt", []byte("text"), map[string]string{"purpose": "assistants"}))
+
+	thumbnail := func(id, query string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+id+"/thumbnail"+query, nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("generated", func(t *testing.T) {
+		resp := thumbnail(picture.ID, "?w=128&h=128")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/jpeg", resp.Header.Get(fiber.HeaderContentType))
+		decoded, err := jpeg.Decode(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Pt(128, 64), decoded.Bounds().Size())
+
+		resp = thumbnail(picture.ID, "?w=50&h=100&format=png")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		decoded, err = png.Decode(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Pt(50, 25), decoded.Bounds().Size())
+	})
+	t.Run("cached", func(t *testing.T) {
+		first := bodyToByteArray(thumbnail(picture.ID, "?w=64&h=64"), t)
+		f, err := getFile(picture.ID)
+		assert.NoError(t, err)
+		_, ok := thumbnails.get(thumbnailKey(*f, 64, 64, "jpeg"))
+		assert.True(t, ok)
+		assert.Equal(t, first, bodyToByteArray(thumbnail(picture.ID, "?w=64&h=64"), t))
+	})
+	t.Run("bounded dimensions", func(t *testing.T) {
+		for _, query := range []string{"?w=0", "?h=5000", "?w=abc", "?format=gif"} {
+			assert.Equal(t, fiber.StatusBadRequest, thumbnail(picture.ID, query).StatusCode, query)
+		}
+	})
+	t.Run("not an image", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusUnsupportedMediaType, thumbnail(text.ID, "").StatusCode)
+	})
+	t.Run("too many pixels", func(t *testing.T) {
+		huge := responseToFile(t, callFilesUploadWithFields(t, app, "huge.png", hugePNG(t, 100000, 100000), map[string]string{"purpose": "vision"}))
+		resp := thumbnail(huge.ID, "")
+		assert.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+		assert.Contains(t, responseToError(t, resp).Message, "pixels")
+	})
+}
+
+func TestListFilesPurposeMatching(t *testing.T) {
+	app, option, _ := startUpApp()
+
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "a.jsonl", Purpose: "fine-tune"},
+		{ID: "file-2", Object: "file", Filename: "b.txt", Purpose: "assistants"},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	list := func(purpose string) ListFiles {
+		resp, err := CallListFilesEndpoint(t, app, purpose)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToListFile(t, resp)
+	}
+
+	t.Run("case is ignored by default", func(t *testing.T) {
+		for _, purpose := range []string{"fine-tune", "Fine-Tune", "FINE-TUNE"} {
+			listFiles := list(purpose)
+			if assert.Len(t, listFiles.Data, 1, purpose) {
+				assert.Equal(t, "file-1", listFiles.Data[0].ID)
+			}
+		}
+	})
+	t.Run("strict matching", func(t *testing.T) {
+		option.StrictPurposeMatching = true
+		t.Cleanup(func() { option.StrictPurposeMatching = false })
+
+		assert.Empty(t, list("Fine-Tune").Data)
+		assert.Len(t, list("fine-tune").Data, 1)
+	})
+}
+
+func TestFileURL(t *testing.T) {
+	app, option, _ := startUpApp()
+
+	defaultStore.files = []File{{ID: "file-1", Object: "file", Filename: "a.txt", Purpose: "fine-tune"}}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	get := func() File {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/file-1", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToFile(t, resp)
+	}
+
+	t.Run("omitted without a base URL", func(t *testing.T) {
+		assert.Empty(t, get().URL)
+	})
+	t.Run("built from the base URL", func(t *testing.T) {
+		option.FilesBaseURL = "https://ai.example.com/"
+		t.Cleanup(func() { option.FilesBaseURL = "" })
+
+		assert.Equal(t, "https://ai.example.com/v1/files/file-1/content", get().URL)
+
+		resp, err := CallListFilesEndpoint(t, app, "")
+		assert.NoError(t, err)
+		listFiles := responseToListFile(t, resp)
+		if assert.Len(t, listFiles.Data, 1) {
+			assert.Equal(t, "https://ai.example.com/v1/files/file-1/content", listFiles.Data[0].URL)
+		}
+		assert.Empty(t, defaultStore.files[0].URL)
+	})
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.VerifyOnRead = true
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	resp := callFilesUploadWithFields(t, app, "data.jsonl", []byte(`{"a":1}`), map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	f := responseToFile(t, resp)
+	assert.NotEmpty(t, f.Sha256)
+
+	download := func() *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("intact content is served", func(t *testing.T) {
+		resp := download()
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, `{"a":1}`, bodyToString(resp, t))
+	})
+	t.Run("corrupted content is refused and quarantined", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, "fine-tune", "data.jsonl"), []byte(`{"a":2}`), 0644))
+
+		resp := download()
+		assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "failed integrity verification")
+		assert.Contains(t, logs.String(), "file content failed verification")
+
+		stored, err := getFile(f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fileStatusQuarantined, stored.Status)
+
+		resp = download()
+		assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+		assert.Contains(t, bodyToString(resp, t), "quarantined")
+	})
+}
+
+// memoryBackend keeps files in memory.
+type memoryBackend struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (b *memoryBackend) Kind() string { return "memory" }
+
+func (b *memoryBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.files == nil {
+		b.files = map[string][]byte{}
+	}
+	b.files[path] = content
+	return nil
+}
+
+func (b *memoryBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (b *memoryBackend) Remove(ctx context.Context, path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	delete(b.files, path)
+	return nil
+}
+
+func TestPurposeBackends(t *testing.T) {
+	app, option, _ := startUpApp()
+	vision, archive := &memoryBackend{}, &memoryBackend{}
+	option.PurposeBackends = map[string]options.FileBackend{"vision": vision, "fine-tune": archive}
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		option.PurposeBackends = nil
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose, content string) File {
+		resp := callFilesUploadWithFields(t, app, name, []byte(content), map[string]string{"purpose": purpose})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToFile(t, resp)
+	}
+	download := func(f File) string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return bodyToString(resp, t)
+	}
+
+	image := upload("cat.png", "vision", "not really a png")
+	data := upload("data.jsonl", "fine-tune", `{"a":1}`)
+	other := upload("notes.txt", "assistants", "hello")
+
+	t.Run("save", func(t *testing.T) {
+		assert.Len(t, vision.files, 1)
+		assert.Contains(t, vision.files, filepath.Join(option.UploadDir, "vision", "cat.png"))
+		assert.Len(t, archive.files, 1)
+		assert.Contains(t, archive.files, filepath.Join(option.UploadDir, "fine-tune", "data.jsonl"))
+		assert.FileExists(t, filepath.Join(option.UploadDir, "assistants", "notes.txt"))
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "vision", "cat.png"))
+	})
+	t.Run("get", func(t *testing.T) {
+		assert.Equal(t, "not really a png", download(image))
+		assert.Equal(t, `{"a":1}`, download(data))
+		assert.Equal(t, "hello", download(other))
+	})
+	t.Run("delete", func(t *testing.T) {
+		resp, err := CallFilesDeleteEndpoint(t, app, image.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, vision.files)
+		assert.Len(t, archive.files, 1)
+	})
+}
+
+func TestStorageStats(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.ContentAddressedFiles = true
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		option.ContentAddressedFiles = false
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	stats := func() StorageStats {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/storage-stats", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var s StorageStats
+		assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &s))
+		return s
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		s := stats()
+		assert.Zero(t, s.Files)
+		assert.Equal(t, 1.0, s.DedupRatio)
+	})
+	t.Run("shared content", func(t *testing.T) {
+		shared := bytes.Repeat([]byte("a"), 100)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			resp := callFilesUploadWithFields(t, app, name, shared, map[string]string{"purpose": "fine-tune"})
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		}
+		resp := callFilesUploadWithFields(t, app, "d.txt", bytes.Repeat([]byte("b"), 100), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		s := stats()
+		assert.Equal(t, 4, s.Files)
+		assert.Equal(t, 2, s.UniqueBlobs)
+		assert.Equal(t, int64(400), s.LogicalBytes)
+		assert.Equal(t, int64(200), s.PhysicalBytes)
+		assert.Equal(t, 2.0, s.DedupRatio)
+		assert.Equal(t, map[string]int{defaultShard: 4}, s.Shards)
+	})
+	t.Run("per backend counts", func(t *testing.T) {
+		option.PurposeBackends = map[string]options.FileBackend{"vision": &memoryBackend{}}
+		t.Cleanup(func() { option.PurposeBackends = nil })
+
+		resp := callFilesUploadWithFields(t, app, "cat.png", []byte("image"), map[string]string{"purpose": "vision"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		assert.Equal(t, map[string]int{defaultShard: 4, "vision": 1}, stats().Shards)
+	})
+}
+
+func TestConcurrentUploadsAndDeletes(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	const n = 20
+	var wg sync.WaitGroup
+	ids := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := callFilesUploadWithFields(t, app, fmt.Sprintf("file-%d.txt", i), []byte("content"), map[string]string{"purpose": "fine-tune"})
+			if assert.Equal(t, fiber.StatusOK, resp.StatusCode) {
+				ids <- responseToFile(t, resp).ID
+			}
+		}(i)
+	}
+	// delete every other file while the uploads run
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i += 2 {
+			id := <-ids
+			resp, err := CallFilesDeleteEndpoint(t, app, id)
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		}
+	}()
+	wg.Wait()
+	close(ids)
+
+	assert.Len(t, filterFiles(""), n/2)
+
+	var saved []File
+	content, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(content, &saved))
+	fileIDs := func(files []File) []string {
+		var ids []string
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+	assert.ElementsMatch(t, fileIDs(filterFiles("")), fileIDs(saved))
+}
+
+func TestFileIDsAreUnique(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	names := map[string]string{}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("split-%d.jsonl", i)
+		resp := callFilesUploadWithFields(t, app, name, []byte(`{"a":1}`), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		f := responseToFile(t, resp)
+		assert.Regexp(t, `^file-[0-9a-f]{24}$`, f.ID)
+		assert.NotContains(t, names, f.ID)
+		names[f.ID] = name
+	}
+
+	for id, name := range names {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+id, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, name, responseToFile(t, resp).Filename)
+	}
+}
+
+func TestValidationRetries(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AsyncFileValidation = true
+	option.ValidationRetries = 3
+	option.ValidationRetryBackoff = time.Millisecond
+	os.MkdirAll(option.UploadDir, 0755)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	called := func(purpose string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[purpose]++
+		return calls[purpose]
+	}
+	option.FileValidators = map[string]options.FileValidator{
+		"fine-tune": func(r io.Reader) error {
+			if called("fine-tune") < 3 {
+				return &options.TransientValidationError{Err: errors.New("schema registry unavailable")}
+			}
+			return nil
+		},
+		"assistants": func(r io.Reader) error {
+			called("assistants")
+			return errors.New("missing field")
+		},
+	}
+	t.Cleanup(func() {
+		defaultStore.mu.Lock()
+		defaultStore.files = nil
+		defaultStore.mu.Unlock()
+		os.RemoveAll(option.UploadDir)
+	})
+
+	settled := func(id string) File {
+		var f *File
+		assert.Eventually(t, func() bool {
+			var err error
+			f, err = getFile(id)
+			return err == nil && f.Status != fileStatusProcessing
+		}, 5*time.Second, 5*time.Millisecond)
+		return *f
+	}
+
+	t.Run("transient failure eventually succeeds", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "data.jsonl", []byte(`{"a":1}`), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		f := settled(responseToFile(t, resp).ID)
+		assert.Equal(t, fileStatusProcessed, f.Status)
+		assert.Equal(t, "3", f.Metadata[validationAttemptsMetadataKey])
+		assert.NotContains(t, f.Metadata, validationRetryMetadataKey)
+	})
+	t.Run("permanent failure is not retried", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "notes.txt", []byte("hello"), map[string]string{"purpose": "assistants"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		f := settled(responseToFile(t, resp).ID)
+		assert.Equal(t, fileStatusError, f.Status)
+		assert.Equal(t, "missing field", f.StatusDetails)
+		assert.Equal(t, "1", f.Metadata[validationAttemptsMetadataKey])
+		mu.Lock()
+		assert.Equal(t, 1, calls["assistants"])
+		mu.Unlock()
+	})
+}
+
+func TestDuplicateFilenames(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AllowDuplicateFilenames = true
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		option.AllowDuplicateFilenames = false
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(content string) File {
+		resp := callFilesUploadWithFields(t, app, "data.jsonl", []byte(content), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToFile(t, resp)
+	}
+	download := func(f File) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	first := upload(`{"client":1}`)
+	second := upload(`{"client":2}`)
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.Equal(t, "data.jsonl", second.Filename)
+	assert.Empty(t, second.Path)
+	assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", first.ID+"-data.jsonl"))
+	assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", second.ID+"-data.jsonl"))
+
+	assert.Equal(t, `{"client":1}`, bodyToString(download(first), t))
+	assert.Equal(t, `{"client":2}`, bodyToString(download(second), t))
+
+	resp, err := CallFilesDeleteEndpoint(t, app, first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", first.ID+"-data.jsonl"))
+	_, err = getFile(first.ID)
+	assert.Error(t, err)
+	assert.Equal(t, `{"client":2}`, bodyToString(download(second), t))
+
+	t.Run("rebuilt index keeps the IDs", func(t *testing.T) {
+		files, err := rebuildIndex(option)
+		assert.NoError(t, err)
+		if assert.Len(t, files, 1) {
+			assert.Equal(t, second.ID, files[0].ID)
+			assert.Equal(t, "data.jsonl", files[0].Filename)
+		}
+	})
+}
+
+func TestListFilesAfterCursor(t *testing.T) {
+	app, _, _ := startUpApp()
+
+	now := time.Now()
+	defaultStore.files = []File{
+		{ID: "file-3", Object: "file", Filename: "c.txt", CreatedAt: now.Add(2 * time.Second)},
+		{ID: "file-1", Object: "file", Filename: "a.txt", CreatedAt: now},
+		{ID: "file-2", Object: "file", Filename: "b.txt", CreatedAt: now.Add(time.Second)},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	list := func(target string) (*http.Response, ListFiles) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		return resp, responseToListFile(t, resp)
+	}
+	ids := func(l ListFiles) []string {
+		var ids []string
+		for _, f := range l.Data {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+
+	t.Run("pages in ascending order", func(t *testing.T) {
+		_, page := list("/files?sort=created_at&order=asc&limit=2")
+		assert.Equal(t, []string{"file-1", "file-2"}, ids(page))
+		assert.True(t, page.HasMore)
+		assert.Equal(t, "file-1", page.FirstID)
+		assert.Equal(t, "file-2", page.LastID)
+
+		_, page = list("/files?sort=created_at&order=asc&limit=2&after=" + page.LastID)
+		assert.Equal(t, []string{"file-3"}, ids(page))
+		assert.False(t, page.HasMore)
+		assert.Equal(t, "file-3", page.FirstID)
+		assert.Equal(t, "file-3", page.LastID)
+	})
+	t.Run("pages in descending order", func(t *testing.T) {
+		_, page := list("/files?sort=created_at&order=desc&limit=1&after=file-3")
+		assert.Equal(t, []string{"file-2"}, ids(page))
+		assert.True(t, page.HasMore)
+	})
+	t.Run("last page is empty", func(t *testing.T) {
+		_, page := list("/files?sort=created_at&order=asc&after=file-3")
+		assert.Empty(t, page.Data)
+		assert.False(t, page.HasMore)
+		assert.Empty(t, page.FirstID)
+	})
+	t.Run("unknown cursor is rejected", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files?after=file-404", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("pages of 20 files without a limit", func(t *testing.T) {
+		for i := 4; i <= 25; i++ {
+			defaultStore.files = append(defaultStore.files, File{ID: fmt.Sprintf("file-%d", i), Object: "file", Filename: "d.txt", CreatedAt: now.Add(time.Duration(i) * time.Second)})
+		}
+		_, page := list("/files?sort=created_at&order=asc")
+		assert.Len(t, page.Data, 20)
+		assert.True(t, page.HasMore)
+		assert.Equal(t, "file-20", page.LastID)
+
+		_, page = list("/files?sort=created_at&order=asc&after=" + page.LastID)
+		assert.Equal(t, []string{"file-21", "file-22", "file-23", "file-24", "file-25"}, ids(page))
+		assert.False(t, page.HasMore)
+	})
+}
+
+func TestUploadDeclaredChecksum(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	content := []byte(`{"a":1}`)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	t.Run("matching", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "good.jsonl", content, map[string]string{"purpose": "fine-tune", "checksum": "sha256:" + strings.ToUpper(checksum)})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, checksum, responseToFile(t, resp).Sha256)
+		assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", "good.jsonl"))
+	})
+	t.Run("mismatching", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "bad.jsonl", []byte(`{"a":2}`), map[string]string{"purpose": "fine-tune", "checksum": checksum})
+		assert.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "bad.jsonl"))
+		assert.Len(t, filterFiles(""), 1)
+	})
+	t.Run("malformed", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "bad.jsonl", content, map[string]string{"purpose": "fine-tune", "checksum": "abc"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestListFilesGroupedByPurpose(t *testing.T) {
+	app, _, _ := startUpApp()
+
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "a.jsonl", Purpose: "fine-tune"},
+		{ID: "file-2", Object: "file", Filename: "b.png", Purpose: "vision"},
+		{ID: "file-3", Object: "file", Filename: "c.jsonl", Purpose: "fine-tune"},
+		{ID: "file-4", Object: "file", Filename: "d.txt", Purpose: "assistants"},
+	}
+	t.Cleanup(func() { defaultStore.files = nil })
+
+	type group struct {
+		Count int    `json:"count"`
+		Data  []File `json:"data"`
+	}
+	list := func(target string) (*http.Response, map[string]group, bool) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.NoError(t, err)
+		var grouped struct {
+			Object  string           `json:"object"`
+			Groups  map[string]group `json:"groups"`
+			HasMore bool             `json:"has_more"`
+		}
+		if resp.StatusCode == fiber.StatusOK {
+			assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &grouped))
+			assert.Equal(t, "list", grouped.Object)
+		}
+		return resp, grouped.Groups, grouped.HasMore
+	}
+
+	t.Run("every purpose gets a group", func(t *testing.T) {
+		_, groups, hasMore := list("/files?group_by=purpose")
+		assert.False(t, hasMore)
+		assert.Len(t, groups, 3)
+		assert.Equal(t, 2, groups["fine-tune"].Count)
+		if assert.Len(t, groups["fine-tune"].Data, 2) {
+			assert.Equal(t, "file-1", groups["fine-tune"].Data[0].ID)
+			assert.Equal(t, "file-3", groups["fine-tune"].Data[1].ID)
+		}
+		assert.Equal(t, 1, groups["vision"].Count)
+		assert.Equal(t, 1, groups["assistants"].Count)
+	})
+	t.Run("counts cover every page", func(t *testing.T) {
+		_, groups, hasMore := list("/files?group_by=purpose&limit=2")
+		assert.True(t, hasMore)
+		assert.Equal(t, 2, groups["fine-tune"].Count)
+		assert.Len(t, groups["fine-tune"].Data, 1)
+		assert.Equal(t, 1, groups["assistants"].Count)
+		assert.Empty(t, groups["assistants"].Data)
+	})
+	t.Run("flat by default", func(t *testing.T) {
+		resp, err := CallListFilesEndpoint(t, app, "")
+		assert.NoError(t, err)
+		assert.Len(t, responseToListFile(t, resp).Data, 4)
+	})
+	t.Run("unsupported grouping", func(t *testing.T) {
+		resp, _, _ := list("/files?group_by=tenant")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestPurposeDirectories(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithAllowedPurposes("*")(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(purpose, content string) *http.Response {
+		return callFilesUploadWithFields(t, app, "data.jsonl", []byte(content), map[string]string{"purpose": purpose})
+	}
+	download := func(f File) string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return bodyToString(resp, t)
+	}
+
+	resp := upload("fine-tune", "training")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	fineTune := responseToFile(t, resp)
+	resp = upload("assistants", "knowledge")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assistants := responseToFile(t, resp)
+
+	assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", "data.jsonl"))
+	assert.FileExists(t, filepath.Join(option.UploadDir, "assistants", "data.jsonl"))
+	assert.Equal(t, "training", download(fineTune))
+	assert.Equal(t, "knowledge", download(assistants))
+
+	t.Run("names still clash within a purpose", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusBadRequest, upload("fine-tune", "again").StatusCode)
+	})
+	t.Run("purposes can't escape the upload directory", func(t *testing.T) {
+		resp := upload("../../escape", "outside")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.FileExists(t, filepath.Join(option.UploadDir, "escape", "data.jsonl"))
+		assert.Equal(t, "", purposeDir(".."))
+		assert.Equal(t, "_blobs", purposeDir(blobsDir))
+	})
+	t.Run("index is reloaded", func(t *testing.T) {
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+		reloaded, err := getFile(assistants.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "knowledge", download(*reloaded))
+	})
+	t.Run("delete removes the file of its purpose only", func(t *testing.T) {
+		resp, err := CallFilesDeleteEndpoint(t, app, fineTune.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "data.jsonl"))
+		assert.FileExists(t, filepath.Join(option.UploadDir, "assistants", "data.jsonl"))
+	})
+	t.Run("rebuild recovers purposes", func(t *testing.T) {
+		files, err := rebuildIndex(option)
+		assert.NoError(t, err)
+		purposes := map[string]bool{}
+		for _, f := range files {
+			purposes[f.Purpose] = true
+		}
+		assert.Equal(t, map[string]bool{"assistants": true, "escape": true}, purposes)
+	})
+}
+
+func TestBatchResultEnvelope(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	first := CallFilesUploadEndpointWithCleanup(t, app, "first.txt", "file", "fine-tune", 5, option)
+	held := CallFilesUploadEndpointWithCleanup(t, app, "held.txt", "file", "fine-tune", 5, option)
+	updateUploadedFile(held.ID, func(f *File) { f.LegalHold = true })
+
+	call := func(path, body string) BatchResult {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		data := bodyToByteArray(resp, t)
+
+		var envelope map[string]json.RawMessage
+		assert.NoError(t, json.Unmarshal(data, &envelope))
+		assert.Contains(t, envelope, "results")
+		assert.Contains(t, envelope, "errors")
+
+		var result BatchResult
+		assert.NoError(t, json.Unmarshal(data, &result))
+		return result
+	}
+	ids := `{"file_ids":["` + first.ID + `","file-missing","` + held.ID + `"]}`
+
+	t.Run("get", func(t *testing.T) {
+		result := call("/files/retrieve/batch", ids)
+		assert.Len(t, result.Results, 2)
+		if assert.Len(t, result.Errors, 1) {
+			assert.Equal(t, "file-missing", result.Errors[0].ID)
+			assert.Equal(t, codeFileNotFound, result.Errors[0].Reason)
+		}
+	})
+	t.Run("metadata update", func(t *testing.T) {
+		result := call("/files/metadata/batch", `{"file_ids":["`+first.ID+`","file-missing"],"set":{"a":"b"}}`)
+		if assert.Len(t, result.Results, 1) {
+			assert.Equal(t, map[string]string{"a": "b"}, result.Results[0].Metadata)
+		}
+		if assert.Len(t, result.Errors, 1) {
+			assert.Equal(t, codeFileNotFound, result.Errors[0].Reason)
+		}
+	})
+	t.Run("delete", func(t *testing.T) {
+		result := call("/files/delete/batch", ids)
+		if assert.Len(t, result.Results, 1) {
+			assert.Equal(t, first.ID, result.Results[0].ID)
+		}
+		if assert.Len(t, result.Errors, 2) {
+			assert.Equal(t, "file-missing", result.Errors[0].ID)
+			assert.Equal(t, held.ID, result.Errors[1].ID)
+			assert.Equal(t, errFileOnHold.Error(), result.Errors[1].Message)
+			assert.Equal(t, codeFileOnHold, result.Errors[1].Reason)
+		}
+		_, err := getFile(first.ID)
+		assert.Error(t, err)
+		_, err = getFile(held.ID)
+		assert.NoError(t, err)
+	})
+	t.Run("empty selection", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/files/delete/batch", strings.NewReader(`{}`))
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestCreatedAtIsUnixSeconds(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	createdAt := func(data []byte) json.RawMessage {
+		var raw map[string]json.RawMessage
+		assert.NoError(t, json.Unmarshal(data, &raw))
+		return raw["created_at"]
+	}
+
+	resp := callFilesUploadWithFields(t, app, "epoch.jsonl", []byte(`{"a":1}`), map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	uploaded := bodyToByteArray(resp, t)
+	epoch := createdAt(uploaded)
+	seconds, err := strconv.ParseInt(string(epoch), 10, 64)
+	assert.NoError(t, err, string(epoch))
+	assert.InDelta(t, time.Now().Unix(), seconds, 5)
+
+	var f File
+	assert.NoError(t, json.Unmarshal(uploaded, &f))
+
+	t.Run("stable across a reload", func(t *testing.T) {
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, epoch, createdAt(bodyToByteArray(resp, t)))
+
+		resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files", nil))
+		assert.NoError(t, err)
+		var list struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		if assert.Len(t, list.Data, 1) {
+			assert.Equal(t, epoch, createdAt(list.Data[0]))
+		}
+	})
+	t.Run("older RFC 3339 indexes are read", func(t *testing.T) {
+		legacy := `[{"id":"` + f.ID + `","object":"file","bytes":7,"created_at":"2024-01-02T15:04:05Z","filename":"epoch.jsonl","purpose":"fine-tune","path":"fine-tune/epoch.jsonl"}]`
+		assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, uploadIndexFile), []byte(legacy), 0644))
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, json.RawMessage("1704207845"), createdAt(bodyToByteArray(resp, t)))
+	})
+}
+
+func TestFileContentRange(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	resp := callFilesUploadWithFields(t, app, "alphabet.txt", content, map[string]string{"purpose": "fine-tune"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	f := responseToFile(t, resp)
+
+	get := func(rangeHeader string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil)
+		if rangeHeader != "" {
+			req.Header.Set(fiber.HeaderRange, rangeHeader)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("whole content", func(t *testing.T) {
+		resp := get("")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1000", resp.Header.Get(fiber.HeaderContentLength))
+		assert.Equal(t, "bytes", resp.Header.Get(fiber.HeaderAcceptRanges))
+		assert.Equal(t, `attachment; filename=alphabet.txt`, resp.Header.Get(fiber.HeaderContentDisposition))
+		assert.Equal(t, content, bodyToByteArray(resp, t))
+	})
+	t.Run("partial content", func(t *testing.T) {
+		resp := get("bytes=100-199")
+		assert.Equal(t, fiber.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "100", resp.Header.Get(fiber.HeaderContentLength))
+		assert.Equal(t, "bytes 100-199/1000", resp.Header.Get(fiber.HeaderContentRange))
+		assert.Equal(t, content[100:200], bodyToByteArray(resp, t))
+	})
+	t.Run("suffix", func(t *testing.T) {
+		resp := get("bytes=-10")
+		assert.Equal(t, fiber.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, content[990:], bodyToByteArray(resp, t))
+	})
+	t.Run("unsatisfiable", func(t *testing.T) {
+		resp := get("bytes=2000-")
+		assert.Equal(t, fiber.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		assert.Equal(t, "bytes */1000", resp.Header.Get(fiber.HeaderContentRange))
+	})
+	t.Run("multiple ranges send everything", func(t *testing.T) {
+		resp := get("bytes=0-1,5-6")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, bodyToByteArray(resp, t))
+	})
+	t.Run("verified content", func(t *testing.T) {
+		option.VerifyOnRead = true
+		t.Cleanup(func() { option.VerifyOnRead = false })
+		resp := get("bytes=100-199")
+		assert.Equal(t, fiber.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, content[100:200], bodyToByteArray(resp, t))
+	})
+}
+
+func TestMaxConcurrentFileDownloads(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithMaxConcurrentFileDownloads(1)(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	popular := responseToFile(t, callFilesUploadWithFields(t, app, "popular.txt", []byte("popular"), map[string]string{"purpose": "fine-tune"}))
+	quiet := responseToFile(t, callFilesUploadWithFields(t, app, "quiet.txt", []byte("quiet"), map[string]string{"purpose": "fine-tune"}))
+	download := func(f File) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("downloads end their slot", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			resp := download(popular)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+			assert.Equal(t, "popular", bodyToString(resp, t))
+		}
+	})
+	t.Run("a saturated file doesn't hold the others up", func(t *testing.T) {
+		// a download of popular is running
+		release, ok := downloads.acquire(popular.ID, option.MaxConcurrentFileDownloads)
+		assert.True(t, ok)
+
+		resp := download(popular)
+		assert.Equal(t, fiber.StatusServiceUnavailable, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+
+		resp = download(quiet)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "quiet", bodyToString(resp, t))
+
+		release()
+		release()
+		assert.Equal(t, fiber.StatusOK, download(popular).StatusCode)
+	})
+	t.Run("idle files are forgotten", func(t *testing.T) {
+		downloads.mu.Lock()
+		defer downloads.mu.Unlock()
+		assert.Empty(t, downloads.running)
+	})
+}
+
+func TestUploadContentType(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, declared string, content []byte) File {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		header.Set(fiber.HeaderContentType, declared)
+		part, _ := writer.CreatePart(header)
+		part.Write(content)
+		writer.WriteField("purpose", "assistants")
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return responseToFile(t, resp)
+	}
+
+	var encoded bytes.Buffer
+	assert.NoError(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+	picture := upload("picture", "application/octet-stream", encoded.Bytes())
+	text := upload("notes.txt", "application/octet-stream", []byte("some notes"))
+	declared := upload("model.bin", "application/x-custom", []byte{0x00, 0x01, 0x02, 0xff})
+
+	t.Run("sniffed", func(t *testing.T) {
+		assert.Equal(t, "image/png", picture.ContentType)
+		assert.Equal(t, "text/plain; charset=utf-8", text.ContentType)
+		assert.Equal(t, fileStatusProcessed, picture.Status)
+	})
+	t.Run("declared when sniffing can't tell", func(t *testing.T) {
+		assert.Equal(t, "application/x-custom", declared.ContentType)
+	})
+	t.Run("persisted and listed", func(t *testing.T) {
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+picture.ID, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, "image/png", responseToFile(t, resp).ContentType)
+
+		types := map[string]string{}
+		resp, err = CallListFilesEndpoint(t, app, "")
+		assert.NoError(t, err)
+		for _, f := range responseToListFile(t, resp).Data {
+			types[f.ID] = f.ContentType
+		}
+		assert.Equal(t, map[string]string{picture.ID: "image/png", text.ID: "text/plain; charset=utf-8", declared.ID: "application/x-custom"}, types)
+	})
+	t.Run("older indexes default to processed", func(t *testing.T) {
+		legacy := `[{"id":"file-legacy","object":"file","bytes":7,"created_at":1704207845,"filename":"old.txt","purpose":"assistants"}]`
+		assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, uploadIndexFile), []byte(legacy), 0644))
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+
+		f, err := getFile("file-legacy")
+		assert.NoError(t, err)
+		assert.Equal(t, fileStatusProcessed, f.Status)
+		assert.Empty(t, f.ContentType)
+	})
+}
+
+func TestFileErrorCodes(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	stored := CallFilesUploadEndpointWithCleanup(t, app, "stored.txt", "file", "fine-tune", 1, option)
+	held := CallFilesUploadEndpointWithCleanup(t, app, "held.txt", "file", "fine-tune", 1, option)
+	updateUploadedFile(held.ID, func(f *File) { f.LegalHold = true })
+	t.Cleanup(func() { updateUploadedFile(held.ID, func(f *File) { f.LegalHold = false }) })
+	quarantined := CallFilesUploadEndpointWithCleanup(t, app, "quarantined.txt", "file", "fine-tune", 1, option)
+	updateUploadedFile(quarantined.ID, func(f *File) { f.Status = fileStatusQuarantined })
+
+	get := func(target string) func() (*http.Response, error) {
+		return func() (*http.Response, error) { return app.Test(httptest.NewRequest(http.MethodGet, target, nil)) }
+	}
+	for _, tc := range []struct {
+		name   string
+		call   func() (*http.Response, error)
+		status int
+		code   string
+	}{
+		{"missing purpose", func() (*http.Response, error) {
+			return CallFilesUploadEndpoint(t, app, "nopurpose.txt", "file", "", 1, option)
+		}, fiber.StatusBadRequest, rejectMissingPurpose},
+		{"too large", func() (*http.Response, error) {
+			return CallFilesUploadEndpoint(t, app, "large.txt", "file", "fine-tune", 11, option)
+		}, fiber.StatusBadRequest, rejectTooLarge},
+		{"already exists", func() (*http.Response, error) {
+			return CallFilesUploadEndpoint(t, app, "stored.txt", "file", "fine-tune", 1, option)
+		}, fiber.StatusBadRequest, rejectFileExists},
+		{"missing file", func() (*http.Response, error) {
+			return CallFilesUploadEndpoint(t, app, "missing.txt", "not-a-file", "fine-tune", 1, option)
+		}, fiber.StatusBadRequest, rejectMissingFile},
+		{"retrieve unknown file", get("/files/file-missing"), fiber.StatusNotFound, codeFileNotFound},
+		{"content of an unknown file", get("/files/file-missing/content"), fiber.StatusNotFound, codeFileNotFound},
+		{"convert unknown file", get("/files/file-missing/convert?to=csv"), fiber.StatusNotFound, codeFileNotFound},
+		{"delete unknown file", func() (*http.Response, error) {
+			return CallFilesDeleteEndpoint(t, app, "file-missing")
+		}, fiber.StatusNotFound, codeFileNotFound},
+		{"storage failure", func() (*http.Response, error) {
+			previous := defaultStore.backend
+			defaultStore.backend = &flakyBackend{failing: true}
+			defer func() { defaultStore.backend = previous }()
+			return CallFilesUploadEndpoint(t, app, "failing.txt", "file", "fine-tune", 1, option)
+		}, fiber.StatusInternalServerError, codeInternalError},
+		{"delete held file", func() (*http.Response, error) {
+			return CallFilesDeleteEndpoint(t, app, held.ID)
+		}, fiber.StatusConflict, codeFileOnHold},
+		{"quarantined content", get("/files/" + quarantined.ID + "/content"), fiber.StatusInternalServerError, codeFileQuarantined},
+		{"invalid limit", get("/files?limit=x"), fiber.StatusBadRequest, codeInvalidRequest},
+		{"unsatisfiable range", func() (*http.Response, error) {
+			req := httptest.NewRequest(http.MethodGet, "/files/"+stored.ID+"/content", nil)
+			req.Header.Set(fiber.HeaderRange, "bytes=1000000000-")
+			return app.Test(req)
+		}, fiber.StatusRequestedRangeNotSatisfiable, codeRangeNotSatisfiable},
+		{"unsupported conversion", get("/files/" + stored.ID + "/convert?to=png"), fiber.StatusUnsupportedMediaType, codeUnsupportedMediaType},
+		{"invalid archive", func() (*http.Response, error) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("file", "archive.zip")
+			part.Write([]byte("not a zip"))
+			writer.Close()
+			req := httptest.NewRequest(http.MethodPost, "/files/import", body)
+			req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+			return app.Test(req)
+		}, fiber.StatusBadRequest, codeInvalidArchive},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := tc.call()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, resp.StatusCode)
+			apiErr := responseToError(t, resp)
+			assert.Equal(t, tc.code, apiErr.Code)
+			assert.NotEmpty(t, apiErr.Message)
+			if tc.status >= fiber.StatusInternalServerError {
+				assert.Equal(t, "server_error", apiErr.Type)
+			} else {
+				assert.Equal(t, "invalid_request_error", apiErr.Type)
+			}
+		})
+	}
+}
+
+func TestUploadPreallocation(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.EnableUploadPreallocation(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	previous := preallocate
+	t.Cleanup(func() {
+		preallocate = previous
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var reserved []int64
+	spy := func(fail error) func(f *os.File, size int64) error {
+		return func(f *os.File, size int64) error {
+			reserved = append(reserved, size)
+			if fail != nil {
+				return fail
+			}
+			return previous(f, size)
+		}
+	}
+
+	t.Run("reserves the declared size and truncates to the content", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("preallocation is only supported on Linux")
+		}
+		reserved = nil
+		preallocate = spy(nil)
+		path := filepath.Join(option.UploadDir, "reserved.bin")
+		assert.NoError(t, localBackend{}.Save(withPreallocation(context.Background(), 1<<20), path, strings.NewReader("short")))
+		assert.Equal(t, []int64{1 << 20}, reserved)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "short", string(content))
+	})
+	t.Run("uploads reserve their size", func(t *testing.T) {
+		reserved = nil
+		preallocate = spy(nil)
+		resp := callFilesUploadWithFields(t, app, "upload.txt", []byte("uploaded"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, []int64{8}, reserved)
+		content, err := os.ReadFile(filepath.Join(option.UploadDir, "fine-tune", "upload.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "uploaded", string(content))
+	})
+	t.Run("falls back when unsupported", func(t *testing.T) {
+		preallocate = spy(errPreallocationUnsupported)
+		resp := callFilesUploadWithFields(t, app, "fallback.txt", []byte("fallback"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		content, err := os.ReadFile(filepath.Join(option.UploadDir, "fine-tune", "fallback.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fallback", string(content))
+	})
+	t.Run("fails fast when the disk is full", func(t *testing.T) {
+		preallocate = spy(syscall.ENOSPC)
+		resp := callFilesUploadWithFields(t, app, "full.txt", []byte("full"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusInsufficientStorage, resp.StatusCode)
+		assert.Equal(t, rejectDiskFull, responseToError(t, resp).Code)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "full.txt"))
+	})
+}
+
+func TestFilesReport(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	created := time.Now().Add(-time.Hour)
+	defaultStore.files = []File{
+		{ID: "file-1", Object: "file", Filename: "train.jsonl", Purpose: "fine-tune", Bytes: 10, CreatedAt: created, Sha256: "abc", Status: fileStatusProcessed, ContentType: "text/plain; charset=utf-8", Metadata: map[string]string{"team": "ml"}},
+		{ID: "file-2", Object: "file", Filename: "doc.pdf", Purpose: "assistants", Bytes: 20, CreatedAt: created, Tenant: "acme", LegalHold: true},
+	}
+	report := func(format string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/report?format="+format, nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		resp := report("csv")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get(fiber.HeaderContentType))
+		rows, err := csv.NewReader(resp.Body).ReadAll()
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 3) {
+			assert.Equal(t, []string{"id", "filename", "purpose", "bytes", "created_at", "age_seconds", "sha256", "status", "content_type", "tenant", "legal_hold", "metadata"}, rows[0])
+			assert.Equal(t, []string{"file-1", "train.jsonl", "fine-tune", "10", created.UTC().Format(time.RFC3339)}, rows[1][:5])
+			age, err := strconv.Atoi(rows[1][5])
+			assert.NoError(t, err)
+			assert.InDelta(t, 3600, age, 5)
+			assert.Equal(t, []string{"abc", "processed", "text/plain; charset=utf-8", "", "false", `{"team":"ml"}`}, rows[1][6:])
+			assert.Equal(t, []string{"acme", "true", ""}, rows[2][9:])
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		resp := report("json")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var body struct {
+			Object      string                   `json:"object"`
+			GeneratedAt int64                    `json:"generated_at"`
+			Data        []map[string]interface{} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "file.report", body.Object)
+		assert.InDelta(t, time.Now().Unix(), body.GeneratedAt, 5)
+		if assert.Len(t, body.Data, 2) {
+			entry := body.Data[0]
+			assert.Len(t, entry, len(reportColumns))
+			for _, column := range reportColumns {
+				assert.Contains(t, entry, column)
+			}
+			assert.Equal(t, "file-1", entry["id"])
+			assert.Equal(t, float64(created.Unix()), entry["created_at"])
+			assert.Equal(t, map[string]interface{}{"team": "ml"}, entry["metadata"])
+			assert.Equal(t, true, body.Data[1]["legal_hold"])
+		}
+	})
+	t.Run("empty store", func(t *testing.T) {
+		files := defaultStore.files
+		defaultStore.files = nil
+		t.Cleanup(func() { defaultStore.files = files })
+		assert.Contains(t, bodyToString(report("json"), t), `"data":[]}`)
+	})
+	t.Run("unsupported format", func(t *testing.T) {
+		resp := report("xml")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, codeInvalidRequest, responseToError(t, resp).Code)
+	})
+}
+
+func TestFineTuneValidation(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.EnableFineTuneValidation(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose, content string) *http.Response {
+		return callFilesUploadWithFields(t, app, name, []byte(content), map[string]string{"purpose": purpose})
+	}
+
+	t.Run("clean file", func(t *testing.T) {
+		content := `{"prompt":"a","completion":"b"}` + "\n\n" +
+			`{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"}]}` + "\n"
+		resp := upload("clean.jsonl", "fine-tune", content)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, bodyToString(resp, t))
+		stored, err := os.ReadFile(filepath.Join(option.UploadDir, "fine-tune", "clean.jsonl"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(stored))
+	})
+	t.Run("broken lines", func(t *testing.T) {
+		for name, tc := range map[string]struct{ content, message string }{
+			"invalid JSON":         {`{"prompt":"a","completion":"b"}` + "\n" + `{"prompt":` + "\n", "line 2: invalid JSON"},
+			"missing completion":   {`{"prompt":"a","completion":"b"}` + "\n\n" + `{"prompt":"a"}`, "line 3: expected prompt and completion, or messages"},
+			"empty messages":       {`{"messages":[]}`, "line 1: messages is empty"},
+			"message without role": {`{"messages":[{"content":"hi"}]}`, "line 1: message 0 must have a role and a content"},
+			"no examples":          {"\n\n", "no training examples"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp := upload("broken.jsonl", "fine-tune", tc.content)
+				assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+				apiErr := responseToError(t, resp)
+				assert.Equal(t, codeValidationFailed, apiErr.Code)
+				assert.Contains(t, apiErr.Message, tc.message)
+				assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "broken.jsonl"))
+			})
+		}
+	})
+	t.Run("other purposes skip validation", func(t *testing.T) {
+		resp := upload("notes.txt", "assistants", "not JSON at all")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, bodyToString(resp, t))
+	})
+	t.Run("disabled by default", func(t *testing.T) {
+		option.ValidateFineTuneFiles = false
+		t.Cleanup(func() { option.ValidateFineTuneFiles = true })
+		resp := upload("passthrough.jsonl", "fine-tune", "not JSON at all")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, bodyToString(resp, t))
+	})
+}
+
+func TestCrossPurposeDuplicates(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose, content string) *http.Response {
+		return callFilesUploadWithFields(t, app, name, []byte(content), map[string]string{"purpose": purpose})
+	}
+
+	t.Run("allowed by default", func(t *testing.T) {
+		defaultStore.files = nil
+		assert.Equal(t, fiber.StatusOK, upload("a.txt", "fine-tune", "shared").StatusCode)
+		resp := upload("b.txt", "assistants", "shared")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(duplicateFileIDHeader))
+	})
+	t.Run("warn", func(t *testing.T) {
+		defaultStore.files = nil
+		options.WithCrossPurposeDuplicatePolicy("warn")(option)
+		t.Cleanup(func() { option.CrossPurposeDuplicatePolicy = "" })
+
+		first := responseToFile(t, upload("warn.txt", "fine-tune", "warned"))
+		resp := upload("warn.txt", "assistants", "warned")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, first.ID, resp.Header.Get(duplicateFileIDHeader))
+		assert.Equal(t, "fine-tune", resp.Header.Get(duplicateFilePurposeHeader))
+		assert.Len(t, defaultStore.files, 2)
+
+		// the same purpose is not a cross purpose duplicate
+		resp = upload("again.txt", "fine-tune", "other content")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(duplicateFileIDHeader))
+	})
+	t.Run("block", func(t *testing.T) {
+		defaultStore.files = nil
+		options.WithCrossPurposeDuplicatePolicy("block")(option)
+		t.Cleanup(func() { option.CrossPurposeDuplicatePolicy = "" })
+
+		first := responseToFile(t, upload("block.txt", "fine-tune", "blocked"))
+		resp := upload("block.txt", "assistants", "blocked")
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+		assert.Equal(t, first.ID, resp.Header.Get(duplicateFileIDHeader))
+		assert.Equal(t, "fine-tune", resp.Header.Get(duplicateFilePurposeHeader))
+		assert.Equal(t, rejectDuplicate, responseToError(t, resp).Code)
+		assert.Len(t, defaultStore.files, 1)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "assistants", "block.txt"))
+
+		resp = upload("other.txt", "assistants", "different")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(duplicateFileIDHeader))
+	})
+}
+
+func TestUploadOverwrite(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	first := responseToFile(t, callFilesUploadWithFields(t, app, "dataset.jsonl", []byte("first"), map[string]string{"purpose": "fine-tune"}))
+	path := filepath.Join(option.UploadDir, "fine-tune", "dataset.jsonl")
+
+	t.Run("rejected without the flag", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "dataset.jsonl", []byte("second"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectFileExists, responseToError(t, resp).Code)
+		assert.Len(t, defaultStore.files, 1)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(content))
+	})
+	t.Run("overwrite form value", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond)
+		resp := callFilesUploadWithFields(t, app, "dataset.jsonl", []byte("second version"), map[string]string{"purpose": "fine-tune", "overwrite": "true"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		replaced := responseToFile(t, resp)
+		assert.Equal(t, first.ID, replaced.ID)
+		assert.Equal(t, len("second version"), replaced.Bytes)
+
+		assert.Len(t, defaultStore.files, 1)
+		indexed, err := getFile(first.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, len("second version"), indexed.Bytes)
+		assert.True(t, indexed.CreatedAt.After(first.CreatedAt))
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "second version", string(content))
+	})
+	t.Run("overwrite header", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "dataset.jsonl")
+		part.Write([]byte("third"))
+		writer.WriteField("purpose", "fine-tune")
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set("X-Overwrite", "true")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, defaultStore.files, 1)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "third", string(content))
+	})
+	t.Run("files on legal hold are kept", func(t *testing.T) {
+		updateUploadedFile(first.ID, func(f *File) { f.LegalHold = true })
+		t.Cleanup(func() { updateUploadedFile(first.ID, func(f *File) { f.LegalHold = false }) })
+		resp := callFilesUploadWithFields(t, app, "dataset.jsonl", []byte("fourth"), map[string]string{"purpose": "fine-tune", "overwrite": "true"})
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+		assert.Equal(t, codeFileOnHold, responseToError(t, resp).Code)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "third", string(content))
+	})
+}
+
+func TestFilesBackendOption(t *testing.T) {
+	app, option, _ := startUpApp()
+	backend := &memoryBackend{}
+	options.WithFilesBackend(backend)(option)
+	previous := defaultStore.backend
+	ConfigureFilesBackend(option)
+	t.Cleanup(func() {
+		defaultStore.backend = previous
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "remote.jsonl", []byte("remote content"), map[string]string{"purpose": "fine-tune"}))
+	stored := filepath.Join(option.UploadDir, "fine-tune", "remote.jsonl")
+	index := filepath.Join(option.UploadDir, uploadIndexFile)
+
+	t.Run("files and index are saved through the backend", func(t *testing.T) {
+		assert.Equal(t, []byte("remote content"), backend.files[stored])
+		assert.Contains(t, string(backend.files[index]), f.ID)
+		assert.NoFileExists(t, stored)
+		assert.NoFileExists(t, index)
+	})
+	t.Run("content is read from the backend", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, "remote content", bodyToString(resp, t))
+	})
+	t.Run("the index is loaded from the backend", func(t *testing.T) {
+		defaultStore.files = nil
+		assert.NoError(t, LoadUploadConfig(option))
+		loaded, err := getFile(f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "remote.jsonl", loaded.Filename)
+	})
+	t.Run("names clash with the files of the backend", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "remote.jsonl", []byte("other content"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectFileExists, responseToError(t, resp).Code)
+		assert.Equal(t, []byte("remote content"), backend.files[stored])
+		assert.Len(t, defaultStore.files, 1)
+	})
+	t.Run("deletes go through the backend", func(t *testing.T) {
+		resp, err := CallFilesDeleteEndpoint(t, app, f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotContains(t, backend.files, stored)
+		assert.NotContains(t, string(backend.files[index]), f.ID)
+	})
+	t.Run("tenant quotas are saved through the backend", func(t *testing.T) {
+		option.AdminApiKeys = []string{"admin-key"}
+		app.Put("/admin/tenants/:tenant_id/quota", AdminOnly(option), SetTenantQuotaEndpoint(nil, option))
+		t.Cleanup(func() {
+			defaultStore.quotas = map[string]tenantQuota{}
+		})
+
+		req := httptest.NewRequest(http.MethodPut, "/admin/tenants/acme/quota", strings.NewReader(`{"max_files":3}`))
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer admin-key")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		quotas := filepath.Join(option.UploadDir, tenantQuotasFile)
+		assert.Contains(t, string(backend.files[quotas]), "acme")
+		assert.NoFileExists(t, quotas)
+
+		defaultStore.quotas = map[string]tenantQuota{}
+		assert.NoError(t, LoadUploadConfig(option))
+		q, ok := defaultStore.tenantQuota("acme")
+		assert.True(t, ok)
+		assert.Equal(t, 3, q.MaxFiles)
+	})
+	t.Run("a missing index is a first boot", func(t *testing.T) {
+		defaultStore.files = nil
+		empty := &memoryBackend{}
+		defaultStore.backend = empty
+		assert.NoError(t, LoadUploadConfig(option))
+		assert.Empty(t, defaultStore.files)
+	})
+}
+
+func TestUploadSizeMetric(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithAllowedPurposes("*")(option)
+	option.Metrics = setupTestMetrics(t)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	// cumulative bucket counts of the uploads of purpose with outcome
+	buckets := func(purpose, outcome string) (map[float64]uint64, uint64) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "files_upload_size_bytes" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["purpose"] != purpose || labels["outcome"] != outcome {
+					continue
+				}
+				counts := map[float64]uint64{}
+				for _, b := range m.GetHistogram().GetBucket() {
+					counts[b.GetUpperBound()] = b.GetCumulativeCount()
+				}
+				return counts, m.GetHistogram().GetSampleCount()
+			}
+		}
+		return nil, 0
+	}
+
+	for name, size := range map[string]int{"small.txt": 100, "medium.txt": 2 << 20, "large.txt": 5 << 20} {
+		resp := callFilesUploadWithFields(t, app, name, bytes.Repeat([]byte("a"), size), map[string]string{"purpose": "size-metrics"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	}
+	resp := callFilesUploadWithFields(t, app, "huge.txt", bytes.Repeat([]byte("a"), 11<<20), map[string]string{"purpose": "size-metrics"})
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	accepted, count := buckets("size-metrics", uploadAccepted)
+	assert.Equal(t, uint64(3), count)
+	assert.Equal(t, map[float64]uint64{1 << 20: 1, 10 << 20: 3, 100 << 20: 3, 1 << 30: 3}, accepted)
+
+	rejected, count := buckets("size-metrics", uploadRejected)
+	assert.Equal(t, uint64(1), count)
+	assert.Equal(t, map[float64]uint64{1 << 20: 0, 10 << 20: 0, 100 << 20: 1, 1 << 30: 1}, rejected)
+}
+
+func TestReloadFilesIndex(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.AdminApiKeys = []string{"admin-key"}
+	app.Post("/admin/files/reload", AdminOnly(option), ReloadFilesIndexEndpoint(nil, option))
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	reload := func(key string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/admin/files/reload", nil)
+		if key != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	kept := responseToFile(t, callFilesUploadWithFields(t, app, "kept.txt", []byte("kept"), map[string]string{"purpose": "fine-tune"}))
+	dropped := responseToFile(t, callFilesUploadWithFields(t, app, "dropped.txt", []byte("dropped"), map[string]string{"purpose": "fine-tune"}))
+
+	// restore an index holding the first file, relabeled, and a new one
+	var restored []File
+	data, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &restored))
+	restored = restored[:1]
+	restored[0].Metadata = map[string]string{"restored": "true"}
+	restored = append(restored, File{ID: "file-restored", Object: "file", Filename: "restored.txt", Purpose: "fine-tune", Bytes: 8, CreatedAt: time.Now(), Status: fileStatusProcessed})
+	data, err = json.Marshal(restored)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, uploadIndexFile), data, 0644))
+
+	t.Run("admin only", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusForbidden, reload("").StatusCode)
+		assert.Len(t, defaultStore.files, 2)
+	})
+	t.Run("reflects the index on disk", func(t *testing.T) {
+		resp := reload("admin-key")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `{"object":"file.index_reload","previous_files":2,"files":2}`, bodyToString(resp, t))
+
+		f, err := getFile(kept.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"restored": "true"}, f.Metadata)
+		_, err = getFile("file-restored")
+		assert.NoError(t, err)
+		_, err = getFile(dropped.ID)
+		assert.Error(t, err)
+
+		resp, err = CallListFilesEndpoint(t, app, "fine-tune")
+		assert.NoError(t, err)
+		assert.Len(t, responseToListFile(t, resp).Data, 2)
+	})
+}
+
+func TestFileExpiration(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		// the background reaper may still be looking at the index
+		defaultStore.mu.Lock()
+		defaultStore.files = nil
+		defaultStore.mu.Unlock()
+		os.RemoveAll(option.UploadDir)
+	})
+
+	get := func(path string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("default TTL", func(t *testing.T) {
+		options.WithFileTTL(time.Hour)(option)
+		t.Cleanup(func() { option.FileTTL = 0 })
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "ttl.txt", []byte("ttl"), map[string]string{"purpose": "fine-tune"}))
+		if assert.NotNil(t, f.ExpiresAt) {
+			assert.Equal(t, f.CreatedAt.Unix()+3600, f.ExpiresAt.Unix())
+		}
+
+		f = responseToFile(t, callFilesUploadWithFields(t, app, "override.txt", []byte("override"), map[string]string{
+			"purpose":                "fine-tune",
+			"expires_after[anchor]":  "created_at",
+			"expires_after[seconds]": "60",
+		}))
+		if assert.NotNil(t, f.ExpiresAt) {
+			assert.Equal(t, f.CreatedAt.Unix()+60, f.ExpiresAt.Unix())
+		}
+	})
+	t.Run("kept forever by default", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "forever.txt", []byte("forever"), map[string]string{"purpose": "fine-tune"})
+		assert.Nil(t, responseToFile(t, resp).ExpiresAt)
+	})
+	t.Run("invalid expires_after", func(t *testing.T) {
+		for _, fields := range []map[string]string{
+			{"purpose": "fine-tune", "expires_after[anchor]": "last_active_at", "expires_after[seconds]": "60"},
+			{"purpose": "fine-tune", "expires_after[seconds]": "-1"},
+			{"purpose": "fine-tune", "expires_after[anchor]": "created_at"},
+		} {
+			resp := callFilesUploadWithFields(t, app, "invalid.txt", []byte("invalid"), fields)
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, codeInvalidRequest, responseToError(t, resp).Code)
+		}
+	})
+	t.Run("expired files are hidden then reaped", func(t *testing.T) {
+		defaultStore.files = nil
+		live := responseToFile(t, callFilesUploadWithFields(t, app, "live.txt", []byte("live"), map[string]string{"purpose": "fine-tune"}))
+
+		past := time.Now().Add(-time.Minute)
+		expired := File{ID: "file-expired", Object: "file", Filename: "expired.txt", Purpose: "fine-tune", Bytes: 7, CreatedAt: past.Add(-time.Hour), ExpiresAt: &past, Status: fileStatusProcessed}
+		expired.Path = storageName(option, expired)
+		held := File{ID: "file-held", Object: "file", Filename: "held.txt", Purpose: "fine-tune", Bytes: 4, CreatedAt: past.Add(-time.Hour), ExpiresAt: &past, Status: fileStatusProcessed, LegalHold: true}
+		held.Path = storageName(option, held)
+		for _, f := range []File{expired, held} {
+			assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, f.Path), []byte("content"), 0644))
+			addUploadedFile(f)
+		}
+
+		resp, err := CallListFilesEndpoint(t, app, "fine-tune")
+		assert.NoError(t, err)
+		listed := responseToListFile(t, resp)
+		if assert.Len(t, listed.Data, 1) {
+			assert.Equal(t, live.ID, listed.Data[0].ID)
+		}
+		for _, path := range []string{"/files/" + expired.ID, "/files/" + expired.ID + "/content"} {
+			resp := get(path)
+			assert.Equal(t, fiber.StatusNotFound, resp.StatusCode, path)
+			assert.Equal(t, codeFileNotFound, responseToError(t, resp).Code)
+		}
+
+		assert.Equal(t, 1, reapExpiredFiles(context.Background(), option, time.Now()))
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, expired.Path))
+		assert.FileExists(t, filepath.Join(option.UploadDir, held.Path))
+		ids := []string{}
+		for _, f := range defaultStore.files {
+			ids = append(ids, f.ID)
+		}
+		assert.ElementsMatch(t, []string{live.ID, held.ID}, ids)
+
+		data, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), expired.ID)
+	})
+	t.Run("the reaper runs in the background", func(t *testing.T) {
+		defaultStore.files = nil
+		past := time.Now().Add(-time.Second)
+		addUploadedFile(File{ID: "file-background", Object: "file", Filename: "background.txt", Purpose: "fine-tune", CreatedAt: past, ExpiresAt: &past})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		o := *option
+		o.Context = ctx
+		o.FileReapInterval = 10 * time.Millisecond
+		done := StartFileReaper(&o)
+		assert.Eventually(t, func() bool { return len(expiredFiles(time.Now())) == 0 }, time.Second, 10*time.Millisecond)
+		// the next tests reset the index the reaper reads
+		cancel()
+		<-done
+	})
+}
+
+func TestMissingContentPolicy(t *testing.T) {
+	app, option, _ := startUpApp()
+	objects := &memoryBackend{}
+	option.PurposeBackends = map[string]options.FileBackend{"assistants": objects}
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		option.PurposeBackends = nil
+		option.MissingContentPolicy = ""
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	// uploads a file whose object is then deleted behind the server's back
+	missing := func(name string) File {
+		uploaded := responseToFile(t, callFilesUploadWithFields(t, app, name, []byte("content"), map[string]string{"purpose": "assistants"}))
+		f, err := getFile(uploaded.ID)
+		assert.NoError(t, err)
+		objects.mu.Lock()
+		assert.Contains(t, objects.files, storagePath(option, *f))
+		delete(objects.files, storagePath(option, *f))
+		objects.mu.Unlock()
+		return *f
+	}
+	download := func(f File) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		return resp
+	}
+
+	for _, tc := range []struct {
+		policy string
+		status int
+		code   string
+		kept   bool
+	}{
+		{"", fiber.StatusInternalServerError, codeContentMissing, true},
+		{"error", fiber.StatusInternalServerError, codeContentMissing, true},
+		{"keep", fiber.StatusNotFound, codeContentMissing, true},
+		{"prune", fiber.StatusNotFound, codeFileNotFound, false},
+	} {
+		t.Run("policy "+tc.policy, func(t *testing.T) {
+			options.WithMissingContentPolicy(tc.policy)(option)
+			logs.Reset()
+			f := missing("missing-" + tc.policy + ".txt")
+
+			resp := download(f)
+			assert.Equal(t, tc.status, resp.StatusCode)
+			apiErr := responseToError(t, resp)
+			assert.Equal(t, tc.code, apiErr.Code)
+			assert.Contains(t, apiErr.Message, f.ID)
+			assert.Contains(t, logs.String(), "Content of file "+f.ID+" is missing from the storage")
+
+			_, err := getFile(f.ID)
+			assert.Equal(t, tc.kept, err == nil)
+			index, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.kept, strings.Contains(string(index), f.ID))
+		})
+	}
+	t.Run("files on legal hold aren't pruned", func(t *testing.T) {
+		options.WithMissingContentPolicy("prune")(option)
+		f := missing("held.txt")
+		updateUploadedFile(f.ID, func(f *File) { f.LegalHold = true })
+
+		resp := download(f)
+		assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, codeContentMissing, responseToError(t, resp).Code)
+		_, err := getFile(f.ID)
+		assert.NoError(t, err)
+	})
+}
+
+func TestDerivedDownloadNames(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	var img bytes.Buffer
+	assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+
+	for _, tc := range []struct {
+		name, filename, contentType, want string
+	}{
+		{"empty filename", "", "image/png", "file-unnamed.png"},
+		{"generic filename", "blob", "image/png", "file-unnamed.png"},
+		{"parameters of the type", "", "text/plain; charset=utf-8", "file-unnamed.txt"},
+		{"unknown type", "", "", "file-unnamed"},
+		{"meaningful filename", "chart", "image/png", "chart"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defaultStore.files = nil
+			f := File{ID: "file-unnamed", Object: "file", Filename: tc.filename, Purpose: "vision", Bytes: img.Len(), CreatedAt: time.Now(), ContentType: tc.contentType, Status: fileStatusProcessed, Path: "vision/file-unnamed"}
+			assert.NoError(t, os.MkdirAll(filepath.Join(option.UploadDir, "vision"), 0755))
+			assert.NoError(t, os.WriteFile(filepath.Join(option.UploadDir, f.Path), img.Bytes(), 0644))
+			addUploadedFile(f)
+
+			assert.Equal(t, tc.want, downloadName(f))
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+			assert.Equal(t, `attachment; filename=`+tc.want, resp.Header.Get(fiber.HeaderContentDisposition))
+		})
+	}
+}
+
+func TestUploadDedup(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, purpose, content string, dedup bool) *http.Response {
+		fields := map[string]string{"purpose": purpose}
+		if dedup {
+			fields["dedup"] = "true"
+		}
+		return callFilesUploadWithFields(t, app, name, []byte(content), fields)
+	}
+
+	t.Run("duplicate upload returns the existing file", func(t *testing.T) {
+		defaultStore.files = nil
+		first := responseToFile(t, upload("first.txt", "fine-tune", "same bytes", true))
+		assert.NotEmpty(t, first.Sha256)
+
+		resp := upload("second.txt", "fine-tune", "same bytes", true)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get(deduplicatedHeader))
+		second := responseToFile(t, resp)
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, "first.txt", second.Filename)
+		assert.Len(t, defaultStore.files, 1)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "second.txt"))
+
+		// the hash is exposed by retrieve and list
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+first.ID, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, first.Sha256, responseToFile(t, resp).Sha256)
+		resp, err = CallListFilesEndpoint(t, app, "fine-tune")
+		assert.NoError(t, err)
+		list := responseToListFile(t, resp)
+		assert.Len(t, list.Data, 1)
+		assert.Equal(t, first.Sha256, list.Data[0].Sha256)
+	})
+	t.Run("different content or purpose is stored", func(t *testing.T) {
+		defaultStore.files = nil
+		first := responseToFile(t, upload("a.txt", "fine-tune", "content", true))
+
+		other := upload("b.txt", "fine-tune", "other content", true)
+		assert.Empty(t, other.Header.Get(deduplicatedHeader))
+		assert.NotEqual(t, first.ID, responseToFile(t, other).ID)
+
+		purpose := upload("a.txt", "assistants", "content", true)
+		assert.Empty(t, purpose.Header.Get(deduplicatedHeader))
+		assert.NotEqual(t, first.ID, responseToFile(t, purpose).ID)
+		assert.Len(t, defaultStore.files, 3)
+	})
+	t.Run("without dedup the upload is stored", func(t *testing.T) {
+		defaultStore.files = nil
+		upload("c.txt", "fine-tune", "content", true)
+		resp := upload("d.txt", "fine-tune", "content", false)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(deduplicatedHeader))
+		assert.Len(t, defaultStore.files, 2)
+	})
+	t.Run("deleting one copy keeps the shared content", func(t *testing.T) {
+		defaultStore.files = nil
+		option.ContentAddressedFiles = true
+		t.Cleanup(func() { option.ContentAddressedFiles = false })
+
+		first := responseToFile(t, upload("e.txt", "fine-tune", "shared", true))
+		second := responseToFile(t, upload("e.txt", "assistants", "shared", true))
+		assert.NotEqual(t, first.ID, second.ID)
+
+		resp, err := CallFilesDeleteEndpoint(t, app, first.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.FileExists(t, blobPath(option.UploadDir, second.Sha256))
+
+		resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/files/"+second.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "shared", bodyToString(resp, t))
+	})
+}
+
+func TestTotalStorageQuota(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	options.WithMaxTotalStorageMB(3)(option)
+	t.Cleanup(func() {
+		option.MaxTotalStorageMB = 0
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	usage := func() StorageUsage {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/usage", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var u StorageUsage
+		assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &u))
+		return u
+	}
+
+	first := CallFilesUploadEndpointWithCleanup(t, app, "first.txt", "file", "fine-tune", 1, option)
+	CallFilesUploadEndpointWithCleanup(t, app, "second.txt", "file", "fine-tune", 1, option)
+	u := usage()
+	assert.Equal(t, "file.usage", u.Object)
+	assert.Equal(t, 2, u.Files)
+	assert.Equal(t, int64(2*1024*1024), u.Bytes)
+	assert.Equal(t, int64(3*1024*1024), u.MaxBytes)
+
+	resp, err := CallFilesUploadEndpoint(t, app, "third.txt", "file", "fine-tune", 2, option)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	apiErr := responseToError(t, resp)
+	assert.Equal(t, rejectQuotaExceeded, apiErr.Code)
+	assert.Contains(t, apiErr.Message, "remaining storage quota")
+	assert.Equal(t, 2, usage().Files)
+
+	resp, err = CallFilesDeleteEndpoint(t, app, first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1024*1024), usage().Bytes)
+
+	resp, err = CallFilesUploadEndpoint(t, app, "third.txt", "file", "fine-tune", 2, option)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(3*1024*1024), usage().Bytes)
+}
+
+// slowOpenBackend delays every open of its backend, and records how many of
+// them run at once.
+type slowOpenBackend struct {
+	fileBackend
+	delay func(path string) time.Duration
+
+	mu             sync.Mutex
+	inFlight, peak int
+}
+
+func (b *slowOpenBackend) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	b.inFlight++
+	b.peak = max(b.peak, b.inFlight)
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+	}()
+
+	time.Sleep(b.delay(path))
+	return b.fileBackend.Open(ctx, path)
+}
+
+func TestConcurrentArchives(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	options.WithFilesArchiveConcurrency(4)(option)
+	previous := defaultStore.backend
+	t.Cleanup(func() {
+		defaultStore.backend = previous
+		option.FilesArchiveConcurrency = 0
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	const count = 12
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("f%02d.txt", i)
+		resp := callFilesUploadWithFields(t, app, name, []byte("content of "+name), map[string]string{"purpose": "assistants"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	}
+	files := filterFiles("")
+
+	// the first files are the slowest to read, so they complete last
+	backend := &slowOpenBackend{fileBackend: previous, delay: func(path string) time.Duration {
+		var n int
+		fmt.Sscanf(filepath.Base(path), "f%02d.txt", &n)
+		return time.Duration(count-n) * 2 * time.Millisecond
+	}}
+	defaultStore.backend = backend
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeExportArchive(context.Background(), option, &buf, files, nil))
+	assert.Greater(t, backend.peak, 1)
+	assert.LessOrEqual(t, backend.peak, 4)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, zr.File, count+1)
+	for i, f := range files {
+		zf := zr.File[i]
+		assert.Equal(t, f.ID, zf.Name)
+		rc, err := zf.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "content of "+f.Filename, string(content))
+	}
+	assert.Equal(t, exportManifestName, zr.File[count].Name)
+
+	t.Run("the archive is imported", func(t *testing.T) {
+		defaultStore.backend = previous
+		defaultStore.files = nil
+		assert.NoError(t, os.RemoveAll(option.UploadDir))
+		resp := callFilesImportEndpoint(t, app, buf.Bytes())
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, filterFiles(""), count)
+		for _, f := range files {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+			assert.NoError(t, err)
+			assert.Equal(t, "content of "+f.Filename, bodyToString(resp, t))
+		}
+	})
+	t.Run("a read failure stops the export", func(t *testing.T) {
+		defaultStore.backend = &slowOpenBackend{fileBackend: &memoryBackend{}, delay: func(string) time.Duration { return 0 }}
+		err := writeExportArchive(context.Background(), option, io.Discard, files, nil)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Contains(t, err.Error(), files[0].ID)
+	})
+}
+
+func TestCreatedAtMilliseconds(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	// created in the same second, indexed out of order
+	second := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, ms := range []int{300, 100, 200} {
+		addUploadedFile(File{ID: fmt.Sprintf("file-%d", ms), Object: "file", Filename: fmt.Sprintf("%d.txt", ms), Purpose: "fine-tune", CreatedAt: second.Add(time.Duration(ms) * time.Millisecond)})
+	}
+	saveUploadConfig(option)
+	defaultStore.files = nil
+	assert.NoError(t, LoadUploadConfig(option))
+
+	list := func(order string) []json.RawMessage {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files?sort=created_at&order="+order, nil))
+		assert.NoError(t, err)
+		var list struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		return list.Data
+	}
+	ids := func(data []json.RawMessage) []string {
+		var ids []string
+		for _, raw := range data {
+			var f File
+			assert.NoError(t, json.Unmarshal(raw, &f))
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+
+	data := list("asc")
+	assert.Equal(t, []string{"file-100", "file-200", "file-300"}, ids(data))
+	assert.Equal(t, []string{"file-300", "file-200", "file-100"}, ids(list("desc")))
+	if assert.Len(t, data, 3) {
+		var raw map[string]json.RawMessage
+		assert.NoError(t, json.Unmarshal(data[0], &raw))
+		assert.Equal(t, json.RawMessage("1704207845"), raw["created_at"])
+		assert.Equal(t, json.RawMessage("1704207845100"), raw["created_at_ms"])
+	}
+}
+
+func TestStreamedUploads(t *testing.T) {
+	_, option, loader := startUpApp()
+	options.EnableStreamingUploads(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	app := fiber.New(fiber.Config{
+		BodyLimit:                    1024 * 1024,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+	app.Use(LimitStreamedBodies(option, "/files"))
+	app.Post("/files", UploadFilesEndpoint(loader, option))
+	app.Post("/files/batch", UploadFilesBatchEndpoint(loader, option))
+	app.Post("/files/import", ImportFilesEndpoint(loader, option))
+	app.Post("/files/from-url", UploadFileFromURLEndpoint(loader, option))
+	app.Get("/files/:file_id/content", GetFilesContentsEndpoint(loader, option))
+
+	spooled := func() []os.DirEntry {
+		entries, err := os.ReadDir(tmpDir)
+		assert.NoError(t, err)
+		return entries
+	}
+
+	t.Run("fields are read around the file part", func(t *testing.T) {
+		content := bytes.Repeat([]byte("a"), 3*1024*1024)
+		resp := callFilesUploadWithFields(t, app, "large.txt", content, map[string]string{"purpose": "fine-tune", "metadata": `{"team":"ml"}`})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		f := responseToFile(t, resp)
+		assert.Equal(t, len(content), f.Bytes)
+		assert.Equal(t, "fine-tune", f.Purpose)
+		assert.Equal(t, map[string]string{"team": "ml"}, f.Metadata)
+		assert.Empty(t, spooled())
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+f.ID+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, content, bodyToByteArray(resp, t))
+	})
+	t.Run("a file exceeding the limit is refused as it arrives", func(t *testing.T) {
+		defaultStore.files = nil
+		content := bytes.Repeat([]byte("a"), 11*1024*1024)
+		resp := callFilesUploadWithFields(t, app, "huge.txt", content, map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectTooLarge, responseToError(t, resp).Code)
+		assert.Empty(t, defaultStore.files)
+		assert.Empty(t, spooled())
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "huge.txt"))
+	})
+	t.Run("a form without a file is refused", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		assert.NoError(t, writer.WriteField("purpose", "fine-tune"))
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectMissingFile, responseToError(t, resp).Code)
+	})
+	// the body of every route is streamed, the other multipart endpoints
+	// parse their form from the stream on demand
+	t.Run("batch uploads still parse their form", func(t *testing.T) {
+		defaultStore.files = nil
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for i := 0; i < 2; i++ {
+			part, err := writer.CreateFormFile("file", fmt.Sprintf("streamed-batch-%d.txt", i))
+			assert.NoError(t, err)
+			part.Write(bytes.Repeat([]byte("b"), 64*1024))
+		}
+		assert.NoError(t, writer.WriteField("purpose", "fine-tune"))
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files/batch", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		var result BatchResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Len(t, result.Results, 2)
+		assert.Empty(t, result.Errors)
+		for _, f := range result.Results {
+			assert.Equal(t, "fine-tune", f.Purpose)
+			assert.Equal(t, 64*1024, f.Bytes)
+		}
+	})
+	t.Run("imports still parse their form", func(t *testing.T) {
+		defaultStore.files = nil
+		content := bytes.Repeat([]byte("c"), 64*1024)
+		archive := buildImportArchive(t, []File{{ID: "file-streamed", Filename: "streamed.txt", Purpose: "assistants"}}, [][]byte{content})
+		resp := callFilesImportEndpoint(t, app, archive)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		f, err := getFile("file-streamed")
+		if assert.NoError(t, err) {
+			assert.Equal(t, len(content), f.Bytes)
+		}
+	})
+	t.Run("other bodies are bounded by the upload limit", func(t *testing.T) {
+		defaultStore.files = nil
+		oversized := int64(option.UploadLimitMB)*1024*1024 + 1
+
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "oversized-batch.txt")
+		assert.NoError(t, err)
+		part.Write(bytes.Repeat([]byte("b"), int(oversized)))
+		assert.NoError(t, writer.WriteField("purpose", "fine-tune"))
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files/batch", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Empty(t, defaultStore.files)
+
+		req = httptest.NewRequest(http.MethodPost, "/files/from-url", strings.NewReader(`{"purpose":"`+strings.Repeat("a", int(oversized))+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err = app.Test(req, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+	t.Run("a chunked body is cut off once it exceeds the upload limit", func(t *testing.T) {
+		chunked := fiber.New(fiber.Config{StreamRequestBody: true})
+		chunked.Use(LimitStreamedBodies(option, "/files"))
+		chunked.Post("/echo", func(c *fiber.Ctx) error {
+			return c.SendString(strconv.Itoa(len(c.Body())))
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go chunked.Listener(ln)
+		defer chunked.Shutdown()
+
+		post := func(size int) *http.Response {
+			// a reader of unknown length is sent chunked
+			body := io.MultiReader(bytes.NewReader(bytes.Repeat([]byte("a"), size)))
+			resp, err := http.Post("http://"+ln.Addr().String()+"/echo", "text/plain", body)
+			assert.NoError(t, err)
+			return resp
+		}
+		resp := post(64 * 1024)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, strconv.Itoa(64*1024), bodyToString(resp, t))
+
+		resp = post(option.UploadLimitMB*1024*1024 + 1)
+		resp.Body.Close()
+		assert.Equal(t, fiber.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+	t.Run("a trickled file is cut off at the maximum duration", func(t *testing.T) {
+		defaultStore.files = nil
+		option.MaxUploadDuration = 200 * time.Millisecond
+		defer func() { option.MaxUploadDuration = 0 }()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go app.Listener(ln)
+		defer app.Shutdown()
+
+		head := new(bytes.Buffer)
+		writer := multipart.NewWriter(head)
+		assert.NoError(t, writer.WriteField("purpose", "fine-tune"))
+		part, err := writer.CreateFormFile("file", "trickled.txt")
+		assert.NoError(t, err)
+		// past what the server reads ahead of the handler, the client sends a
+		// byte every 10ms, taking ten seconds to send it all
+		part.Write(bytes.Repeat([]byte("a"), 16*1024))
+		size := 1000
+		sent := 0
+		body := io.MultiReader(head, readerFunc(func(p []byte) (int, error) {
+			if sent == size {
+				return 0, io.EOF
+			}
+			time.Sleep(10 * time.Millisecond)
+			p[0] = 'a'
+			sent++
+			return 1, nil
+		}))
+		req, err := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/files", body)
+		assert.NoError(t, err)
+		req.ContentLength = int64(head.Len() + size)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Equal(t, fiber.StatusRequestTimeout, resp.StatusCode)
+		assert.Equal(t, rejectUploadTimeout, responseToError(t, resp).Code)
+		assert.Empty(t, defaultStore.files)
+		assert.Empty(t, spooled())
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine-tune", "trickled.txt"))
+	})
+}
+
+// recordingSink records the changes it is told about, failing the first calls
+// when asked to.
+type recordingSink struct {
+	mu       sync.Mutex
+	events   []string
+	metadata []map[string]string
+	failures int
+}
+
+func (s *recordingSink) record(kind string, f File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("catalog unavailable")
+	}
+	s.events = append(s.events, kind+" "+f.ID)
+	s.metadata = append(s.metadata, f.Metadata)
+	return nil
+}
+
+func (s *recordingSink) FileCreated(ctx context.Context, f File) error { return s.record("created", f) }
+func (s *recordingSink) FileUpdated(ctx context.Context, f File) error { return s.record("updated", f) }
+func (s *recordingSink) FileDeleted(ctx context.Context, f File) error { return s.record("deleted", f) }
+
+func TestMetadataSink(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	sink := &recordingSink{}
+	options.WithMetadataSink(sink)(option)
+	options.WithMetadataSinkRetries(2, time.Millisecond)(option)
+	ConfigureMetadataSink(option)
+	t.Cleanup(func() {
+		defaultStore.mirror = nil
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	events := func() []string {
+		defaultStore.mirror.wait()
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		events := sink.events
+		sink.events, sink.metadata = nil, nil
+		return events
+	}
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "catalog.txt", []byte("content"), map[string]string{"purpose": "fine-tune"}))
+	assert.Equal(t, []string{"created " + f.ID}, events())
+
+	t.Run("updates", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/files/metadata/batch", strings.NewReader(`{"file_ids":["`+f.ID+`"],"set":{"team":"ml"}}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		defaultStore.mirror.wait()
+		assert.Equal(t, []map[string]string{{"team": "ml"}}, sink.metadata)
+		assert.Equal(t, []string{"updated " + f.ID}, events())
+
+		resp = callFilesUploadWithFields(t, app, "catalog.txt", []byte("new content"), map[string]string{"purpose": "fine-tune", "overwrite": "true"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"updated " + f.ID}, events())
+	})
+	t.Run("failures are retried without failing the change", func(t *testing.T) {
+		sink.failures = 2
+		resp, err := CallFilesDeleteEndpoint(t, app, f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"deleted " + f.ID}, events())
+	})
+	t.Run("a failing sink doesn't fail the change", func(t *testing.T) {
+		sink.failures = 10
+		resp := callFilesUploadWithFields(t, app, "lost.txt", []byte("content"), map[string]string{"purpose": "fine-tune"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, events())
+		sink.failures = 0
+	})
+}
+
+func TestCompressedFiles(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(name, encoding string, content []byte) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{}
+		header.Set(fiber.HeaderContentDisposition, `form-data; name="file"; filename="`+name+`"`)
+		header.Set(fiber.HeaderContentEncoding, encoding)
+		part, err := writer.CreatePart(header)
+		assert.NoError(t, err)
+		part.Write(content)
+		assert.NoError(t, writer.WriteField("purpose", "fine-tune"))
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	download := func(id, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+id+"/content", nil)
+		if acceptEncoding != "" {
+			req.Header.Set(fiber.HeaderAcceptEncoding, acceptEncoding)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	plain := []byte(strings.Repeat(`{"prompt":"a","completion":"b"}`+"\n", 100))
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(plain)
+	zw.Close()
+
+	resp := upload("train.jsonl.gz", "gzip", compressed.Bytes())
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	f := responseToFile(t, resp)
+	assert.Equal(t, gzipEncoding, f.ContentEncoding)
+	assert.Equal(t, compressed.Len(), f.Bytes)
+	assert.Equal(t, len(plain), f.UncompressedBytes)
+	stored, _ := getFile(f.ID)
+	content, err := os.ReadFile(filepath.Join(option.UploadDir, stored.Path))
+	assert.NoError(t, err)
+	assert.Equal(t, compressed.Bytes(), content, "the content is stored as sent")
+
+	t.Run("clients taking gzip get the stored content", func(t *testing.T) {
+		resp := download(f.ID, "gzip, deflate")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, gzipEncoding, resp.Header.Get(fiber.HeaderContentEncoding))
+		assert.Equal(t, fiber.HeaderAcceptEncoding, resp.Header.Get(fiber.HeaderVary))
+		assert.Equal(t, compressed.Bytes(), bodyToByteArray(resp, t))
+	})
+	t.Run("other clients get the decompressed content", func(t *testing.T) {
+		for _, accept := range []string{"", "identity"} {
+			resp := download(f.ID, accept)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get(fiber.HeaderContentEncoding))
+			assert.Equal(t, `attachment; filename=train.jsonl`, resp.Header.Get(fiber.HeaderContentDisposition))
+			assert.Equal(t, plain, bodyToByteArray(resp, t))
+		}
+	})
+	t.Run("invalid gzip content is refused", func(t *testing.T) {
+		resp := upload("broken.jsonl.gz", "gzip", plain)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, codeValidationFailed, responseToError(t, resp).Code)
+	})
+	t.Run("unsupported encodings are refused", func(t *testing.T) {
+		resp := upload("train.jsonl.br", "br", plain)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, responseToError(t, resp).Message, "unsupported content encoding")
+	})
+}
+
+func TestDerivedContentCache(t *testing.T) {
+	app, option, _ := startUpApp()
+	cacheDir := t.TempDir()
+	options.WithDerivedContentCache(cacheDir, 1)(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	get := func(path string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.NoError(t, err)
+		return resp
+	}
+	cached := func() []string {
+		names, _ := filepath.Glob(filepath.Join(cacheDir, derivedCachePrefix+"*"))
+		return names
+	}
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "rows.jsonl", []byte(`{"a":"1"}`+"\n"), map[string]string{"purpose": "fine-tune"}))
+
+	t.Run("repeated conversions are served from the cache", func(t *testing.T) {
+		resp := get("/files/" + f.ID + "/convert?to=csv")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+		assert.Equal(t, "a\n1\n", bodyToString(resp, t))
+		assert.Len(t, cached(), 1)
+
+		resp = get("/files/" + f.ID + "/convert?to=csv")
+		assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+		assert.Equal(t, "a\n1\n", bodyToString(resp, t))
+	})
+	t.Run("overwriting the source invalidates its outputs", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond)
+		resp := callFilesUploadWithFields(t, app, "rows.jsonl", []byte(`{"b":"2"}`+"\n"), map[string]string{"purpose": "fine-tune", "overwrite": "true"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, cached())
+
+		resp = get("/files/" + f.ID + "/convert?to=csv")
+		assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+		assert.Equal(t, "b\n2\n", bodyToString(resp, t))
+	})
+	t.Run("thumbnails are cached", func(t *testing.T) {
+		var img bytes.Buffer
+		assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 20))))
+		picture := responseToFile(t, callFilesUploadWithFields(t, app, "small.png", img.Bytes(), map[string]string{"purpose": "vision"}))
+
+		first := get("/files/" + picture.ID + "/thumbnail?w=16&h=16")
+		assert.Equal(t, "MISS", first.Header.Get("X-Cache"))
+		second := get("/files/" + picture.ID + "/thumbnail?w=16&h=16")
+		assert.Equal(t, "HIT", second.Header.Get("X-Cache"))
+		assert.Equal(t, bodyToByteArray(first, t), bodyToByteArray(second, t))
+	})
+	t.Run("deleting the source drops its outputs", func(t *testing.T) {
+		resp, err := CallFilesDeleteEndpoint(t, app, f.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Len(t, cached(), 1, "only the thumbnail is left")
+	})
+	t.Run("least recently used outputs are evicted", func(t *testing.T) {
+		dc := derivedCacheFor(option)
+		big := File{ID: "file-big", CreatedAt: time.Now()}
+		out, err := dc.store(big, "fill", func(w io.Writer) error {
+			_, err := w.Write(make([]byte, 1024*1024))
+			return err
+		})
+		assert.NoError(t, err)
+		out.Close()
+		assert.Len(t, cached(), 1, "the thumbnail was evicted")
+		kept, ok := dc.open(big, "fill")
+		assert.True(t, ok)
+		kept.Close()
+	})
+}
+
+func TestFileOwners(t *testing.T) {
+	option := &options.Option{
+		UploadLimitMB: 10,
+		UploadDir:     "test_dir",
+		ApiKeys:       []string{"alice", "bob"},
+		AdminApiKeys:  []string{"admin-key"},
+	}
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	app := fiber.New()
+	app.Post("/files", UploadFilesEndpoint(nil, option))
+	app.Get("/files", ListFilesEndpoint(nil, option))
+	app.Get("/files/:file_id", GetFilesEndpoint(nil, option))
+	app.Delete("/files/:file_id", DeleteFilesEndpoint(nil, option))
+
+	upload := func(header, value string, fields map[string]string) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "owned.txt")
+		part.Write([]byte("content"))
+		writer.WriteField("purpose", "fine-tune")
+		for k, v := range fields {
+			writer.WriteField(k, v)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(header, value)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	call := func(method, target, header, value string) *http.Response {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(header, value)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	listed := func(resp *http.Response) []File {
+		var list struct{ Data []File }
+		assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &list))
+		return list.Data
+	}
+
+	resp := upload(fiber.HeaderAuthorization, "Bearer alice", nil)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	file := responseToFile(t, resp)
+	assert.Empty(t, file.OwnerKey, "the owner is only shown to admins")
+	indexed, _ := getFile(file.ID)
+	assert.Equal(t, apiKeyID("alice"), indexed.OwnerKey)
+
+	t.Run("owners see their files", func(t *testing.T) {
+		assert.Len(t, listed(call(http.MethodGet, "/files", fiber.HeaderAuthorization, "Bearer alice")), 1)
+		assert.Equal(t, fiber.StatusOK, call(http.MethodGet, "/files/"+file.ID, fiber.HeaderAuthorization, "Bearer alice").StatusCode)
+	})
+	t.Run("other keys can't see them", func(t *testing.T) {
+		assert.Empty(t, listed(call(http.MethodGet, "/files", fiber.HeaderAuthorization, "Bearer bob")))
+		resp := call(http.MethodGet, "/files/"+file.ID, fiber.HeaderAuthorization, "Bearer bob")
+		assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, codeFileNotFound, responseToError(t, resp).Code)
+	})
+	t.Run("other keys can't delete or replace them", func(t *testing.T) {
+		assert.Equal(t, fiber.StatusNotFound, call(http.MethodDelete, "/files/"+file.ID, fiber.HeaderAuthorization, "Bearer bob").StatusCode)
+		resp := upload(fiber.HeaderAuthorization, "Bearer bob", map[string]string{"overwrite": "true"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, "names only clash among the files of an owner")
+		bobs := responseToFile(t, resp)
+		assert.NotEqual(t, file.ID, bobs.ID)
+		kept, err := getFile(file.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, apiKeyID("alice"), kept.OwnerKey)
+
+		resp = call(http.MethodDelete, "/files/"+bobs.ID, fiber.HeaderAuthorization, "Bearer bob")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		_, err = os.Stat(storagePath(option, *kept))
+		assert.NoError(t, err, "each owner's file has its own content")
+	})
+	t.Run("admins see every file", func(t *testing.T) {
+		files := listed(call(http.MethodGet, "/files", fiber.HeaderAuthorization, "Bearer admin-key"))
+		assert.Len(t, files, 1)
+		assert.Equal(t, apiKeyID("alice"), files[0].OwnerKey)
+	})
+
+	t.Run("files are shared without auth", func(t *testing.T) {
+		option.ApiKeys = nil
+		t.Cleanup(func() { option.ApiKeys = []string{"alice", "bob"} })
+		assert.Len(t, listed(call(http.MethodGet, "/files", "X-Owner", "carol")), 1)
+	})
+	t.Run("the owner header scopes files without auth", func(t *testing.T) {
+		option.ApiKeys = nil
+		options.WithFilesOwnerHeader("X-Owner")(option)
+		t.Cleanup(func() { option.ApiKeys, option.FilesOwnerHeader = []string{"alice", "bob"}, "" })
+
+		assert.Empty(t, listed(call(http.MethodGet, "/files", "X-Owner", "carol")))
+		assert.Equal(t, fiber.StatusNotFound, call(http.MethodGet, "/files/"+file.ID, "X-Owner", "carol").StatusCode)
+	})
+}
+
+func TestUpdateFileEndpoint(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	update := func(method, id, body string) *http.Response {
+		req := httptest.NewRequest(method, "/files/"+id, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	content := func(id string) string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/files/"+id+"/content", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		return bodyToString(resp, t)
+	}
+
+	f := responseToFile(t, callFilesUploadWithFields(t, app, "draft.jsonl", []byte("rows"), map[string]string{"purpose": "assistants"}))
+	responseToFile(t, callFilesUploadWithFields(t, app, "taken.jsonl", []byte("other"), map[string]string{"purpose": "assistants"}))
+
+	t.Run("rename", func(t *testing.T) {
+		resp := update(http.MethodPatch, f.ID, `{"filename": "../final.jsonl"}`)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		renamed := responseToFile(t, resp)
+		assert.Equal(t, f.ID, renamed.ID)
+		// shown as sent, stored under its sanitized form
+		assert.Equal(t, "../final.jsonl", renamed.Filename)
+		assert.Empty(t, renamed.Path)
+
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "assistants", "draft.jsonl"))
+		assert.FileExists(t, filepath.Join(option.UploadDir, "assistants", "final.jsonl"))
+		assert.Equal(t, "rows", content(f.ID))
+	})
+	t.Run("purpose change", func(t *testing.T) {
+		resp := update(http.MethodPost, f.ID, `{"purpose": "fine-tune"}`)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		moved := responseToFile(t, resp)
+		assert.Equal(t, "fine-tune", moved.Purpose)
+		assert.Equal(t, "../final.jsonl", moved.Filename)
+
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "assistants", "final.jsonl"))
+		assert.FileExists(t, filepath.Join(option.UploadDir, "fine-tune", "final.jsonl"))
+		assert.Equal(t, "rows", content(f.ID))
+
+		var saved []File
+		data, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, &saved))
+		for _, s := range saved {
+			if s.ID == f.ID {
+				assert.Equal(t, "fine-tune", s.Purpose)
+			}
+		}
+	})
+	t.Run("names can't clash", func(t *testing.T) {
+		resp := update(http.MethodPatch, f.ID, `{"filename": "taken.jsonl", "purpose": "assistants"}`)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectFileExists, responseToError(t, resp).Code)
+	})
+	t.Run("concurrent renames to the same name", func(t *testing.T) {
+		// a slow backend keeps each rename between its check and its move
+		option.PurposeBackends = map[string]options.FileBackend{"batch": &slowOpenBackend{fileBackend: &memoryBackend{}, delay: func(string) time.Duration { return 20 * time.Millisecond }}}
+		t.Cleanup(func() { option.PurposeBackends = nil })
+		var ids []string
+		for i := 0; i < 5; i++ {
+			name := fmt.Sprintf("racer-%d.jsonl", i)
+			ids = append(ids, responseToFile(t, callFilesUploadWithFields(t, app, name, []byte(name), map[string]string{"purpose": "batch"})).ID)
+		}
+
+		var wg sync.WaitGroup
+		statuses := make([]int, len(ids))
+		for i, id := range ids {
+			wg.Add(1)
+			go func(i int, id string) {
+				defer wg.Done()
+				statuses[i] = update(http.MethodPatch, id, `{"filename": "winner.jsonl"}`).StatusCode
+			}(i, id)
+		}
+		wg.Wait()
+
+		renamed := 0
+		for _, status := range statuses {
+			if status == fiber.StatusOK {
+				renamed++
+			} else {
+				assert.Equal(t, fiber.StatusBadRequest, status)
+			}
+		}
+		assert.Equal(t, 1, renamed)
+		assert.Len(t, filterFiles("batch"), len(ids))
+	})
+	t.Run("stored content is never replaced", func(t *testing.T) {
+		// the files of a backend can't be told apart from the disk, only the
+		// move finds what is already there
+		objects := &memoryBackend{}
+		option.PurposeBackends = map[string]options.FileBackend{"user_data": objects}
+		t.Cleanup(func() { option.PurposeBackends = nil })
+		g := responseToFile(t, callFilesUploadWithFields(t, app, "mine.txt", []byte("mine"), map[string]string{"purpose": "user_data"}))
+		stray := filepath.Join(option.UploadDir, "user_data", "stray.txt")
+		assert.NoError(t, objects.Save(context.Background(), stray, strings.NewReader("stray")))
+
+		resp := update(http.MethodPatch, g.ID, `{"filename": "stray.txt"}`)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectFileExists, responseToError(t, resp).Code)
+		assert.Equal(t, []byte("stray"), objects.files[stray])
+		assert.Equal(t, "mine", content(g.ID))
+	})
+	t.Run("unknown fields are refused", func(t *testing.T) {
+		resp := update(http.MethodPatch, f.ID, `{"filename": "x.jsonl", "bytes": 3}`)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, codeInvalidRequest, responseToError(t, resp).Code)
+	})
+	t.Run("not found", func(t *testing.T) {
+		resp := update(http.MethodPatch, "file-missing", `{"filename": "x.jsonl"}`)
+		assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, codeFileNotFound, responseToError(t, resp).Code)
+	})
+}
+
+func TestUploadWarnings(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	t.Run("none for an upload stored as sent", func(t *testing.T) {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "plain.txt", []byte("text"), map[string]string{"purpose": "assistants"}))
+		assert.Empty(t, f.Warnings)
+	})
+	t.Run("sanitized filename", func(t *testing.T) {
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "notes..v2.txt", []byte("text"), map[string]string{"purpose": "assistants"}))
+		assert.Equal(t, []string{`filename sanitized to "notesv2.txt" for storage`}, f.Warnings)
+		indexed, _ := getFile(f.ID)
+		assert.Empty(t, indexed.Warnings, "warnings are not kept in the index")
+	})
+	t.Run("normalized line endings", func(t *testing.T) {
+		options.WithNormalizedLineEndings("fine-tune")(option)
+		t.Cleanup(func() { option.NormalizeLineEndings = nil })
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "windows.jsonl", []byte("{\"a\":1}\r\n"), map[string]string{"purpose": "fine-tune"}))
+		assert.Equal(t, []string{"CRLF line endings converted to LF"}, f.Warnings)
+	})
+	t.Run("content not matching the extension", func(t *testing.T) {
+		var img bytes.Buffer
+		assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+		f := responseToFile(t, callFilesUploadWithFields(t, app, "picture.txt", img.Bytes(), map[string]string{"purpose": "assistants"}))
+		assert.Equal(t, []string{"content type image/png doesn't match the .txt extension"}, f.Warnings)
+	})
+}
+
+func TestAllowedPurposes(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	t.Run("recognized purpose", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "batch.jsonl", []byte("{}"), map[string]string{"purpose": "batch"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	})
+	t.Run("unknown purpose", func(t *testing.T) {
+		resp := callFilesUploadWithFields(t, app, "typo.jsonl", []byte("{}"), map[string]string{"purpose": "fine_tune"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		e := responseToError(t, resp)
+		assert.Equal(t, rejectMissingPurpose, e.Code)
+		assert.Equal(t, `Invalid purpose "fine_tune", accepted values are: fine-tune, assistants, batch, vision, user_data, evals`, e.Message)
+		assert.NoFileExists(t, filepath.Join(option.UploadDir, "fine_tune", "typo.jsonl"))
+	})
+	t.Run("configured purposes", func(t *testing.T) {
+		options.WithAllowedPurposes("fine-tune", "embeddings")(option)
+		t.Cleanup(func() { option.AllowedPurposes = nil })
+
+		resp := callFilesUploadWithFields(t, app, "corpus.txt", []byte("text"), map[string]string{"purpose": "embeddings"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		resp = callFilesUploadWithFields(t, app, "other.txt", []byte("text"), map[string]string{"purpose": "assistants"})
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, responseToError(t, resp).Message, "accepted values are: fine-tune, embeddings")
+	})
+}
+
+func TestBatchDeleteFiles(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	first := responseToFile(t, callFilesUploadWithFields(t, app, "first.txt", []byte("1"), map[string]string{"purpose": "assistants"}))
+	second := responseToFile(t, callFilesUploadWithFields(t, app, "second.txt", []byte("2"), map[string]string{"purpose": "assistants"}))
+	kept := responseToFile(t, callFilesUploadWithFields(t, app, "kept.txt", []byte("3"), map[string]string{"purpose": "assistants"}))
+
+	body := `{"ids":["` + first.ID + `","file-missing","` + second.ID + `","` + first.ID + `"]}`
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/files/delete", strings.NewReader(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	var result BatchResult
+	assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &result))
+
+	if assert.Len(t, result.Results, 2) {
+		assert.Equal(t, first.ID, result.Results[0].ID)
+		assert.Equal(t, second.ID, result.Results[1].ID)
+	}
+	if assert.Len(t, result.Errors, 2) {
+		assert.Equal(t, "file-missing", result.Errors[0].ID)
+		assert.Equal(t, codeFileNotFound, result.Errors[0].Reason)
+		assert.Equal(t, first.ID, result.Errors[1].ID, "a repeated ID is only deleted once")
+		assert.Equal(t, codeFileNotFound, result.Errors[1].Reason)
+	}
+
+	assert.Len(t, defaultStore.files, 1)
+	assert.NoFileExists(t, filepath.Join(option.UploadDir, "assistants", "first.txt"))
+	assert.NoFileExists(t, filepath.Join(option.UploadDir, "assistants", "second.txt"))
+
+	var saved []File
+	data, err := os.ReadFile(filepath.Join(option.UploadDir, uploadIndexFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &saved))
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, kept.ID, saved[0].ID)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	for _, backend := range []struct {
+		name    string
+		objects *memoryBackend
+	}{
+		{"local disk", nil},
+		{"files backend", &memoryBackend{}},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			o := &options.Option{UploadDir: t.TempDir(), UploadLimitMB: 1, DeniedFilenames: []string{"*.exe"}}
+			if backend.objects != nil {
+				o.FilesBackend = backend.objects
+			}
+			testFileStore(t, o, backend.objects)
+		})
+	}
+}
+
+// testFileStore runs TestFileStore against a store of o, whose files are kept
+// by objects when set.
+func testFileStore(t *testing.T, o *options.Option, objects *memoryBackend) {
+	store := NewFileStore(o)
+	ctx := context.Background()
+	stored := func(path string) bool {
+		if objects == nil {
+			_, err := os.Stat(path)
+			return err == nil
+		}
+		objects.mu.Lock()
+		defer objects.mu.Unlock()
+		_, ok := objects.files[path]
+		return ok
+	}
+
+	added := map[string]File{}
+	contents := map[string]string{}
+	for _, tc := range []struct {
+		name     string
+		file     File
+		content  string
+		wantErr  error
+		wantName string
+	}{
+		{name: "stored", file: File{Filename: "notes.txt", Purpose: "assistants", OwnerKey: "alice"}, content: "hello", wantName: "notes.txt"},
+		{name: "sanitized name", file: File{Filename: "../../escape.txt", Purpose: "assistants"}, content: "out", wantName: "escape.txt"},
+		{name: "other purpose", file: File{Filename: "data.jsonl", Purpose: "batch"}, content: "{}\n", wantName: "data.jsonl"},
+		{name: "duplicate name", file: File{Filename: "notes.txt", Purpose: "assistants", OwnerKey: "alice"}, content: "again", wantErr: errFileExists},
+		{name: "name of another owner", file: File{Filename: "notes.txt", Purpose: "assistants", OwnerKey: "bob"}, content: "bob's", wantName: "notes.txt"},
+		{name: "denied name", file: File{Filename: "setup.exe", Purpose: "assistants"}, content: "MZ", wantErr: errFilenameDenied},
+		{name: "too large", file: File{Filename: "large.txt", Purpose: "assistants"}, content: strings.Repeat("a", 1024*1024+1), wantErr: errFileTooLarge},
+		{name: "unknown purpose", file: File{Filename: "secret.txt", Purpose: "secrets"}, content: "x", wantErr: errInvalidPurpose},
+		{name: "missing purpose", file: File{Filename: "orphan.txt"}, content: "x", wantErr: errInvalidPurpose},
+		{name: "missing filename", file: File{Purpose: "assistants"}, content: "x", wantErr: errInvalidFilename},
+	} {
+		t.Run("add "+tc.name, func(t *testing.T) {
+			f, err := store.Add(ctx, tc.file, strings.NewReader(tc.content))
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NotEmpty(t, f.ID)
+			assert.Equal(t, "file", f.Object)
+			assert.Equal(t, tc.wantName, f.Filename)
+			assert.Equal(t, len(tc.content), f.Bytes)
+			assert.False(t, f.CreatedAt.IsZero())
+			assert.True(t, stored(storagePath(o, f)))
+			added[tc.name] = f
+			contents[tc.name] = tc.content
+		})
+	}
+	assert.Empty(t, defaultStore.List(""), "a store of its own leaves the default one alone")
+
+	for _, tc := range []struct {
+		purpose string
+		want    int
+	}{
+		{"", 4},
+		{"assistants", 3},
+		{"batch", 1},
+		{"fine-tune", 0},
+	} {
+		t.Run("list "+tc.purpose, func(t *testing.T) {
+			assert.Len(t, store.List(tc.purpose), tc.want)
+		})
+	}
+
+	for name, f := range added {
+		t.Run("content of "+name, func(t *testing.T) {
+			got, err := store.Get(f.ID)
+			if assert.NoError(t, err) {
+				assert.Equal(t, f.Filename, got.Filename)
+			}
+			rc, err := store.Content(ctx, f.ID)
+			if assert.NoError(t, err) {
+				data, err := io.ReadAll(rc)
+				rc.Close()
+				assert.NoError(t, err)
+				assert.Equal(t, contents[name], string(data))
+			}
+		})
+	}
+	_, err := store.Get("file-missing")
+	assert.ErrorIs(t, err, errFileNotFound)
+
+	for _, tc := range []struct {
+		name    string
+		file    string
+		hold    bool
+		wantErr error
+	}{
+		{name: "deleted", file: "stored"},
+		{name: "already deleted", file: "stored", wantErr: errFileNotFound},
+		{name: "on hold", file: "sanitized name", hold: true, wantErr: errFileOnHold},
+	} {
+		t.Run("delete "+tc.name, func(t *testing.T) {
+			f := added[tc.file]
+			if tc.hold {
+				store.update(f.ID, func(f *File) { f.LegalHold = true })
+			}
+			assert.ErrorIs(t, store.Delete(ctx, f.ID), tc.wantErr)
+			assert.Equal(t, tc.wantErr == errFileOnHold, stored(storagePath(o, f)))
+		})
+	}
+
+	assert.NoError(t, store.setTenantQuota(o, "acme", tenantQuota{MaxFiles: 2}))
+	_, ok := defaultStore.tenantQuota("acme")
+	assert.False(t, ok, "the quotas of a store are its own")
+
+	assert.NoError(t, store.Save())
+	// the index is kept by the backend of the store
+	index := filepath.Join(o.UploadDir, uploadIndexFile)
+	assert.True(t, stored(index))
+	if objects != nil {
+		assert.NoFileExists(t, index)
+	}
+	reloaded := NewFileStore(o)
+	assert.NoError(t, reloaded.Load())
+	assert.Len(t, reloaded.List(""), 3)
+	q, ok := reloaded.tenantQuota("acme")
+	assert.True(t, ok)
+	assert.Equal(t, 2, q.MaxFiles)
+	for _, tc := range []struct {
+		file     string
+		wantErr  error
+		wantHeld bool
+	}{
+		{file: "stored", wantErr: errFileNotFound},
+		{file: "sanitized name", wantHeld: true},
+		{file: "other purpose"},
+		{file: "name of another owner"},
+	} {
+		t.Run("reload "+tc.file, func(t *testing.T) {
+			got, err := reloaded.Get(added[tc.file].ID)
+			assert.ErrorIs(t, err, tc.wantErr)
+			if err == nil {
+				assert.Equal(t, tc.wantHeld, got.LegalHold)
+			}
+		})
+	}
+}
+
+// stallingBackend writes half of what is saved at the path stall, then hangs
+// until released before writing the rest.
+type stallingBackend struct {
+	memoryBackend
+	stall   string
+	release chan struct{}
+}
+
+func (b *stallingBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	if path != b.stall {
+		return b.memoryBackend.Save(ctx, path, r)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.memoryBackend.Save(ctx, path, bytes.NewReader(content[:len(content)/2]))
+	<-b.release
+	return b.memoryBackend.Save(ctx, path, bytes.NewReader(content))
+}
+
+func TestIndexSaveTimeout(t *testing.T) {
+	option := &options.Option{UploadDir: t.TempDir(), FileSaveTimeout: 20 * time.Millisecond}
+	index := filepath.Join(option.UploadDir, uploadIndexFile)
+	backend := &stallingBackend{release: make(chan struct{})}
+	options.WithFilesBackend(backend)(option)
+	previous := defaultStore.backend
+	defaultStore.backend = backend
+	t.Cleanup(func() { defaultStore.backend = previous })
+
+	assert.NoError(t, defaultStore.saveIndexFile(option, uploadIndexFile, []byte(`[{"id":"file-old"}]`)))
+
+	backend.stall = index
+	err := defaultStore.saveIndexFile(option, uploadIndexFile, []byte(`[{"id":"file-new"}]`))
+	assert.ErrorIs(t, err, errFileOperationTimeout)
+
+	data, err := defaultStore.readIndexFile(option, uploadIndexFile)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"id":"file-new"}]`, string(data), "the copy is read while the index is cut short")
+
+	close(backend.release)
+	assert.Eventually(t, func() bool {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		return string(backend.files[index]) == `[{"id":"file-new"}]`
+	}, time.Second, 5*time.Millisecond, "the late save is kept rather than removed")
+}
+
+// gatedBackend holds the first save back until release is closed, closing
+// held once it returned.
+type gatedBackend struct {
+	fileBackend
+	release chan struct{}
+	held    chan struct{}
+	once    sync.Once
+}
+
+func (b *gatedBackend) Save(ctx context.Context, path string, r io.Reader) error {
+	first := false
+	b.once.Do(func() { first = true })
+	if !first {
+		return b.fileBackend.Save(ctx, path, r)
+	}
+	defer close(b.held)
+	<-b.release
+	return b.fileBackend.Save(ctx, path, r)
+}
+
+type renamingGatedBackend struct {
+	*gatedBackend
+}
+
+func (b renamingGatedBackend) Rename(ctx context.Context, from, to string) error {
+	return localBackend{}.Rename(ctx, from, to)
+}
+
+func TestAbandonedSave(t *testing.T) {
+	for name, renames := range map[string]bool{"renaming backend": true, "other backends": false} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "fine-tune")
+			path := filepath.Join(dir, "a.txt")
+			gated := &gatedBackend{fileBackend: &memoryBackend{}, release: make(chan struct{}), held: make(chan struct{})}
+			var backend fileBackend = gated
+			if renames {
+				gated.fileBackend = localBackend{}
+				backend = renamingGatedBackend{gated}
+			}
+			stored := func() string {
+				rc, err := backend.Open(context.Background(), path)
+				if err != nil {
+					return err.Error()
+				}
+				defer rc.Close()
+				content, _ := io.ReadAll(rc)
+				return string(content)
+			}
+
+			var abandoned, readLate atomic.Bool
+			old := strings.NewReader("old content")
+			src := readerFunc(func(p []byte) (int, error) {
+				if abandoned.Load() {
+					readLate.Store(true)
+				}
+				return old.Read(p)
+			})
+			err := saveWithTimeout(context.Background(), backend, 20*time.Millisecond, path, src)
+			assert.ErrorIs(t, err, errFileOperationTimeout)
+			abandoned.Store(true)
+
+			assert.NoError(t, saveWithTimeout(context.Background(), backend, time.Second, path, strings.NewReader("new content")))
+			close(gated.release)
+			<-gated.held
+
+			// the late save is undone without touching the new content
+			if renames {
+				assert.Eventually(t, func() bool {
+					entries, _ := os.ReadDir(dir)
+					return len(entries) == 1
+				}, time.Second, 10*time.Millisecond)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			assert.Equal(t, "new content", stored())
+			assert.False(t, readLate.Load())
+		})
+	}
+}
+
+// buildImportArchive returns an unsigned archive holding contents under a
+// manifest describing them as files.
+func buildImportArchive(t *testing.T, files []File, contents [][]byte) []byte {
+	var manifest exportManifest
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for i, f := range files {
+		sum := sha256.Sum256(contents[i])
+		path := "content-" + strconv.Itoa(i)
+		manifest.Files = append(manifest.Files, exportEntry{File: f, Path: path, Checksum: hex.EncodeToString(sum[:])})
+		w, err := zw.Create(path)
+		assert.NoError(t, err)
+		w.Write(contents[i])
+	}
+	w, err := zw.Create(exportManifestName)
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewEncoder(w).Encode(manifest))
+	assert.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func TestImportManifestFields(t *testing.T) {
+	app, option, _ := startUpApp()
+	options.WithFilesOwnerHeader("X-Owner")(option)
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	archive := buildImportArchive(t, []File{{
+		ID:        "file-planted",
+		Object:    "file",
+		Bytes:     1,
+		Filename:  "planted.txt",
+		Purpose:   "assistants",
+		OwnerKey:  "victim",
+		Tenant:    "victim-tenant",
+		LegalHold: true,
+		Status:    fileStatusError,
+	}}, [][]byte{[]byte("imported content")})
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "export.zip")
+	assert.NoError(t, err)
+	part.Write(archive)
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/files/import", body)
+	req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+	req.Header.Set("X-Owner", "importer")
+	req.Header.Set(tenantHeader, "importer-tenant")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	f, err := getFile("file-planted")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "importer", f.OwnerKey)
+		assert.Equal(t, "importer-tenant", f.Tenant)
+		assert.False(t, f.LegalHold)
+		assert.Equal(t, fileStatusProcessed, f.Status)
+		assert.Equal(t, len("imported content"), f.Bytes)
+	}
+}
+
+func TestImportUploadLimits(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.MaxFiles = 2
+	option.DeniedFilenames = []string{"*.exe"}
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	files := []File{
+		{ID: "file-kept", Filename: "kept.txt", Purpose: "assistants"},
+		{ID: "file-large", Filename: "large.txt", Purpose: "assistants"},
+		{ID: "file-denied", Filename: "tool.exe", Purpose: "assistants"},
+		{ID: "file-purpose", Filename: "other.txt", Purpose: "unknown"},
+		{ID: "file-second", Filename: "second.txt", Purpose: "assistants"},
+		{ID: "file-extra", Filename: "extra.txt", Purpose: "assistants"},
+	}
+	contents := [][]byte{
+		[]byte("kept"),
+		bytes.Repeat([]byte("a"), option.UploadLimitMB*1024*1024+1),
+		[]byte("denied"),
+		[]byte("purpose"),
+		[]byte("second"),
+		[]byte("extra"),
+	}
+	resp := callFilesImportEndpoint(t, app, buildImportArchive(t, files, contents))
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Data    []File   `json:"data"`
+		Skipped []string `json:"skipped"`
+	}
+	assert.NoError(t, json.Unmarshal(bodyToByteArray(resp, t), &result))
+	assert.Equal(t, []string{"file-large", "file-denied", "file-purpose", "file-extra"}, result.Skipped)
+	assert.Len(t, result.Data, 2)
+	assert.Len(t, defaultStore.files, 2, "the file count limit holds")
+}
+
+func TestDuplicateLookupOwners(t *testing.T) {
+	app, option, _ := startUpApp()
+	option.ApiKeys = []string{"alice", "bob", "carol"}
+	option.CrossPurposeDuplicatePolicy = crossPurposeDuplicateBlock
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	upload := func(key, name, purpose string, fields map[string]string) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", name)
+		part.Write([]byte("shared content"))
+		writer.WriteField("purpose", purpose)
+		for k, v := range fields {
+			writer.WriteField(k, v)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+key)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	alices := responseToFile(t, upload("alice", "alice.txt", "assistants", nil))
+
+	t.Run("another owner's file isn't deduplicated", func(t *testing.T) {
+		resp := upload("bob", "bob.txt", "assistants", map[string]string{"dedup": "true"})
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(deduplicatedHeader))
+		assert.NotEqual(t, alices.ID, responseToFile(t, resp).ID)
+	})
+	t.Run("another owner's content neither blocks nor shows", func(t *testing.T) {
+		resp := upload("carol", "carol.txt", "batch", nil)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(duplicateFileIDHeader))
+		assert.NotContains(t, bodyToString(resp, t), alices.ID)
+	})
+	t.Run("the owner's content is still found", func(t *testing.T) {
+		resp := upload("alice", "other.txt", "batch", nil)
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+		assert.Equal(t, rejectDuplicate, responseToError(t, resp).Code)
+	})
+}
+
+func TestUnstorableFilenames(t *testing.T) {
+	app, option, _ := startUpApp()
+	os.MkdirAll(option.UploadDir, 0755)
+	t.Cleanup(func() {
+		defaultStore.files = nil
+		os.RemoveAll(option.UploadDir)
+	})
+
+	for _, name := range []string{"..", ".", "/"} {
+		t.Run("upload "+name, func(t *testing.T) {
+			resp := callFilesUploadWithFields(t, app, name, []byte("content"), map[string]string{"purpose": "batch"})
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, rejectBadFilename, responseToError(t, resp).Code)
+		})
+	}
+	t.Run("batch", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "..")
+		part.Write([]byte("content"))
+		writer.WriteField("purpose", "batch")
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files/batch", body)
+		req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		var result BatchResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Empty(t, result.Results)
+		if assert.Len(t, result.Errors, 1) {
+			assert.Equal(t, rejectBadFilename, result.Errors[0].Reason)
+		}
+	})
+	t.Run("from url", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/files/from-url", strings.NewReader(`{"url":"http://example.com/..","purpose":"batch"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, rejectBadFilename, responseToError(t, resp).Code)
+	})
+	t.Run("import", func(t *testing.T) {
+		archive := buildImportArchive(t, []File{{ID: "file-dots", Filename: "..", Purpose: "batch"}}, [][]byte{[]byte("content")})
+		resp := callFilesImportEndpoint(t, app, archive)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		_, err := getFile("file-dots")
+		assert.ErrorIs(t, err, errFileNotFound)
+	})
+	t.Run("registered", func(t *testing.T) {
+		_, err := RegisterFile(option, strings.NewReader("content"), "", "batch")
+		assert.ErrorIs(t, err, errInvalidFilename)
+	})
+
+	// the directory of the purpose is left usable
+	assert.NoFileExists(t, filepath.Join(option.UploadDir, "batch"))
+	resp := callFilesUploadWithFields(t, app, "b.txt", []byte("content"), map[string]string{"purpose": "batch"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, purposeDir("batch"), storageName(option, File{ID: "file-x", Filename: "..", Purpose: "batch"}))
+}
@@ -0,0 +1,172 @@
+package openai
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"sync"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Bounds of the thumbnails sides.
+const (
+	defaultThumbnailSide = 128
+	maxThumbnailSide     = 1024
+)
+
+// maxCachedThumbnails bounds the number of thumbnails kept in memory.
+const maxCachedThumbnails = 256
+
+// thumbnailCache keeps the thumbnails generated recently, evicting the oldest
+// once full. It is used when no derived content cache is configured.
+type thumbnailCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	order   []string
+}
+
+var thumbnails = &thumbnailCache{entries: map[string][]byte{}}
+
+func (tc *thumbnailCache) get(key string) ([]byte, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	b, ok := tc.entries[key]
+	return b, ok
+}
+
+func (tc *thumbnailCache) put(key string, b []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.entries[key]; ok {
+		return
+	}
+	if len(tc.order) >= maxCachedThumbnails {
+		delete(tc.entries, tc.order[0])
+		tc.order = tc.order[1:]
+	}
+	tc.entries[key] = b
+	tc.order = append(tc.order, key)
+}
+
+// thumbnailSize fits an image of size into width x height, keeping its aspect
+// ratio. Images are never enlarged.
+func thumbnailSize(size image.Point, width, height int) (int, int) {
+	if size.X <= width && size.Y <= height {
+		return size.X, size.Y
+	}
+	if size.X*height > size.Y*width {
+		return width, max(1, size.Y*width/size.X)
+	}
+	return max(1, size.X*height/size.Y), height
+}
+
+// thumbnailKey identifies a thumbnail of f in the cache. It changes along with
+// the content of the file.
+func thumbnailKey(f File, width, height int, format string) string {
+	return fmt.Sprintf("%s/%d/%d/%s/%dx%d.%s", f.ID, f.CreatedAt.UnixNano(), f.Bytes, f.Sha256, width, height, format)
+}
+
+// ThumbnailFilesEndpoint streams a thumbnail of an image file fitting in the w
+// and h query parameters, as a JPEG or, with format=png, a PNG.
+func ThumbnailFilesEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		file, err := getFileFromRequest(c, o)
+		if err != nil {
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+		if !isImageFile(*file) {
+			return sendFileError(c, fiber.StatusUnsupportedMediaType, codeUnsupportedMediaType, fmt.Sprintf("File %s is not an image", file.Filename))
+		}
+
+		side := func(name string) (int, error) {
+			v := c.Query(name)
+			if v == "" {
+				return defaultThumbnailSide, nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxThumbnailSide {
+				return 0, fmt.Errorf("%s must be between 1 and %d", name, maxThumbnailSide)
+			}
+			return n, nil
+		}
+		width, err := side("w")
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+		height, err := side("h")
+		if err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+		format := c.Query("format", "jpeg")
+		if format != "jpeg" && format != "png" {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported thumbnail format %q", format))
+		}
+
+		dc := derivedCacheFor(o)
+		transform := fmt.Sprintf("thumbnail&%dx%d.%s", width, height, format)
+		key := thumbnailKey(*file, width, height, format)
+		if dc != nil {
+			if cached, ok := dc.open(*file, transform); ok {
+				return sendDerivedContent(c, "image/"+format, cached, true)
+			}
+		} else if b, ok := thumbnails.get(key); ok {
+			c.Set(fiber.HeaderContentType, "image/"+format)
+			return c.Send(b)
+		}
+
+		rc, err := openDecodedContent(c.UserContext(), o, *file)
+		if errors.Is(err, errFileOperationTimeout) {
+			return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out opening file: %s", file.Filename))
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+		defer rc.Close()
+
+		img, err := decodeImage(rc)
+		if errors.Is(err, errImageTooLarge) {
+			return sendFileError(c, fiber.StatusUnprocessableEntity, codeInvalidRequest, fmt.Sprintf("Unable to thumbnail %s: %s", file.Filename, err))
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusUnsupportedMediaType, codeUnsupportedMediaType, fmt.Sprintf("Unable to decode image %s: %s", file.Filename, err))
+		}
+		w, h := thumbnailSize(img.Bounds().Size(), width, height)
+
+		var buf bytes.Buffer
+		thumbnail := resizeImage(img, w, h)
+		if format == "png" {
+			err = png.Encode(&buf, thumbnail)
+		} else {
+			err = jpeg.Encode(&buf, thumbnail, nil)
+		}
+		if err != nil {
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, err.Error())
+		}
+
+		if dc != nil {
+			cached, err := dc.store(*file, transform, func(w io.Writer) error {
+				_, err := w.Write(buf.Bytes())
+				return err
+			})
+			if err != nil {
+				log.Warn().Msgf("Unable to cache thumbnail of %s: %s", file.ID, err)
+			} else {
+				cached.Close()
+			}
+			c.Set("X-Cache", "MISS")
+		} else {
+			thumbnails.put(key, buf.Bytes())
+		}
+		c.Set(fiber.HeaderContentType, "image/"+format)
+		return c.Send(buf.Bytes())
+	}
+}
@@ -0,0 +1,228 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	config "github.com/go-skynet/LocalAI/api/config"
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/go-skynet/LocalAI/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// errEncryptionKeyChange is returned when moving a file between purposes
+// encrypted with different keys, its content being only readable with the key
+// of its purpose.
+var errEncryptionKeyChange = errors.New("files can't change to a purpose encrypted with another key")
+
+// errStorageTaken is returned when moving a file to a path already holding
+// content, which is never replaced.
+var errStorageTaken = errors.New("a file is already stored under the new name")
+
+// UpdateFileEndpoint renames a file or changes its purpose, keeping its ID so
+// that references to it stay valid. The content is moved to where files of
+// the new name and purpose are stored.
+func UpdateFileEndpoint(cm *config.ConfigLoader, o *options.Option) func(c *fiber.Ctx) error {
+	type UpdateFileRequest struct {
+		Filename *string `json:"filename"`
+		Purpose  *string `json:"purpose"`
+	}
+	return func(c *fiber.Ctx) error {
+		file, err := getFileFromRequest(c, o)
+		if err != nil {
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		}
+
+		var req UpdateFileRequest
+		dec := json.NewDecoder(bytes.NewReader(c.Body()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		}
+		if req.Filename == nil && req.Purpose == nil {
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, "Nothing to update, set filename or purpose")
+		}
+
+		updated := *file
+		if req.Filename != nil {
+			// the name is shown as sent, like the one of an upload, only its
+			// sanitized form is used to store the file
+			updated.Filename = strings.TrimSpace(*req.Filename)
+			if !storableName(utils.SanitizeFileName(updated.Filename)) {
+				return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid filename %q", *req.Filename))
+			}
+			if r := rejectionFor(checkFilenameAllowed(o, updated.Filename)); r != nil {
+				return sendRejection(c, r)
+			}
+		}
+		if req.Purpose != nil {
+			updated.Purpose = strings.TrimSpace(*req.Purpose)
+			if updated.Purpose == "" {
+				return sendFileError(c, fiber.StatusBadRequest, rejectMissingPurpose, "Purpose is not defined")
+			}
+			if r := rejectionFor(checkPurposeAllowed(o, updated.Purpose)); r != nil {
+				return sendRejection(c, r)
+			}
+		}
+		if updated.Filename == file.Filename && updated.Purpose == file.Purpose {
+			files := []File{*file}
+			presentFiles(c, o, files)
+			return sendJSON(c, files[0])
+		}
+
+		if err := checkFileMutable(o, *file); err != nil {
+			return sendFileError(c, fiber.StatusConflict, batchErrorCode(err), err.Error())
+		}
+		// the new name stays free until the file is moved under it
+		defaultStore.renameMu.Lock()
+		if existing, ok := indexedUpload(file.OwnerKey, updated.Purpose, updated.Filename); !ok || existing.ID != file.ID {
+			if r := rejectionFor(checkFileConflict(o, file.OwnerKey, updated.Purpose, updated.Filename)); r != nil {
+				defaultStore.renameMu.Unlock()
+				return sendRejection(c, r)
+			}
+		}
+		err = moveFile(c.UserContext(), o, *file, &updated)
+		defaultStore.renameMu.Unlock()
+
+		switch {
+		case errors.Is(err, errFileNotFound):
+			return sendFileError(c, fiber.StatusNotFound, codeFileNotFound, err.Error())
+		case errors.Is(err, errStorageTaken):
+			return sendFileError(c, fiber.StatusBadRequest, rejectFileExists, err.Error())
+		case errors.Is(err, errEncryptionKeyChange):
+			return sendFileError(c, fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+		case errors.Is(err, errFileOperationTimeout):
+			return sendFileError(c, fiber.StatusGatewayTimeout, codeTimeout, fmt.Sprintf("Timed out moving file: %s", file.Filename))
+		case errors.Is(err, errBackendUnavailable):
+			return sendFileError(c, fiber.StatusServiceUnavailable, codeBackendUnavailable, err.Error())
+		case err != nil:
+			return sendFileError(c, fiber.StatusInternalServerError, codeInternalError, fmt.Sprintf("Unable to move file: %s, %v", file.Filename, err))
+		}
+		saveUploadConfig(o)
+
+		files := []File{updated}
+		presentFiles(c, o, files)
+		return sendJSON(c, files[0])
+	}
+}
+
+// moveFile gives f the name and purpose of updated, in the index and in the
+// storage. The content of content-addressed files is copied to the blob of
+// the new purpose when it differs, the previous one being released, and the
+// other files are moved to the path of their new name.
+func moveFile(ctx context.Context, o *options.Option, f File, updated *File) error {
+	oldKey, _ := encryptionKey(o, f.Purpose)
+	newKey, _ := encryptionKey(o, updated.Purpose)
+	if !bytes.Equal(oldKey, newKey) {
+		return errEncryptionKeyChange
+	}
+
+	apply := func() error {
+		ok := updateUploadedFile(f.ID, func(indexed *File) {
+			indexed.Filename, indexed.Purpose, indexed.Path = updated.Filename, updated.Purpose, updated.Path
+			*updated = *indexed
+		})
+		if !ok {
+			return fmt.Errorf("%w %s", errFileNotFound, f.ID)
+		}
+		return nil
+	}
+
+	fromBackend, toBackend := defaultStore.backendFor(o, f.Purpose), defaultStore.backendFor(o, updated.Purpose)
+	if o.ContentAddressedFiles && f.Sha256 != "" {
+		from, to := blobName(o, f.Sha256, f.Purpose), blobName(o, f.Sha256, updated.Purpose)
+		if from == to {
+			return apply()
+		}
+
+		defaultStore.blobsMu.Lock()
+		defer defaultStore.blobsMu.Unlock()
+		if defaultStore.blobRefs(o, to) == 0 {
+			if err := copyStoredContent(ctx, o, fromBackend, blobPath(o.UploadDir, from), toBackend, blobPath(o.UploadDir, to)); err != nil {
+				return err
+			}
+		}
+		if err := apply(); err != nil {
+			if rerr := defaultStore.releaseBlob(ctx, o, updated.Purpose, to); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				log.Error().Msgf("Unable to release blob %s of moved file %s: %v", f.Sha256, f.ID, rerr)
+			}
+			return err
+		}
+		if err := defaultStore.releaseBlob(ctx, o, f.Purpose, from); err != nil && !errors.Is(err, os.ErrNotExist) {
+			// the file is moved, only an unreferenced blob is left behind
+			log.Error().Msgf("Unable to release blob %s of moved file %s: %v", f.Sha256, f.ID, err)
+		}
+		return nil
+	}
+
+	updated.Path = defaultStore.freeStorageName(o, *updated)
+	from, to := storagePath(o, f), storagePath(o, *updated)
+	if from != to || !sameBackend(fromBackend, toBackend) {
+		if err := moveStoredContent(ctx, o, fromBackend, from, toBackend, to); err != nil {
+			return err
+		}
+	}
+	if err := apply(); err != nil {
+		// the file was deleted meanwhile, don't leave its content behind
+		removeWithTimeout(ctx, toBackend, o.FileRemoveTimeout, to)
+		return err
+	}
+	return nil
+}
+
+// sameBackend reports whether a and b are the same backend. Backends of types
+// that can't be compared are taken as different.
+func sameBackend(a, b fileBackend) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// copyStoredContent copies the stored bytes at from to to, as they are.
+func copyStoredContent(ctx context.Context, o *options.Option, fromBackend fileBackend, from string, toBackend fileBackend, to string) error {
+	rc, err := openWithTimeout(ctx, fromBackend, o.FileOpenTimeout, from)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return saveWithTimeout(ctx, toBackend, o.FileSaveTimeout, to, rc)
+}
+
+// moveStoredContent moves the stored bytes at from to to, failing with
+// errStorageTaken when to already holds content. Files of the local disk are
+// renamed, the others copied then removed.
+func moveStoredContent(ctx context.Context, o *options.Option, fromBackend fileBackend, from string, toBackend fileBackend, to string) error {
+	rc, err := openWithTimeout(ctx, toBackend, o.FileOpenTimeout, to)
+	if err == nil {
+		rc.Close()
+		return errStorageTaken
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// a local disk behind retries is still renamed in place
+	_, fromLocal := unwrapBackend(fromBackend).(localBackend)
+	_, toLocal := unwrapBackend(toBackend).(localBackend)
+	if fromLocal && toLocal {
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	}
+
+	if err := copyStoredContent(ctx, o, fromBackend, from, toBackend, to); err != nil {
+		return err
+	}
+	if err := removeWithTimeout(ctx, fromBackend, o.FileRemoveTimeout, from); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("Unable to remove %s once moved to %s: %v", from, to, err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/go-skynet/LocalAI/api/options"
+	"github.com/rs/zerolog/log"
+)
+
+// Processing states reported in File.Status.
+const (
+	fileStatusProcessing = "processing"
+	fileStatusProcessed  = "processed"
+	fileStatusError      = "error"
+	// the content no longer matches its checksum, see VerifyOnRead
+	fileStatusQuarantined = "quarantined"
+)
+
+// validatorPool bounds how many validators run at the same time, so a burst of
+// large uploads queues up instead of pegging every CPU.
+type validatorPool struct {
+	slots chan struct{}
+}
+
+func (p *validatorPool) run(validate func() error) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	return validate()
+}
+
+// validatorPool returns the pool of the validators run by s with o.
+func (s *FileStore) validatorPool(o *options.Option) *validatorPool {
+	if p, ok := s.validatorPools.Load(o); ok {
+		return p.(*validatorPool)
+	}
+
+	size := o.MaxConcurrentValidators
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p, _ := s.validatorPools.LoadOrStore(o, &validatorPool{slots: make(chan struct{}, size)})
+	return p.(*validatorPool)
+}
+
+// validateContent runs the validator registered for purpose, if any, against
+// r in the validators pool. The content is rewound afterwards.
+func (s *FileStore) validateContent(o *options.Option, purpose string, r io.ReadSeeker) error {
+	validate, ok := o.FileValidators[purpose]
+	if !ok {
+		return nil
+	}
+
+	err := s.validatorPool(o).run(func() error {
+		return validate(r)
+	})
+	if _, serr := r.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// fineTunePurpose is the purpose of training data, checked with
+// ValidateFineTuneFiles.
+const fineTunePurpose = "fine-tune"
+
+// validateFineTuneJSONL checks that every line of r is a training example:
+// a JSON object holding either a prompt and a completion, or a non empty list
+// of chat messages with a role and a content. Blank lines are skipped.
+func validateFineTuneJSONL(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	examples := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var example struct {
+			Prompt     *string `json:"prompt"`
+			Completion *string `json:"completion"`
+			Messages   []struct {
+				Role    string          `json:"role"`
+				Content json.RawMessage `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &example); err != nil {
+			return fmt.Errorf("line %d: invalid JSON: %w", line, err)
+		}
+
+		switch {
+		case example.Messages != nil:
+			if len(example.Messages) == 0 {
+				return fmt.Errorf("line %d: messages is empty", line)
+			}
+			for i, m := range example.Messages {
+				if m.Role == "" || len(m.Content) == 0 {
+					return fmt.Errorf("line %d: message %d must have a role and a content", line, i)
+				}
+			}
+		case example.Prompt == nil || example.Completion == nil:
+			return fmt.Errorf("line %d: expected prompt and completion, or messages", line)
+		}
+		examples++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if examples == 0 {
+		return errors.New("no training examples")
+	}
+	return nil
+}
+
+// Metadata keys exposing the retries of a validation, set when
+// ValidationRetries is.
+const (
+	validationAttemptsMetadataKey = "validation_attempts"
+	validationRetryMetadataKey    = "validation_retry_at"
+)
+
+// isTransientValidationError tells whether a validation failed for a reason
+// worth retrying: the validator said so, or the content couldn't be read.
+func isTransientValidationError(err error) bool {
+	var transient *options.TransientValidationError
+	return errors.As(err, &transient) ||
+		errors.Is(err, errFileOperationTimeout) || errors.Is(err, errBackendUnavailable)
+}
+
+// validateAsync validates the stored content of f in the background and
+// records the outcome in its status. Transient failures are retried up to
+// ValidationRetries times, the file staying in the processing status until
+// then.
+func (s *FileStore) validateAsync(o *options.Option, f File) {
+	validate := o.FileValidators[f.Purpose]
+
+	go func() {
+		var err error
+		attempt := 1
+		for ; ; attempt++ {
+			err = s.validatorPool(o).run(func() error {
+				rc, err := s.openDecodedContent(context.Background(), o, f)
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				return validate(rc)
+			})
+			if err == nil || attempt > o.ValidationRetries || !isTransientValidationError(err) {
+				break
+			}
+
+			delay := o.ValidationRetryBackoff << (attempt - 1)
+			log.Warn().Msgf("Validation of file %s failed, retrying in %s: %s", f.ID, delay, err)
+			found := s.update(f.ID, func(f *File) {
+				f.StatusDetails = err.Error()
+				f.Metadata = patchMetadata(f.Metadata, map[string]string{
+					validationAttemptsMetadataKey: strconv.Itoa(attempt),
+					validationRetryMetadataKey:    time.Now().Add(delay).UTC().Format(time.RFC3339),
+				}, nil)
+			})
+			if !found {
+				// deleted in the meantime
+				return
+			}
+			s.save(o)
+			time.Sleep(delay)
+		}
+
+		status, details := fileStatusProcessed, ""
+		if err != nil {
+			log.Warn().Msgf("Validation of file %s failed: %s", f.ID, err)
+			status, details = fileStatusError, err.Error()
+		}
+
+		s.update(f.ID, func(f *File) {
+			f.Status = status
+			f.StatusDetails = details
+			if o.ValidationRetries > 0 {
+				f.Metadata = patchMetadata(f.Metadata, map[string]string{
+					validationAttemptsMetadataKey: strconv.Itoa(attempt),
+				}, []string{validationRetryMetadataKey})
+			}
+		})
+
+		s.save(o)
+	}()
+}
@@ -0,0 +1,51 @@
+package openai
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-skynet/LocalAI/pkg/utils"
+)
+
+// uploadWarnings lists what storing f changed of the upload or noticed about
+// it without refusing it.
+func uploadWarnings(f File) []string {
+	var warnings []string
+	if name := utils.SanitizeFileName(f.Filename); name != f.Filename {
+		warnings = append(warnings, fmt.Sprintf("filename sanitized to %q for storage", name))
+	}
+	if f.Extension != "" {
+		warnings = append(warnings, fmt.Sprintf("extension %s of the content appended to the download name", f.Extension))
+	}
+	if f.LineEndingsNormalized {
+		warnings = append(warnings, "CRLF line endings converted to LF")
+	}
+	if ext := filepath.Ext(f.Filename); ext != "" && f.ContentType != "" {
+		expected := baseContentType(mime.TypeByExtension(ext))
+		sniffed := baseContentType(f.ContentType)
+		if expected != "" && expected != sniffed && sniffed != "application/octet-stream" && !(textContentType(expected) && textContentType(sniffed)) {
+			warnings = append(warnings, fmt.Sprintf("content type %s doesn't match the %s extension", sniffed, ext))
+		}
+	}
+	return warnings
+}
+
+// warnUploads sets the warnings of the uploaded files of a response.
+func warnUploads(files []File) {
+	for i := range files {
+		files[i].Warnings = uploadWarnings(files[i])
+	}
+}
+
+func baseContentType(ctype string) string {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	return strings.ToLower(strings.TrimSpace(ctype))
+}
+
+// textContentType tells the types sniffed as plain text, which the content
+// of a text file of any format may be taken for.
+func textContentType(ctype string) bool {
+	return strings.HasPrefix(ctype, "text/") || strings.HasSuffix(ctype, "json") || strings.HasSuffix(ctype, "xml") || ctype == "application/javascript"
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"io"
 	"time"
 
+	"github.com/go-skynet/LocalAI/api/schema"
 	"github.com/go-skynet/LocalAI/metrics"
 	"github.com/go-skynet/LocalAI/pkg/gallery"
 	model "github.com/go-skynet/LocalAI/pkg/model"
@@ -50,10 +52,280 @@ type Option struct {
 	ModelsURL []string
 
 	WatchDogBusyTimeout, WatchDogIdleTimeout time.Duration
-}
+
+	// Timeouts applied to the files API storage operations. Zero disables them.
+	FileSaveTimeout, FileOpenTimeout, FileRemoveTimeout time.Duration
+
+	// Default ordering of the files list ("created_at", "filename" or "bytes"
+	// sorted "asc" or "desc"). Empty keeps insertion order.
+	FilesListSort, FilesListOrder string
+
+	// Store uploaded bytes under their checksum so identical uploads share one
+	// blob. Not meant to be toggled on an existing upload dir.
+	ContentAddressedFiles bool
+
+	// How often orphan blobs are collected, and how old they must be.
+	BlobCompactionInterval, BlobCompactionGracePeriod time.Duration
+
+	// AES keys used to encrypt uploaded files at rest, by purpose. The "*"
+	// entry applies to purposes without a dedicated key. Empty disables
+	// encryption.
+	FileEncryptionKeys map[string][]byte
+
+	// Validators run against uploaded content, by purpose. At most
+	// MaxConcurrentValidators run at once (defaults to the number of CPUs).
+	// With AsyncFileValidation uploads return right away with a "processing"
+	// status instead of waiting for the outcome.
+	FileValidators          map[string]FileValidator
+	MaxConcurrentValidators int
+	AsyncFileValidation     bool
+
+	// How many times async validations failing with a TransientValidationError
+	// are run again, waiting ValidationRetryBackoff before the first retry and
+	// twice as long before each of the next ones
+	ValidationRetries      int
+	ValidationRetryBackoff time.Duration
+
+	// Key used to sign the manifest of exported files archives, and to verify
+	// it on import.
+	FilesExportSigningKey []byte
+
+	// Cache serialized files listings for up to FilesListCacheTTL, keeping at
+	// most FilesListCacheSize of them. Any change to the files drops them.
+	FilesListCacheTTL  time.Duration
+	FilesListCacheSize int
+
+	// Limits on the total size and number of uploaded files. Zero disables them.
+	MaxTotalStorageMB, MaxFiles int
+
+	// Free space to keep on the upload filesystem, uploads that would eat
+	// into it are refused. Zero disables the check.
+	MinFreeDiskMB int
+
+	// Reserve the space of uploads on disk before writing them, where the
+	// filesystem supports it, so that a full disk fails them early
+	PreallocateUploads bool
+
+	// Write-once mode: files can't be overwritten or updated once created
+	WORMFiles bool
+
+	// Keys granting access to the admin endpoints
+	AdminApiKeys []string
+
+	// Tenant of the files uploaded with each API key, when keys are required
+	TenantKeys map[string]string
+
+	// What to do when the stored size of a file differs from its content:
+	// "correct" the index, report an "error", or "ignore" it (the default)
+	SizeMismatchPolicy string
+
+	// What to do when the content of a downloaded file is missing from the
+	// storage: "prune" the file from the index, "keep" it, both answering
+	// not found, or report an "error" (the default)
+	MissingContentPolicy string
+
+	// Bounds fetching a file uploaded from a URL
+	FileFetchTimeout time.Duration
+
+	// Restricts API keys to some of the "read", "write" and "delete" files
+	// scopes. Keys not listed are granted every scope.
+	ApiKeyScopes map[string][]string
+
+	// Retries of failed files backend calls, with a jittered exponential
+	// backoff starting at FileBackendRetryBackoff
+	FileBackendRetries      int
+	FileBackendRetryBackoff time.Duration
+	// Consecutive failures opening the files backend circuit breaker, and how
+	// long it stays open before probing the backend again. Zero disables it.
+	FileBackendBreakerThreshold int
+	FileBackendBreakerCooldown  time.Duration
+
+	// Naming template of exported archive entries, made of {id}, {purpose}
+	// and {filename}, and the top-level directory holding them
+	FilesExportNaming, FilesExportRootDir string
+
+	// Files read at once while exporting an archive, or extracted at once
+	// while importing one (one at a time when 0)
+	FilesArchiveConcurrency int
+
+	// Largest page of files a list request can get, larger limits are
+	// clamped. Defaults to 10000, requests without a limit get 20 files.
+	MaxFilesListLimit int
+
+	// Answer 406 to file content requests whose Accept header doesn't match
+	// the type of the file
+	FilesContentNegotiation bool
+
+	// Don't record the client IP, user agent and API key of uploads
+	DisableUploadSourceCapture bool
+
+	// Purposes whose uploads get their CRLF line endings converted to LF
+	NormalizeLineEndings map[string]bool
+
+	// Purposes uploads may be made for, the ones recognized by OpenAI when
+	// empty. A "*" entry accepts any purpose
+	AllowedPurposes []string
+
+	// File names, or glob patterns, uploads can't use whatever their purpose
+	DeniedFilenames []string
+
+	// Labels added to the metadata of every new file, unless the client sets
+	// the same key
+	DefaultMetadata map[string]string
+
+	// Whether files uploaded without an extension are served with the one of
+	// their sniffed type ("append") or as uploaded ("preserve", the default)
+	ExtensionlessFilenamePolicy string
+
+	// Limits on the labels clients attach to files, defaulting to 16 keys of
+	// up to 64 characters with values of up to 512
+	MaxMetadataKeys        int
+	MaxMetadataKeyLength   int
+	MaxMetadataValueLength int
+
+	// What to do when the files index can't be loaded: "rebuild" it from the
+	// files on disk (the default), start "empty", or "fail-fast"
+	IndexLoadFailurePolicy string
+
+	// Log one in every N successful file downloads, failed ones always are.
+	// Successful downloads aren't logged when unset.
+	FileAccessLogSampling int
+
+	// Keep the files index in memory only, forgetting every file on restart
+	EphemeralIndex bool
+
+	// Bounds the wall clock time of an upload, from reading the request to
+	// storing the file. Requires StreamUploads, so that the body is cut off
+	// while it arrives
+	MaxUploadDuration time.Duration
+
+	// Read upload bodies as they arrive instead of buffering them, so that
+	// uploads are copied to disk in a bounded way and refused as soon as they
+	// exceed UploadLimitMB. The bodies of the other endpoints are still read
+	// whole and bounded by UploadLimitMB.
+	StreamUploads bool
+
+	// Match the purpose filter of listings exactly. By default the case of
+	// purposes is ignored, so that "Fine-Tune" lists the "fine-tune" files.
+	StrictPurposeMatching bool
+
+	// Public address of the API (e.g. "https://ai.example.com"), used to link
+	// files to their content in responses
+	FilesBaseURL string
+
+	// Check the checksum of files on every download, quarantining those whose
+	// content changed. Checksums are only recorded for files stored with it set.
+	VerifyOnRead bool
+
+	// Default lifetime of uploaded files, unless the upload sets expires_after.
+	// Files are kept until deleted when unset. Expired files are deleted
+	// every FileReapInterval (defaults to a minute).
+	FileTTL          time.Duration
+	FileReapInterval time.Duration
+
+	// Backend storing the files and their index, e.g. on object storage for
+	// servers without a persistent disk. Files are kept under UploadDir on the
+	// local disk when unset.
+	FilesBackend FileBackend
+
+	// Backends storing the files of some purposes instead of the default one,
+	// e.g. to keep images on fast disks and archives on object storage
+	PurposeBackends map[string]FileBackend
+
+	// Let several files share the same name, storing each of them under its
+	// ID instead of rejecting the uploads of names already taken
+	AllowDuplicateFilenames bool
+
+	// Downloads of a same file served at once, the excess ones being
+	// rejected (unlimited when 0)
+	MaxConcurrentFileDownloads int
+
+	// Check that fine-tune uploads are JSONL training data, each line holding
+	// a prompt and a completion or chat messages
+	ValidateFineTuneFiles bool
+
+	// What to do when an upload has the content of a file of another purpose:
+	// "warn" about it, "block" it, or "allow" it (the default). The existing
+	// file is named in the response headers; only files stored with this set
+	// have the checksum needed to compare them.
+	CrossPurposeDuplicatePolicy string
+
+	// Hooks run in order around every upload
+	PreUpload  []PreUploadHook
+	PostUpload []PostUploadHook
+
+	// Mirrors the metadata of the files to an external catalog. Failed calls
+	// are retried MetadataSinkRetries times, waiting MetadataSinkRetryBackoff
+	// before the first retry and twice as long before each of the next ones
+	MetadataSink             MetadataSink
+	MetadataSinkRetries      int
+	MetadataSinkRetryBackoff time.Duration
+
+	// Directory caching the outputs of the convert and thumbnail endpoints,
+	// by file and parameters, disabled when empty. It holds up to
+	// DerivedContentCacheMB (256 by default), evicting the least recently
+	// used outputs first
+	DerivedContentCacheDir string
+	DerivedContentCacheMB  int
+
+	// Header naming the owner of the files when no API key is configured,
+	// each client then only seeing its own files. Files stay shared by every
+	// client when it is empty. With API keys, files are always owned by the
+	// key that uploaded them
+	FilesOwnerHeader string
+}
+
+// FileValidator checks the content of an uploaded file, returning an error
+// when it must be rejected.
+type FileValidator func(r io.Reader) error
+
+// TransientValidationError is returned by a validator failing for a reason
+// unrelated to the content, e.g. a dependency being briefly unavailable, so
+// that the validation is retried.
+type TransientValidationError struct {
+	Err error
+}
+
+func (e *TransientValidationError) Error() string { return e.Err.Error() }
+
+func (e *TransientValidationError) Unwrap() error { return e.Err }
 
 type AppOption func(*Option)
 
+// PreUploadHook runs before an upload is stored. Returning an error aborts the
+// upload, answering the status of an *UploadHookError or 400.
+type PreUploadHook func(ctx context.Context, req schema.UploadRequest) error
+
+// PostUploadHook runs once an upload is stored.
+type PostUploadHook func(ctx context.Context, req schema.UploadRequest, f schema.File)
+
+// UploadHookError aborts an upload with the given status.
+type UploadHookError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadHookError) Error() string {
+	return e.Message
+}
+
+// FileBackend stores, reads and removes the bytes of uploaded files. Opening
+// or removing a missing file returns an error matching os.ErrNotExist.
+type FileBackend interface {
+	Save(ctx context.Context, path string, r io.Reader) error
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	Remove(ctx context.Context, path string) error
+}
+
+// MetadataSink is told about every file added to the index, changed in it or
+// removed from it, in the order of the changes. Its errors are logged and
+// never fail the change.
+type MetadataSink interface {
+	FileCreated(ctx context.Context, f schema.File) error
+	FileUpdated(ctx context.Context, f schema.File) error
+	FileDeleted(ctx context.Context, f schema.File) error
+}
+
 func NewOptions(o ...AppOption) *Option {
 	opt := &Option{
 		Context:        context.Background(),
@@ -267,3 +539,364 @@ func WithMetrics(meter *metrics.Metrics) AppOption {
 		o.Metrics = meter
 	}
 }
+
+func WithFileSaveTimeout(t time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileSaveTimeout = t
+	}
+}
+
+func WithFileOpenTimeout(t time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileOpenTimeout = t
+	}
+}
+
+func WithFileRemoveTimeout(t time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileRemoveTimeout = t
+	}
+}
+
+func WithFilesListOrdering(sort, order string) AppOption {
+	return func(o *Option) {
+		o.FilesListSort = sort
+		o.FilesListOrder = order
+	}
+}
+
+var EnableContentAddressedFiles = func(o *Option) {
+	o.ContentAddressedFiles = true
+}
+
+func WithBlobCompaction(interval, gracePeriod time.Duration) AppOption {
+	return func(o *Option) {
+		o.BlobCompactionInterval = interval
+		o.BlobCompactionGracePeriod = gracePeriod
+	}
+}
+
+func WithFileEncryptionKey(purpose string, key []byte) AppOption {
+	return func(o *Option) {
+		if o.FileEncryptionKeys == nil {
+			o.FileEncryptionKeys = make(map[string][]byte)
+		}
+		o.FileEncryptionKeys[purpose] = key
+	}
+}
+
+func WithFileValidator(purpose string, v FileValidator) AppOption {
+	return func(o *Option) {
+		if o.FileValidators == nil {
+			o.FileValidators = make(map[string]FileValidator)
+		}
+		o.FileValidators[purpose] = v
+	}
+}
+
+func WithMaxConcurrentValidators(n int) AppOption {
+	return func(o *Option) {
+		o.MaxConcurrentValidators = n
+	}
+}
+
+var EnableAsyncFileValidation = func(o *Option) {
+	o.AsyncFileValidation = true
+}
+
+func WithValidationRetries(retries int, backoff time.Duration) AppOption {
+	return func(o *Option) {
+		o.ValidationRetries = retries
+		o.ValidationRetryBackoff = backoff
+	}
+}
+
+func WithFilesExportSigningKey(key []byte) AppOption {
+	return func(o *Option) {
+		o.FilesExportSigningKey = key
+	}
+}
+
+func WithFilesListCache(ttl time.Duration, size int) AppOption {
+	return func(o *Option) {
+		o.FilesListCacheTTL = ttl
+		o.FilesListCacheSize = size
+	}
+}
+
+func WithMaxTotalStorageMB(limit int) AppOption {
+	return func(o *Option) {
+		o.MaxTotalStorageMB = limit
+	}
+}
+
+func WithMaxFiles(limit int) AppOption {
+	return func(o *Option) {
+		o.MaxFiles = limit
+	}
+}
+
+func WithMinFreeDiskMB(reserve int) AppOption {
+	return func(o *Option) {
+		o.MinFreeDiskMB = reserve
+	}
+}
+
+var EnableWORMFiles = func(o *Option) {
+	o.WORMFiles = true
+}
+
+func WithAdminApiKeys(keys []string) AppOption {
+	return func(o *Option) {
+		o.AdminApiKeys = keys
+	}
+}
+
+func WithTenantKeys(keys map[string]string) AppOption {
+	return func(o *Option) {
+		o.TenantKeys = keys
+	}
+}
+
+func WithSizeMismatchPolicy(policy string) AppOption {
+	return func(o *Option) {
+		o.SizeMismatchPolicy = policy
+	}
+}
+
+func WithFileFetchTimeout(timeout time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileFetchTimeout = timeout
+	}
+}
+
+func WithApiKeyScopes(key string, scopes ...string) AppOption {
+	return func(o *Option) {
+		if o.ApiKeyScopes == nil {
+			o.ApiKeyScopes = map[string][]string{}
+		}
+		o.ApiKeyScopes[key] = scopes
+	}
+}
+
+func WithFileBackendRetries(retries int, backoff time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileBackendRetries = retries
+		o.FileBackendRetryBackoff = backoff
+	}
+}
+
+func WithFileBackendBreaker(threshold int, cooldown time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileBackendBreakerThreshold = threshold
+		o.FileBackendBreakerCooldown = cooldown
+	}
+}
+
+func WithFilesExportNaming(naming, rootDir string) AppOption {
+	return func(o *Option) {
+		o.FilesExportNaming = naming
+		o.FilesExportRootDir = rootDir
+	}
+}
+
+func WithMaxFilesListLimit(limit int) AppOption {
+	return func(o *Option) {
+		o.MaxFilesListLimit = limit
+	}
+}
+
+var EnableFilesContentNegotiation = func(o *Option) {
+	o.FilesContentNegotiation = true
+}
+
+func WithPreUploadHook(hook PreUploadHook) AppOption {
+	return func(o *Option) {
+		o.PreUpload = append(o.PreUpload, hook)
+	}
+}
+
+func WithPostUploadHook(hook PostUploadHook) AppOption {
+	return func(o *Option) {
+		o.PostUpload = append(o.PostUpload, hook)
+	}
+}
+
+var DisableUploadSourceCapture = func(o *Option) {
+	o.DisableUploadSourceCapture = true
+}
+
+func WithNormalizedLineEndings(purposes ...string) AppOption {
+	return func(o *Option) {
+		if o.NormalizeLineEndings == nil {
+			o.NormalizeLineEndings = make(map[string]bool)
+		}
+		for _, purpose := range purposes {
+			o.NormalizeLineEndings[purpose] = true
+		}
+	}
+}
+
+func WithDeniedFilenames(patterns ...string) AppOption {
+	return func(o *Option) {
+		o.DeniedFilenames = append(o.DeniedFilenames, patterns...)
+	}
+}
+
+func WithDefaultMetadata(metadata map[string]string) AppOption {
+	return func(o *Option) {
+		o.DefaultMetadata = metadata
+	}
+}
+
+func WithExtensionlessFilenamePolicy(policy string) AppOption {
+	return func(o *Option) {
+		o.ExtensionlessFilenamePolicy = policy
+	}
+}
+
+func WithMaxMetadata(keys, keyLength, valueLength int) AppOption {
+	return func(o *Option) {
+		o.MaxMetadataKeys = keys
+		o.MaxMetadataKeyLength = keyLength
+		o.MaxMetadataValueLength = valueLength
+	}
+}
+
+func WithIndexLoadFailurePolicy(policy string) AppOption {
+	return func(o *Option) {
+		o.IndexLoadFailurePolicy = policy
+	}
+}
+
+func WithFileAccessLogSampling(n int) AppOption {
+	return func(o *Option) {
+		o.FileAccessLogSampling = n
+	}
+}
+
+var EnableEphemeralIndex = func(o *Option) {
+	o.EphemeralIndex = true
+}
+
+func WithMaxUploadDuration(d time.Duration) AppOption {
+	return func(o *Option) {
+		o.MaxUploadDuration = d
+	}
+}
+
+var EnableStrictPurposeMatching = func(o *Option) {
+	o.StrictPurposeMatching = true
+}
+
+func WithFilesBaseURL(url string) AppOption {
+	return func(o *Option) {
+		o.FilesBaseURL = url
+	}
+}
+
+var EnableVerifyOnRead = func(o *Option) {
+	o.VerifyOnRead = true
+}
+
+// WithPurposeBackend stores the files of purpose on backend.
+func WithPurposeBackend(purpose string, backend FileBackend) AppOption {
+	return func(o *Option) {
+		if o.PurposeBackends == nil {
+			o.PurposeBackends = map[string]FileBackend{}
+		}
+		o.PurposeBackends[purpose] = backend
+	}
+}
+
+var EnableDuplicateFilenames = func(o *Option) {
+	o.AllowDuplicateFilenames = true
+}
+
+func WithMaxConcurrentFileDownloads(n int) AppOption {
+	return func(o *Option) {
+		o.MaxConcurrentFileDownloads = n
+	}
+}
+
+var EnableUploadPreallocation = func(o *Option) {
+	o.PreallocateUploads = true
+}
+
+var EnableFineTuneValidation = func(o *Option) {
+	o.ValidateFineTuneFiles = true
+}
+
+func WithCrossPurposeDuplicatePolicy(policy string) AppOption {
+	return func(o *Option) {
+		o.CrossPurposeDuplicatePolicy = policy
+	}
+}
+
+// WithFilesBackend stores the files and their index on backend instead of the
+// local disk.
+func WithFilesBackend(backend FileBackend) AppOption {
+	return func(o *Option) {
+		o.FilesBackend = backend
+	}
+}
+
+func WithFileTTL(ttl time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileTTL = ttl
+	}
+}
+
+func WithFileReapInterval(interval time.Duration) AppOption {
+	return func(o *Option) {
+		o.FileReapInterval = interval
+	}
+}
+
+func WithMissingContentPolicy(policy string) AppOption {
+	return func(o *Option) {
+		o.MissingContentPolicy = policy
+	}
+}
+
+func WithFilesArchiveConcurrency(n int) AppOption {
+	return func(o *Option) {
+		o.FilesArchiveConcurrency = n
+	}
+}
+
+var EnableStreamingUploads = func(o *Option) {
+	o.StreamUploads = true
+}
+
+func WithMetadataSink(sink MetadataSink) AppOption {
+	return func(o *Option) {
+		o.MetadataSink = sink
+	}
+}
+
+func WithMetadataSinkRetries(retries int, backoff time.Duration) AppOption {
+	return func(o *Option) {
+		o.MetadataSinkRetries = retries
+		o.MetadataSinkRetryBackoff = backoff
+	}
+}
+
+func WithDerivedContentCache(dir string, maxMB int) AppOption {
+	return func(o *Option) {
+		o.DerivedContentCacheDir = dir
+		o.DerivedContentCacheMB = maxMB
+	}
+}
+
+func WithFilesOwnerHeader(header string) AppOption {
+	return func(o *Option) {
+		o.FilesOwnerHeader = header
+	}
+}
+
+func WithAllowedPurposes(purposes ...string) AppOption {
+	return func(o *Option) {
+		o.AllowedPurposes = purposes
+	}
+}
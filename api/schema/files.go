@@ -0,0 +1,128 @@
+package schema
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// File represents the structure of a file object from the OpenAI API.
+type File struct {
+	ID        string    `json:"id"`         // Unique identifier for the file
+	Object    string    `json:"object"`     // Type of the object (e.g., "file")
+	Bytes     int       `json:"bytes"`      // Size of the file in bytes
+	CreatedAt time.Time `json:"created_at"` // The time at which the file was created, sent as Unix seconds
+	Filename  string    `json:"filename"`   // The name of the file
+	Purpose   string    `json:"purpose"`    // The purpose of the file (e.g., "fine-tune", "classifications", etc.)
+	// When the file expires and is deleted, sent as Unix seconds. Files without
+	// it are kept until deleted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Extension inferred from the content of a file uploaded without one,
+	// appended to its name when downloaded
+	Extension string `json:"extension,omitempty"`
+	Sha256    string `json:"sha256,omitempty"` // Checksum of the content, set for content-addressed or verified files
+	// MIME type sniffed from the content, or declared by the client when the
+	// content doesn't tell
+	ContentType string `json:"content_type,omitempty"`
+	// Encoding the content is stored with, "gzip" for files uploaded
+	// compressed, in which case Bytes is the compressed size
+	ContentEncoding   string `json:"content_encoding,omitempty"`
+	UncompressedBytes int    `json:"uncompressed_bytes,omitempty"`
+	// Status of the file processing ("processing", "processed" or "error"),
+	// or "quarantined" when its content failed verification
+	Status        string `json:"status,omitempty"`
+	StatusDetails string `json:"status_details,omitempty"` // Why validation failed, when Status is "error"
+	// Labels attached by the client at upload time
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tenant   string            `json:"tenant,omitempty"` // Tenant the file counts against
+	// Who the file belongs to: the fingerprint of the uploading API key, or
+	// the owner header when auth is disabled. Only shown to admins
+	OwnerKey string `json:"owner_key,omitempty"`
+	// Held files can't be deleted until the hold is released
+	LegalHold bool `json:"legal_hold,omitempty"`
+	// Whether CRLF line endings were converted to LF on store
+	LineEndingsNormalized bool `json:"line_endings_normalized,omitempty"`
+	// Who uploaded the file, only shown to admins
+	Source *FileSource `json:"source,omitempty"`
+	// Kind of storage holding the file (e.g. "local"), only shown to admins
+	// asking for it
+	Storage string `json:"storage,omitempty"`
+	// Link to the content of the file, set in responses when a base URL is
+	// configured
+	URL string `json:"url,omitempty"`
+	// What the server changed or noticed about the input of an upload, set in
+	// its response only
+	Warnings []string `json:"warnings,omitempty"`
+	// Where the content is stored, relative to the upload directory. It is
+	// kept in the index but never shown to clients
+	Path string `json:"path,omitempty"`
+}
+
+// MarshalJSON writes CreatedAt and ExpiresAt as Unix seconds, the form the
+// OpenAI clients expect. CreatedAt is also written as Unix milliseconds in
+// created_at_ms, which tells apart the files created in the same second.
+func (f File) MarshalJSON() ([]byte, error) {
+	type plain File
+	var expiresAt *int64
+	if f.ExpiresAt != nil {
+		seconds := f.ExpiresAt.Unix()
+		expiresAt = &seconds
+	}
+	return json.Marshal(struct {
+		plain
+		CreatedAt   int64  `json:"created_at"`
+		CreatedAtMs int64  `json:"created_at_ms"`
+		ExpiresAt   *int64 `json:"expires_at,omitempty"`
+	}{plain(f), f.CreatedAt.Unix(), f.CreatedAt.UnixMilli(), expiresAt})
+}
+
+// UnmarshalJSON reads CreatedAt from created_at_ms when set, otherwise as Unix
+// seconds or as the RFC 3339 string older indexes were written with, and
+// ExpiresAt as Unix seconds.
+func (f *File) UnmarshalJSON(data []byte) error {
+	type plain File
+	aux := struct {
+		*plain
+		CreatedAt   json.RawMessage `json:"created_at"`
+		CreatedAtMs *int64          `json:"created_at_ms"`
+		ExpiresAt   *int64          `json:"expires_at"`
+	}{plain: (*plain)(f)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	f.ExpiresAt = nil
+	if aux.ExpiresAt != nil {
+		expiresAt := time.Unix(*aux.ExpiresAt, 0)
+		f.ExpiresAt = &expiresAt
+	}
+	if aux.CreatedAtMs != nil {
+		f.CreatedAt = time.UnixMilli(*aux.CreatedAtMs)
+		return nil
+	}
+	if len(aux.CreatedAt) == 0 || string(aux.CreatedAt) == "null" {
+		return nil
+	}
+
+	var seconds int64
+	if err := json.Unmarshal(aux.CreatedAt, &seconds); err == nil {
+		f.CreatedAt = time.Unix(seconds, 0)
+		return nil
+	}
+	return json.Unmarshal(aux.CreatedAt, &f.CreatedAt)
+}
+
+// FileSource records the client an upload came from, for auditing.
+type FileSource struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	APIKeyID  string `json:"api_key_id,omitempty"` // Fingerprint of the API key, never the key itself
+}
+
+// UploadRequest describes an upload to the upload hooks.
+type UploadRequest struct {
+	Filename string
+	Purpose  string
+	Bytes    int64
+	Metadata map[string]string
+	Tenant   string
+	Client   string // Address of the uploading client
+}
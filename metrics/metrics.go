@@ -14,10 +14,21 @@ import (
 )
 
 type Metrics struct {
-	meter         api.Meter
-	apiTimeMetric api.Float64Histogram
+	meter                  api.Meter
+	apiTimeMetric          api.Float64Histogram
+	uploadRejectionsMetric api.Int64Counter
+	breakerStateMetric     api.Int64UpDownCounter
+	uploadSizeMetric       api.Int64Histogram
 }
 
+// UploadSizeBuckets are the upper bounds, in bytes, of the buckets of the
+// upload size histogram: 1MB, 10MB, 100MB and 1GB.
+var UploadSizeBuckets = []float64{1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+// uploadSizeMetricName names the upload size histogram, exported with a
+// "_bytes" suffix for its unit.
+const uploadSizeMetricName = "files_upload_size"
+
 // setupOTelSDK bootstraps the OpenTelemetry pipeline.
 // If it does not return an error, make sure to call shutdown for proper cleanup.
 func SetupMetrics() (*Metrics, error) {
@@ -25,7 +36,11 @@ func SetupMetrics() (*Metrics, error) {
 	if err != nil {
 		return nil, err
 	}
-	provider := metric.NewMeterProvider(metric.WithReader(exporter))
+	uploadSizeView := metric.NewView(
+		metric.Instrument{Name: uploadSizeMetricName},
+		metric.Stream{Aggregation: metric.AggregationExplicitBucketHistogram{Boundaries: UploadSizeBuckets}},
+	)
+	provider := metric.NewMeterProvider(metric.WithReader(exporter), metric.WithView(uploadSizeView))
 	meter := provider.Meter("github.com/go-skynet/LocalAI")
 
 	apiTimeMetric, err := meter.Float64Histogram("api_call", api.WithDescription("api calls"))
@@ -33,9 +48,27 @@ func SetupMetrics() (*Metrics, error) {
 		return nil, err
 	}
 
+	uploadRejectionsMetric, err := meter.Int64Counter("files_upload_rejections", api.WithDescription("rejected file uploads by reason"))
+	if err != nil {
+		return nil, err
+	}
+
+	breakerStateMetric, err := meter.Int64UpDownCounter("files_backend_breaker_state", api.WithDescription("files backend circuit breakers in each state"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploadSizeMetric, err := meter.Int64Histogram(uploadSizeMetricName, api.WithUnit("By"), api.WithDescription("size of file uploads by purpose and outcome"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &Metrics{
-		meter:         meter,
-		apiTimeMetric: apiTimeMetric,
+		meter:                  meter,
+		apiTimeMetric:          apiTimeMetric,
+		uploadRejectionsMetric: uploadRejectionsMetric,
+		breakerStateMetric:     breakerStateMetric,
+		uploadSizeMetric:       uploadSizeMetric,
 	}, nil
 }
 
@@ -81,3 +114,29 @@ func (m *Metrics) ObserveAPICall(method string, path string, duration float64) {
 	)
 	m.apiTimeMetric.Record(context.Background(), duration, opts)
 }
+
+func (m *Metrics) ObserveUploadRejection(reason string) {
+	opts := api.WithAttributes(
+		attribute.String("reason", reason),
+	)
+	m.uploadRejectionsMetric.Add(context.Background(), 1, opts)
+}
+
+// ObserveBreakerState records a circuit breaker moving from one state to
+// another. An empty from registers a new breaker.
+func (m *Metrics) ObserveBreakerState(from, to string) {
+	if from != "" {
+		m.breakerStateMetric.Add(context.Background(), -1, api.WithAttributes(attribute.String("state", from)))
+	}
+	m.breakerStateMetric.Add(context.Background(), 1, api.WithAttributes(attribute.String("state", to)))
+}
+
+// ObserveUploadSize records the size of an upload of purpose, accepted or
+// rejected as told by outcome.
+func (m *Metrics) ObserveUploadSize(purpose, outcome string, size int64) {
+	opts := api.WithAttributes(
+		attribute.String("purpose", purpose),
+		attribute.String("outcome", outcome),
+	)
+	m.uploadSizeMetric.Record(context.Background(), size, opts)
+}